@@ -394,3 +394,45 @@ func TestTokenUploadAndProtection(t *testing.T) {
 		assert.Equal(t, "new", string(content))
 	})
 }
+
+func TestAtomicOverwrite(t *testing.T) {
+	session := PrepareAuth(t, db, "uploader-atomic", false, AuthH.Config.Server.JwtSecret)
+	target := "/atomic/release.bin"
+
+	w := Perform(t, router, "PUT", target, WithBody([]byte("version-1")), WithSession(session))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var original api.MetaResource
+	db.Where("path = ?", target).First(&original)
+
+	t.Run("Failed checksum keeps previous version and metadata", func(t *testing.T) {
+		w := Perform(t, router, "PUT", target, WithBody([]byte("version-2")),
+			WithHeader("X-Checksum-Sha256", "ffff"),
+			WithHeader("X-Tags", "broken"),
+			WithSession(session))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		content, _ := os.ReadFile(filepath.Join(baseDir, "atomic", "release.bin"))
+		assert.Equal(t, "version-1", string(content))
+
+		var meta api.MetaResource
+		db.Preload("Tags").Where("path = ?", target).First(&meta)
+		assert.Equal(t, original.SHA256, meta.SHA256)
+		assert.Equal(t, original.Size, meta.Size)
+		assert.Empty(t, meta.Tags)
+	})
+
+	t.Run("Oversized overwrite keeps previous version", func(t *testing.T) {
+		WithConfig(t, func(c *config.Config) { c.Storage.MaxUploadSize = "10B" })
+
+		w := Perform(t, router, "PUT", target, WithBody(make([]byte, 100)), WithSession(session))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+		content, _ := os.ReadFile(filepath.Join(baseDir, "atomic", "release.bin"))
+		assert.Equal(t, "version-1", string(content))
+	})
+
+	t.Run("No temp files are left behind", func(t *testing.T) {
+		entries, _ := os.ReadDir(filepath.Join(baseDir, ".yaar", "tmp"))
+		assert.Empty(t, entries)
+	})
+}
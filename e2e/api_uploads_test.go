@@ -0,0 +1,165 @@
+package e2e
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func createUploadSession(t *testing.T, session *TestSession, payload map[string]any) api.UploadSession {
+	t.Helper()
+	w := Perform(t, router, "POST", "/_/api/v1/uploads", WithJSON(payload), WithSession(session))
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var s api.UploadSession
+	json.Unmarshal(w.Body.Bytes(), &s)
+	assert.NotEmpty(t, s.ID)
+	return s
+}
+
+func TestResumableUpload(t *testing.T) {
+	session := PrepareAuth(t, db, "resumer", false, AuthH.Config.Server.JwtSecret)
+	content := []byte("first-chunk|second-chunk")
+	sum := sha256.Sum256(content)
+
+	t.Run("Upload in chunks and finalize with policy headers", func(t *testing.T) {
+		s := createUploadSession(t, session, map[string]any{"path": "/resumable/image.iso", "size": len(content)})
+		url := "/_/api/v1/uploads/" + s.ID
+
+		w := Perform(t, router, "PATCH", url, WithBody(content[:12]), WithHeader("Upload-Offset", "0"), WithSession(session))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "12", w.Header().Get("Upload-Offset"))
+
+		// Client lost its state, ask for the offset
+		w = Perform(t, router, "HEAD", url, WithSession(session))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "12", w.Header().Get("Upload-Offset"))
+
+		// Wrong offset is rejected
+		w = Perform(t, router, "PATCH", url, WithBody(content[12:]), WithHeader("Upload-Offset", "0"), WithSession(session))
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		// Finalize before all bytes arrived is rejected
+		w = Perform(t, router, "PUT", url, WithSession(session))
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = Perform(t, router, "PATCH", url, WithBody(content[12:]), WithHeader("Upload-Offset", "12"), WithSession(session))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Upload-Offset"))
+
+		w = Perform(t, router, "PUT", url,
+			WithHeader("X-Stream", "images/v1"),
+			WithHeader("X-Tags", "arch=x64"),
+			WithHeader("X-Expires", "7d"),
+			WithHeader("X-Checksum-Sha256", hex.EncodeToString(sum[:])),
+			WithSession(session))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		data, err := os.ReadFile(filepath.Join(baseDir, "resumable", "image.iso"))
+		assert.NoError(t, err)
+		assert.Equal(t, content, data)
+
+		var meta api.MetaResource
+		db.Preload("Tags").Where("path = ?", "/resumable/image.iso").First(&meta)
+		assert.Equal(t, hex.EncodeToString(sum[:]), meta.SHA256)
+		assert.Equal(t, int64(len(content)), meta.Size)
+		assert.Equal(t, "images", *meta.Stream)
+		assert.Equal(t, "v1", *meta.Group)
+		assert.NotNil(t, meta.ExpiresAt)
+		assert.Len(t, meta.Tags, 1)
+
+		// Session is gone after finalize
+		w = Perform(t, router, "GET", url, WithSession(session))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Checksum mismatch on finalize", func(t *testing.T) {
+		s := createUploadSession(t, session, map[string]any{"path": "/resumable/bad.bin"})
+		url := "/_/api/v1/uploads/" + s.ID
+		Perform(t, router, "PATCH", url, WithBody(content), WithHeader("Upload-Offset", "0"), WithSession(session))
+
+		w := Perform(t, router, "PUT", url, WithHeader("X-Checksum-Sha256", "ffff"), WithSession(session))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoFileExists(t, filepath.Join(baseDir, "resumable", "bad.bin"))
+
+		w = Perform(t, router, "HEAD", url, WithSession(session))
+		assert.Equal(t, http.StatusOK, w.Code, "the session is kept")
+		assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Upload-Offset"))
+
+		sum := sha256.Sum256(content)
+		w = Perform(t, router, "PUT", url, WithHeader("X-Checksum-Sha256", hex.EncodeToString(sum[:])), WithSession(session))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.FileExists(t, filepath.Join(baseDir, "resumable", "bad.bin"))
+	})
+
+	t.Run("Sessions are private to their owner", func(t *testing.T) {
+		other := PrepareAuth(t, db, "resumer-other", false, AuthH.Config.Server.JwtSecret)
+		s := createUploadSession(t, session, map[string]any{"path": "/resumable/private.bin"})
+
+		w := Perform(t, router, "PATCH", "/_/api/v1/uploads/"+s.ID, WithBody(content), WithHeader("Upload-Offset", "0"), WithSession(other))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = Perform(t, router, "DELETE", "/_/api/v1/uploads/"+s.ID, WithSession(session))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	})
+
+	t.Run("Anonymous users cannot create sessions", func(t *testing.T) {
+		w := Perform(t, router, "POST", "/_/api/v1/uploads", WithJSON(map[string]any{"path": "/resumable/anon.bin"}))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("System directory is not reachable", func(t *testing.T) {
+		w := Perform(t, router, "POST", "/_/api/v1/uploads", WithJSON(map[string]any{"path": "/.yaar/uploads/x"}), WithSession(session))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = Perform(t, router, "GET", "/_/api/v1/fs/.yaar/uploads", WithSession(session))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Stale sessions are removed by the janitor", func(t *testing.T) {
+		s := createUploadSession(t, session, map[string]any{"path": "/resumable/stale.bin"})
+		db.Model(&api.UploadSession{}).Where("id = ?", s.ID).UpdateColumn("updated_at", time.Now().Add(-48*time.Hour))
+
+		Meta.RunCleanup()
+
+		var count int64
+		db.Model(&api.UploadSession{}).Where("id = ?", s.ID).Count(&count)
+		assert.Equal(t, int64(0), count)
+		assert.NoFileExists(t, filepath.Join(baseDir, ".yaar", "uploads", s.ID))
+	})
+}
+
+func TestResumableUploadLimits(t *testing.T) {
+	WithConfig(t, func(c *config.Config) { c.Storage.MaxUploadSize = "10B" })
+	session := PrepareAuth(t, db, "resumer-limits", false, AuthH.Config.Server.JwtSecret)
+
+	t.Run("Reject declared size above limit", func(t *testing.T) {
+		w := Perform(t, router, "POST", "/_/api/v1/uploads", WithJSON(map[string]any{"path": "/resumable/big.bin", "size": 100}), WithSession(session))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("Reject chunks exceeding the limit", func(t *testing.T) {
+		s := createUploadSession(t, session, map[string]any{"path": "/resumable/big2.bin"})
+		url := "/_/api/v1/uploads/" + s.ID
+
+		w := Perform(t, router, "PATCH", url, WithBody([]byte("12345678")), WithHeader("Upload-Offset", "0"), WithSession(session))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = Perform(t, router, "PATCH", url, WithBody([]byte("12345678")), WithHeader("Upload-Offset", "8"), WithSession(session))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+		// Progress before the rejected chunk is kept
+		w = Perform(t, router, "GET", url, WithSession(session))
+		assert.Equal(t, "8", w.Header().Get("Upload-Offset"))
+	})
+}
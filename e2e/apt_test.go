@@ -0,0 +1,152 @@
+package e2e
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// debPackage builds a .deb like dpkg-deb -Zgzip does
+func debPackage(t *testing.T, name, version, arch string) []byte {
+	control := fmt.Sprintf("Package: %s\nVersion: %s\nArchitecture: %s\nMaintainer: CI <ci@example.com>\nDescription: test package\n a longer description\n", name, version, arch)
+
+	targz := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for n, content := range files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: n, Mode: 0644, Size: int64(len(content))}))
+			tw.Write([]byte(content))
+		}
+		tw.Close()
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	var deb bytes.Buffer
+	deb.WriteString("!<arch>\n")
+	member := func(name string, data []byte) {
+		fmt.Fprintf(&deb, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", name, 0, 0, 0, "100644", len(data))
+		deb.Write(data)
+		if len(data)%2 == 1 {
+			deb.WriteString("\n")
+		}
+	}
+	member("debian-binary", []byte("2.0\n"))
+	member("control.tar.gz", targz(map[string]string{"./control": control}))
+	member("data.tar.gz", targz(map[string]string{"./usr/bin/" + name: "binary"}))
+	return deb.Bytes()
+}
+
+func TestAPTRepository(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.APT.Paths = []string{"/apt"}
+	})
+	session := PrepareAuth(t, db, "apt-publisher", false, AuthH.Config.Server.JwtSecret)
+
+	get := func(t *testing.T, p string) string {
+		w := Perform(t, router, http.MethodGet, p)
+		require.Equal(t, http.StatusOK, w.Code, p)
+		return w.Body.String()
+	}
+
+	hello := debPackage(t, "hello", "1.0-1", "amd64")
+	t.Run("Upload generates the index", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/apt/pool/hello_1.0-1_amd64.deb", WithSession(session), WithBody(hello))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = Perform(t, router, http.MethodPut, "/apt/pool/tools_2.0_all.deb", WithSession(session), WithBody(debPackage(t, "tools", "2.0", "all")))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		packages := get(t, "/apt/Packages")
+		sum := sha256.Sum256(hello)
+		assert.Contains(t, packages, "Package: hello\nVersion: 1.0-1\nArchitecture: amd64\n")
+		assert.Contains(t, packages, "Description: test package\n a longer description\n")
+		assert.Contains(t, packages, "Filename: pool/hello_1.0-1_amd64.deb\n")
+		assert.Contains(t, packages, fmt.Sprintf("Size: %d\n", len(hello)))
+		assert.Contains(t, packages, "SHA256: "+hex.EncodeToString(sum[:])+"\n")
+		assert.Contains(t, packages, "Package: tools\n")
+
+		gz, err := gzip.NewReader(strings.NewReader(get(t, "/apt/Packages.gz")))
+		require.NoError(t, err)
+		unzipped, _ := io.ReadAll(gz)
+		assert.Equal(t, packages, string(unzipped))
+
+		release := get(t, "/apt/Release")
+		packagesSum := sha256.Sum256([]byte(packages))
+		assert.Contains(t, release, "Architectures: all amd64\n")
+		assert.Contains(t, release, fmt.Sprintf(" %s %d Packages\n", hex.EncodeToString(packagesSum[:]), len(packages)))
+
+		w = Perform(t, router, http.MethodGet, "/apt/InRelease")
+		assert.Equal(t, http.StatusNotFound, w.Code, "unsigned without a key")
+	})
+
+	t.Run("Delete removes the package", func(t *testing.T) {
+		w := Perform(t, router, http.MethodDelete, "/apt/pool/tools_2.0_all.deb", WithSession(session))
+		require.Equal(t, http.StatusNoContent, w.Code)
+		assert.NotContains(t, get(t, "/apt/Packages"), "Package: tools")
+		assert.Contains(t, get(t, "/apt/Release"), "Architectures: amd64\n")
+	})
+
+	t.Run("Invalid packages are skipped", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/apt/pool/broken_1.0_amd64.deb", WithSession(session), WithBody([]byte("not a deb")))
+		require.Equal(t, http.StatusOK, w.Code)
+		packages := get(t, "/apt/Packages")
+		assert.Contains(t, packages, "Package: hello")
+		assert.NotContains(t, packages, "broken")
+	})
+
+	t.Run("Expired packages are removed", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/apt/pool/nightly_0.1_amd64.deb", WithSession(session), WithBody(debPackage(t, "nightly", "0.1", "amd64")))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, get(t, "/apt/Packages"), "Package: nightly")
+
+		past := time.Now().Add(-time.Hour).UTC()
+		require.NoError(t, db.Model(&api.MetaResource{}).Where("path = ?", "/apt/pool/nightly_0.1_amd64.deb").Update("expires_at", past).Error)
+		Meta.RunCleanup()
+		assert.NotContains(t, get(t, "/apt/Packages"), "Package: nightly")
+	})
+
+	t.Run("InRelease is signed with the configured key", func(t *testing.T) {
+		entity, err := openpgp.NewEntity("yaar", "", "apt@example.com", nil)
+		require.NoError(t, err)
+		keyFile := filepath.Join(t.TempDir(), "signing.asc")
+		f, err := os.Create(keyFile)
+		require.NoError(t, err)
+		aw, err := armor.Encode(f, openpgp.PrivateKeyType, nil)
+		require.NoError(t, err)
+		require.NoError(t, entity.SerializePrivate(aw, nil))
+		aw.Close()
+		f.Close()
+
+		WithConfig(t, func(c *config.Config) {
+			c.APT.Paths = []string{"/apt"}
+			c.APT.SigningKey = keyFile
+		})
+		w := Perform(t, router, http.MethodPut, "/apt/pool/signed_1.0_amd64.deb", WithSession(session), WithBody(debPackage(t, "signed", "1.0", "amd64")))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		block, _ := clearsign.Decode([]byte(get(t, "/apt/InRelease")))
+		require.NotNil(t, block)
+		assert.Equal(t, get(t, "/apt/Release"), string(block.Plaintext))
+		_, err = openpgp.CheckDetachedSignature(openpgp.EntityList{entity}, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, nil)
+		assert.NoError(t, err)
+	})
+}
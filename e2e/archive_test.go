@@ -0,0 +1,168 @@
+package e2e
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func zipEntries(t *testing.T, data []byte) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	entries := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		entries[f.Name] = string(content)
+	}
+	return entries
+}
+
+func tarGzEntries(t *testing.T, data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+
+	entries := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, _ := io.ReadAll(tr)
+		entries[hdr.Name] = string(content)
+	}
+	return entries
+}
+
+// dispositionFilename returns the filename parameter of the Content-Disposition header
+func dispositionFilename(t *testing.T, h http.Header) string {
+	disposition, params, err := mime.ParseMediaType(h.Get("Content-Disposition"))
+	require.NoError(t, err)
+	assert.Equal(t, "attachment", disposition)
+	return params["filename"]
+}
+
+func keys(m map[string]string) []string {
+	var k []string
+	for key := range m {
+		k = append(k, key)
+	}
+	sort.Strings(k)
+	return k
+}
+
+func TestDirectoryArchive(t *testing.T) {
+	session := PrepareAuth(t, db, "archiver", false, AuthH.Config.Server.JwtSecret)
+
+	files := map[string]string{
+		"/site/index.html":      "<html/>",
+		"/site/css/main.css":    "body{}",
+		"/site/img/a/logo.svg":  "<svg/>",
+		"/other/not-included.t": "nope",
+		"/we\"ird; name/f.txt":  "quoted",
+	}
+	for p, content := range files {
+		w := Perform(t, router, http.MethodPut, p, WithSession(session), WithBody([]byte(content)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	t.Run("Zip", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/site/?archive=zip")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+		assert.Equal(t, "site.zip", dispositionFilename(t, w.Header()))
+
+		entries := zipEntries(t, w.Body.Bytes())
+		assert.Equal(t, []string{"css/", "css/main.css", "img/", "img/a/", "img/a/logo.svg", "index.html"}, keys(entries))
+		assert.Equal(t, "<html/>", entries["index.html"])
+		assert.Equal(t, "<svg/>", entries["img/a/logo.svg"])
+	})
+
+	t.Run("Tar.gz", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/site/css?archive=tar.gz")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "css.tar.gz", dispositionFilename(t, w.Header()))
+
+		entries := tarGzEntries(t, w.Body.Bytes())
+		assert.Equal(t, map[string]string{"main.css": "body{}"}, entries)
+	})
+
+	t.Run("Names are escaped in the header", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/we%22ird%3B%20name/?archive=zip")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `we"ird; name.zip`, dispositionFilename(t, w.Header()))
+	})
+
+	t.Run("Root never contains system files", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/?archive=zip")
+		require.Equal(t, http.StatusOK, w.Code)
+		for name := range zipEntries(t, w.Body.Bytes()) {
+			assert.NotContains(t, name, ".yaar")
+		}
+	})
+
+	t.Run("Unknown format", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/site/?archive=rar")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("File ignores archive parameter", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/site/index.html?archive=zip")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "<html/>", w.Body.String())
+	})
+
+	t.Run("HEAD sends headers only", func(t *testing.T) {
+		w := Perform(t, router, http.MethodHead, "/site/?archive=zip")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+		assert.Empty(t, w.Body.Bytes())
+	})
+}
+
+func TestStreamGroupArchive(t *testing.T) {
+	session := PrepareAuth(t, db, "group-archiver", false, AuthH.Config.Server.JwtSecret)
+
+	upload := func(path, content, group string) {
+		w := Perform(t, router, http.MethodPut, path, WithSession(session), WithBody([]byte(content)),
+			WithHeader("X-Stream", "deploy/"+group))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	upload("/deploy/1.0/app.bin", "app-1.0", "1.0")
+	upload("/deploy/1.0/conf/app.yaml", "conf-1.0", "1.0")
+	upload("/deploy/1.1/app.bin", "app-1.1", "1.1")
+
+	t.Run("Zip by default", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/_/api/v1/streams/deploy/1.0/archive")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "deploy-1.0.zip", dispositionFilename(t, w.Header()))
+
+		entries := zipEntries(t, w.Body.Bytes())
+		assert.Equal(t, map[string]string{"app.bin": "app-1.0", "conf/app.yaml": "conf-1.0"}, entries)
+	})
+
+	t.Run("Tar.gz", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/_/api/v1/streams/deploy/1.1/archive?format=tar.gz")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, map[string]string{"app.bin": "app-1.1"}, tarGzEntries(t, w.Body.Bytes()))
+	})
+
+	t.Run("Unknown group", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/_/api/v1/streams/deploy/9.9/archive")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,122 @@
+package e2e
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/kovi/yaar/internal/config"
+	"github.com/kovi/yaar/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupRoles(t *testing.T) {
+	prevRole := AuthH.Config.Auth.DefaultRole
+	AuthH.Config.Auth.DefaultRole = ""
+	t.Cleanup(func() { AuthH.Config.Auth.DefaultRole = prevRole })
+	WithConfig(t, func(c *config.Config) {
+		c.Storage.AnonymousRead = []string{"/rbac/public"}
+	})
+	admin := PrepareAuth(t, db, "rbac-admin", true, AuthH.Config.Server.JwtSecret)
+	carol := PrepareAuth(t, db, "rbac-carol", false, AuthH.Config.Server.JwtSecret)
+	put := func(t *testing.T, p string, opts ...RequestOption) int {
+		return Perform(t, router, http.MethodPut, p, append(opts, WithBody([]byte(p)))...).Code
+	}
+
+	require.Equal(t, http.StatusOK, put(t, "/rbac/other/x.bin", WithSession(admin)))
+	assert.Equal(t, http.StatusForbidden, put(t, "/rbac/other/y.bin", WithSession(carol)), "users outside of groups may not change anything")
+	w := Perform(t, router, http.MethodDelete, "/rbac/other/x.bin", WithSession(carol))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = Perform(t, router, http.MethodPost, "/_/api/admin/groups", WithSession(admin), WithJSON(map[string]any{
+		"name": "team-frontend", "bindings": []map[string]any{{"role": "owner", "scope": "/rbac/frontend"}},
+	}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = Perform(t, router, http.MethodPost, "/_/api/admin/groups", WithSession(admin), WithJSON(map[string]any{
+		"name": "team-frontend", "bindings": []map[string]any{{"role": "publisher", "scope": "/rbac/frontend"}},
+	}))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var group models.Group
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &group))
+	groupURL := fmt.Sprintf("/_/api/admin/groups/%d", group.ID)
+	memberURL := fmt.Sprintf("%s/members/%d", groupURL, carol.User.ID)
+
+	w = Perform(t, router, http.MethodPut, memberURL, WithSession(carol))
+	assert.Equal(t, http.StatusForbidden, w.Code, "only admins manage groups")
+	w = Perform(t, router, http.MethodPut, memberURL, WithSession(admin))
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	t.Run("Publisher", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, put(t, "/rbac/frontend/app.js", WithSession(carol)))
+		assert.Equal(t, http.StatusForbidden, put(t, "/rbac/other/y.bin", WithSession(carol)))
+		w := Perform(t, router, http.MethodDelete, "/rbac/frontend/app.js", WithSession(carol))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = Perform(t, router, http.MethodGet, "/rbac/other/x.bin", WithSession(carol))
+		assert.Equal(t, http.StatusNotFound, w.Code, "members only read below their bindings")
+
+		w = Perform(t, router, http.MethodGet, "/_/api/admin/groups", WithSession(admin))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"username":"rbac-carol"`)
+	})
+
+	t.Run("Tokens stay within the roles of their user", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+			"user_id": carol.User.ID, "name": "carol-ci", "path_scope": "/",
+		}))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var tokenData map[string]any
+		json.Unmarshal(w.Body.Bytes(), &tokenData)
+		token := WithToken(tokenData["plain_token"].(string))
+
+		assert.Equal(t, http.StatusOK, put(t, "/rbac/frontend/ci.js", token))
+		assert.Equal(t, http.StatusForbidden, put(t, "/rbac/other/ci.bin", token))
+	})
+
+	t.Run("Maintainer", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPatch, groupURL, WithSession(admin), WithJSON(map[string]any{
+			"bindings": []map[string]any{{"role": "maintainer", "scope": "/rbac/frontend"}, {"role": "viewer", "scope": "/rbac/other"}},
+		}))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodDelete, "/rbac/frontend/app.js", WithSession(carol))
+		assert.Equal(t, http.StatusNoContent, w.Code, "bindings apply without a new login")
+		w = Perform(t, router, http.MethodGet, "/rbac/other/x.bin", WithSession(carol))
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = Perform(t, router, http.MethodGet, "/_/api/admin/users", WithSession(carol))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Admin role", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPatch, groupURL, WithSession(admin), WithJSON(map[string]any{
+			"bindings": []map[string]any{{"role": "admin", "scope": "/"}},
+		}))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = Perform(t, router, http.MethodGet, "/_/api/admin/users", WithSession(carol))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Leaving the group", func(t *testing.T) {
+		w := Perform(t, router, http.MethodDelete, memberURL, WithSession(admin))
+		require.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, http.StatusForbidden, put(t, "/rbac/other/z.bin", WithSession(carol)), "removing a member never widens their scopes")
+		assert.Equal(t, http.StatusForbidden, put(t, "/rbac/frontend/z.js", WithSession(carol)))
+		w = Perform(t, router, http.MethodGet, "/rbac/other/x.bin", WithSession(carol))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = Perform(t, router, http.MethodDelete, groupURL, WithSession(admin))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		w = Perform(t, router, http.MethodDelete, groupURL, WithSession(admin))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Default role", func(t *testing.T) {
+		AuthH.Config.Auth.DefaultRole = "viewer"
+		dave := PrepareAuth(t, db, "rbac-dave", false, AuthH.Config.Server.JwtSecret)
+		w := Perform(t, router, http.MethodGet, "/rbac/other/x.bin", WithSession(dave))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, http.StatusForbidden, put(t, "/rbac/other/dave.bin", WithSession(dave)))
+	})
+}
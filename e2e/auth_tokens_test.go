@@ -10,8 +10,10 @@ import (
 	"time"
 
 	"github.com/kovi/yaar/internal/auth"
+	"github.com/kovi/yaar/internal/config"
 	"github.com/kovi/yaar/internal/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTokenManagementAndScoping(t *testing.T) {
@@ -133,3 +135,119 @@ func TestTokenExpiry(t *testing.T) {
 		assert.Equal(t, 404, w.Code)
 	})
 }
+
+func TestTokenPermissions(t *testing.T) {
+	admin := PrepareAuth(t, db, "perm-admin", true, AuthH.Config.Server.JwtSecret)
+	createToken := func(t *testing.T, permissions []map[string]any) RequestOption {
+		w := Perform(t, router, http.MethodPost, "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+			"user_id": admin.User.ID, "name": "perm-token", "permissions": permissions,
+		}))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var resp map[string]any
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return WithToken(resp["plain_token"].(string))
+	}
+
+	w := Perform(t, router, http.MethodPut, "/perm/releases/1.0/app.bin", WithSession(admin), WithBody([]byte("release")))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	t.Run("Unknown permission", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+			"user_id": admin.User.ID, "name": "bad", "permissions": []map[string]any{{"action": "everything"}},
+		}))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Download only", func(t *testing.T) {
+		token := createToken(t, []map[string]any{{"action": "read", "scope": "/perm/releases"}})
+
+		w := Perform(t, router, http.MethodGet, "/perm/releases/1.0/app.bin", token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = Perform(t, router, http.MethodDelete, "/perm/releases/1.0/app.bin", token)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = Perform(t, router, http.MethodPut, "/perm/releases/1.0/other.bin", token, WithBody([]byte("x")))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = Perform(t, router, http.MethodPatch, "/_/api/v1/fs/perm/releases/1.0/app.bin", token, WithJSON(map[string]any{"tags": "a=b"}))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = Perform(t, router, http.MethodGet, "/_/api/admin/users", token)
+		assert.Equal(t, http.StatusForbidden, w.Code, "the owner is admin, the token is not")
+	})
+
+	t.Run("Globs", func(t *testing.T) {
+		token := createToken(t, []map[string]any{
+			{"action": "write", "scope": "/perm/builds/*/nightly"},
+			{"action": "patch-meta", "scope": "/perm/builds/*/nightly"},
+		})
+
+		w := Perform(t, router, http.MethodPut, "/perm/builds/app/nightly/1.bin", token, WithBody([]byte("x")))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = Perform(t, router, http.MethodPut, "/perm/builds/app/stable/1.bin", token, WithBody([]byte("x")))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = Perform(t, router, http.MethodPatch, "/_/api/v1/fs/perm/builds/app/nightly/1.bin", token, WithJSON(map[string]any{"tags": "a=b"}))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = Perform(t, router, http.MethodDelete, "/perm/builds/app/nightly/1.bin", token)
+		assert.Equal(t, http.StatusForbidden, w.Code, "writing does not allow deleting")
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		token := createToken(t, []map[string]any{{"action": "delete", "scope": "/perm/releases"}, {"action": "admin"}})
+
+		w := Perform(t, router, http.MethodDelete, "/perm/releases/1.0/app.bin", token)
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		w = Perform(t, router, http.MethodGet, "/_/api/admin/users", token)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestBasicAuthTokens(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.Storage.AnonymousRead = []string{"/public"}
+	})
+	admin := PrepareAuth(t, db, "basic-admin", true, AuthH.Config.Server.JwtSecret)
+	w := Perform(t, router, http.MethodPost, "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+		"user_id": admin.User.ID, "name": "maven-deploy", "path_scope": "/basic",
+	}))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var tokenData map[string]any
+	json.Unmarshal(w.Body.Bytes(), &tokenData)
+	token := tokenData["plain_token"].(string)
+	basic := func(username, password string) RequestOption {
+		return func(req *http.Request) { req.SetBasicAuth(username, password) }
+	}
+	const challenge = `Basic realm="yaar"`
+
+	t.Run("Unauthenticated writes are challenged", func(t *testing.T) {
+		for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodDelete} {
+			w := Perform(t, router, method, "/basic/app-1.0.jar", WithBody([]byte("jar")))
+			assert.Equal(t, http.StatusUnauthorized, w.Code, method)
+			assert.Equal(t, challenge, w.Header().Get("WWW-Authenticate"), method)
+		}
+		w := Perform(t, router, http.MethodGet, "/basic/app-1.0.jar")
+		assert.Equal(t, challenge, w.Header().Get("WWW-Authenticate"), "unreadable downloads too")
+
+		w = Perform(t, router, http.MethodGet, "/_/api/auth/me")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Empty(t, w.Header().Get("WWW-Authenticate"), "the UI API never makes the browser prompt")
+	})
+
+	t.Run("Token as password", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/basic/app-1.0.jar", basic("deployer", token), WithBody([]byte("jar")))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = Perform(t, router, http.MethodGet, "/basic/app-1.0.jar", basic("", token))
+		assert.Equal(t, http.StatusOK, w.Code, "any username is accepted")
+		assert.Equal(t, "jar", w.Body.String())
+
+		w = Perform(t, router, http.MethodPut, "/other/app.jar", basic("basic-admin", token), WithBody([]byte("jar")))
+		assert.Equal(t, http.StatusForbidden, w.Code, "token scopes apply")
+	})
+
+	t.Run("Invalid tokens are challenged again", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/basic/app-1.0.jar", basic("basic-admin", admin.PlainPassword))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "passwords are no tokens")
+		assert.Equal(t, challenge, w.Header().Get("WWW-Authenticate"))
+
+		w = Perform(t, router, http.MethodGet, "/basic/app-1.0.jar", WithHeader("X-API-Token", "af_invalid"))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+	})
+}
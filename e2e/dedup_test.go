@@ -0,0 +1,85 @@
+package e2e
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupStorage(t *testing.T) {
+	WithConfig(t, func(c *config.Config) { c.Storage.Dedup = true })
+	session := PrepareAuth(t, db, "dedup-user", false, AuthH.Config.Server.JwtSecret)
+
+	content := []byte("the very same jar content")
+	sum := sha256.Sum256(content)
+	blob := filepath.Join(baseDir, ".yaar", "blobs", hex.EncodeToString(sum[:1]), hex.EncodeToString(sum[:]))
+
+	t.Run("Identical uploads share one blob", func(t *testing.T) {
+		for _, p := range []string{"/dedup/g1/lib.jar", "/dedup/g2/lib.jar"} {
+			w := Perform(t, router, "PUT", p, WithBody(content), WithSession(session))
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		}
+
+		assert.FileExists(t, blob)
+		a, _ := os.Stat(filepath.Join(baseDir, "dedup", "g1", "lib.jar"))
+		b, _ := os.Stat(filepath.Join(baseDir, "dedup", "g2", "lib.jar"))
+		assert.True(t, os.SameFile(a, b), "both paths should reference the same blob")
+
+		// Files are served as usual
+		w := Perform(t, router, "GET", "/dedup/g2/lib.jar")
+		assert.Equal(t, content, w.Body.Bytes())
+	})
+
+	t.Run("Report saved space", func(t *testing.T) {
+		w := Perform(t, router, "GET", "/_/api/admin/dedup", WithSession(session))
+		assert.Equal(t, http.StatusForbidden, w.Code, "admins only")
+
+		admin := PrepareAuth(t, db, "dedup-admin", true, AuthH.Config.Server.JwtSecret)
+		w = Perform(t, router, "GET", "/_/api/admin/dedup", WithSession(admin))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var stats api.DedupStats
+		json.Unmarshal(w.Body.Bytes(), &stats)
+		assert.True(t, stats.Enabled)
+		assert.GreaterOrEqual(t, stats.SavedBytes, int64(len(content)))
+	})
+
+	t.Run("Blob is dropped with the last reference", func(t *testing.T) {
+		w := Perform(t, router, "DELETE", "/dedup/g1", WithSession(session))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.FileExists(t, blob, "blob is still referenced by g2")
+
+		w = Perform(t, router, "DELETE", "/dedup/g2/lib.jar", WithSession(session))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.NoFileExists(t, blob)
+	})
+
+	t.Run("Overwrite releases the old blob", func(t *testing.T) {
+		w := Perform(t, router, "PUT", "/dedup/over.bin", WithBody(content), WithSession(session))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.FileExists(t, blob)
+
+		w = Perform(t, router, "PUT", "/dedup/over.bin", WithBody([]byte("new content")), WithSession(session))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoFileExists(t, blob)
+	})
+
+	t.Run("Janitor releases blobs of expired files", func(t *testing.T) {
+		w := Perform(t, router, "PUT", "/dedup/ttl.bin", WithBody(content), WithHeader("X-Expires", "2000-01-01"), WithSession(session))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.FileExists(t, blob)
+
+		Meta.RunCleanup()
+
+		assert.NoFileExists(t, filepath.Join(baseDir, "dedup", "ttl.bin"))
+		assert.NoFileExists(t, blob)
+	})
+}
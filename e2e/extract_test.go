@@ -0,0 +1,218 @@
+package e2e
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type archiveFile struct {
+	Name, Body string
+}
+
+func makeZip(t *testing.T, files ...archiveFile) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.Name)
+		require.NoError(t, err)
+		w.Write([]byte(f.Body))
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func makeTarGz(t *testing.T, files ...archiveFile) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.Name, Mode: 0644, Size: int64(len(f.Body))}))
+		tw.Write([]byte(f.Body))
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestUploadExtract(t *testing.T) {
+	session := PrepareAuth(t, db, "extractor", false, AuthH.Config.Server.JwtSecret)
+
+	t.Run("Zip with policy headers", func(t *testing.T) {
+		archive := makeZip(t,
+			archiveFile{"index.html", "<html/>"},
+			archiveFile{"css/site.css", "body{}"},
+		)
+		w := Perform(t, router, http.MethodPut, "/docs/v1", WithSession(session), WithBody(archive),
+			WithHeader("X-Extract", "zip"),
+			WithHeader("X-Stream", "docs/v1"),
+			WithHeader("X-Tags", "kind=site"),
+			WithHeader("X-Expires", "7d"))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), `"files":2`)
+
+		assert.FileExists(t, filepath.Join(baseDir, "docs/v1/index.html"))
+		assert.FileExists(t, filepath.Join(baseDir, "docs/v1/css/site.css"))
+		assert.NoFileExists(t, filepath.Join(baseDir, "docs/v1.zip"))
+
+		var meta api.MetaResource
+		require.NoError(t, db.Preload("Tags").Where("path = ?", "/docs/v1/css/site.css").First(&meta).Error)
+		sum := sha256.Sum256([]byte("body{}"))
+		assert.Equal(t, hex.EncodeToString(sum[:]), meta.SHA256)
+		assert.Equal(t, int64(6), meta.Size)
+		assert.Contains(t, meta.ContentType, "text/css")
+		assert.Equal(t, "docs", *meta.Stream)
+		assert.Equal(t, "v1", *meta.Group)
+		assert.NotNil(t, meta.ExpiresAt)
+		require.Len(t, meta.Tags, 1)
+		assert.Equal(t, "kind", meta.Tags[0].Key)
+
+		// served like any other upload
+		w = Perform(t, router, http.MethodGet, "/docs/v1/index.html")
+		assert.Equal(t, "<html/>", w.Body.String())
+	})
+
+	t.Run("Tar.gz overwrites existing files", func(t *testing.T) {
+		archive := makeTarGz(t, archiveFile{"index.html", "<html>v2</html>"})
+		w := Perform(t, router, http.MethodPut, "/docs/v1", WithSession(session), WithBody(archive),
+			WithHeader("X-Extract", "tar.gz"))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/docs/v1/index.html")
+		assert.Equal(t, "<html>v2</html>", w.Body.String())
+
+		var meta api.MetaResource
+		db.Where("path = ?", "/docs/v1/index.html").First(&meta)
+		assert.Equal(t, int64(len("<html>v2</html>")), meta.Size)
+	})
+
+	t.Run("Zip-slip is rejected", func(t *testing.T) {
+		archive := makeZip(t,
+			archiveFile{"ok.txt", "fine"},
+			archiveFile{"../../escaped.txt", "evil"},
+		)
+		w := Perform(t, router, http.MethodPut, "/slip/target", WithSession(session), WithBody(archive),
+			WithHeader("X-Extract", "zip"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoFileExists(t, filepath.Join(baseDir, "escaped.txt"))
+		assert.NoFileExists(t, filepath.Join(baseDir, "slip/target/ok.txt"), "nothing is placed when one entry is bad")
+	})
+
+	t.Run("System directory is not reachable", func(t *testing.T) {
+		archive := makeTarGz(t, archiveFile{".yaar/tmp/x", "evil"})
+		w := Perform(t, router, http.MethodPut, "/", WithSession(session), WithBody(archive),
+			WithHeader("X-Extract", "tar.gz"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Zip bomb is limited by max upload size", func(t *testing.T) {
+		WithConfig(t, func(c *config.Config) {
+			c.Storage.MaxUploadSize = "8KB"
+		})
+		// 1MB of zeros compresses to about 1KB, the archive itself is within the limit
+		archive := makeZip(t, archiveFile{"zeros.bin", string(make([]byte, 1<<20))})
+		require.Less(t, len(archive), 8000)
+
+		w := Perform(t, router, http.MethodPut, "/bomb", WithSession(session), WithBody(archive),
+			WithHeader("X-Extract", "zip"))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "extracted content")
+		assert.NoFileExists(t, filepath.Join(baseDir, "bomb/zeros.bin"))
+	})
+
+	t.Run("Number of entries is limited", func(t *testing.T) {
+		WithConfig(t, func(c *config.Config) {
+			c.Storage.MaxExtractEntries = 2
+		})
+		archive := makeZip(t, archiveFile{"a", "a"}, archiveFile{"b", "b"}, archiveFile{"c", "c"})
+		w := Perform(t, router, http.MethodPut, "/many", WithSession(session), WithBody(archive),
+			WithHeader("X-Extract", "zip"))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+		assert.NoFileExists(t, filepath.Join(baseDir, "many/a"))
+	})
+
+	t.Run("Failure mid-archive keeps the previous files", func(t *testing.T) {
+		// "clash/inner.txt" can't be placed once "clash" is a file
+		archive := makeTarGz(t,
+			archiveFile{"index.html", "<html>v3</html>"},
+			archiveFile{"clash", "file"},
+			archiveFile{"clash/inner.txt", "inner"},
+		)
+		w := Perform(t, router, http.MethodPut, "/docs/v1", WithSession(session), WithBody(archive),
+			WithHeader("X-Extract", "tar.gz"))
+		assert.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/docs/v1/index.html")
+		assert.Equal(t, "<html>v2</html>", w.Body.String())
+		var meta api.MetaResource
+		db.Where("path = ?", "/docs/v1/index.html").First(&meta)
+		assert.Equal(t, int64(len("<html>v2</html>")), meta.Size)
+		assert.NoFileExists(t, filepath.Join(baseDir, "docs/v1/clash"))
+
+		staged, _ := os.ReadDir(filepath.Join(baseDir, ".yaar/staging"))
+		assert.Empty(t, staged, "staged files are cleaned up")
+	})
+
+	t.Run("Invalid format and archive", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/bad", WithSession(session), WithBody([]byte("x")),
+			WithHeader("X-Extract", "rar"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = Perform(t, router, http.MethodPut, "/bad", WithSession(session), WithBody([]byte("not a zip")),
+			WithHeader("X-Extract", "zip"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Target must not be a file", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/plain.txt", WithSession(session), WithBody([]byte("x")))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = Perform(t, router, http.MethodPut, "/plain.txt", WithSession(session),
+			WithBody(makeZip(t, archiveFile{"a", "b"})), WithHeader("X-Extract", "zip"))
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Scope applies to every entry", func(t *testing.T) {
+		admin := PrepareAuth(t, db, "extract-admin", true, AuthH.Config.Server.JwtSecret)
+		resp := Perform(t, router, "POST", "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+			"user_id": admin.User.ID, "name": "extract-bot", "path_scope": "/scoped",
+		}))
+		require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+		var tokenData map[string]any
+		json.Unmarshal(resp.Body.Bytes(), &tokenData)
+		token := tokenData["plain_token"].(string)
+
+		w := Perform(t, router, http.MethodPut, "/scoped", WithToken(token),
+			WithBody(makeZip(t, archiveFile{"in.txt", "ok"})), WithHeader("X-Extract", "zip"))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodPut, "/scoped-other", WithToken(token),
+			WithBody(makeZip(t, archiveFile{"in.txt", "ok"})), WithHeader("X-Extract", "zip"))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Single audit entry", func(t *testing.T) {
+		archive := makeZip(t, archiveFile{"a.txt", "a"}, archiveFile{"b.txt", "b"}, archiveFile{"c.txt", "c"})
+		w := Perform(t, router, http.MethodPut, "/audited", WithSession(session), WithBody(archive),
+			WithHeader("X-Extract", "zip"))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(baseDir), "audit.log"))
+		require.NoError(t, err)
+		assert.Equal(t, 1, bytes.Count(data, []byte(`"resource":"/audited"`)))
+		assert.Equal(t, 0, bytes.Count(data, []byte(`"resource":"/audited/a.txt"`)))
+	})
+}
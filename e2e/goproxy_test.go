@@ -0,0 +1,168 @@
+package e2e
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// goModuleZip builds a module zip with every file below <module>@<version>/
+func goModuleZip(t *testing.T, prefix string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(prefix + name)
+		require.NoError(t, err)
+		w.Write([]byte(content))
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestGoModuleProxy(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.GoProxy.Paths = []string{"/goproxy"}
+	})
+	session := PrepareAuth(t, db, "go-publisher", false, AuthH.Config.Server.JwtSecret)
+
+	// Upper case letters are encoded as !<lower> in proxy URLs
+	const module = "corp.example.com/Lib"
+	const base = "/goproxy/corp.example.com/!lib/@v/"
+	gomod := "module corp.example.com/Lib\n\ngo 1.21\n"
+
+	publish := func(t *testing.T, version string) []byte {
+		data := goModuleZip(t, module+"@"+version+"/", map[string]string{"go.mod": gomod, "lib.go": "package lib\n"})
+		w := Perform(t, router, http.MethodPut, base+version+".zip", WithSession(session), WithBody(data))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return data
+	}
+
+	var v1 []byte
+	t.Run("Publish", func(t *testing.T) {
+		v1 = publish(t, "v1.0.0")
+		publish(t, "v1.10.0")
+		publish(t, "v1.2.0")
+		publish(t, "v1.11.0-rc.1")
+	})
+
+	t.Run("Module files are served", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, base+"v1.0.0.zip")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, v1, w.Body.Bytes())
+
+		w = Perform(t, router, http.MethodGet, base+"v1.0.0.mod")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, gomod, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, base+"v1.0.0.info")
+		require.Equal(t, http.StatusOK, w.Code)
+		var info map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+		assert.Equal(t, "v1.0.0", info["Version"])
+		assert.NotEmpty(t, info["Time"])
+	})
+
+	t.Run("list and @latest", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, base+"list")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "v1.0.0\nv1.2.0\nv1.10.0\nv1.11.0-rc.1\n", w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/goproxy/corp.example.com/!lib/@latest")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"Version":"v1.10.0"`, "pre-releases are not latest")
+
+		w = Perform(t, router, http.MethodGet, "/goproxy/corp.example.com/unknown/@v/list")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Published versions are immutable", func(t *testing.T) {
+		var res api.MetaResource
+		require.NoError(t, db.Where("path = ?", base+"v1.0.0.zip").First(&res).Error)
+		assert.True(t, *res.Immutable)
+		assert.Equal(t, module, *res.Stream)
+		assert.Equal(t, "v1.0.0", *res.Group)
+
+		data := goModuleZip(t, module+"@v1.0.0/", map[string]string{"go.mod": gomod, "lib.go": "package lib // changed\n"})
+		w := Perform(t, router, http.MethodPut, base+"v1.0.0.zip", WithSession(session), WithBody(data))
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = Perform(t, router, http.MethodDelete, base+"v1.0.0.info", WithSession(session))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = Perform(t, router, http.MethodPut, base+"v1.3.0.mod", WithSession(session), WithBody([]byte(gomod)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Concurrent publishes of a version", func(t *testing.T) {
+		var wg sync.WaitGroup
+		codes := make([]int, 8)
+		zips := make([][]byte, len(codes))
+		for i := range codes {
+			zips[i] = goModuleZip(t, module+"@v1.8.0/", map[string]string{"go.mod": gomod, "lib.go": fmt.Sprintf("package lib // %d\n", i)})
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				codes[i] = Perform(t, router, http.MethodPut, base+"v1.8.0.zip", WithSession(session), WithBody(zips[i])).Code
+			}(i)
+		}
+		wg.Wait()
+
+		winner := slices.Index(codes, http.StatusOK)
+		require.NotEqual(t, -1, winner, codes)
+		for i, code := range codes {
+			if i != winner {
+				assert.Equal(t, http.StatusConflict, code)
+			}
+		}
+		w := Perform(t, router, http.MethodGet, base+"v1.8.0.zip")
+		assert.Equal(t, zips[winner], w.Body.Bytes())
+	})
+
+	t.Run("Invalid uploads are rejected", func(t *testing.T) {
+		cases := map[string]struct {
+			url, prefix, gomod string
+		}{
+			"not canonical":           {base + "v1.3.zip", module + "@v1.3/", gomod},
+			"not semver":              {base + "latest.zip", module + "@latest/", gomod},
+			"major version mismatch":  {base + "v2.0.0.zip", module + "@v2.0.0/", gomod},
+			"files outside of prefix": {base + "v1.4.0.zip", "other@v1.4.0/", gomod},
+			"go.mod of other module":  {base + "v1.5.0.zip", module + "@v1.5.0/", "module corp.example.com/other\n"},
+		}
+		for name, tc := range cases {
+			data := goModuleZip(t, tc.prefix, map[string]string{"go.mod": tc.gomod})
+			w := Perform(t, router, http.MethodPut, tc.url, WithSession(session), WithBody(data))
+			assert.Equal(t, http.StatusBadRequest, w.Code, name)
+		}
+
+		w := Perform(t, router, http.MethodPut, base+"v1.6.0.zip", WithSession(session), WithBody([]byte("not a zip")))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = Perform(t, router, http.MethodGet, base+"list")
+		assert.NotContains(t, w.Body.String(), "v1.5.0")
+	})
+
+	t.Run("Major version suffix", func(t *testing.T) {
+		data := goModuleZip(t, "corp.example.com/lib/v2@v2.0.0/", map[string]string{"go.mod": "module corp.example.com/lib/v2\n"})
+		w := Perform(t, router, http.MethodPut, "/goproxy/corp.example.com/lib/v2/@v/v2.0.0.zip", WithSession(session), WithBody(data))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/goproxy/corp.example.com/lib/v2/@v/v2.0.0.mod")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Anonymous publish is rejected", func(t *testing.T) {
+		data := goModuleZip(t, module+"@v1.7.0/", map[string]string{"go.mod": gomod})
+		w := Perform(t, router, http.MethodPut, base+"v1.7.0.zip", WithBody(data))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
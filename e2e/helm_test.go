@@ -0,0 +1,203 @@
+package e2e
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// helmChart packages a chart like helm package does, with a bundled dependency
+func helmChart(t *testing.T, name, version string) []byte {
+	files := map[string]string{
+		name + "/Chart.yaml":             "apiVersion: v2\nname: " + name + "\nversion: " + version + "\nappVersion: \"2.0\"\ndescription: A test chart\n",
+		name + "/values.yaml":            "replicas: 1\n",
+		name + "/charts/dep/Chart.yaml":  "apiVersion: v2\nname: dep\nversion: 9.9.9\n",
+		name + "/templates/service.yaml": "kind: Service\n",
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, n := range []string{name + "/Chart.yaml", name + "/values.yaml", name + "/charts/dep/Chart.yaml", name + "/templates/service.yaml"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: n, Mode: 0644, Size: int64(len(files[n]))}))
+		tw.Write([]byte(files[n]))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+type testHelmIndex struct {
+	APIVersion string `yaml:"apiVersion"`
+	Entries    map[string][]struct {
+		Name       string   `yaml:"name"`
+		Version    string   `yaml:"version"`
+		AppVersion string   `yaml:"appVersion"`
+		Digest     string   `yaml:"digest"`
+		URLs       []string `yaml:"urls"`
+		Created    string   `yaml:"created"`
+	} `yaml:"entries"`
+}
+
+func TestHelmRepository(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.Helm.Paths = []string{"/charts", "/charts-b"}
+	})
+	admin := PrepareAuth(t, db, "helm-admin", true, AuthH.Config.Server.JwtSecret)
+	resp := Perform(t, router, "POST", "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+		"user_id": admin.User.ID, "name": "helm-bot", "path_scope": "/charts",
+	}))
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	var tokenData map[string]any
+	json.Unmarshal(resp.Body.Bytes(), &tokenData)
+	// helm cm-push sends the token as basic auth password
+	auth := WithBasicAuth(tokenData["plain_token"].(string))
+
+	index := func(t *testing.T) testHelmIndex {
+		w := Perform(t, router, http.MethodGet, "/charts/index.yaml")
+		require.Equal(t, http.StatusOK, w.Code)
+		var idx testHelmIndex
+		require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &idx))
+		return idx
+	}
+
+	v1 := helmChart(t, "web", "0.1.0")
+	t.Run("Plain upload updates index.yaml", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/charts/web-0.1.0.tgz", auth, WithBody(v1))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		idx := index(t)
+		assert.Equal(t, "v1", idx.APIVersion)
+		require.Len(t, idx.Entries["web"], 1)
+		entry := idx.Entries["web"][0]
+		sum := sha256.Sum256(v1)
+		assert.Equal(t, "0.1.0", entry.Version)
+		assert.Equal(t, "2.0", entry.AppVersion)
+		assert.Equal(t, hex.EncodeToString(sum[:]), entry.Digest)
+		assert.Equal(t, []string{"web-0.1.0.tgz"}, entry.URLs)
+		assert.NotEmpty(t, entry.Created)
+		assert.NotContains(t, idx.Entries, "dep", "bundled dependencies are not indexed")
+	})
+
+	t.Run("ChartMuseum upload", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/charts/api/charts", auth, WithBody(helmChart(t, "web", "0.2.0")))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.JSONEq(t, `{"saved":true}`, w.Body.String())
+
+		// cm-push sends a multipart form with chart and provenance file
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, _ := mw.CreateFormFile("chart", "web-0.10.0.tgz")
+		fw.Write(helmChart(t, "web", "0.10.0"))
+		fw, _ = mw.CreateFormFile("prov", "web-0.10.0.tgz.prov")
+		fw.Write([]byte("signature"))
+		mw.Close()
+		w = Perform(t, router, http.MethodPost, "/charts/api/charts", auth, WithBody(buf.Bytes()), WithHeader("Content-Type", mw.FormDataContentType()))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/charts/web-0.10.0.tgz.prov")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var res api.MetaResource
+		require.NoError(t, db.Where("path = ?", "/charts/web-0.2.0.tgz").First(&res).Error)
+		assert.Equal(t, "web", *res.Stream)
+		assert.Equal(t, "0.2.0", *res.Group)
+
+		idx := index(t)
+		require.Len(t, idx.Entries["web"], 3)
+		assert.Equal(t, "0.10.0", idx.Entries["web"][0].Version, "newest first")
+	})
+
+	t.Run("Existing versions need force", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/charts/api/charts", auth, WithBody(helmChart(t, "web", "0.2.0")))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		w = Perform(t, router, http.MethodPost, "/charts/api/charts?force=true", auth, WithBody(helmChart(t, "web", "0.2.0")))
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		w = Perform(t, router, http.MethodPost, "/charts/api/charts", auth, WithBody([]byte("not a chart")))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = Perform(t, router, http.MethodPost, "/charts/api/charts", WithBody(helmChart(t, "web", "0.3.0")))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("ChartMuseum queries", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/charts/api/charts")
+		require.Equal(t, http.StatusOK, w.Code)
+		var all map[string][]map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &all))
+		assert.Len(t, all["web"], 3)
+
+		w = Perform(t, router, http.MethodGet, "/charts/api/charts/web/0.1.0")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"version":"0.1.0"`)
+
+		w = Perform(t, router, http.MethodGet, "/charts/api/charts/nope")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("ChartMuseum delete prunes the index", func(t *testing.T) {
+		w := Perform(t, router, http.MethodDelete, "/charts/api/charts/web/0.10.0", auth)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/charts/web-0.10.0.tgz.prov")
+		assert.NotEqual(t, http.StatusOK, w.Code)
+		for _, e := range index(t).Entries["web"] {
+			assert.NotEqual(t, "0.10.0", e.Version)
+		}
+	})
+
+	t.Run("Expired charts are pruned", func(t *testing.T) {
+		past := time.Now().Add(-time.Hour).UTC()
+		require.NoError(t, db.Model(&api.MetaResource{}).Where("path = ?", "/charts/web-0.1.0.tgz").Update("expires_at", past).Error)
+		Meta.RunCleanup()
+
+		idx := index(t)
+		require.Len(t, idx.Entries["web"], 1)
+		assert.Equal(t, "0.2.0", idx.Entries["web"][0].Version)
+	})
+
+	t.Run("Index is rebuilt in the background", func(t *testing.T) {
+		var before api.MetaResource
+		require.NoError(t, db.Where("path = ?", "/charts/index.yaml").First(&before).Error)
+		w := Perform(t, router, http.MethodPut, "/charts/web-0.3.0.tgz", auth, WithBody(helmChart(t, "web", "0.3.0")))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		// Without a read of the repository
+		assert.Eventually(t, func() bool {
+			var after api.MetaResource
+			db.Where("path = ?", "/charts/index.yaml").First(&after)
+			return after.SHA256 != before.SHA256
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("Reads only wait for their own repository", func(t *testing.T) {
+		var before api.MetaResource
+		require.NoError(t, db.Where("path = ?", "/charts/index.yaml").First(&before).Error)
+		w := Perform(t, router, http.MethodPut, "/charts/web-0.4.0.tgz", auth, WithBody(helmChart(t, "web", "0.4.0")))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = Perform(t, router, http.MethodPut, "/charts-b/api-1.0.0.tgz", WithSession(admin), WithBody(helmChart(t, "api", "1.0.0")))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/charts-b/index.yaml")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "api-1.0.0.tgz")
+		var after api.MetaResource
+		require.NoError(t, db.Where("path = ?", "/charts/index.yaml").First(&after).Error)
+		assert.Equal(t, before.SHA256, after.SHA256, "the other repository is left to the background")
+
+		w = Perform(t, router, http.MethodGet, "/charts/index.yaml")
+		assert.Contains(t, w.Body.String(), "web-0.4.0.tgz")
+	})
+}
@@ -113,3 +113,10 @@ func WithToken(token string) RequestOption {
 		req.Header.Set("X-API-Token", token)
 	}
 }
+
+// WithBasicAuth sends the API token as password, like docker login, Maven or pip do
+func WithBasicAuth(token string) RequestOption {
+	return func(req *http.Request) {
+		req.SetBasicAuth("token", token)
+	}
+}
@@ -0,0 +1,275 @@
+package e2e
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/kovi/yaar/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ldapEntry is a directory entry of the mock server
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the values of attribute name, matched case-insensitively
+func (e ldapEntry) Get(name string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// mockLDAP is a minimal directory server answering simple binds and searches
+type mockLDAP struct {
+	net.Listener
+	entries   []ldapEntry
+	passwords map[string]string // By DN
+	searches  atomic.Int32
+}
+
+func newMockLDAP(t *testing.T) *mockLDAP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	m := &mockLDAP{Listener: l, passwords: map[string]string{"cn=svc,dc=example,dc=org": "svc-secret"}}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *mockLDAP) URL() string { return "ldap://" + m.Addr().String() }
+
+func (m *mockLDAP) add(dn, password string, attrs map[string][]string) {
+	m.entries = append(m.entries, ldapEntry{DN: dn, Attributes: attrs})
+	if password != "" {
+		m.passwords[dn] = password
+	}
+}
+
+// berString is the content of a primitive packet
+func berString(p *ber.Packet) string { return p.Data.String() }
+
+func berOctets(s string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, s, "")
+}
+
+func berSequence(children ...*ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for _, c := range children {
+		p.AppendChild(c)
+	}
+	return p
+}
+
+func (m *mockLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := ber.ReadPacket(r)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+		id, op := msg.Children[0].Value, msg.Children[1]
+		reply := func(p *ber.Packet) {
+			conn.Write(berSequence(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""), p).Bytes())
+		}
+		result := func(tag ber.Tag, code int) *ber.Packet {
+			p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+			p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+			p.AppendChild(berOctets(""))
+			p.AppendChild(berOctets(""))
+			return p
+		}
+
+		switch {
+		case op.ClassType == ber.ClassApplication && op.Tag == ldap.ApplicationBindRequest:
+			dn, pw := berString(op.Children[1]), berString(op.Children[2])
+			code := ldap.LDAPResultInvalidCredentials
+			if dn == "" || (m.passwords[dn] != "" && m.passwords[dn] == pw) {
+				code = ldap.LDAPResultSuccess
+			}
+			reply(result(ldap.ApplicationBindResponse, code))
+		case op.ClassType == ber.ClassApplication && op.Tag == ldap.ApplicationSearchRequest:
+			m.searches.Add(1)
+			base, filter := berString(op.Children[0]), op.Children[6]
+			for _, e := range m.entries {
+				if !strings.HasSuffix(e.DN, ","+base) || !ldapMatch(e, filter) {
+					continue
+				}
+				attrs := berSequence()
+				for _, name := range op.Children[7].Children {
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range e.Get(berString(name)) {
+						values.AppendChild(berOctets(v))
+					}
+					attrs.AppendChild(berSequence(berOctets(berString(name)), values))
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(berOctets(e.DN))
+				entry.AppendChild(attrs)
+				reply(entry)
+			}
+			reply(result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			return
+		}
+	}
+}
+
+// ldapMatch evaluates the and, or, equality and presence filters
+func ldapMatch(e ldapEntry, f *ber.Packet) bool {
+	switch f.Tag {
+	case ldap.FilterAnd, ldap.FilterOr:
+		for _, c := range f.Children {
+			if ldapMatch(e, c) != (f.Tag == ldap.FilterAnd) {
+				return f.Tag == ldap.FilterOr
+			}
+		}
+		return f.Tag == ldap.FilterAnd
+	case ldap.FilterEqualityMatch:
+		for _, v := range e.Get(berString(f.Children[0])) {
+			if strings.EqualFold(v, berString(f.Children[1])) {
+				return true
+			}
+		}
+	case ldap.FilterPresent:
+		return len(e.Get(berString(f))) > 0
+	}
+	return false
+}
+
+func TestLDAPLogin(t *testing.T) {
+	dir := newMockLDAP(t)
+	people, groups := "ou=people,dc=example,dc=org", "ou=groups,dc=example,dc=org"
+	person := func(uid string, memberOf ...string) map[string][]string {
+		return map[string][]string{"objectClass": {"person"}, "uid": {uid}, "cn": {uid}, "memberOf": memberOf}
+	}
+	dir.add("uid=ldap-dave,"+people, "dave-pw", person("ldap-dave", "cn=team-ldap,"+groups, "cn=staff,"+groups))
+	dir.add("uid=ldap-erin,"+people, "erin-pw", person("ldap-erin", "cn=yaar-admins,"+groups))
+	dir.add("uid=ldap-local,"+people, "local-pw", person("ldap-local"))
+	dir.add("uid=ldap-grace,"+people, "grace-pw", person("ldap-grace"))
+	dir.add("uid=ldap-heidi,"+people, "heidi-pw", person("ldap-heidi", "cn=staff,"+groups))
+	dir.add("cn=team-ldap,"+groups, "", map[string][]string{"cn": {"team-ldap"}, "member": {"uid=ldap-grace," + people}})
+
+	prev, prevAuth := AuthH.Config.LDAP, AuthH.Config.Auth
+	t.Cleanup(func() { AuthH.Config.LDAP, AuthH.Config.Auth = prev, prevAuth })
+	AuthH.Config.Auth.Providers = []string{"local", "ldap"}
+	AuthH.Config.Auth.DefaultRole = ""
+	AuthH.Config.LDAP = config.NewConfig().LDAP
+	AuthH.Config.LDAP.URL = dir.URL()
+	AuthH.Config.LDAP.BindDN = "cn=svc,dc=example,dc=org"
+	AuthH.Config.LDAP.BindPassword = "svc-secret"
+	AuthH.Config.LDAP.BaseDN = people
+	AuthH.Config.LDAP.UserFilter = "(&(objectClass=person)(uid=%s))"
+	AuthH.Config.LDAP.AdminGroups = []string{"yaar-admins"}
+	AuthH.Config.LDAP.CacheTTL = time.Minute
+
+	admin := PrepareAuth(t, db, "ldap-local", true, AuthH.Config.Server.JwtSecret)
+	w := Perform(t, router, http.MethodPost, "/_/api/admin/groups", WithSession(admin), WithJSON(map[string]any{
+		"name": "team-ldap", "provider": "ldap", "bindings": []map[string]any{{"role": "publisher", "scope": "/ldap"}},
+	}))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var group models.Group
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &group))
+
+	login := func(t *testing.T, username, password string) *httptest.ResponseRecorder {
+		return Perform(t, router, http.MethodPost, "/_/api/login", WithJSON(map[string]string{"username": username, "password": password}))
+	}
+	session := func(t *testing.T, w *httptest.ResponseRecorder) RequestOption {
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return WithHeader("Authorization", "Bearer "+resp.Token)
+	}
+
+	t.Run("First login provisions the user", func(t *testing.T) {
+		auth := session(t, login(t, "ldap-dave", "dave-pw"))
+		assert.Equal(t, http.StatusOK, Perform(t, router, http.MethodPut, "/ldap/a.txt", auth, WithBody([]byte("a"))).Code)
+		assert.Equal(t, http.StatusForbidden, Perform(t, router, http.MethodPut, "/other/a.txt", auth, WithBody([]byte("a"))).Code)
+
+		w := Perform(t, router, http.MethodGet, "/_/api/admin/users", WithSession(admin))
+		assert.Contains(t, w.Body.String(), `"username":"ldap-dave","is_admin":false,"read_scope":"/","provider":"ldap"`)
+	})
+
+	t.Run("Wrong passwords and unknown users", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, login(t, "ldap-dave", "wrong").Code)
+		assert.Equal(t, http.StatusUnauthorized, login(t, "ldap-nobody", "dave-pw").Code)
+		assert.Equal(t, http.StatusUnauthorized, login(t, "*", "dave-pw").Code, "filter values are escaped")
+	})
+
+	t.Run("Lookups are cached", func(t *testing.T) {
+		before := dir.searches.Load()
+		session(t, login(t, "ldap-dave", "dave-pw"))
+		assert.Equal(t, before, dir.searches.Load())
+		login(t, "ldap-dave", "wrong")
+		assert.Equal(t, before+1, dir.searches.Load(), "other passwords go to the directory")
+	})
+
+	t.Run("Without group lookups memberships stay", func(t *testing.T) {
+		AuthH.Config.LDAP.GroupAttribute = ""
+		t.Cleanup(func() { AuthH.Config.LDAP.GroupAttribute = "memberOf" })
+		session(t, login(t, "ldap-heidi", "heidi-pw"))
+
+		var heidi models.User
+		require.NoError(t, db.Where("username = ?", "ldap-heidi").First(&heidi).Error)
+		w := Perform(t, router, http.MethodPut, fmt.Sprintf("/_/api/admin/groups/%d/members/%d", group.ID, heidi.ID), WithSession(admin))
+		require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+		auth := session(t, login(t, "ldap-heidi", "heidi-pw"))
+		assert.Equal(t, http.StatusOK, Perform(t, router, http.MethodPut, "/ldap/heidi.txt", auth, WithBody([]byte("h"))).Code)
+	})
+
+	t.Run("Admin group", func(t *testing.T) {
+		auth := session(t, login(t, "ldap-erin", "erin-pw"))
+		assert.Equal(t, http.StatusOK, Perform(t, router, http.MethodGet, "/_/api/admin/users", auth).Code)
+	})
+
+	t.Run("Local accounts are not taken over", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, login(t, "ldap-local", "local-pw").Code)
+		session(t, login(t, "ldap-local", admin.PlainPassword))
+	})
+
+	t.Run("Group search", func(t *testing.T) {
+		AuthH.Config.LDAP.GroupBaseDN = groups
+		t.Cleanup(func() { AuthH.Config.LDAP.GroupBaseDN = "" })
+		auth := session(t, login(t, "ldap-grace", "grace-pw"))
+		assert.Equal(t, http.StatusOK, Perform(t, router, http.MethodPut, "/ldap/grace.txt", auth, WithBody([]byte("g"))).Code)
+	})
+
+	t.Run("Provider chain", func(t *testing.T) {
+		AuthH.Config.Auth.Providers = []string{"ldap"}
+		assert.Equal(t, http.StatusUnauthorized, login(t, "ldap-local", admin.PlainPassword).Code, "local logins are off")
+
+		AuthH.Config.LDAP.URL = "ldap://127.0.0.1:1"
+		assert.Equal(t, http.StatusServiceUnavailable, login(t, "ldap-new", "pw").Code)
+
+		AuthH.Config.Auth.Providers = []string{"ldap", "local"}
+		session(t, login(t, "ldap-local", admin.PlainPassword))
+	})
+}
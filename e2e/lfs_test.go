@@ -0,0 +1,167 @@
+package e2e
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testLFSBatch struct {
+	Transfer string `json:"transfer"`
+	Objects  []struct {
+		Oid     string `json:"oid"`
+		Size    int64  `json:"size"`
+		Actions map[string]struct {
+			Href   string            `json:"href"`
+			Header map[string]string `json:"header"`
+		} `json:"actions"`
+		Error *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	} `json:"objects"`
+}
+
+type testLFSLock struct {
+	ID    string `json:"id"`
+	Path  string `json:"path"`
+	Owner struct {
+		Name string `json:"name"`
+	} `json:"owner"`
+}
+
+func TestGitLFS(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.LFS.Paths = []string{"/lfs"}
+	})
+	alice := PrepareAuth(t, db, "lfs-alice", false, AuthH.Config.Server.JwtSecret)
+	admin := PrepareAuth(t, db, "lfs-admin", true, AuthH.Config.Server.JwtSecret)
+	resp := Perform(t, router, "POST", "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+		"user_id": admin.User.ID, "name": "lfs-push", "path_scope": "/lfs/game",
+	}))
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	var tokenData map[string]any
+	json.Unmarshal(resp.Body.Bytes(), &tokenData)
+	auth := WithBasicAuth(tokenData["plain_token"].(string))
+
+	content := []byte("large binary asset")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	batch := func(t *testing.T, operation string, opts ...RequestOption) testLFSBatch {
+		opts = append(opts, WithHeader("Accept", "application/vnd.git-lfs+json"), WithJSON(map[string]any{
+			"operation": operation, "transfers": []string{"basic"},
+			"objects": []map[string]any{{"oid": oid, "size": len(content)}},
+		}))
+		w := Perform(t, router, http.MethodPost, "/lfs/game/objects/batch", opts...)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "application/vnd.git-lfs+json", w.Header().Get("Content-Type"))
+		var b testLFSBatch
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+		require.Len(t, b.Objects, 1)
+		return b
+	}
+	hrefPath := func(href string) string {
+		u, err := url.Parse(href)
+		require.NoError(t, err)
+		return u.Path
+	}
+
+	t.Run("Upload needs credentials", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/lfs/game/objects/batch", WithJSON(map[string]any{"operation": "upload"}))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Header().Get("LFS-Authenticate"), "Basic")
+	})
+
+	t.Run("Download of a missing object", func(t *testing.T) {
+		b := batch(t, "download")
+		require.NotNil(t, b.Objects[0].Error)
+		assert.Equal(t, http.StatusNotFound, b.Objects[0].Error.Code)
+	})
+
+	t.Run("Upload and verify", func(t *testing.T) {
+		b := batch(t, "upload", auth)
+		assert.Equal(t, "basic", b.Transfer)
+		upload, ok := b.Objects[0].Actions["upload"]
+		require.True(t, ok)
+		assert.Equal(t, "/lfs/game/objects/"+oid[0:2]+"/"+oid[2:4]+"/"+oid, hrefPath(upload.Href))
+
+		w := Perform(t, router, http.MethodPut, hrefPath(upload.Href), WithBody([]byte("not the object")), auth)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "content must match the oid")
+
+		opts := []RequestOption{WithBody(content)}
+		for k, v := range upload.Header {
+			opts = append(opts, WithHeader(k, v))
+		}
+		w = Perform(t, router, http.MethodPut, hrefPath(upload.Href), opts...)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		verify := b.Objects[0].Actions["verify"]
+		w = Perform(t, router, http.MethodPost, hrefPath(verify.Href), auth, WithJSON(map[string]any{"oid": oid, "size": len(content)}))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		b = batch(t, "upload", auth)
+		assert.Empty(t, b.Objects[0].Actions, "stored objects are not uploaded again")
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		b := batch(t, "download")
+		download, ok := b.Objects[0].Actions["download"]
+		require.True(t, ok)
+		w := Perform(t, router, http.MethodGet, hrefPath(download.Href))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, content, w.Body.Bytes())
+	})
+
+	t.Run("Upload outside the token scope", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/lfs/other/objects/batch", auth, WithJSON(map[string]any{
+			"operation": "upload", "objects": []map[string]any{{"oid": oid, "size": len(content)}},
+		}))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":403`)
+	})
+
+	t.Run("Locks", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/lfs/game/locks", WithSession(alice), WithJSON(map[string]any{"path": "assets/level1.bin"}))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var created struct{ Lock testLFSLock }
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		assert.Equal(t, "lfs-alice", created.Lock.Owner.Name)
+
+		w = Perform(t, router, http.MethodPost, "/lfs/game/locks", auth, WithJSON(map[string]any{"path": "assets/level1.bin"}))
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		// the lock record is immutable for the regular API
+		w = Perform(t, router, http.MethodDelete, "/lfs/game/locks/"+created.Lock.ID, WithSession(admin))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = Perform(t, router, http.MethodGet, "/lfs/game/locks?path=assets/level1.bin", auth)
+		require.Equal(t, http.StatusOK, w.Code)
+		var list struct{ Locks []testLFSLock }
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		require.Len(t, list.Locks, 1)
+		assert.Equal(t, created.Lock.ID, list.Locks[0].ID)
+
+		w = Perform(t, router, http.MethodPost, "/lfs/game/locks/verify", WithSession(alice), WithJSON(map[string]any{}))
+		require.Equal(t, http.StatusOK, w.Code)
+		var verify struct{ Ours, Theirs []testLFSLock }
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &verify))
+		assert.Len(t, verify.Ours, 1)
+		assert.Empty(t, verify.Theirs)
+
+		unlock := "/lfs/game/locks/" + created.Lock.ID + "/unlock"
+		w = Perform(t, router, http.MethodPost, unlock, auth, WithJSON(map[string]any{}))
+		assert.Equal(t, http.StatusForbidden, w.Code, "only the owner releases a lock")
+		w = Perform(t, router, http.MethodPost, unlock, auth, WithJSON(map[string]any{"force": true}))
+		require.Equal(t, http.StatusOK, w.Code, "admins may force it")
+
+		w = Perform(t, router, http.MethodPost, unlock, WithSession(alice), WithJSON(map[string]any{}))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,167 @@
+package e2e
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"testing"
+
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testMavenMetadata struct {
+	GroupID    string `xml:"groupId"`
+	ArtifactID string `xml:"artifactId"`
+	Version    string `xml:"version"`
+	Versioning struct {
+		Latest   string   `xml:"latest"`
+		Release  string   `xml:"release"`
+		Versions []string `xml:"versions>version"`
+		Snapshot struct {
+			Timestamp   string `xml:"timestamp"`
+			BuildNumber int    `xml:"buildNumber"`
+		} `xml:"snapshot"`
+		LastUpdated      string `xml:"lastUpdated"`
+		SnapshotVersions []struct {
+			Classifier string `xml:"classifier"`
+			Extension  string `xml:"extension"`
+			Value      string `xml:"value"`
+		} `xml:"snapshotVersions>snapshotVersion"`
+	} `xml:"versioning"`
+}
+
+func TestMavenRepository(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.Maven.Paths = []string{"/m2"}
+	})
+	session := PrepareAuth(t, db, "maven-deployer", false, AuthH.Config.Server.JwtSecret)
+
+	// deploy mimics the requests of mvn deploy for one file: the file and its checksum sidecars
+	deploy := func(t *testing.T, p, content string) {
+		w := Perform(t, router, http.MethodPut, p, WithSession(session), WithBody([]byte(content)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		sum := sha1.Sum([]byte(content))
+		w = Perform(t, router, http.MethodPut, p+".sha1", WithSession(session), WithBody([]byte(hex.EncodeToString(sum[:]))))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	metadata := func(t *testing.T, p string) testMavenMetadata {
+		w := Perform(t, router, http.MethodGet, p)
+		require.Equal(t, http.StatusOK, w.Code)
+		var md testMavenMetadata
+		require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &md), w.Body.String())
+		return md
+	}
+
+	t.Run("Release versions", func(t *testing.T) {
+		for _, v := range []string{"1.9", "1.10", "1.10-rc1"} {
+			deploy(t, "/m2/com/acme/app/"+v+"/app-"+v+".pom", "<project/>")
+			deploy(t, "/m2/com/acme/app/"+v+"/app-"+v+".jar", "jar "+v)
+		}
+
+		md := metadata(t, "/m2/com/acme/app/maven-metadata.xml")
+		assert.Equal(t, "com.acme", md.GroupID)
+		assert.Equal(t, "app", md.ArtifactID)
+		assert.Equal(t, []string{"1.9", "1.10-rc1", "1.10"}, md.Versioning.Versions, "versions are ordered the Maven way")
+		assert.Equal(t, "1.10", md.Versioning.Latest)
+		assert.Equal(t, "1.10", md.Versioning.Release)
+		assert.Len(t, md.Versioning.LastUpdated, 14)
+	})
+
+	t.Run("Checksum sidecars are served from stored hashes", func(t *testing.T) {
+		sum := sha1.Sum([]byte("jar 1.9"))
+		w := Perform(t, router, http.MethodGet, "/m2/com/acme/app/1.9/app-1.9.jar.sha1")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, hex.EncodeToString(sum[:]), w.Body.String())
+
+		for _, ext := range []string{".md5", ".sha256"} {
+			w = Perform(t, router, http.MethodGet, "/m2/com/acme/app/1.9/app-1.9.jar"+ext)
+			assert.Equal(t, http.StatusOK, w.Code, ext)
+		}
+
+		// the metadata has sidecars too
+		w = Perform(t, router, http.MethodGet, "/m2/com/acme/app/maven-metadata.xml.sha1")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Len(t, w.Body.String(), 40)
+
+		// sidecars are not stored as files
+		w = Perform(t, router, http.MethodGet, "/_/api/v1/fs/m2/com/acme/app/1.9/app-1.9.jar.sha1")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Wrong checksum upload is rejected", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/m2/com/acme/app/1.9/app-1.9.jar.sha1", WithSession(session),
+			WithBody([]byte("0000000000000000000000000000000000000000")))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Client metadata is replaced", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/m2/com/acme/app/maven-metadata.xml", WithSession(session),
+			WithBody([]byte("<metadata><groupId>bogus</groupId></metadata>")))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		md := metadata(t, "/m2/com/acme/app/maven-metadata.xml")
+		assert.Equal(t, "com.acme", md.GroupID)
+		assert.Len(t, md.Versioning.Versions, 3)
+
+		// the client's checksum of its own copy is accepted and ignored
+		w = Perform(t, router, http.MethodPut, "/m2/com/acme/app/maven-metadata.xml.sha1", WithSession(session),
+			WithBody([]byte("1111111111111111111111111111111111111111")))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Snapshots", func(t *testing.T) {
+		dir := "/m2/com/acme/lib/2.0-SNAPSHOT/"
+		deploy(t, dir+"lib-2.0-20250101.100000-1.jar", "build 1")
+		deploy(t, dir+"lib-2.0-20250101.100000-1.pom", "<project/>")
+		deploy(t, dir+"lib-2.0-20250102.110000-2.jar", "build 2")
+		deploy(t, dir+"lib-2.0-20250102.110000-2-sources.jar", "sources 2")
+		deploy(t, dir+"lib-2.0-20250102.110000-2.pom", "<project/>")
+
+		md := metadata(t, dir+"maven-metadata.xml")
+		assert.Equal(t, "2.0-SNAPSHOT", md.Version)
+		assert.Equal(t, "20250102.110000", md.Versioning.Snapshot.Timestamp)
+		assert.Equal(t, 2, md.Versioning.Snapshot.BuildNumber)
+
+		values := map[string]string{}
+		for _, sv := range md.Versioning.SnapshotVersions {
+			values[sv.Classifier+":"+sv.Extension] = sv.Value
+		}
+		assert.Equal(t, map[string]string{
+			":jar":        "2.0-20250102.110000-2",
+			":pom":        "2.0-20250102.110000-2",
+			"sources:jar": "2.0-20250102.110000-2",
+		}, values)
+
+		md = metadata(t, "/m2/com/acme/lib/maven-metadata.xml")
+		assert.Equal(t, []string{"2.0-SNAPSHOT"}, md.Versioning.Versions)
+		assert.Equal(t, "2.0-SNAPSHOT", md.Versioning.Latest)
+		assert.Empty(t, md.Versioning.Release)
+	})
+
+	t.Run("Delete updates metadata", func(t *testing.T) {
+		w := Perform(t, router, http.MethodDelete, "/m2/com/acme/app/1.10", WithSession(session))
+		require.Equal(t, http.StatusNoContent, w.Code)
+
+		md := metadata(t, "/m2/com/acme/app/maven-metadata.xml")
+		assert.Equal(t, []string{"1.9", "1.10-rc1"}, md.Versioning.Versions)
+		assert.Equal(t, "1.10-rc1", md.Versioning.Latest)
+
+		w = Perform(t, router, http.MethodDelete, "/m2/com/acme/lib/2.0-SNAPSHOT/lib-2.0-20250102.110000-2-sources.jar", WithSession(session))
+		require.Equal(t, http.StatusNoContent, w.Code)
+		md = metadata(t, "/m2/com/acme/lib/2.0-SNAPSHOT/maven-metadata.xml")
+		assert.Len(t, md.Versioning.SnapshotVersions, 2)
+	})
+
+	t.Run("Outside of maven paths nothing is generated", func(t *testing.T) {
+		deploy(t, "/plain/com/acme/app/1.0/app-1.0.jar", "jar")
+		w := Perform(t, router, http.MethodGet, "/_/api/v1/fs/plain/com/acme/app/maven-metadata.xml")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = Perform(t, router, http.MethodGet, "/_/api/v1/fs/plain/com/acme/app/1.0/app-1.0.jar.sha1")
+		assert.Equal(t, http.StatusOK, w.Code, "stored as regular file")
+	})
+}
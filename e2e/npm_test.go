@@ -0,0 +1,249 @@
+package e2e
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// npmTarball packs a package.json like npm pack does
+func npmTarball(t *testing.T, name, version string) []byte {
+	pkg, _ := json.Marshal(map[string]any{
+		"name": name, "version": version, "description": "test package " + version,
+		"dependencies": map[string]string{"left-pad": "^1.0.0"},
+	})
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "package/package.json", Mode: 0644, Size: int64(len(pkg))}))
+	tw.Write(pkg)
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// npmPublishBody is the document npm publish sends
+func npmPublishBody(name, version, filename string, tarball []byte, distTag string) map[string]any {
+	sha1sum := sha1.Sum(tarball)
+	sha512sum := sha512.Sum512(tarball)
+	return map[string]any{
+		"_id":       name,
+		"name":      name,
+		"dist-tags": map[string]string{distTag: version},
+		"versions": map[string]any{version: map[string]any{
+			"name": name, "version": version,
+			"dist": map[string]any{
+				"shasum":    hex.EncodeToString(sha1sum[:]),
+				"integrity": "sha512-" + base64.StdEncoding.EncodeToString(sha512sum[:]),
+				"tarball":   "http://example.com/" + name + "/-/" + filename,
+			},
+		}},
+		"_attachments": map[string]any{filename: map[string]any{
+			"content_type": "application/octet-stream",
+			"data":         base64.StdEncoding.EncodeToString(tarball),
+			"length":       len(tarball),
+		}},
+	}
+}
+
+type testPackument struct {
+	Rev      string            `json:"_rev"`
+	Name     string            `json:"name"`
+	DistTags map[string]string `json:"dist-tags"`
+	Versions map[string]struct {
+		Version      string            `json:"version"`
+		Dependencies map[string]string `json:"dependencies"`
+		Dist         struct {
+			Shasum    string `json:"shasum"`
+			Integrity string `json:"integrity"`
+			Tarball   string `json:"tarball"`
+		} `json:"dist"`
+	} `json:"versions"`
+}
+
+func TestNPMRegistry(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.NPM.Paths = []string{"/npm"}
+	})
+
+	admin := PrepareAuth(t, db, "npm-admin", true, AuthH.Config.Server.JwtSecret)
+	resp := Perform(t, router, "POST", "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+		"user_id": admin.User.ID, "name": "npm-bot", "path_scope": "/npm",
+	}))
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	var tokenData map[string]any
+	json.Unmarshal(resp.Body.Bytes(), &tokenData)
+	// npm sends the _authToken of .npmrc as bearer token
+	auth := WithHeader("Authorization", "Bearer "+tokenData["plain_token"].(string))
+
+	publish := func(t *testing.T, name, version, distTag string) []byte {
+		tarball := npmTarball(t, name, version)
+		filename := path.Base(name) + "-" + version + ".tgz"
+		w := Perform(t, router, http.MethodPut, "/npm/"+url.PathEscape(name), auth,
+			WithJSON(npmPublishBody(name, version, filename, tarball, distTag)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return tarball
+	}
+
+	packument := func(t *testing.T, name string) testPackument {
+		w := Perform(t, router, http.MethodGet, "/npm/"+url.PathEscape(name), func(req *http.Request) { req.Host = "example.com" })
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var doc testPackument
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+		return doc
+	}
+
+	var v1 []byte
+	t.Run("Publish", func(t *testing.T) {
+		v1 = publish(t, "@acme/pkg", "1.0.0", "latest")
+		publish(t, "@acme/pkg", "1.1.0-beta.1", "beta")
+
+		w := Perform(t, router, http.MethodGet, "/npm/-/whoami", auth)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "npm-admin")
+	})
+
+	t.Run("Packument is built from the tarballs", func(t *testing.T) {
+		doc := packument(t, "@acme/pkg")
+		assert.Equal(t, "@acme/pkg", doc.Name)
+		assert.NotEmpty(t, doc.Rev)
+		assert.Equal(t, map[string]string{"latest": "1.0.0", "beta": "1.1.0-beta.1"}, doc.DistTags)
+		require.Contains(t, doc.Versions, "1.0.0")
+
+		v := doc.Versions["1.0.0"]
+		sha1sum := sha1.Sum(v1)
+		sha512sum := sha512.Sum512(v1)
+		assert.Equal(t, "^1.0.0", v.Dependencies["left-pad"])
+		assert.Equal(t, hex.EncodeToString(sha1sum[:]), v.Dist.Shasum)
+		assert.Equal(t, "sha512-"+base64.StdEncoding.EncodeToString(sha512sum[:]), v.Dist.Integrity)
+		assert.Equal(t, "http://example.com/npm/@acme/pkg/-/pkg-1.0.0.tgz", v.Dist.Tarball)
+
+		// the scoped name may also be sent unescaped
+		w := Perform(t, router, http.MethodGet, "/npm/@acme/pkg")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), doc.Rev)
+	})
+
+	t.Run("Tarball download", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/npm/@acme/pkg/-/pkg-1.0.0.tgz")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, v1, w.Body.Bytes())
+	})
+
+	t.Run("Version is a stream group", func(t *testing.T) {
+		var res api.MetaResource
+		require.NoError(t, db.Where("path = ?", "/npm/@acme/pkg/-/pkg-1.0.0.tgz").First(&res).Error)
+		assert.Equal(t, "@acme/pkg", *res.Stream)
+		assert.Equal(t, "1.0.0", *res.Group)
+	})
+
+	t.Run("Published versions can't be overwritten", func(t *testing.T) {
+		tarball := npmTarball(t, "@acme/pkg", "1.0.0")
+		w := Perform(t, router, http.MethodPut, "/npm/@acme%2fpkg", auth,
+			WithJSON(npmPublishBody("@acme/pkg", "1.0.0", "pkg-1.0.0.tgz", tarball, "latest")))
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Integrity is verified", func(t *testing.T) {
+		body := npmPublishBody("@acme/pkg", "2.0.0", "pkg-2.0.0.tgz", npmTarball(t, "@acme/pkg", "2.0.0"), "latest")
+		body["_attachments"].(map[string]any)["pkg-2.0.0.tgz"].(map[string]any)["data"] = base64.StdEncoding.EncodeToString(npmTarball(t, "@acme/pkg", "6.6.6"))
+		body["_attachments"].(map[string]any)["pkg-2.0.0.tgz"].(map[string]any)["length"] = 0
+		w := Perform(t, router, http.MethodPut, "/npm/@acme%2fpkg", auth, WithJSON(body))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Anonymous publish is rejected", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/npm/@acme%2fpkg",
+			WithJSON(npmPublishBody("@acme/pkg", "3.0.0", "pkg-3.0.0.tgz", npmTarball(t, "@acme/pkg", "3.0.0"), "latest")))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Dist-tags", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/npm/-/package/@acme%2fpkg/dist-tags/stable", auth, WithJSON("1.1.0-beta.1"))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/npm/-/package/@acme%2fpkg/dist-tags")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"latest":"1.0.0","beta":"1.1.0-beta.1","stable":"1.1.0-beta.1"}`, w.Body.String())
+
+		w = Perform(t, router, http.MethodDelete, "/npm/-/package/@acme%2fpkg/dist-tags/beta", auth)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, packument(t, "@acme/pkg").DistTags, "beta")
+	})
+
+	t.Run("Versions are the groups of the stream", func(t *testing.T) {
+		publish(t, "plain-pkg", "2.0.0", "latest")
+		publish(t, "plain-pkg", "1.5.0", "old")
+		require.NoError(t, db.Model(&api.MetaResource{}).Where("path = ?", "/npm/plain-pkg/-/plain-pkg-2.0.0.tgz").
+			UpdateColumn("created_at", time.Now().Add(-time.Hour)).Error)
+
+		// without a latest tag the newest group is the latest
+		w := Perform(t, router, http.MethodDelete, "/npm/-/package/plain-pkg/dist-tags/latest", auth)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, map[string]string{"latest": "1.5.0", "old": "1.5.0"}, packument(t, "plain-pkg").DistTags)
+
+		// a tarball moved to another stream is no longer a version
+		w = Perform(t, router, http.MethodPatch, "/_/api/v1/fs/npm/plain-pkg/-/plain-pkg-2.0.0.tgz", auth,
+			WithJSON(map[string]any{"stream": "archived/2.0.0"}))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		doc := packument(t, "plain-pkg")
+		assert.NotContains(t, doc.Versions, "2.0.0")
+		assert.Contains(t, doc.Versions, "1.5.0")
+	})
+
+	t.Run("Unpublish a version", func(t *testing.T) {
+		doc := packument(t, "@acme/pkg")
+		// npm unpublish @acme/pkg@1.1.0-beta.1 first rewrites the dist-tags, then deletes the tarball
+		w := Perform(t, router, http.MethodPut, "/npm/@acme%2fpkg/-rev/"+doc.Rev, auth,
+			WithJSON(map[string]any{"name": "@acme/pkg", "dist-tags": map[string]string{"latest": "1.0.0"}}))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = Perform(t, router, http.MethodDelete, "/npm/@acme/pkg/-/pkg-1.1.0-beta.1.tgz/-rev/"+doc.Rev, auth)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		doc = packument(t, "@acme/pkg")
+		assert.Equal(t, map[string]string{"latest": "1.0.0"}, doc.DistTags)
+		assert.NotContains(t, doc.Versions, "1.1.0-beta.1")
+	})
+
+	t.Run("Immutable versions can't be unpublished", func(t *testing.T) {
+		publish(t, "@acme/locked-pkg", "1.0.0", "latest")
+		require.NoError(t, db.Model(&api.MetaResource{}).Where("path = ?", "/npm/@acme/locked-pkg/-/locked-pkg-1.0.0.tgz").Update("immutable", true).Error)
+
+		w := Perform(t, router, http.MethodDelete, "/npm/@acme%2flocked-pkg/-rev/1", auth)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		packument(t, "@acme/locked-pkg")
+	})
+
+	t.Run("Unpublish the package", func(t *testing.T) {
+		w := Perform(t, router, http.MethodDelete, "/npm/@acme%2fpkg/-rev/1", auth)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/npm/@acme%2fpkg")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Token scope applies", func(t *testing.T) {
+		WithConfig(t, func(c *config.Config) {
+			c.NPM.Paths = []string{"/npm", "/npm-other"}
+		})
+		tarball := npmTarball(t, "pkg", "1.0.0")
+		w := Perform(t, router, http.MethodPut, "/npm-other/pkg", auth,
+			WithJSON(npmPublishBody("pkg", "1.0.0", "pkg-1.0.0.tgz", tarball, "latest")))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
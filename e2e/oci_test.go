@@ -0,0 +1,276 @@
+package e2e
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ociDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func ociManifestFor(config, layer []byte) []byte {
+	m, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]any{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": ociDigest(config), "size": len(config)},
+		"layers":        []any{map[string]any{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": ociDigest(layer), "size": len(layer)}},
+	})
+	return m
+}
+
+func TestOCIRegistry(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.OCI.Enabled = true
+	})
+
+	admin := PrepareAuth(t, db, "oci-admin", true, AuthH.Config.Server.JwtSecret)
+	createToken := func(t *testing.T, scope string) string {
+		resp := Perform(t, router, "POST", "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+			"user_id": admin.User.ID, "name": "oci-" + scope, "path_scope": scope,
+		}))
+		require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+		var tokenData map[string]any
+		json.Unmarshal(resp.Body.Bytes(), &tokenData)
+		return tokenData["plain_token"].(string)
+	}
+	token := createToken(t, "/oci/team")
+	auth := WithBasicAuth(token)
+
+	// pushBlob uploads a blob in two chunks, like docker push does
+	pushBlob := func(t *testing.T, repo string, data []byte) {
+		w := Perform(t, router, http.MethodPost, "/v2/"+repo+"/blobs/uploads/", auth)
+		require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		location := w.Header().Get("Location")
+		require.NotEmpty(t, location)
+
+		half := len(data) / 2
+		w = Perform(t, router, http.MethodPatch, location, auth, WithBody(data[:half]),
+			WithHeader("Content-Range", fmt.Sprintf("0-%d", half-1)))
+		require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		assert.Equal(t, fmt.Sprintf("0-%d", half-1), w.Header().Get("Range"))
+
+		w = Perform(t, router, http.MethodPut, location+"?digest="+ociDigest(data), auth, WithBody(data[half:]))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.Equal(t, ociDigest(data), w.Header().Get("Docker-Content-Digest"))
+	}
+
+	config1, layer1 := []byte(`{"architecture":"amd64","v":1}`), []byte("layer one content")
+	config2, layer2 := []byte(`{"architecture":"amd64","v":2}`), []byte("layer two content")
+	manifest1, manifest2 := ociManifestFor(config1, layer1), ociManifestFor(config2, layer2)
+
+	t.Run("Ping challenges anonymous clients", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/v2/")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+
+		w = Perform(t, router, http.MethodGet, "/v2/", auth)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "registry/2.0", w.Header().Get("Docker-Distribution-API-Version"))
+	})
+
+	t.Run("Push", func(t *testing.T) {
+		pushBlob(t, "team/app", layer1)
+
+		// monolithic upload
+		w := Perform(t, router, http.MethodPost, "/v2/team/app/blobs/uploads/?digest="+ociDigest(config1), auth, WithBody(config1))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodHead, "/v2/team/app/blobs/"+ociDigest(layer1))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, fmt.Sprint(len(layer1)), w.Header().Get("Content-Length"))
+
+		w = Perform(t, router, http.MethodPut, "/v2/team/app/manifests/1.0", auth, WithBody(manifest1),
+			WithHeader("Content-Type", "application/vnd.oci.image.manifest.v1+json"), WithHeader("X-KeepLatest", "true"))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.Equal(t, ociDigest(manifest1), w.Header().Get("Docker-Content-Digest"))
+	})
+
+	t.Run("Pull", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/v2/team/app/manifests/1.0")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, manifest1, w.Body.Bytes())
+		assert.Equal(t, "application/vnd.oci.image.manifest.v1+json", w.Header().Get("Content-Type"))
+		assert.Equal(t, ociDigest(manifest1), w.Header().Get("Docker-Content-Digest"))
+
+		w = Perform(t, router, http.MethodGet, "/v2/team/app/manifests/"+ociDigest(manifest1))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = Perform(t, router, http.MethodGet, "/v2/team/app/blobs/"+ociDigest(layer1))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, layer1, w.Body.Bytes())
+
+		w = Perform(t, router, http.MethodGet, "/v2/team/app/manifests/missing")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "MANIFEST_UNKNOWN")
+	})
+
+	t.Run("Tag is a stream group", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/_/api/v1/fs/oci/team/app/_tags/1.0")
+		require.Equal(t, http.StatusOK, w.Code)
+		var meta map[string]any
+		json.Unmarshal(w.Body.Bytes(), &meta)
+		assert.Equal(t, "team/app", meta["stream"])
+		assert.Equal(t, "1.0", meta["group"])
+	})
+
+	t.Run("Manifest with missing blobs is rejected", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/v2/team/app/manifests/broken", auth,
+			WithBody(ociManifestFor([]byte("nope"), layer1)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "MANIFEST_BLOB_UNKNOWN")
+
+		w = Perform(t, router, http.MethodPut, "/v2/team/app/manifests/broken", auth,
+			WithBody([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "MANIFEST_INVALID", "config is required")
+	})
+
+	t.Run("Wrong digest is rejected", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/v2/team/app/blobs/uploads/?digest="+ociDigest([]byte("other")), auth, WithBody(layer2))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "DIGEST_INVALID")
+	})
+
+	t.Run("Token scope is enforced per repository", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/v2/other/app/blobs/uploads/", auth)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "DENIED")
+
+		w = Perform(t, router, http.MethodPost, "/v2/team/app/blobs/uploads/")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("Cross repository mount", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/v2/team/copy/blobs/uploads/?mount="+ociDigest(layer1)+"&from=team/app", auth)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		w = Perform(t, router, http.MethodGet, "/v2/team/copy/blobs/"+ociDigest(layer1))
+		assert.Equal(t, layer1, w.Body.Bytes())
+	})
+
+	t.Run("Tags list and catalog", func(t *testing.T) {
+		pushBlob(t, "team/app", layer2)
+		pushBlob(t, "team/app", config2)
+		w := Perform(t, router, http.MethodPut, "/v2/team/app/manifests/2.0", auth, WithBody(manifest2), WithHeader("X-KeepLatest", "true"))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/v2/team/app/tags/list")
+		require.Equal(t, http.StatusOK, w.Code)
+		var tags struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &tags)
+		assert.Equal(t, "team/app", tags.Name)
+		assert.Equal(t, []string{"1.0", "2.0"}, tags.Tags)
+
+		w = Perform(t, router, http.MethodGet, "/v2/team/app/tags/list?n=1")
+		json.Unmarshal(w.Body.Bytes(), &tags)
+		assert.Equal(t, []string{"1.0"}, tags.Tags)
+		assert.Contains(t, w.Header().Get("Link"), "last=1.0")
+
+		w = Perform(t, router, http.MethodGet, "/v2/_catalog")
+		assert.Contains(t, w.Body.String(), `"team/app"`)
+	})
+
+	t.Run("KeepLatest expires older tags and garbage is collected", func(t *testing.T) {
+		var tag api.MetaResource
+		require.NoError(t, db.Where("path = ?", "/oci/team/app/_tags/1.0").First(&tag).Error)
+		require.NotNil(t, tag.ExpiresAt, "1.0 was superseded by 2.0")
+
+		// pretend the push is older than the grace period of the garbage collection
+		old := time.Now().Add(-2 * time.Hour)
+		db.Model(&api.MetaResource{}).Where("path LIKE ?", "/oci/team/app/%").UpdateColumn("updated_at", old)
+		Meta.RunCleanup()
+		Meta.RegenerateIndexes()
+
+		w := Perform(t, router, http.MethodGet, "/v2/team/app/manifests/1.0")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = Perform(t, router, http.MethodGet, "/v2/team/app/manifests/"+ociDigest(manifest1))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = Perform(t, router, http.MethodHead, "/v2/team/app/blobs/"+ociDigest(layer1))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = Perform(t, router, http.MethodHead, "/v2/team/app/blobs/"+ociDigest(layer2))
+		assert.Equal(t, http.StatusOK, w.Code, "still referenced by 2.0")
+		w = Perform(t, router, http.MethodHead, "/v2/team/copy/blobs/"+ociDigest(layer1))
+		assert.Equal(t, http.StatusOK, w.Code, "other repositories are not affected")
+	})
+
+	t.Run("Existing blobs are kept for a new manifest", func(t *testing.T) {
+		old := time.Now().Add(-2 * time.Hour)
+		db.Model(&api.MetaResource{}).Where("path LIKE ?", "/oci/team/%").UpdateColumn("updated_at", old)
+		record := func(p string) api.MetaResource {
+			var r api.MetaResource
+			require.NoError(t, db.Where("path = ?", p).First(&r).Error)
+			return r
+		}
+
+		blob := "/oci/team/copy/_blobs/sha256/" + ociDigest(layer1)[7:]
+		before := record(blob)
+		w := Perform(t, router, http.MethodHead, "/v2/team/copy/blobs/"+ociDigest(layer1), auth)
+		require.Equal(t, http.StatusOK, w.Code)
+		after := record(blob)
+		assert.True(t, after.UpdatedAt.After(old), "HEAD touches the blob")
+		assert.True(t, after.ModTime.Equal(before.ModTime), "the time of the file stays for the sync")
+
+		pushBlob(t, "team/copy", config1)
+		db.Model(&api.MetaResource{}).Where("path LIKE ?", "/oci/team/copy/%").UpdateColumn("updated_at", old)
+		pushBlob(t, "team/copy", config1)
+		assert.True(t, record("/oci/team/copy/_blobs/sha256/"+ociDigest(config1)[7:]).UpdatedAt.After(old), "pushing again touches the blob")
+	})
+
+	t.Run("Unreadable manifests stop the garbage collection", func(t *testing.T) {
+		pushBlob(t, "team/gc", config2)
+		pushBlob(t, "team/gc", layer2)
+		w := Perform(t, router, http.MethodPut, "/v2/team/gc/manifests/1.0", auth, WithBody(manifest2))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		Meta.RegenerateIndexes()
+		manifestFile := filepath.Join(baseDir, "oci", "team", "gc", "_manifests", "sha256", ociDigest(manifest2)[7:])
+		require.NoError(t, os.WriteFile(manifestFile, []byte("{"), 0644))
+
+		// Another push runs the garbage collection of the repository
+		pushBlob(t, "team/gc", config1)
+		pushBlob(t, "team/gc", layer1)
+		db.Model(&api.MetaResource{}).Where("path LIKE ?", "/oci/team/gc/%").UpdateColumn("updated_at", time.Now().Add(-2*time.Hour))
+		w = Perform(t, router, http.MethodPut, "/v2/team/gc/manifests/2.0", auth, WithBody(manifest1))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		Meta.RegenerateIndexes()
+		for _, blob := range [][]byte{config2, layer2} {
+			w = Perform(t, router, http.MethodHead, "/v2/team/gc/blobs/"+ociDigest(blob), auth)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+	})
+
+	t.Run("Delete manifest by digest", func(t *testing.T) {
+		db.Model(&api.MetaResource{}).Where("path LIKE ?", "/oci/team/app/%").UpdateColumn("updated_at", time.Now().Add(-2*time.Hour))
+		w := Perform(t, router, http.MethodDelete, "/v2/team/app/manifests/"+ociDigest(manifest2), auth)
+		assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		Meta.RegenerateIndexes()
+
+		w = Perform(t, router, http.MethodGet, "/v2/team/app/manifests/2.0")
+		assert.Equal(t, http.StatusNotFound, w.Code, "tags of the manifest are removed too")
+		w = Perform(t, router, http.MethodHead, "/v2/team/app/blobs/"+ociDigest(layer2))
+		assert.Equal(t, http.StatusNotFound, w.Code, "unreferenced blobs are collected")
+	})
+
+	t.Run("Disabled registry serves the file tree", func(t *testing.T) {
+		WithConfig(t, func(c *config.Config) {})
+		w := Perform(t, router, http.MethodGet, "/v2/")
+		assert.Empty(t, w.Header().Get("Docker-Distribution-API-Version"))
+	})
+}
@@ -0,0 +1,211 @@
+package e2e
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/kovi/yaar/internal/models"
+	"github.com/kovi/yaar/internal/oidc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockOIDC is a minimal identity provider: discovery, JWKS and a token endpoint checking PKCE
+type mockOIDC struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	m := &mockOIDC{key: key, codes: map[string]mockGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		m.mu.Lock()
+		grant, ok := m.codes[r.FormValue("code")]
+		delete(m.codes, r.FormValue("code"))
+		m.mu.Unlock()
+		if id != "yaar" || secret != "s3cret" || !ok || oidc.Challenge(r.FormValue("code_verifier")) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+		token.Header["kid"] = "k1"
+		signed, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": signed})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize plays the login at the IdP and returns the code for the authorization request
+func (m *mockOIDC) authorize(authURL *url.URL, username string, groups []string, claims jwt.MapClaims) string {
+	q := authURL.Query()
+	all := jwt.MapClaims{
+		"iss": m.URL, "aud": q.Get("client_id"), "sub": "sub-" + username,
+		"exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix(),
+		"nonce": q.Get("nonce"), "preferred_username": username, "groups": groups,
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	code := oidc.RandomString()
+	m.mu.Lock()
+	m.codes[code] = mockGrant{challenge: q.Get("code_challenge"), claims: all}
+	m.mu.Unlock()
+	return code
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockOIDC(t)
+	prev, prevAuth := AuthH.Config.OIDC, AuthH.Config.Auth
+	t.Cleanup(func() { AuthH.Config.OIDC, AuthH.Config.Auth = prev, prevAuth })
+	AuthH.Config.Auth.Providers = []string{"local", "oidc"}
+	AuthH.Config.Auth.DefaultRole = ""
+	AuthH.Config.OIDC.Issuer = idp.URL
+	AuthH.Config.OIDC.ClientID = "yaar"
+	AuthH.Config.OIDC.ClientSecret = "s3cret"
+	AuthH.Config.OIDC.AdminGroups = []string{"yaar-admins"}
+
+	admin := PrepareAuth(t, db, "sso-admin", true, AuthH.Config.Server.JwtSecret)
+	w := Perform(t, router, http.MethodPost, "/_/api/admin/groups", WithSession(admin), WithJSON(map[string]any{
+		"name": "team-sso", "provider": "oidc", "bindings": []map[string]any{{"role": "publisher", "scope": "/sso"}},
+	}))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = Perform(t, router, http.MethodPost, "/_/api/admin/groups", WithSession(admin), WithJSON(map[string]any{
+		"name": "sso-manual", "bindings": []map[string]any{{"role": "publisher", "scope": "/sso-manual"}},
+	}))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var manual models.Group
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &manual))
+
+	tokenRe := regexp.MustCompile(`'af_token', "([^"]+)"`)
+	login := func(t *testing.T, username string, groups []string, claims jwt.MapClaims) *httptest.ResponseRecorder {
+		w := Perform(t, router, http.MethodGet, "/_/api/auth/oidc/login?redirect=/sso/docs")
+		require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+		authURL, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "S256", authURL.Query().Get("code_challenge_method"))
+		cookie := w.Result().Cookies()[0]
+
+		code := idp.authorize(authURL, username, groups, claims)
+		callback := "/_/api/auth/oidc/callback?code=" + code + "&state=" + authURL.Query().Get("state")
+		return Perform(t, router, http.MethodGet, callback, WithHeader("Cookie", cookie.Name+"="+cookie.Value))
+	}
+	session := func(t *testing.T, w *httptest.ResponseRecorder) RequestOption {
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		m := tokenRe.FindStringSubmatch(w.Body.String())
+		require.Len(t, m, 2)
+		assert.Contains(t, w.Body.String(), `location.replace("/sso/docs")`)
+		return WithHeader("Authorization", "Bearer "+m[1])
+	}
+
+	t.Run("First login provisions the user", func(t *testing.T) {
+		auth := session(t, login(t, "sso-dave", []string{"team-sso", "unknown"}, nil))
+
+		w := Perform(t, router, http.MethodGet, "/_/api/auth/me", auth)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"username":"sso-dave"`)
+		assert.Contains(t, w.Body.String(), `"is_admin":false`)
+
+		assert.Equal(t, http.StatusOK, Perform(t, router, http.MethodPut, "/sso/a.txt", auth, WithBody([]byte("a"))).Code)
+		assert.Equal(t, http.StatusForbidden, Perform(t, router, http.MethodPut, "/other/a.txt", auth, WithBody([]byte("a"))).Code)
+
+		w = Perform(t, router, http.MethodPost, "/_/api/login", WithJSON(map[string]string{"username": "sso-dave", "password": "x"}))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "provider users have no password")
+	})
+
+	t.Run("Only provider groups are synced", func(t *testing.T) {
+		var dave models.User
+		require.NoError(t, db.Where("username = ?", "sso-dave").First(&dave).Error)
+		w := Perform(t, router, http.MethodPut, fmt.Sprintf("/_/api/admin/groups/%d/members/%d", manual.ID, dave.ID), WithSession(admin))
+		require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+		auth := session(t, login(t, "sso-dave", []string{"team-sso", "sso-manual"}, nil))
+		assert.Equal(t, http.StatusOK, Perform(t, router, http.MethodPut, "/sso-manual/a.txt", auth, WithBody([]byte("a"))).Code)
+
+		auth = session(t, login(t, "sso-dave", nil, nil))
+		assert.Equal(t, http.StatusOK, Perform(t, router, http.MethodPut, "/sso/b.txt", auth, WithBody([]byte("b"))).Code, "a missing claim keeps the memberships")
+
+		auth = session(t, login(t, "sso-dave", []string{}, nil))
+		assert.Equal(t, http.StatusForbidden, Perform(t, router, http.MethodPut, "/sso/c.txt", auth, WithBody([]byte("c"))).Code, "an empty claim leaves provider groups")
+		assert.Equal(t, http.StatusOK, Perform(t, router, http.MethodPut, "/sso-manual/c.txt", auth, WithBody([]byte("c"))).Code, "local memberships stay")
+		assert.Equal(t, http.StatusForbidden, Perform(t, router, http.MethodPut, "/other/c.txt", auth, WithBody([]byte("c"))).Code)
+	})
+
+	t.Run("Admin group", func(t *testing.T) {
+		auth := session(t, login(t, "sso-dave", []string{"yaar-admins"}, nil))
+		w := Perform(t, router, http.MethodGet, "/_/api/admin/users", auth)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, http.StatusOK, Perform(t, router, http.MethodPut, "/other/a.txt", auth, WithBody([]byte("a"))).Code)
+	})
+
+	t.Run("Local accounts are not taken over", func(t *testing.T) {
+		w := login(t, "sso-admin", nil, nil)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Invalid responses", func(t *testing.T) {
+		w := login(t, "sso-erin", nil, jwt.MapClaims{"nonce": "replayed"})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w = login(t, "sso-erin", nil, jwt.MapClaims{"aud": "someone-else"})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w = Perform(t, router, http.MethodGet, "/_/api/auth/oidc/login")
+		cookie := w.Result().Cookies()[0]
+		w = Perform(t, router, http.MethodGet, "/_/api/auth/oidc/callback?code=x&state=forged", WithHeader("Cookie", cookie.Name+"="+cookie.Value))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		// Other tokens signed with the secret are no login state
+		other, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"state": "forged", "exp": time.Now().Add(time.Minute).Unix()}).
+			SignedString([]byte(AuthH.Config.Server.JwtSecret))
+		require.NoError(t, err)
+		w = Perform(t, router, http.MethodGet, "/_/api/auth/oidc/callback?code=x&state=forged", WithHeader("Cookie", cookie.Name+"="+other))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		AuthH.Config.Auth.Providers = []string{"local"}
+		w := Perform(t, router, http.MethodGet, "/_/api/auth/oidc/login")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
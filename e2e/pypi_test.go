@@ -0,0 +1,182 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// twineUpload builds the multipart form twine sends to the legacy upload API
+func twineUpload(t *testing.T, fields map[string]string, filename string, content []byte) RequestOption {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField(":action", "file_upload")
+	mw.WriteField("protocol_version", "1")
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("content", filename)
+	require.NoError(t, err)
+	fw.Write(content)
+	require.NoError(t, mw.Close())
+
+	return func(req *http.Request) {
+		WithBody(buf.Bytes())(req)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+	}
+}
+
+// readFlag is a body noting if it was read
+type readFlag struct{ read *atomic.Bool }
+
+func (r readFlag) Read(p []byte) (int, error) {
+	r.read.Store(true)
+	return 0, io.EOF
+}
+
+func TestPyPIRepository(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.PyPI.Paths = []string{"/pypi", "/py_pi"}
+		c.Storage.MaxUploadSize = "1MB"
+	})
+	session := PrepareAuth(t, db, "pypi-publisher", false, AuthH.Config.Server.JwtSecret)
+
+	wheel := []byte("wheel content")
+	wheelSum := sha256.Sum256(wheel)
+
+	t.Run("twine upload", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/pypi/", WithSession(session), twineUpload(t, map[string]string{
+			"name":            "My.Package",
+			"version":         "1.0",
+			"sha256_digest":   hex.EncodeToString(wheelSum[:]),
+			"requires_python": ">=3.8,<4",
+		}, "my_package-1.0-py3-none-any.whl", wheel))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/pypi/my-package/my_package-1.0-py3-none-any.whl")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, wheel, w.Body.Bytes())
+
+		// sdists can also be uploaded like any other file
+		w = Perform(t, router, http.MethodPut, "/pypi/my-package/my_package-1.0.tar.gz", WithSession(session), WithBody([]byte("sdist")))
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Existing files are not replaced", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/pypi/", WithSession(session), twineUpload(t, map[string]string{
+			"name": "my-package", "version": "1.0",
+		}, "my_package-1.0-py3-none-any.whl", []byte("other")))
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Digest mismatch is rejected", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/pypi/", WithSession(session), twineUpload(t, map[string]string{
+			"name": "my-package", "version": "1.1", "sha256_digest": hex.EncodeToString(wheelSum[:]),
+		}, "my_package-1.1-py3-none-any.whl", []byte("tampered")))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Anonymous upload is rejected", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/pypi/", twineUpload(t, map[string]string{
+			"name": "evil", "version": "1.0",
+		}, "evil-1.0-py3-none-any.whl", []byte("x")))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		var read atomic.Bool
+		w = Perform(t, router, http.MethodPost, "/pypi/", twineUpload(t, map[string]string{
+			"name": "evil", "version": "1.0",
+		}, "evil-1.0-py3-none-any.whl", []byte("x")), func(req *http.Request) {
+			req.Body = io.NopCloser(readFlag{&read})
+		})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.False(t, read.Load(), "the form is not parsed")
+	})
+
+	t.Run("Upload size is limited", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/pypi/", WithSession(session), twineUpload(t, map[string]string{
+			"name": "big", "version": "1.0",
+		}, "big-1.0-py3-none-any.whl", make([]byte, 3<<20)))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("Other forms are regular uploads", func(t *testing.T) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, err := mw.CreateFormFile("file", "notes.txt")
+		require.NoError(t, err)
+		fw.Write([]byte("notes"))
+		require.NoError(t, mw.Close())
+		w := Perform(t, router, http.MethodPost, "/pypi/docs", WithSession(session), WithBody(buf.Bytes()),
+			WithHeader("Content-Type", mw.FormDataContentType()))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		w = Perform(t, router, http.MethodGet, "/pypi/docs/notes.txt")
+		assert.Equal(t, "notes", w.Body.String())
+	})
+
+	t.Run("Project list", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/pypi/simple/")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `<a href="my-package/">my-package</a>`)
+
+		w = Perform(t, router, http.MethodGet, "/pypi/simple/", WithHeader("Accept", "application/vnd.pypi.simple.v1+json"))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/vnd.pypi.simple.v1+json", w.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"meta":{"api-version":"1.0"},"projects":[{"name":"my-package"}]}`, w.Body.String())
+	})
+
+	t.Run("Project page", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/pypi/simple/my-package/")
+		require.Equal(t, http.StatusOK, w.Code)
+		body := w.Body.String()
+		assert.Contains(t, body, `href="/pypi/my-package/my_package-1.0-py3-none-any.whl#sha256=`+hex.EncodeToString(wheelSum[:])+`"`)
+		assert.Contains(t, body, `data-requires-python="&gt;=3.8,&lt;4"`)
+		assert.Contains(t, body, `my_package-1.0.tar.gz`)
+
+		w = Perform(t, router, http.MethodGet, "/pypi/simple/my-package/", WithHeader("Accept", "application/vnd.pypi.simple.v1+json"))
+		require.Equal(t, http.StatusOK, w.Code)
+		var page struct {
+			Name  string `json:"name"`
+			Files []struct {
+				Filename       string            `json:"filename"`
+				Hashes         map[string]string `json:"hashes"`
+				RequiresPython string            `json:"requires-python"`
+			} `json:"files"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		assert.Equal(t, "my-package", page.Name)
+		require.Len(t, page.Files, 2)
+		assert.Equal(t, "my_package-1.0-py3-none-any.whl", page.Files[0].Filename)
+		assert.Equal(t, hex.EncodeToString(wheelSum[:]), page.Files[0].Hashes["sha256"])
+		assert.Equal(t, ">=3.8,<4", page.Files[0].RequiresPython)
+	})
+
+	t.Run("Names are normalized", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/pypi/simple/My_Package/")
+		assert.Equal(t, http.StatusMovedPermanently, w.Code)
+		assert.Equal(t, "/pypi/simple/my-package/", w.Header().Get("Location"))
+
+		w = Perform(t, router, http.MethodGet, "/pypi/simple/unknown/")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Only files below the index are listed", func(t *testing.T) {
+		for _, p := range []string{"/pyxpi/other/other-1.0.tar.gz", "/PY_PI/other/other-1.0.tar.gz"} {
+			w := Perform(t, router, http.MethodPut, p, WithSession(session), WithBody([]byte("sdist")))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		}
+
+		w := Perform(t, router, http.MethodGet, "/py_pi/simple/", WithHeader("Accept", "application/vnd.pypi.simple.v1+json"))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"meta":{"api-version":"1.0"},"projects":[]}`, w.Body.String())
+	})
+}
@@ -0,0 +1,122 @@
+package e2e
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/kovi/yaar/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAccess(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.Storage.AnonymousRead = []string{"/ra-public"}
+	})
+	admin := PrepareAuth(t, db, "ra-admin", true, AuthH.Config.Server.JwtSecret)
+	bob := PrepareAuth(t, db, "ra-bob", false, AuthH.Config.Server.JwtSecret)
+	require.NoError(t, db.Model(&models.User{}).Where("id = ?", bob.User.ID).Update("read_scope", "/ra-private/team").Error)
+
+	for p, stream := range map[string]string{
+		"/ra-public/a.txt":        "ra-public/1",
+		"/ra-private/team/b.txt":  "ra-private/1",
+		"/ra-private/other/c.txt": "ra-private/1",
+	} {
+		w := Perform(t, router, http.MethodPut, p, WithSession(admin), WithBody([]byte(p)), WithHeader("X-Stream", stream))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	names := func(t *testing.T, w interface{ Bytes() []byte }) []string {
+		var entries []api.FileResponse
+		require.NoError(t, json.Unmarshal(w.Bytes(), &entries))
+		var out []string
+		for _, e := range entries {
+			out = append(out, path.Base(e.Name))
+		}
+		return out
+	}
+
+	t.Run("Anonymous", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/ra-public/a.txt")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = Perform(t, router, http.MethodGet, "/ra-private/team/b.txt")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+
+		w = Perform(t, router, http.MethodGet, "/ra-private/missing.txt")
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "missing and unreadable paths look the same")
+
+		w = Perform(t, router, http.MethodGet, "/_/api/v1/fs/ra-private")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Empty(t, w.Header().Get("WWW-Authenticate"), "the UI asks for the login itself")
+
+		w = Perform(t, router, http.MethodGet, "/_/api/v1/fs/")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, names(t, w.Body), "ra-public")
+		assert.NotContains(t, names(t, w.Body), "ra-private")
+	})
+
+	t.Run("User read scope", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/ra-private/team/b.txt", WithSession(bob))
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = Perform(t, router, http.MethodGet, "/ra-public/a.txt", WithSession(bob))
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = Perform(t, router, http.MethodGet, "/ra-private/other/c.txt", WithSession(bob))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = Perform(t, router, http.MethodGet, "/_/api/v1/fs/ra-private", WithSession(bob))
+		require.Equal(t, http.StatusOK, w.Code, "directories leading to the scope are listable")
+		assert.Equal(t, []string{"team"}, names(t, w.Body))
+
+		w = Perform(t, router, http.MethodGet, "/_/api/v1/fs/ra-private/other", WithSession(bob))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = Perform(t, router, http.MethodGet, "/_/api/auth/me", WithSession(bob))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"read_paths":["/ra-private/team"]`)
+	})
+
+	t.Run("Token narrows the read scope", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPost, "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+			"user_id": admin.User.ID, "name": "ra-reader", "read_scope": "/ra-private/other",
+		}))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var tokenData map[string]any
+		json.Unmarshal(w.Body.Bytes(), &tokenData)
+		token := WithToken(tokenData["plain_token"].(string))
+
+		w = Perform(t, router, http.MethodGet, "/ra-private/other/c.txt", token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = Perform(t, router, http.MethodGet, "/ra-private/team/b.txt", token)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Search and streams", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/_/api/v1/search?q=ra-private", WithSession(bob))
+		require.Equal(t, http.StatusOK, w.Code)
+		var results []api.SearchResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+		require.Len(t, results, 1)
+		assert.Equal(t, "/ra-private/team/b.txt", results[0].Path)
+
+		w = Perform(t, router, http.MethodGet, "/_/api/v1/streams")
+		require.Equal(t, http.StatusOK, w.Code)
+		var streams []string
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &streams))
+		assert.Contains(t, streams, "ra-public")
+		assert.NotContains(t, streams, "ra-private")
+
+		w = Perform(t, router, http.MethodGet, "/_/api/v1/streams/ra-private", WithSession(bob))
+		require.Equal(t, http.StatusOK, w.Code)
+		var groups []api.GroupInfo
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &groups))
+		require.Len(t, groups, 1)
+		require.Len(t, groups[0].Files, 1)
+		assert.Equal(t, "/ra-private/team/b.txt", groups[0].Files[0].Name)
+	})
+}
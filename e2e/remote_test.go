@@ -0,0 +1,142 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteRepository(t *testing.T) {
+	jar := []byte("upstream jar content")
+	modified := time.Now().Add(-24 * time.Hour)
+
+	var hits atomic.Int32
+	var down atomic.Bool
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/org/lib/1.0/lib-1.0.jar":
+			http.ServeContent(w, r, "lib-1.0.jar", modified, bytes.NewReader(jar))
+		case "/org/lib/1.0/slow.jar":
+			<-release
+			w.Write(jar)
+		case "/org/lib/1.0/bad.jar":
+			w.Header().Set("X-Checksum-Sha256", "0000")
+			w.Write(jar)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	WithConfig(t, func(c *config.Config) {
+		c.Remotes = []config.RemoteConfig{
+			{Path: "/remote/central", URL: upstream.URL, TTL: time.Hour},
+			{Path: "/remote/offline", URL: upstream.URL, Offline: true},
+		}
+	})
+
+	const path = "/remote/central/org/lib/1.0/lib-1.0.jar"
+
+	t.Run("Miss is fetched and cached", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, path)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, jar, w.Body.Bytes())
+		sum := sha256.Sum256(jar)
+		assert.Equal(t, hex.EncodeToString(sum[:]), w.Header().Get("X-Checksum-Sha256"))
+
+		var res api.MetaResource
+		require.NoError(t, db.Preload("Tags").Where("path = ?", path).First(&res).Error)
+		require.Len(t, res.Tags, 1)
+		assert.Equal(t, "origin", res.Tags[0].Key)
+		assert.Equal(t, "remote", res.Tags[0].Value)
+		assert.Equal(t, int32(1), hits.Load())
+	})
+
+	t.Run("Fresh copies are served from the cache", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, path)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, jar, w.Body.Bytes())
+		assert.Equal(t, int32(1), hits.Load())
+	})
+
+	// pretend the TTL has passed
+	past := time.Now().Add(-2 * time.Hour).UTC()
+	require.NoError(t, db.Model(&api.MetaResource{}).Where("path = ?", path).UpdateColumn("updated_at", past).Error)
+
+	t.Run("Stale copies are revalidated", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, path)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, jar, w.Body.Bytes())
+		assert.Equal(t, int32(2), hits.Load())
+
+		var res api.MetaResource
+		require.NoError(t, db.Where("path = ?", path).First(&res).Error)
+		assert.WithinDuration(t, time.Now(), res.UpdatedAt, time.Minute, "304 refreshes the cache")
+	})
+
+	t.Run("Stale copies are served while upstream is down", func(t *testing.T) {
+		require.NoError(t, db.Model(&api.MetaResource{}).Where("path = ?", path).UpdateColumn("updated_at", past).Error)
+		down.Store(true)
+		defer down.Store(false)
+
+		w := Perform(t, router, http.MethodGet, path)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, jar, w.Body.Bytes())
+
+		w = Perform(t, router, http.MethodGet, "/remote/central/org/lib/2.0/lib-2.0.jar")
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+
+	t.Run("Upstream errors", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/remote/central/org/missing.jar")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = Perform(t, router, http.MethodGet, "/remote/central/org/lib/1.0/bad.jar")
+		assert.Equal(t, http.StatusBadGateway, w.Code, "checksum mismatch")
+		var count int64
+		db.Model(&api.MetaResource{}).Where("path = ?", "/remote/central/org/lib/1.0/bad.jar").Count(&count)
+		assert.Zero(t, count)
+	})
+
+	t.Run("Downloads outlive the requests waiting for them", func(t *testing.T) {
+		const slow = "/remote/central/org/lib/1.0/slow.jar"
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		w := Perform(t, router, http.MethodGet, slow, func(req *http.Request) { *req = *req.WithContext(ctx) })
+		assert.Equal(t, http.StatusBadGateway, w.Code, "the request is gone before the upstream answers")
+
+		close(release)
+		assert.Eventually(t, func() bool {
+			var count int64
+			db.Model(&api.MetaResource{}).Where("path = ?", slow).Count(&count)
+			return count == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		w = Perform(t, router, http.MethodGet, slow)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, jar, w.Body.Bytes())
+	})
+
+	t.Run("Offline remotes only serve the cache", func(t *testing.T) {
+		before := hits.Load()
+		w := Perform(t, router, http.MethodGet, "/remote/offline/org/lib/1.0/lib-1.0.jar")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, before, hits.Load())
+	})
+}
@@ -0,0 +1,212 @@
+package e2e
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type rpmTestTag struct {
+	tag, typ, count uint32
+	data            []byte
+}
+
+func rpmString(tag uint32, s string) rpmTestTag {
+	return rpmTestTag{tag, 6, 1, append([]byte(s), 0)}
+}
+
+func rpmStrings(tag uint32, values ...string) rpmTestTag {
+	var data []byte
+	for _, s := range values {
+		data = append(append(data, s...), 0)
+	}
+	return rpmTestTag{tag, 8, uint32(len(values)), data}
+}
+
+func rpmInt32(tag uint32, values ...uint32) rpmTestTag {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(data[i*4:], v)
+	}
+	return rpmTestTag{tag, 4, uint32(len(values)), data}
+}
+
+func rpmInt16(tag uint32, values ...uint16) rpmTestTag {
+	data := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(data[i*2:], v)
+	}
+	return rpmTestTag{tag, 3, uint32(len(values)), data}
+}
+
+// rpmTestHeader encodes a header structure with its index and aligned data store
+func rpmTestHeader(tags ...rpmTestTag) []byte {
+	sort.Slice(tags, func(i, j int) bool { return tags[i].tag < tags[j].tag })
+	var index, store bytes.Buffer
+	for _, t := range tags {
+		align := map[uint32]int{3: 2, 4: 4}[t.typ]
+		for align > 0 && store.Len()%align != 0 {
+			store.WriteByte(0)
+		}
+		binary.Write(&index, binary.BigEndian, []uint32{t.tag, t.typ, uint32(store.Len()), t.count})
+		store.Write(t.data)
+	}
+
+	var h bytes.Buffer
+	h.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(&h, binary.BigEndian, []uint32{uint32(len(tags)), uint32(store.Len())})
+	h.Write(index.Bytes())
+	h.Write(store.Bytes())
+	return h.Bytes()
+}
+
+// rpmTestPackage builds a binary package with a lead, a signature header and a main header
+func rpmTestPackage(name, version string) []byte {
+	var pkg bytes.Buffer
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	pkg.Write(lead)
+
+	sig := rpmTestHeader(rpmInt32(1000, 1234))
+	pkg.Write(sig)
+	pkg.Write(make([]byte, (8-len(sig)%8)%8))
+
+	pkg.Write(rpmTestHeader(
+		rpmString(1000, name),
+		rpmString(1001, version),
+		rpmString(1002, "1"),
+		rpmStrings(1004, "Says hello"),
+		rpmStrings(1005, "A friendly greeting & more"),
+		rpmInt32(1006, 1700000000),
+		rpmInt32(1009, 4096),
+		rpmString(1014, "MIT"),
+		rpmString(1022, "x86_64"),
+		rpmString(1044, name+"-"+version+"-1.src.rpm"),
+		rpmStrings(1047, name),
+		rpmInt32(1112, 8),
+		rpmStrings(1113, version+"-1"),
+		rpmStrings(1049, "rpmlib(CompressedFileNames)", "bash", "libc.so.6()(64bit)"),
+		rpmInt32(1048, 1<<24|8|2, 8|4, 0),
+		rpmStrings(1050, "3.0.4-1", "4.0", ""),
+		rpmStrings(1118, "/usr/bin/", "/usr/share/doc/"),
+		rpmStrings(1117, name, name),
+		rpmInt32(1116, 0, 1),
+		rpmInt16(1030, 0o100755, 0o040755),
+		rpmInt32(1037, 0, 0),
+		rpmInt32(1080, 1700000000),
+		rpmStrings(1081, "CI <ci@example.com> - "+version+"-1"),
+		rpmStrings(1082, "- Initial release"),
+	))
+	pkg.WriteString("payload")
+	return pkg.Bytes()
+}
+
+type testRepomd struct {
+	Data []struct {
+		Type     string `xml:"type,attr"`
+		Checksum string `xml:"checksum"`
+		Location struct {
+			Href string `xml:"href,attr"`
+		} `xml:"location"`
+	} `xml:"data"`
+}
+
+func TestRPMRepository(t *testing.T) {
+	WithConfig(t, func(c *config.Config) {
+		c.RPM.Paths = []string{"/rpm"}
+	})
+	session := PrepareAuth(t, db, "rpm-publisher", false, AuthH.Config.Server.JwtSecret)
+
+	// metadata returns the uncompressed metadata files by type, verified against repomd.xml
+	metadata := func(t *testing.T) map[string]string {
+		w := Perform(t, router, http.MethodGet, "/rpm/repodata/repomd.xml")
+		require.Equal(t, http.StatusOK, w.Code)
+		var repomd testRepomd
+		require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &repomd))
+
+		files := make(map[string]string)
+		for _, d := range repomd.Data {
+			w := Perform(t, router, http.MethodGet, "/rpm/"+d.Location.Href)
+			require.Equal(t, http.StatusOK, w.Code, d.Location.Href)
+			sum := sha256.Sum256(w.Body.Bytes())
+			assert.Equal(t, hex.EncodeToString(sum[:]), d.Checksum, d.Type)
+
+			gz, err := gzip.NewReader(w.Body)
+			require.NoError(t, err)
+			data, err := io.ReadAll(gz)
+			require.NoError(t, err)
+			files[d.Type] = string(data)
+		}
+		return files
+	}
+
+	hello := rpmTestPackage("hello", "1.0")
+	t.Run("Upload generates repodata", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/rpm/Packages/hello-1.0-1.x86_64.rpm", WithSession(session), WithBody(hello))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		md := metadata(t)
+		sum := sha256.Sum256(hello)
+		primary := md["primary"]
+		assert.Contains(t, primary, `xmlns:rpm="http://linux.duke.edu/metadata/rpm"`)
+		assert.Contains(t, primary, `packages="1"`)
+		assert.Contains(t, primary, `<name>hello</name>`)
+		assert.Contains(t, primary, `<version epoch="0" ver="1.0" rel="1"></version>`)
+		assert.Contains(t, primary, `<checksum type="sha256" pkgid="YES">`+hex.EncodeToString(sum[:])+`</checksum>`)
+		assert.Contains(t, primary, `<description>A friendly greeting &amp; more</description>`)
+		assert.Contains(t, primary, `<location href="Packages/hello-1.0-1.x86_64.rpm"></location>`)
+		assert.Contains(t, primary, `<rpm:license>MIT</rpm:license>`)
+		assert.Contains(t, primary, `<rpm:header-range start="136"`)
+		assert.Contains(t, primary, `<rpm:entry name="hello" flags="EQ" epoch="0" ver="1.0" rel="1"></rpm:entry>`)
+		assert.Contains(t, primary, `<rpm:entry name="bash" flags="GE" epoch="0" ver="4.0"></rpm:entry>`)
+		assert.Contains(t, primary, `<rpm:entry name="libc.so.6()(64bit)"></rpm:entry>`)
+		assert.NotContains(t, primary, "rpmlib(")
+		assert.Contains(t, primary, `<file>/usr/bin/hello</file>`)
+		assert.NotContains(t, primary, `/usr/share/doc/hello`, "only well-known paths go into primary")
+
+		assert.Contains(t, md["filelists"], `<file type="dir">/usr/share/doc/hello</file>`)
+		assert.Contains(t, md["other"], `<changelog author="CI &lt;ci@example.com&gt; - 1.0-1" date="1700000000">- Initial release</changelog>`)
+	})
+
+	t.Run("Further uploads are added", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/rpm/Packages/tools-2.0-1.x86_64.rpm", WithSession(session), WithBody(rpmTestPackage("tools", "2.0")))
+		require.Equal(t, http.StatusOK, w.Code)
+		w = Perform(t, router, http.MethodPut, "/rpm/Packages/broken-1.0-1.x86_64.rpm", WithSession(session), WithBody([]byte("not an rpm")))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		primary := metadata(t)["primary"]
+		assert.Contains(t, primary, `packages="2"`)
+		assert.Contains(t, primary, `<name>hello</name>`)
+		assert.Contains(t, primary, `<name>tools</name>`)
+	})
+
+	t.Run("Delete removes the package", func(t *testing.T) {
+		w := Perform(t, router, http.MethodDelete, "/rpm/Packages/tools-2.0-1.x86_64.rpm", WithSession(session))
+		require.Equal(t, http.StatusNoContent, w.Code)
+		primary := metadata(t)["primary"]
+		assert.Contains(t, primary, `packages="1"`)
+		assert.NotContains(t, primary, `<name>tools</name>`)
+	})
+
+	t.Run("Expired packages are removed", func(t *testing.T) {
+		past := time.Now().Add(-time.Hour).UTC()
+		require.NoError(t, db.Model(&api.MetaResource{}).Where("path LIKE ?", "/rpm/Packages/%").Update("expires_at", past).Error)
+		Meta.RunCleanup()
+
+		w := Perform(t, router, http.MethodGet, "/rpm/repodata/repomd.xml")
+		assert.Equal(t, http.StatusNotFound, w.Code, "no packages left")
+	})
+}
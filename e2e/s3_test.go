@@ -0,0 +1,224 @@
+package e2e
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/models"
+	"github.com/kovi/yaar/internal/sigv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// WithS3Signature signs the request with SigV4, it must be the last option
+func WithS3Signature(creds sigv4.Credentials, body []byte) RequestOption {
+	return func(req *http.Request) {
+		sum := sha256.Sum256(body)
+		sigv4.Sign(req, hex.EncodeToString(sum[:]), creds, "us-east-1", "s3", time.Now())
+	}
+}
+
+func hexMD5(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+type testS3List struct {
+	KeyCount              int
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key  string
+		ETag string
+		Size int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+func (l testS3List) keys() []string {
+	var keys []string
+	for _, c := range l.Contents {
+		keys = append(keys, c.Key)
+	}
+	for _, p := range l.CommonPrefixes {
+		keys = append(keys, p.Prefix)
+	}
+	return keys
+}
+
+func TestS3(t *testing.T) {
+	admin := PrepareAuth(t, db, "s3-admin", true, AuthH.Config.Server.JwtSecret)
+	resp := Perform(t, router, "POST", "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+		"user_id": admin.User.ID, "name": "s3-client", "path_scope": "/s3-bucket",
+	}))
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	var tokenData map[string]any
+	json.Unmarshal(resp.Body.Bytes(), &tokenData)
+	creds := sigv4.Credentials{AccessKey: tokenData["s3_access_key"].(string), SecretKey: tokenData["s3_secret_key"].(string)}
+
+	s3 := func(t *testing.T, method, p string, body []byte, opts ...RequestOption) *http.Response {
+		opts = append(opts, WithBody(body), WithS3Signature(creds, body))
+		return Perform(t, router, method, p, opts...).Result()
+	}
+	read := func(r *http.Response) string {
+		data, _ := io.ReadAll(r.Body)
+		return string(data)
+	}
+	list := func(t *testing.T, query string) testS3List {
+		r := s3(t, http.MethodGet, "/s3-bucket?list-type=2&"+query, nil)
+		body := read(r)
+		require.Equal(t, http.StatusOK, r.StatusCode, body)
+		var l testS3List
+		require.NoError(t, xml.Unmarshal([]byte(body), &l))
+		return l
+	}
+
+	t.Run("Credentials of the token", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/_/api/auth/s3-credentials", WithToken(tokenData["plain_token"].(string)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), creds.SecretKey)
+	})
+
+	t.Run("CreateBucket and PutObject", func(t *testing.T) {
+		r := s3(t, http.MethodPut, "/s3-bucket", nil)
+		require.Equal(t, http.StatusOK, r.StatusCode, read(r))
+
+		for _, key := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "z.txt"} {
+			r = s3(t, http.MethodPut, "/s3-bucket/"+key, []byte("content of "+key), WithHeader("X-Amz-Tagging", "team=storage"))
+			require.Equal(t, http.StatusOK, r.StatusCode, read(r))
+		}
+		assert.Equal(t, `"`+hexMD5("content of z.txt")+`"`, r.Header.Get("ETag"))
+
+		var res api.MetaResource
+		require.NoError(t, db.Preload("Tags").Where("path = ?", "/s3-bucket/dir/b.txt").First(&res).Error)
+		require.Len(t, res.Tags, 1)
+		assert.Equal(t, "storage", res.Tags[0].Value)
+
+		r = s3(t, http.MethodPut, "/s3-bucket/a.txt", []byte("again"), WithHeader("If-None-Match", "*"))
+		assert.Equal(t, http.StatusPreconditionFailed, r.StatusCode)
+		r = s3(t, http.MethodPut, "/s3-other/a.txt", []byte("x"))
+		assert.Equal(t, http.StatusForbidden, r.StatusCode, "outside of the token scope")
+	})
+
+	t.Run("Payload hash is verified", func(t *testing.T) {
+		body := []byte("tampered")
+		r := Perform(t, router, http.MethodPut, "/s3-bucket/bad.txt", WithBody(body),
+			WithS3Signature(creds, []byte("original"))).Result()
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+		assert.Contains(t, read(r), "XAmzContentSHA256Mismatch")
+	})
+
+	t.Run("GetObject and HeadObject", func(t *testing.T) {
+		r := s3(t, http.MethodGet, "/s3-bucket/dir/b.txt", nil)
+		require.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, "content of dir/b.txt", read(r))
+		assert.Equal(t, `"`+hexMD5("content of dir/b.txt")+`"`, r.Header.Get("ETag"))
+
+		r = s3(t, http.MethodHead, "/s3-bucket/a.txt", nil)
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, "16", r.Header.Get("Content-Length"))
+
+		r = s3(t, http.MethodGet, "/s3-bucket/missing.txt", nil)
+		assert.Equal(t, http.StatusNotFound, r.StatusCode)
+		assert.Contains(t, read(r), "<Code>NoSuchKey</Code>")
+	})
+
+	t.Run("ListObjectsV2", func(t *testing.T) {
+		l := list(t, "")
+		assert.Equal(t, []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "z.txt"}, l.keys())
+		assert.Equal(t, int64(len("content of a.txt")), l.Contents[0].Size)
+
+		l = list(t, "delimiter=/")
+		assert.Equal(t, []string{"a.txt", "z.txt", "dir/"}, l.keys())
+		l = list(t, "delimiter=/&prefix=dir/")
+		assert.Equal(t, []string{"dir/b.txt", "dir/sub/"}, l.keys())
+
+		l = list(t, "max-keys=3")
+		assert.True(t, l.IsTruncated)
+		assert.Equal(t, 3, l.KeyCount)
+		l = list(t, "max-keys=3&continuation-token="+url.QueryEscape(l.NextContinuationToken))
+		assert.False(t, l.IsTruncated)
+		assert.Equal(t, []string{"z.txt"}, l.keys())
+	})
+
+	t.Run("Multipart upload", func(t *testing.T) {
+		r := s3(t, http.MethodPost, "/s3-bucket/big.bin?uploads", nil)
+		body := read(r)
+		require.Equal(t, http.StatusOK, r.StatusCode, body)
+		var initiated struct{ UploadId string }
+		require.NoError(t, xml.Unmarshal([]byte(body), &initiated))
+
+		parts := []string{strings.Repeat("a", 1000), strings.Repeat("b", 10)}
+		complete := "<CompleteMultipartUpload>"
+		for i, part := range parts {
+			r = s3(t, http.MethodPut, fmt.Sprintf("/s3-bucket/big.bin?partNumber=%d&uploadId=%s", i+1, initiated.UploadId), []byte(part))
+			require.Equal(t, http.StatusOK, r.StatusCode, read(r))
+			complete += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, r.Header.Get("ETag"))
+		}
+		complete += "</CompleteMultipartUpload>"
+
+		r = s3(t, http.MethodPost, "/s3-bucket/big.bin?uploadId="+initiated.UploadId, []byte(complete))
+		require.Equal(t, http.StatusOK, r.StatusCode, read(r))
+		r = s3(t, http.MethodGet, "/s3-bucket/big.bin", nil)
+		assert.Equal(t, parts[0]+parts[1], read(r))
+
+		var count int64
+		db.Model(&api.UploadSession{}).Where("id = ?", initiated.UploadId).Count(&count)
+		assert.Zero(t, count)
+
+		r = s3(t, http.MethodDelete, "/s3-bucket/big.bin?uploadId="+initiated.UploadId, nil)
+		assert.Equal(t, http.StatusNotFound, r.StatusCode)
+	})
+
+	t.Run("Bad signature", func(t *testing.T) {
+		wrong := sigv4.Credentials{AccessKey: creds.AccessKey, SecretKey: "wrong"}
+		r := Perform(t, router, http.MethodGet, "/s3-bucket/a.txt", WithS3Signature(wrong, nil)).Result()
+		assert.Equal(t, http.StatusForbidden, r.StatusCode)
+		assert.Contains(t, read(r), "SignatureDoesNotMatch")
+	})
+
+	t.Run("Presigned URL", func(t *testing.T) {
+		now := time.Now().UTC()
+		q := url.Values{}
+		q.Set("X-Amz-Algorithm", sigv4.Algorithm)
+		q.Set("X-Amz-Credential", creds.AccessKey+"/"+sigv4.Scope(now, "us-east-1", "s3"))
+		q.Set("X-Amz-Date", now.Format(sigv4.TimeFormat))
+		q.Set("X-Amz-Expires", "300")
+		q.Set("X-Amz-SignedHeaders", "host")
+		req, _ := http.NewRequest(http.MethodGet, "/s3-bucket/a.txt?"+q.Encode(), nil)
+		canonical := sigv4.CanonicalRequest(req, []string{"host"}, sigv4.UnsignedPayload)
+		sts := sigv4.StringToSign(now.Format(sigv4.TimeFormat), sigv4.Scope(now, "us-east-1", "s3"), canonical)
+		q.Set("X-Amz-Signature", sigv4.Signature(creds.SecretKey, now, "us-east-1", "s3", sts))
+
+		w := Perform(t, router, http.MethodGet, "/s3-bucket/a.txt?"+q.Encode())
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "content of a.txt", w.Body.String())
+	})
+
+	t.Run("DeleteObject", func(t *testing.T) {
+		r := s3(t, http.MethodDelete, "/s3-bucket/z.txt", nil)
+		assert.Equal(t, http.StatusNoContent, r.StatusCode)
+		r = s3(t, http.MethodDelete, "/s3-bucket/z.txt", nil)
+		assert.Equal(t, http.StatusNoContent, r.StatusCode, "missing keys are no error")
+		assert.Equal(t, http.StatusNotFound, Perform(t, router, http.MethodGet, "/s3-bucket/z.txt").Code)
+	})
+
+	t.Run("Revoked tokens lose their keys", func(t *testing.T) {
+		require.NoError(t, db.Delete(&models.Token{}, tokenData["id"]).Error)
+		r := s3(t, http.MethodGet, "/s3-bucket/a.txt", nil)
+		assert.Equal(t, http.StatusForbidden, r.StatusCode)
+	})
+}
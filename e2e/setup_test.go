@@ -12,6 +12,7 @@ import (
 	"github.com/kovi/yaar/internal/audit"
 	"github.com/kovi/yaar/internal/auth"
 	"github.com/kovi/yaar/internal/config"
+	"github.com/kovi/yaar/internal/storage"
 	"github.com/kovi/yaar/middleware"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
@@ -22,6 +23,8 @@ var (
 )
 
 func PushNewConfig(c *config.Config) {
+	// Pending index changes belong to the config in use
+	Meta.RegenerateIndexes()
 	prevConfigs = append(prevConfigs, Meta.Config)
 	Meta.Config = c
 	err := Meta.Config.Finalize()
@@ -31,6 +34,7 @@ func PushNewConfig(c *config.Config) {
 }
 
 func PopConfig() {
+	Meta.RegenerateIndexes()
 	Meta.Config = prevConfigs[len(prevConfigs)-1]
 	prevConfigs = prevConfigs[:len(prevConfigs)-1]
 }
@@ -70,9 +74,10 @@ func setupServer(db *gorm.DB, rootDir, baseDir string) *gin.Engine {
 	// setup router
 	router := gin.New()
 	router.Use(middleware.LogrusMiddleware(logrus.StandardLogger()))
-	router.Use(auth.Identify(cfg.Server.JwtSecret, db, &AuthH.UserCache))
+	router.Use(auth.Identify(&AuthH.Config, db, &AuthH.UserCache))
 	Meta = &api.Handler{
 		BaseDir: baseDir,
+		Storage: storage.NewFS(baseDir),
 		DB:      db,
 		Log:     logrus.WithField("module", "meta"),
 		Config:  cfg,
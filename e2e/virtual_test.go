@@ -0,0 +1,99 @@
+package e2e
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualRepository(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/org/upstream.jar" {
+			w.Write([]byte("from upstream"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	WithConfig(t, func(c *config.Config) {
+		c.Remotes = []config.RemoteConfig{{Path: "/virtual-remote", URL: upstream.URL}}
+		c.Virtuals = []config.VirtualConfig{{Path: "/virtual/libs", Paths: []string{"/teams/a", "/teams/b", "/virtual-remote"}}}
+	})
+	session := PrepareAuth(t, db, "virtual-user", false, AuthH.Config.Server.JwtSecret)
+
+	upload := func(t *testing.T, p, content string) {
+		w := Perform(t, router, http.MethodPut, p, WithSession(session), WithBody([]byte(content)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	get := func(t *testing.T, p string) *httptest.ResponseRecorder {
+		return Perform(t, router, http.MethodGet, p, WithHeader("Accept", "*/*"))
+	}
+
+	upload(t, "/teams/a/org/a.jar", "a")
+	upload(t, "/teams/b/org/b.jar", "b")
+	upload(t, "/teams/b/org/shared.jar", "shared from b")
+
+	t.Run("First hit wins", func(t *testing.T) {
+		w := get(t, "/virtual/libs/org/a.jar")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "a", w.Body.String())
+
+		w = get(t, "/virtual/libs/org/shared.jar")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "shared from b", w.Body.String())
+
+		// the cached lookup must not hide a file added to an earlier directory
+		upload(t, "/teams/a/org/shared.jar", "shared from a")
+		w = get(t, "/virtual/libs/org/shared.jar")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "shared from a", w.Body.String())
+	})
+
+	t.Run("Remotes are fetched through the view", func(t *testing.T) {
+		w := get(t, "/virtual/libs/org/upstream.jar")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "from upstream", w.Body.String())
+
+		var count int64
+		db.Model(&api.MetaResource{}).Where("path = ?", "/virtual-remote/org/upstream.jar").Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("Merged directory listing", func(t *testing.T) {
+		w := Perform(t, router, http.MethodGet, "/_/api/v1/fs/virtual/libs/org")
+		require.Equal(t, http.StatusOK, w.Code)
+		var entries []api.FileResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+			if e.Name == "shared.jar" {
+				assert.Equal(t, int64(len("shared from a")), e.Size)
+			}
+		}
+		sort.Strings(names)
+		assert.Equal(t, []string{"a.jar", "b.jar", "shared.jar", "upstream.jar"}, names)
+
+		w = Perform(t, router, http.MethodGet, "/_/api/v1/fs/virtual/libs/org/b.jar")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"name":"b.jar"`)
+
+		w = Perform(t, router, http.MethodGet, "/_/api/v1/fs/virtual/libs/nope")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Virtual repositories are read-only", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/virtual/libs/org/c.jar", WithSession(session), WithBody([]byte("c")))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		w = Perform(t, router, http.MethodDelete, "/virtual/libs/org/a.jar", WithSession(session))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
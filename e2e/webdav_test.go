@@ -0,0 +1,179 @@
+package e2e
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"testing"
+
+	"github.com/kovi/yaar/internal/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDavMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				Props []struct {
+					XMLName xml.Name
+					Value   string `xml:",innerxml"`
+				} `xml:",any"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// props returns the properties of href by status, keyed by "namespace local"
+func (ms testDavMultistatus) props(href string) map[string]map[string]string {
+	result := map[string]map[string]string{}
+	for _, r := range ms.Responses {
+		if r.Href != href {
+			continue
+		}
+		for _, ps := range r.Propstats {
+			result[ps.Status] = map[string]string{}
+			for _, p := range ps.Prop.Props {
+				result[ps.Status][p.XMLName.Space+" "+p.XMLName.Local] = p.Value
+			}
+		}
+	}
+	return result
+}
+
+func TestWebDAV(t *testing.T) {
+	admin := PrepareAuth(t, db, "dav-admin", true, AuthH.Config.Server.JwtSecret)
+	resp := Perform(t, router, "POST", "/_/api/admin/tokens", WithSession(admin), WithJSON(map[string]any{
+		"user_id": admin.User.ID, "name": "dav-mount", "path_scope": "/dav-docs",
+	}))
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	var tokenData map[string]any
+	json.Unmarshal(resp.Body.Bytes(), &tokenData)
+	auth := WithBasicAuth(tokenData["plain_token"].(string))
+
+	propfind := func(t *testing.T, p, depth, body string) testDavMultistatus {
+		w := Perform(t, router, "PROPFIND", p, WithHeader("Depth", depth), WithBody([]byte(body)))
+		require.Equal(t, http.StatusMultiStatus, w.Code, w.Body.String())
+		var ms testDavMultistatus
+		require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &ms))
+		return ms
+	}
+
+	t.Run("OPTIONS announces class 2", func(t *testing.T) {
+		w := Perform(t, router, http.MethodOptions, "/_/dav/")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "1, 2", w.Header().Get("DAV"))
+	})
+
+	t.Run("MKCOL", func(t *testing.T) {
+		w := Perform(t, router, "MKCOL", "/_/dav/dav-docs")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+
+		w = Perform(t, router, "MKCOL", "/_/dav/dav-docs", auth)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		w = Perform(t, router, "MKCOL", "/_/dav/dav-docs", auth)
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		w = Perform(t, router, "MKCOL", "/_/dav/dav-docs/missing/sub", auth)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		w = Perform(t, router, "MKCOL", "/_/dav/dav-other", auth)
+		assert.Equal(t, http.StatusForbidden, w.Code, "outside of the token scope")
+	})
+
+	t.Run("PUT uses the upload pipeline", func(t *testing.T) {
+		w := Perform(t, router, http.MethodPut, "/_/dav/dav-docs/a.txt", auth, WithBody([]byte("hello")),
+			WithHeader("X-Tags", "team=docs"), WithHeader("X-Stream", "manual/1.0"))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = Perform(t, router, http.MethodGet, "/dav-docs/a.txt")
+		assert.Equal(t, "hello", w.Body.String())
+		w = Perform(t, router, http.MethodGet, "/_/dav/dav-docs/a.txt")
+		assert.Equal(t, "hello", w.Body.String())
+		assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", w.Header().Get("X-Checksum-Sha256"))
+	})
+
+	t.Run("PROPFIND exposes yaar metadata", func(t *testing.T) {
+		ms := propfind(t, "/_/dav/dav-docs/", "1", "")
+		require.Len(t, ms.Responses, 2)
+		assert.Equal(t, "<D:collection/>", ms.props("/_/dav/dav-docs/")["HTTP/1.1 200 OK"]["DAV: resourcetype"])
+
+		props := ms.props("/_/dav/dav-docs/a.txt")["HTTP/1.1 200 OK"]
+		assert.Equal(t, "5", props["DAV: getcontentlength"])
+		assert.Equal(t, "team=docs", props["https://github.com/kovi/yaar tags"])
+		assert.Equal(t, "manual/1.0", props["https://github.com/kovi/yaar stream"])
+		assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", props["https://github.com/kovi/yaar sha256"])
+
+		ms = propfind(t, "/_/dav/dav-docs/a.txt", "0", `<?xml version="1.0"?>
+<propfind xmlns="DAV:" xmlns:y="https://github.com/kovi/yaar" xmlns:x="urn:other">
+  <prop><getetag/><y:tags/><y:expires/><x:color/></prop>
+</propfind>`)
+		byStatus := ms.props("/_/dav/dav-docs/a.txt")
+		assert.Len(t, byStatus["HTTP/1.1 200 OK"], 2)
+		assert.Contains(t, byStatus["HTTP/1.1 404 Not Found"], "https://github.com/kovi/yaar expires")
+		assert.Contains(t, byStatus["HTTP/1.1 404 Not Found"], "urn:other color")
+
+		w := Perform(t, router, "PROPFIND", "/_/dav/", WithHeader("Depth", "infinity"), WithBody(nil))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = Perform(t, router, "PROPFIND", "/_/dav/.yaar", WithHeader("Depth", "0"), WithBody(nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("PROPPATCH is refused", func(t *testing.T) {
+		w := Perform(t, router, "PROPPATCH", "/_/dav/dav-docs/a.txt", auth, WithBody([]byte(`<?xml version="1.0"?>
+<propertyupdate xmlns="DAV:" xmlns:y="https://github.com/kovi/yaar"><set><prop><y:tags>x=y</y:tags></prop></set></propertyupdate>`)))
+		require.Equal(t, http.StatusMultiStatus, w.Code)
+		assert.Contains(t, w.Body.String(), "403 Forbidden")
+	})
+
+	t.Run("COPY and MOVE", func(t *testing.T) {
+		w := Perform(t, router, "COPY", "/_/dav/dav-docs/a.txt", auth, WithHeader("Destination", "http://example.com/_/dav/dav-docs/b.txt"))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var res api.MetaResource
+		require.NoError(t, db.Preload("Tags").Where("path = ?", "/dav-docs/b.txt").First(&res).Error)
+		require.Len(t, res.Tags, 1)
+		assert.Equal(t, "docs", res.Tags[0].Value)
+
+		w = Perform(t, router, "MOVE", "/_/dav/dav-docs/b.txt", auth, WithHeader("Destination", "/_/dav/dav-docs/a.txt"), WithHeader("Overwrite", "F"))
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		w = Perform(t, router, "MOVE", "/_/dav/dav-docs/b.txt", auth, WithHeader("Destination", "/_/dav/dav-docs/sub/c.txt"))
+		assert.Equal(t, http.StatusConflict, w.Code, "parent must exist")
+
+		w = Perform(t, router, "MOVE", "/_/dav/dav-docs/b.txt", auth, WithHeader("Destination", "/_/dav/dav-docs/c.txt"))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.Equal(t, http.StatusNotFound, Perform(t, router, http.MethodGet, "/_/dav/dav-docs/b.txt").Code)
+		var count int64
+		db.Model(&api.MetaResource{}).Where("path = ?", "/dav-docs/c.txt").Count(&count)
+		assert.Equal(t, int64(1), count)
+
+		w = Perform(t, router, "MOVE", "/_/dav/dav-docs/c.txt", auth, WithHeader("Destination", "/_/dav/c.txt"))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("LOCK and UNLOCK", func(t *testing.T) {
+		w := Perform(t, router, "LOCK", "/_/dav/dav-docs/a.txt", auth, WithBody([]byte(`<?xml version="1.0"?>
+<lockinfo xmlns="DAV:"><lockscope><exclusive/></lockscope><locktype><write/></locktype><owner><href>me</href></owner></lockinfo>`)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		token := w.Header().Get("Lock-Token")
+		assert.Contains(t, token, "opaquelocktoken:")
+		assert.Contains(t, w.Body.String(), "<D:owner><href>me</href></D:owner>")
+
+		w = Perform(t, router, "LOCK", "/_/dav/dav-docs/a.txt", auth, WithBody(nil), WithHeader("If", "("+token+")"))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, token, w.Header().Get("Lock-Token"))
+
+		w = Perform(t, router, "LOCK", "/_/dav/dav-docs/new.txt", auth, WithBody([]byte(`<lockinfo xmlns="DAV:"><lockscope><exclusive/></lockscope><locktype><write/></locktype></lockinfo>`)))
+		assert.Equal(t, http.StatusCreated, w.Code, "locking creates an empty file")
+
+		w = Perform(t, router, "UNLOCK", "/_/dav/dav-docs/a.txt", auth, WithHeader("Lock-Token", token))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	})
+
+	t.Run("DELETE", func(t *testing.T) {
+		w := Perform(t, router, http.MethodDelete, "/_/dav/dav-docs/a.txt", auth)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, http.StatusNotFound, Perform(t, router, http.MethodGet, "/_/dav/dav-docs/a.txt").Code)
+	})
+}
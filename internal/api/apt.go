@@ -0,0 +1,415 @@
+package api
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// APT repositories are flat repositories (deb http://host/<prefix> ./): Packages, Packages.gz and Release
+// at the prefix list every .deb stored below it. InRelease is added when apt.signing_key is configured.
+
+const (
+	aptPackagesFile   = "Packages"
+	aptPackagesGzFile = "Packages.gz"
+	aptReleaseFile    = "Release"
+	aptInReleaseFile  = "InRelease"
+
+	// aptMaxControlSize limits the control file read from a package
+	aptMaxControlSize = 1 << 20
+)
+
+var aptIndexFiles = []string{aptPackagesFile, aptPackagesGzFile, aptReleaseFile, aptInReleaseFile}
+
+// aptField is a field of a deb822 paragraph, multi-line values keep their continuation lines
+type aptField struct {
+	Name  string
+	Value string
+}
+
+type aptParagraph []aptField
+
+// Get returns the value of a field, field names are case-insensitive
+func (p aptParagraph) Get(name string) string {
+	for _, f := range p {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+func (p aptParagraph) String() string {
+	var b strings.Builder
+	for _, f := range p {
+		b.WriteString(f.Name)
+		b.WriteString(":")
+		if !strings.HasPrefix(f.Value, "\n") {
+			b.WriteString(" ")
+		}
+		b.WriteString(f.Value)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// parseAPTParagraphs parses deb822 text, like a control file or a Packages index
+func parseAPTParagraphs(text string) ([]aptParagraph, error) {
+	var paragraphs []aptParagraph
+	var current aptParagraph
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(current) > 0 {
+				paragraphs = append(paragraphs, current)
+				current = nil
+			}
+		case line[0] == ' ' || line[0] == '\t':
+			if len(current) == 0 {
+				return nil, errors.New("continuation line without field")
+			}
+			current[len(current)-1].Value += "\n" + line
+		case line[0] == '#':
+		default:
+			name, value, ok := strings.Cut(line, ":")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("invalid line %q", line)
+			}
+			current = append(current, aptField{Name: name, Value: strings.TrimSpace(value)})
+		}
+	}
+	if len(current) > 0 {
+		paragraphs = append(paragraphs, current)
+	}
+	return paragraphs, nil
+}
+
+// readDebControl returns the control paragraph of a .deb, an ar archive with a control.tar member
+func readDebControl(r io.Reader) (aptParagraph, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != "!<arch>\n" {
+		return nil, errors.New("not a deb archive")
+	}
+
+	header := make([]byte, 60)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return nil, errors.New("control.tar not found")
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil || size < 0 {
+			return nil, errors.New("invalid ar header")
+		}
+
+		member := io.LimitReader(br, size)
+		switch name {
+		case "control.tar":
+			return readDebControlTar(member)
+		case "control.tar.gz":
+			gz, err := gzip.NewReader(member)
+			if err != nil {
+				return nil, err
+			}
+			return readDebControlTar(gz)
+		case "control.tar.xz", "control.tar.zst":
+			return nil, fmt.Errorf("%s is not supported, build the package with dpkg-deb -Zgzip", name)
+		}
+
+		// members are 2-byte aligned
+		if _, err := io.CopyN(io.Discard, br, size+size%2); err != nil {
+			return nil, errors.New("truncated deb archive")
+		}
+	}
+}
+
+func readDebControlTar(r io.Reader) (aptParagraph, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return nil, errors.New("control file not found")
+		}
+		if path.Clean(strings.TrimPrefix(hdr.Name, "./")) != "control" {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, aptMaxControlSize))
+		if err != nil {
+			return nil, err
+		}
+		paragraphs, err := parseAPTParagraphs(string(data))
+		if err != nil {
+			return nil, err
+		}
+		if len(paragraphs) != 1 {
+			return nil, errors.New("control file must have exactly one paragraph")
+		}
+		control := paragraphs[0]
+		for _, required := range []string{"Package", "Version", "Architecture"} {
+			if control.Get(required) == "" {
+				return nil, fmt.Errorf("control file has no %s field", required)
+			}
+		}
+		return control, nil
+	}
+}
+
+// aptPackages returns the records of the .deb files of a repository
+func (h *Handler) aptPackages(root string) ([]MetaResource, error) {
+	candidates, err := h.filesUnder(root + "/")
+	if err != nil {
+		return nil, err
+	}
+	var debs []MetaResource
+	for _, r := range candidates {
+		if strings.HasSuffix(r.Path, ".deb") {
+			debs = append(debs, r)
+		}
+	}
+	return debs, nil
+}
+
+// updateAPTIndexes regenerates the indexes of the APT repositories the changed paths belong to
+func (h *Handler) updateAPTIndexes(paths ...string) {
+	roots := make(map[string]bool)
+	for _, p := range paths {
+		root, ok := h.Config.APTRepo(p)
+		if !ok || (path.Dir(p) == root && isAPTIndexFile(path.Base(p))) {
+			continue
+		}
+		roots[root] = true
+	}
+
+	for root := range roots {
+		if err := h.writeAPTIndex(root); err != nil {
+			h.Log.WithError(err).Errorf("apt: failed to update the index of %s", root)
+		}
+	}
+}
+
+func isAPTIndexFile(name string) bool {
+	for _, f := range aptIndexFiles {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) writeAPTIndex(root string) error {
+	debs, err := h.aptPackages(root)
+	if err != nil {
+		return err
+	}
+	if len(debs) == 0 {
+		for _, f := range aptIndexFiles {
+			if err := h.removeFile(path.Join(root, f)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Reading a package is expensive, reuse the paragraphs of unchanged ones
+	cached := make(map[string]aptParagraph)
+	if old, err := h.readAPTPackages(path.Join(root, aptPackagesFile)); err == nil {
+		for _, p := range old {
+			cached[p.Get("Filename")] = p
+		}
+	}
+
+	var packages bytes.Buffer
+	architectures := make(map[string]bool)
+	for _, deb := range debs {
+		filename := strings.TrimPrefix(deb.Path, root+"/")
+		paragraph, ok := cached[filename]
+		if !ok || paragraph.Get("SHA256") != deb.SHA256 {
+			control, err := h.readDebControlFile(deb.Path)
+			if err != nil {
+				h.Log.WithError(err).Warnf("apt: skipping %s", deb.Path)
+				continue
+			}
+			paragraph = aptPackageParagraph(control, filename, deb)
+		}
+		architectures[paragraph.Get("Architecture")] = true
+		packages.WriteString(paragraph.String())
+		packages.WriteString("\n")
+	}
+
+	// Nothing to do unless the package list or the signing setup changed
+	signed := h.Config.APT.SigningKey != ""
+	packagesSum := sha256.Sum256(packages.Bytes())
+	if meta, err := h.GetFileMeta(path.Join(root, aptPackagesFile)); err == nil && meta != nil && meta.SHA256 == hex.EncodeToString(packagesSum[:]) {
+		_, err := h.Storage.Stat(path.Join(root, aptInReleaseFile))
+		if signed == (err == nil) {
+			return nil
+		}
+	}
+
+	var packagesGz bytes.Buffer
+	gz := gzip.NewWriter(&packagesGz)
+	gz.Write(packages.Bytes())
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	release := aptRelease(root, architectures, map[string][]byte{
+		aptPackagesFile:   packages.Bytes(),
+		aptPackagesGzFile: packagesGz.Bytes(),
+	})
+
+	if err := h.writeGeneratedFile(path.Join(root, aptPackagesFile), "text/plain; charset=utf-8", packages.Bytes()); err != nil {
+		return err
+	}
+	if err := h.writeGeneratedFile(path.Join(root, aptPackagesGzFile), "application/gzip", packagesGz.Bytes()); err != nil {
+		return err
+	}
+	if err := h.writeGeneratedFile(path.Join(root, aptReleaseFile), "text/plain; charset=utf-8", release); err != nil {
+		return err
+	}
+
+	if !signed {
+		return h.removeFile(path.Join(root, aptInReleaseFile))
+	}
+	inRelease, err := h.signAPTRelease(release)
+	if err != nil {
+		return err
+	}
+	return h.writeGeneratedFile(path.Join(root, aptInReleaseFile), "text/plain; charset=utf-8", inRelease)
+}
+
+func (h *Handler) readAPTPackages(p string) ([]aptParagraph, error) {
+	data, err := h.readStoredFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return parseAPTParagraphs(string(data))
+}
+
+func (h *Handler) readDebControlFile(p string) (aptParagraph, error) {
+	f, err := h.Storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readDebControl(f)
+}
+
+// aptPackageParagraph is the Packages entry of a .deb: its control fields plus location and checksums
+func aptPackageParagraph(control aptParagraph, filename string, deb MetaResource) aptParagraph {
+	generated := []aptField{
+		{Name: "Filename", Value: filename},
+		{Name: "Size", Value: strconv.FormatInt(deb.Size, 10)},
+		{Name: "MD5sum", Value: deb.MD5},
+		{Name: "SHA1", Value: deb.SHA1},
+		{Name: "SHA256", Value: deb.SHA256},
+	}
+
+	var paragraph aptParagraph
+	for _, f := range control {
+		overridden := false
+		for _, g := range generated {
+			overridden = overridden || strings.EqualFold(f.Name, g.Name)
+		}
+		if !overridden {
+			paragraph = append(paragraph, f)
+		}
+	}
+	return append(paragraph, generated...)
+}
+
+// aptRelease builds the Release file listing the checksums of the index files
+func aptRelease(root string, architectures map[string]bool, files map[string][]byte) []byte {
+	var archs, names []string
+	for a := range architectures {
+		archs = append(archs, a)
+	}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(archs)
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Origin: yaar\n")
+	fmt.Fprintf(&b, "Label: %s\n", path.Base(root))
+	fmt.Fprintf(&b, "Date: %s\n", time.Now().UTC().Format(time.RFC1123))
+	fmt.Fprintf(&b, "Architectures: %s\n", strings.Join(archs, " "))
+
+	sums := []struct {
+		field string
+		sum   func([]byte) string
+	}{
+		{"MD5Sum", func(d []byte) string { s := md5.Sum(d); return hex.EncodeToString(s[:]) }},
+		{"SHA1", func(d []byte) string { s := sha1.Sum(d); return hex.EncodeToString(s[:]) }},
+		{"SHA256", func(d []byte) string { s := sha256.Sum256(d); return hex.EncodeToString(s[:]) }},
+	}
+	for _, s := range sums {
+		fmt.Fprintf(&b, "%s:\n", s.field)
+		for _, name := range names {
+			fmt.Fprintf(&b, " %s %d %s\n", s.sum(files[name]), len(files[name]), name)
+		}
+	}
+	return []byte(b.String())
+}
+
+// signAPTRelease returns the InRelease file, the Release file clearsigned with the configured key
+func (h *Handler) signAPTRelease(release []byte) ([]byte, error) {
+	f, err := os.Open(h.Config.APT.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keyring, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", h.Config.APT.SigningKey, err)
+	}
+	var signer *openpgp.Entity
+	for _, e := range keyring {
+		if e.PrivateKey != nil {
+			signer = e
+			break
+		}
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("%s holds no private key", h.Config.APT.SigningKey)
+	}
+	if signer.PrivateKey.Encrypted {
+		if err := signer.PrivateKey.Decrypt([]byte(h.Config.APT.SigningPassphrase)); err != nil {
+			return nil, fmt.Errorf("decrypting the signing key: %w", err)
+		}
+	}
+
+	var out bytes.Buffer
+	w, err := clearsign.Encode(&out, signer.PrivateKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(release); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/storage"
+)
+
+// archiveWriter streams entries into an archive format
+type archiveWriter interface {
+	addDir(name string, info fs.FileInfo) error
+	addFile(name string, info fs.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) addDir(name string, info fs.FileInfo) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name + "/"
+	_, err = a.zw.CreateHeader(hdr)
+	return err
+}
+
+func (a *zipArchive) addFile(name string, info fs.FileInfo, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzArchive) addDir(name string, info fs.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name + "/"
+	return a.tw.WriteHeader(hdr)
+}
+
+func (a *tarGzArchive) addFile(name string, info fs.FileInfo, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// never write more than announced in the header, the file may grow while we read it
+	_, err = io.CopyN(a.tw, r, hdr.Size)
+	return err
+}
+
+func (a *tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// archiveFormats maps the ?archive= values to extension and content type
+var archiveFormats = map[string]struct{ ext, contentType string }{
+	"zip":    {".zip", "application/zip"},
+	"tar.gz": {".tar.gz", "application/gzip"},
+	"tgz":    {".tar.gz", "application/gzip"},
+}
+
+// startArchive validates the requested format, sends the headers and returns the writer.
+// On error the response is already written.
+func startArchive(c *gin.Context, format, name string) (archiveWriter, bool) {
+	f, ok := archiveFormats[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported archive format, use zip or tar.gz"})
+		return nil, false
+	}
+
+	c.Header("Content-Type", f.contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + f.ext}))
+	c.Status(http.StatusOK)
+	if c.Request.Method == http.MethodHead {
+		return nil, false
+	}
+
+	if f.ext == ".zip" {
+		return &zipArchive{zw: zip.NewWriter(c.Writer)}, true
+	}
+	gz := gzip.NewWriter(c.Writer)
+	return &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}, true
+}
+
+// archiveName is the download name for a directory or group, without extension
+func archiveName(p string) string {
+	name := path.Base(p)
+	if name == "/" || name == "." || name == "" {
+		return "root"
+	}
+	return name
+}
+
+// addStoredFile copies one file from storage into the archive
+func (h *Handler) addStoredFile(a archiveWriter, name, storedPath string) error {
+	f, err := h.Storage.Open(storedPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return a.addFile(name, info, f)
+}
+
+// ServeArchive streams the directory tree at dirPath as zip or tar.gz (GET /dir/?archive=zip)
+func (h *Handler) ServeArchive(c *gin.Context, dirPath string) {
+	log := logger(c).WithField("path", dirPath)
+
+	a, ok := startArchive(c, c.Query("archive"), archiveName(dirPath))
+	if !ok {
+		return
+	}
+
+	root := storage.Clean(dirPath)
+	err := storage.Walk(h.Storage, root, func(name string, info fs.FileInfo) error {
+		if name == root {
+			return nil
+		}
+		if !h.canSee(c, name, info.IsDir()) {
+			if info.IsDir() {
+				return storage.SkipDir
+			}
+			return nil
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+		if info.IsDir() {
+			return a.addDir(rel, info)
+		}
+		if err := h.addStoredFile(a, rel, name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+	if err == nil {
+		err = a.Close()
+	}
+	if err != nil {
+		// Headers are gone already, all we can do is cut the stream
+		log.WithError(err).Error("Archive: streaming failed")
+		c.Abort()
+		return
+	}
+	log.Infof("Archive: served %s", c.Query("archive"))
+}
+
+// GetStreamGroupArchive handles GET /_/api/v1/streams/:name/:group/archive
+// Entries are named relative to the deepest directory shared by all files of the group.
+func (h *Handler) GetStreamGroupArchive(c *gin.Context) {
+	streamName, groupName := c.Param("name"), c.Param("group")
+	log := logger(c).WithField("stream", streamName).WithField("group", groupName)
+
+	var paths []string
+	err := h.DB.Model(&MetaResource{}).
+		Where("stream = ? AND `group` = ? AND type = ?", streamName, groupName, ResourceTypeFile).
+		Order("path ASC").
+		Pluck("path", &paths).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error"})
+		return
+	}
+
+	var readable []string
+	for _, p := range paths {
+		if h.canRead(c, p) {
+			readable = append(readable, p)
+		}
+	}
+	if len(readable) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "zip")
+	a, ok := startArchive(c, format, archiveName(streamName)+"-"+archiveName(groupName))
+	if !ok {
+		return
+	}
+
+	base := commonDir(readable)
+	for _, p := range readable {
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, base), "/")
+		err = h.addStoredFile(a, rel, p)
+		if errors.Is(err, fs.ErrNotExist) {
+			// DB and storage out of sync, the next sync fixes it
+			log.WithField("path", p).Warn("Archive: file missing in storage")
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = a.Close()
+	}
+	if err != nil {
+		log.WithError(err).Error("Archive: streaming failed")
+		c.Abort()
+		return
+	}
+	log.Infof("Archive: served group with %d files", len(readable))
+}
+
+// commonDir returns the deepest directory containing all paths
+func commonDir(paths []string) string {
+	dir := path.Dir(paths[0])
+	for _, p := range paths[1:] {
+		for dir != "/" && !strings.HasPrefix(p, dir+"/") {
+			dir = path.Dir(dir)
+		}
+	}
+	return dir
+}
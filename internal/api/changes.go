@@ -0,0 +1,162 @@
+package api
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+)
+
+// indexDelay is how long changes are collected before index files are regenerated,
+// so a burst of uploads (e.g. a Maven deploy) rebuilds each repository once
+const indexDelay = 500 * time.Millisecond
+
+// afterChange is called once files were stored or removed, through the API or by the janitor.
+// Repository formats use it to keep their generated index files up to date, which happens in the background.
+func (h *Handler) afterChange(paths ...string) {
+	if len(paths) == 0 {
+		return
+	}
+	h.resetVirtualCache()
+
+	h.changesMu.Lock()
+	defer h.changesMu.Unlock()
+	h.pendingChanges = append(h.pendingChanges, paths...)
+	if h.indexTimer == nil {
+		h.indexTimer = time.AfterFunc(indexDelay, h.RegenerateIndexes)
+	}
+}
+
+// RegenerateIndexes updates the index files of the repositories with pending changes right away
+// and collects the OCI garbage they left
+func (h *Handler) RegenerateIndexes() {
+	h.indexMu.Lock()
+	defer h.indexMu.Unlock()
+
+	h.changesMu.Lock()
+	paths := h.pendingChanges
+	h.pendingChanges = nil
+	h.regenerating = paths
+	if h.indexTimer != nil {
+		h.indexTimer.Stop()
+		h.indexTimer = nil
+	}
+	h.changesMu.Unlock()
+	defer func() {
+		h.changesMu.Lock()
+		h.regenerating = nil
+		h.changesMu.Unlock()
+	}()
+	if len(paths) == 0 {
+		return
+	}
+
+	for _, repo := range h.indexedRepos() {
+		repo.update(paths...)
+	}
+	h.collectOCIGarbage(paths...)
+}
+
+// indexedRepo is a repository format with generated index files
+type indexedRepo struct {
+	root   func(string) (string, bool)
+	update func(...string)
+}
+
+func (h *Handler) indexedRepos() []indexedRepo {
+	return []indexedRepo{
+		{h.Config.MavenRepo, h.updateMavenMetadata},
+		{h.Config.NPMRepo, h.updateNPMPackuments},
+		{h.Config.APTRepo, h.updateAPTIndexes},
+		{h.Config.RPMRepo, h.updateRPMRepodata},
+		{h.Config.HelmRepo, h.updateHelmIndexes},
+	}
+}
+
+// awaitIndexes regenerates the pending index files of the repository p is in before a read, so clients see
+// their own changes. Reads of other paths, or of repositories without changes, don't wait.
+func (h *Handler) awaitIndexes(p string) {
+	for _, repo := range h.indexedRepos() {
+		root, ok := repo.root(p)
+		if !ok {
+			continue
+		}
+		below := func(changed string) bool {
+			r, ok := repo.root(changed)
+			return ok && r == root
+		}
+
+		h.changesMu.Lock()
+		waiting := slices.ContainsFunc(h.pendingChanges, below) || slices.ContainsFunc(h.regenerating, below)
+		h.changesMu.Unlock()
+		if !waiting {
+			return
+		}
+
+		// Also waits for a regeneration in progress
+		h.indexMu.Lock()
+		defer h.indexMu.Unlock()
+		h.changesMu.Lock()
+		var paths, rest []string
+		for _, changed := range h.pendingChanges {
+			if below(changed) {
+				paths = append(paths, changed)
+			} else {
+				rest = append(rest, changed)
+			}
+		}
+		h.pendingChanges = rest
+		h.changesMu.Unlock()
+		if len(paths) > 0 {
+			repo.update(paths...)
+		}
+		return
+	}
+}
+
+// writeGeneratedFile stores content produced by the server (e.g. an index file) like an upload,
+// so it gets a MetaResource with checksums and is replaced atomically.
+func (h *Handler) writeGeneratedFile(path, contentType string, data []byte) error {
+	_, err := h.storeBytes(path, contentType, data, uploadPolicy{})
+	return err
+}
+
+// storeBytes stores data at path as if it was uploaded with the given policy
+func (h *Handler) storeBytes(path, contentType string, data []byte, policy uploadPolicy) (MetaResource, error) {
+	out, err := h.createTempFile()
+	if err != nil {
+		return MetaResource{}, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hashes := newHashSet()
+	if _, err := out.Write(data); err != nil {
+		return MetaResource{}, err
+	}
+	if err := out.Close(); err != nil {
+		return MetaResource{}, err
+	}
+	hashes.Write(data)
+	sums := hashes.Sums()
+
+	return h.saveUploadMeta(path, contentType, int64(len(data)), sums, policy, out.Name())
+}
+
+// removeFile deletes a single file and its MetaResource, if present
+func (h *Handler) removeFile(path string) error {
+	if err := h.Storage.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	res, err := h.GetFileMeta(path)
+	if err != nil || res == nil {
+		return err
+	}
+	if err := h.DB.Delete(res).Error; err != nil {
+		return err
+	}
+	h.releaseBlobs(res.SHA256)
+	return nil
+}
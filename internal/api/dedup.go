@@ -0,0 +1,146 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/storage"
+)
+
+// blobDir holds the content-addressed blobs when storage.dedup is enabled.
+// Every stored path is a hardlink to its blob, so the content is on disk only once.
+const blobDir = systemDir + "/blobs"
+
+func (h *Handler) blobPath(sha256 string) string {
+	return h.localPath(blobDir + "/" + sha256[:2] + "/" + sha256)
+}
+
+// placeFile moves a verified temp file into storage at urlPath.
+// In dedup mode the content goes to the blob store (or is dropped if the blob
+// already exists) and urlPath becomes a hardlink to the blob.
+func (h *Handler) placeFile(tempPath, urlPath, sha256 string) error {
+	if !h.Config.Storage.Dedup {
+		return storage.Import(h.Storage, tempPath, urlPath)
+	}
+
+	blob := h.blobPath(sha256)
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return err
+	}
+
+	err := os.Link(tempPath, blob)
+	if os.IsExist(err) {
+		// Same content is already stored, reference the existing blob instead
+		if err := os.Remove(tempPath); err != nil {
+			return err
+		}
+		err = os.Link(blob, tempPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	// rename over the target keeps the replacement atomic
+	return storage.Import(h.Storage, tempPath, urlPath)
+}
+
+// releaseBlobs drops the blobs that are no longer referenced by any path.
+// The reference count of a blob is the number of MetaResource rows with its SHA256.
+func (h *Handler) releaseBlobs(shas ...string) {
+	for _, sha := range shas {
+		if len(sha) != 64 {
+			continue
+		}
+
+		var refs int64
+		if err := h.DB.Model(&MetaResource{}).Where("sha256 = ?", sha).Count(&refs).Error; err != nil {
+			h.Log.WithError(err).Errorf("Dedup: failed to count references of %s", sha)
+			continue
+		}
+		if refs > 0 {
+			continue
+		}
+
+		if err := os.Remove(h.blobPath(sha)); err != nil && !os.IsNotExist(err) {
+			h.Log.WithError(err).Errorf("Dedup: failed to remove blob %s", sha)
+			continue
+		}
+		h.Log.Debugf("Dedup: released blob %s", sha)
+	}
+}
+
+// listBlobs returns the size of every blob in the store keyed by SHA256
+func (h *Handler) listBlobs() map[string]int64 {
+	blobs := make(map[string]int64)
+	filepath.WalkDir(h.localPath(blobDir), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			blobs[d.Name()] = info.Size()
+		}
+		return nil
+	})
+	return blobs
+}
+
+// collectOrphanBlobs removes blobs without references, e.g. after files were changed on disk
+func (h *Handler) collectOrphanBlobs() {
+	blobs := h.listBlobs()
+	shas := make([]string, 0, len(blobs))
+	for sha := range blobs {
+		shas = append(shas, sha)
+	}
+	h.releaseBlobs(shas...)
+}
+
+type DedupStats struct {
+	Enabled         bool  `json:"enabled"`
+	Blobs           int   `json:"blobs"`            // Number of unique contents stored
+	BlobBytes       int64 `json:"blob_bytes"`       // Physical size of the blob store
+	References      int64 `json:"references"`       // Number of paths pointing to a blob
+	ReferencedBytes int64 `json:"referenced_bytes"` // Size the referencing paths would take without dedup
+	SavedBytes      int64 `json:"saved_bytes"`
+}
+
+// GetDedupStats handles GET /_/api/admin/dedup
+func (h *Handler) GetDedupStats(c *gin.Context) {
+	stats := DedupStats{Enabled: h.Config.Storage.Dedup}
+
+	blobs := h.listBlobs()
+	for _, size := range blobs {
+		stats.Blobs++
+		stats.BlobBytes += size
+	}
+
+	var rows []struct {
+		SHA256 string
+		Refs   int64
+		Size   int64
+	}
+	err := h.DB.Model(&MetaResource{}).
+		Select("sha256, COUNT(*) AS refs, MAX(size) AS size").
+		Where("type = ? AND sha256 != ''", ResourceTypeFile).
+		Group("sha256").
+		Scan(&rows).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error"})
+		return
+	}
+
+	for _, r := range rows {
+		if _, ok := blobs[strings.ToLower(r.SHA256)]; !ok {
+			continue
+		}
+		stats.References += r.Refs
+		stats.ReferencedBytes += r.Refs * r.Size
+	}
+	stats.SavedBytes = stats.ReferencedBytes - stats.BlobBytes
+	if stats.SavedBytes < 0 {
+		stats.SavedBytes = 0
+	}
+
+	c.JSON(200, stats)
+}
@@ -0,0 +1,323 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/audit"
+	"gorm.io/gorm"
+)
+
+// errExtractLimit is returned when the unpacked content exceeds MaxUploadSizeBytes or MaxExtractEntries
+var errExtractLimit = errors.New("extracted content exceeds the upload size limit")
+
+var errExtractEntries = errors.New("archive has more entries than allowed")
+
+// extractedFile is an archive entry unpacked into a temp file, waiting to be placed
+type extractedFile struct {
+	Path        string
+	TempPath    string
+	ContentType string
+	Size        int64
+	Sums        fileSums
+}
+
+// archiveEntry is one regular file or directory of an archive being read
+type archiveEntry struct {
+	Name  string
+	IsDir bool
+	Open  func() (io.ReadCloser, error)
+}
+
+// extractFormats are the accepted X-Extract values
+var extractFormats = map[string]bool{"zip": true, "tar": true, "tar.gz": true, "tgz": true}
+
+// readArchive calls fn for every file and directory in the archive at localPath.
+// Links and other special entries are skipped.
+func readArchive(localPath, format string, fn func(archiveEntry) error) error {
+	switch format {
+	case "zip":
+		zr, err := zip.OpenReader(localPath)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		for _, f := range zr.File {
+			mode := f.Mode()
+			if !mode.IsDir() && !mode.IsRegular() {
+				continue
+			}
+			err := fn(archiveEntry{Name: f.Name, IsDir: mode.IsDir(), Open: f.Open})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "tar", "tar.gz", "tgz":
+		f, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var r io.Reader = f
+		if format != "tar" {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			r = gz
+		}
+
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+				continue
+			}
+			err = fn(archiveEntry{
+				Name:  hdr.Name,
+				IsDir: hdr.Typeflag == tar.TypeDir,
+				Open:  func() (io.ReadCloser, error) { return io.NopCloser(tr), nil },
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("unsupported X-Extract format %q, use zip, tar or tar.gz", format)
+	}
+}
+
+// entryPath resolves an archive entry name below targetDir.
+// Names escaping the target (zip-slip) are rejected.
+func entryPath(targetDir, name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("illegal entry name %q", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("illegal entry name %q", name)
+		}
+	}
+
+	p := path.Join(targetDir, name)
+	if p != targetDir && !strings.HasPrefix(p, strings.TrimSuffix(targetDir, "/")+"/") {
+		return "", fmt.Errorf("illegal entry name %q", name)
+	}
+	return p, nil
+}
+
+// extractArchive unpacks the archive into temp files.
+// Unpacked bytes are counted as they are written, so a small archive
+// can't expand beyond MaxUploadSizeBytes (zip bombs), whatever the headers claim.
+// On error the temp files are already removed.
+func (h *Handler) extractArchive(localPath, format, targetDir string) (files []extractedFile, dirs []string, err error) {
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				os.Remove(f.TempPath)
+			}
+			files = nil
+		}
+	}()
+
+	budget := h.Config.Storage.MaxUploadSizeBytes
+	seen := make(map[string]int)
+	entries := 0
+
+	err = readArchive(localPath, format, func(e archiveEntry) error {
+		if entries++; entries > h.Config.Storage.MaxExtractEntries {
+			return errExtractEntries
+		}
+		p, err := entryPath(targetDir, e.Name)
+		if err != nil {
+			return err
+		}
+		if isSystemPath(p) {
+			return fmt.Errorf("illegal entry name %q", e.Name)
+		}
+		if e.IsDir {
+			if p != targetDir {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+
+		r, err := e.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		out, err := h.createTempFile()
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		ef := extractedFile{Path: p, TempPath: out.Name()}
+		if i, dup := seen[p]; dup {
+			// the last entry with the same name wins, as with tar -x
+			os.Remove(files[i].TempPath)
+			files[i] = ef
+		} else {
+			seen[p] = len(files)
+			files = append(files, ef)
+		}
+
+		hashes := newHashSet()
+		sniff := &sniffWriter{}
+		written, err := io.Copy(io.MultiWriter(out, hashes, sniff), io.LimitReader(r, budget+1))
+		if err != nil {
+			return err
+		}
+		if written > budget {
+			return errExtractLimit
+		}
+		budget -= written
+
+		ef.Size = written
+		ef.Sums = hashes.Sums()
+		ef.ContentType = mime.TypeByExtension(path.Ext(p))
+		if ef.ContentType == "" {
+			ef.ContentType = http.DetectContentType(sniff.buf)
+		}
+		files[seen[p]] = ef
+		return out.Close()
+	})
+	return files, dirs, err
+}
+
+// sniffWriter keeps the first 512 bytes for content type detection
+type sniffWriter struct {
+	buf []byte
+}
+
+func (w *sniffWriter) Write(p []byte) (int, error) {
+	if n := 512 - len(w.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// HandleExtract unpacks an uploaded archive (X-Extract: zip|tar|tar.gz) into targetDir.
+// Every file gets its own MetaResource with the policy of the upload. All records are
+// written in one transaction and the extraction is audited as a single action.
+func (h *Handler) HandleExtract(c *gin.Context, archivePath, format, targetDir string, policy uploadPolicy) {
+	log := logger(c).WithField("path", targetDir)
+	scopes := c.GetStringSlice("allowed_paths")
+
+	files, dirs, err := h.extractArchive(archivePath, format, targetDir)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionExtract, targetDir, err)
+		if errors.Is(err, errExtractLimit) || errors.Is(err, errExtractEntries) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		log.WithError(err).Warn("Extract: invalid archive")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid archive: " + err.Error()})
+		return
+	}
+	defer func() {
+		for _, f := range files {
+			os.Remove(f.TempPath) // no-op once placed
+		}
+	}()
+
+	// Check every entry before anything is written, the archive is placed completely or not at all
+	for _, f := range files {
+		stat, err := h.Storage.Stat(f.Path)
+		if err == nil && stat.IsDir() {
+			msg := fmt.Sprintf("%s: directory with same name already exists", f.Path)
+			h.Audit.WithContext(c).Failure(audit.ActionExtract, targetDir, errors.New(msg))
+			c.JSON(http.StatusConflict, gin.H{"error": msg})
+			return
+		}
+		opts := ModifyOptions{IgnoreProtected: err != nil, IsUpload: true}
+		if ok, msg := h.CanModify(f.Path, scopes, opts); !ok {
+			msg = fmt.Sprintf("%s: %s", f.Path, msg)
+			h.Audit.WithContext(c).Failure(audit.ActionExtract, targetDir, errors.New(msg))
+			c.JSON(http.StatusForbidden, gin.H{"error": msg})
+			return
+		}
+	}
+
+	// Entries are staged first and only swapped in at the end of the transaction,
+	// a failure restores the files they replaced
+	swap := &stagedSwap{h: h}
+	for _, f := range files {
+		if err = swap.stage(f.TempPath, f.Path, f.Sums.SHA256); err != nil {
+			break
+		}
+	}
+
+	var released []string
+	var total int64
+	if err == nil {
+		err = h.DB.Transaction(func(tx *gorm.DB) error {
+			for _, d := range dirs {
+				if err := h.Storage.Mkdir(d); err != nil {
+					return err
+				}
+			}
+			for _, f := range files {
+				_, previousSHA256, err := saveUploadMetaTx(tx, f.Path, f.ContentType, f.Size, f.Sums, policy)
+				if err != nil {
+					return err
+				}
+				if previousSHA256 != f.Sums.SHA256 {
+					released = append(released, previousSHA256)
+				}
+				total += f.Size
+			}
+			return swap.swap()
+		})
+	}
+	swap.done(err == nil)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionExtract, targetDir, err)
+		log.WithError(err).Error("Extract: failed to store entries")
+		c.JSON(500, gin.H{"error": "Failed to store extracted files"})
+		return
+	}
+	h.releaseBlobs(released...)
+
+	h.Audit.WithContext(c).Success(audit.ActionExtract, targetDir, "format", format, "files", len(files), "size", total)
+
+	changed := make([]string, len(files))
+	for i, f := range files {
+		changed[i] = f.Path
+	}
+	h.afterChange(changed...)
+
+	status := http.StatusOK
+	if c.Request.Method == http.MethodPost {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"path": targetDir, "files": len(files), "size": total})
+}
@@ -1,10 +1,6 @@
 package api
 
 import (
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -21,7 +17,19 @@ import (
 	"gorm.io/gorm"
 )
 
-func (h *Handler) fsPath(path string) string {
+// systemDir is the reserved directory inside BaseDir that holds internal state
+// such as upload sessions. It is never served, listed, synced or writable via the API.
+// It always lives on the local disk, whatever storage backend holds the artifact tree.
+const systemDir = "/.yaar"
+
+func isSystemPath(path string) bool {
+	p := filepath.Clean("/" + path)
+	return p == systemDir || strings.HasPrefix(p, systemDir+"/")
+}
+
+// localPath maps a path below systemDir to the local disk.
+// The artifact tree itself is only accessed through h.Storage.
+func (h *Handler) localPath(path string) string {
 	return filepath.Join(h.BaseDir, filepath.Clean(path))
 }
 
@@ -34,11 +42,23 @@ func logger(c *gin.Context) *logrus.Entry {
 }
 
 // ServeFile handles serving file with GET/HEAD
-// Adds headers from db and calls c.File on fsPath
+// Adds headers from db and streams the file from storage (Range requests included)
 func (h *Handler) ServeFile(c *gin.Context, path string) {
 	log := logger(c)
-	fsPath := h.fsPath(path)
-	log.WithField("fspath", fsPath).Infof("ServeFile")
+	log.WithField("path", path).Infof("ServeFile")
+
+	f, err := h.Storage.Open(path)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		c.Status(http.StatusNotFound)
+		return
+	}
 
 	p := dbPath(path)
 	meta, err := h.GetFileMeta(p)
@@ -58,13 +78,17 @@ func (h *Handler) ServeFile(c *gin.Context, path string) {
 		}
 	}
 
-	c.File(fsPath)
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), f)
 }
 
 /* ===================== WRITE ===================== */
 
 func (h *Handler) HandleUpload(c *gin.Context) {
-	urlPath := dbPath(c.Request.URL.Path)
+	h.uploadFile(c, dbPath(c.Request.URL.Path))
+}
+
+// uploadFile stores the request body at urlPath, or the multipart file below it
+func (h *Handler) uploadFile(c *gin.Context, urlPath string) {
 	method := c.Request.Method
 	contentType := c.ContentType()
 	log := logger(c).WithField("path", urlPath)
@@ -78,6 +102,13 @@ func (h *Handler) HandleUpload(c *gin.Context) {
 		return
 	}
 
+	// X-Extract unpacks the uploaded archive into the target directory
+	extract := strings.ToLower(c.GetHeader("X-Extract"))
+	if extract != "" && !extractFormats[extract] {
+		c.JSON(400, gin.H{"error": "X-Extract must be zip, tar or tar.gz"})
+		return
+	}
+
 	var fileReader io.ReadCloser
 	var finalRelativePath string
 
@@ -90,6 +121,9 @@ func (h *Handler) HandleUpload(c *gin.Context) {
 		}
 		// Filename comes from form, directory comes from URL
 		finalRelativePath = filepath.Join(urlPath, fileHeader.Filename)
+		if extract != "" {
+			finalRelativePath = urlPath
+		}
 		f, _ := fileHeader.Open()
 		fileReader = f
 		contentType = fileHeader.Header.Get("Content-Type")
@@ -100,11 +134,13 @@ func (h *Handler) HandleUpload(c *gin.Context) {
 	}
 	defer fileReader.Close()
 
-	fullPath := filepath.Join(h.BaseDir, filepath.Clean(finalRelativePath))
-
 	// Overwrite Check
-	stat, err := os.Stat(fullPath)
-	if err == nil && method == http.MethodPost {
+	stat, err := h.Storage.Stat(finalRelativePath)
+	if err == nil && extract != "" && !stat.IsDir() {
+		c.JSON(http.StatusConflict, gin.H{"error": "extract target is a file"})
+		return
+	}
+	if err == nil && method == http.MethodPost && extract == "" {
 		var msg string
 		if stat.IsDir() {
 			msg = "directory with same name already exists"
@@ -116,7 +152,7 @@ func (h *Handler) HandleUpload(c *gin.Context) {
 	}
 
 	opts := ModifyOptions{
-		IgnoreProtected: err != nil, // Allow if new file, block if overwrite
+		IgnoreProtected: err != nil || extract != "", // Allow if new file, block if overwrite; extracted entries are checked one by one
 		IsUpload:        true,
 	}
 
@@ -126,79 +162,61 @@ func (h *Handler) HandleUpload(c *gin.Context) {
 		return
 	}
 
-	// Extract Policy Headers
-	keepLatest := c.GetHeader("X-KeepLatest") == "true"
-	tags := c.GetHeader("X-Tags")
-	expiresHeader := c.GetHeader("X-Expires")
-	clientSha256 := c.GetHeader("X-Checksum-Sha256")
-	clientSha1 := c.GetHeader("X-Checksum-Sha1")
-	clientMd5 := c.GetHeader("X-Checksum-Md5")
-	streamHeader := c.GetHeader("X-Stream")
-	stream, group, err := utils.ParseStream(streamHeader)
-	// Validation: Stream requires Group
-	if err != nil {
-		c.JSON(400, gin.H{"error": err.Error()})
+	// Maven clients upload checksum sidecars we already serve from the stored hashes
+	if extract == "" && isMavenChecksum(finalRelativePath) && h.acceptMavenChecksum(c, finalRelativePath) {
 		return
 	}
 
-	// If KeepLatest is requested, Stream/Group MUST be present
-	if keepLatest && stream == "" {
-		c.JSON(400, gin.H{"error": "X-KeepLatest requires an X-Stream header"})
-		return
-	}
-	expiresAt, err := utils.ParseExpiry(expiresHeader)
+	policy, err := parseUploadPolicy(c)
 	if err != nil {
-		c.JSON(400, gin.H{"error": "X-Expires: " + err.Error()})
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Prepare Hashing and Saving
-	os.MkdirAll(filepath.Dir(fullPath), 0755)
-	out, err := os.Create(fullPath)
+	// The body goes to a temp file first, readers keep seeing the previous version
+	// until the new one is verified and recorded.
+	out, err := h.createTempFile()
 	if err != nil {
-		log.WithError(err).Errorf("failed to open file: %v", fullPath)
-		c.JSON(400, gin.H{"error": "X-Expires: " + err.Error()})
+		log.WithError(err).Error("failed to create temp file")
+		c.JSON(500, gin.H{"error": "Failed to store file"})
 		return
 	}
+	tempPath := out.Name()
+	defer os.Remove(tempPath) // no-op once renamed into place
 	defer out.Close()
 
-	md5 := md5.New()
-	sha1 := sha1.New()
-	sha256 := sha256.New()
+	hashes := newHashSet()
 
 	// Stream to file and all hashers at once
-	multi := io.MultiWriter(out, md5, sha1, sha256)
+	multi := io.MultiWriter(out, hashes)
 	limitedBody := io.LimitReader(fileReader, h.Config.Storage.MaxUploadSizeBytes)
-	written, _ := io.Copy(multi, limitedBody)
+	written, copyErr := io.Copy(multi, limitedBody)
 
 	if written >= h.Config.Storage.MaxUploadSizeBytes {
 		// If the next read returns data, they exceeded the limit
 		// (Checking one extra byte to be sure)
 		buf := make([]byte, 1)
 		if n, _ := fileReader.Read(buf); n > 0 {
-			os.Remove(fullPath) // Delete partial file
-			h.Audit.WithContext(c).Failure(audit.ActionUpload, fullPath, errors.New("file contect exceeded limit"), "MaxUploadSizeBytes", h.Config.Storage.MaxUploadSizeBytes)
+			h.Audit.WithContext(c).Failure(audit.ActionUpload, urlPath, errors.New("file contect exceeded limit"), "MaxUploadSizeBytes", h.Config.Storage.MaxUploadSizeBytes)
 			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File content exceeded limit"})
 			return
 		}
 	}
 
-	// inbound integrity check
-	sumMD5 := hex.EncodeToString(md5.Sum(nil))
-	sumSHA1 := hex.EncodeToString(sha1.Sum(nil))
-	sumSHA256 := hex.EncodeToString(sha256.Sum(nil))
-	mismatchErr := ""
-	if clientSha256 != "" && !strings.EqualFold(clientSha256, sumSHA256) {
-		mismatchErr = fmt.Sprintf("SHA256 mismatch: expected %s, got %s", clientSha256, sumSHA256)
-	} else if clientSha1 != "" && !strings.EqualFold(clientSha1, sumSHA1) {
-		mismatchErr = fmt.Sprintf("SHA1 mismatch: expected %s, got %s", clientSha1, sumSHA1)
-	} else if clientMd5 != "" && !strings.EqualFold(clientMd5, sumMD5) {
-		mismatchErr = fmt.Sprintf("MD5 mismatch: expected %s, got %s", clientMd5, sumMD5)
+	if copyErr == nil {
+		copyErr = out.Close()
+	}
+	if copyErr != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, urlPath, copyErr)
+		log.WithError(copyErr).Error("failed to receive upload")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload interrupted"})
+		return
 	}
 
-	if mismatchErr != "" {
-		os.Remove(fullPath)
-
+	// inbound integrity check
+	sums := hashes.Sums()
+	if mismatchErr := policy.verify(sums); mismatchErr != "" {
 		h.Audit.WithContext(c).Failure(audit.ActionUpload, urlPath, errors.New(mismatchErr), "status", "corrupted")
 
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -208,104 +226,270 @@ func (h *Handler) HandleUpload(c *gin.Context) {
 		return
 	}
 
-	// 4. Update Database
+	if extract != "" {
+		h.HandleExtract(c, tempPath, extract, finalRelativePath, policy)
+		return
+	}
+
+	// 4. Update Database and move the file into place
+	res, err := h.saveUploadMeta(finalRelativePath, contentType, written, sums, policy, tempPath)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, urlPath, err)
+		log.WithError(err).Error("db sync failed")
+		c.JSON(500, gin.H{"error": "Database sync failed"})
+		return
+	}
+
+	// 4. Audit Success
+	h.Audit.WithContext(c).Success(audit.ActionUpload, urlPath, "size", written, "sha256", res.SHA256)
+	h.afterChange(finalRelativePath)
+
+	status := http.StatusOK
+	if method == http.MethodPost {
+		status = http.StatusCreated
+	}
+	c.JSON(status, res)
+}
+
+// uploadPolicy holds the policy headers sent along with an upload
+type uploadPolicy struct {
+	Stream     string
+	Group      string
+	KeepLatest bool
+	Tags       string
+	ExpiresAt  *time.Time
+
+	// Optional client-provided checksums for inbound integrity verification
+	SHA256 string
+	SHA1   string
+	MD5    string
+}
+
+// parseUploadPolicy extracts and validates the X-* policy headers of an upload request
+func parseUploadPolicy(c *gin.Context) (uploadPolicy, error) {
+	p := uploadPolicy{
+		KeepLatest: c.GetHeader("X-KeepLatest") == "true",
+		Tags:       c.GetHeader("X-Tags"),
+		SHA256:     c.GetHeader("X-Checksum-Sha256"),
+		SHA1:       c.GetHeader("X-Checksum-Sha1"),
+		MD5:        c.GetHeader("X-Checksum-Md5"),
+	}
+
+	var err error
+	// Validation: Stream requires Group
+	p.Stream, p.Group, err = utils.ParseStream(c.GetHeader("X-Stream"))
+	if err != nil {
+		return p, err
+	}
+
+	// If KeepLatest is requested, Stream/Group MUST be present
+	if p.KeepLatest && p.Stream == "" {
+		return p, errors.New("X-KeepLatest requires an X-Stream header")
+	}
+
+	if expiresHeader := c.GetHeader("X-Expires"); expiresHeader != "" {
+		expiresAt, err := utils.ParseExpiry(expiresHeader)
+		if err != nil {
+			return p, errors.New("X-Expires: " + err.Error())
+		}
+		p.ExpiresAt = &expiresAt
+	}
+
+	return p, nil
+}
+
+// verify compares the client-provided checksums with the calculated ones.
+// Returns a human readable mismatch description or an empty string.
+func (p uploadPolicy) verify(sums fileSums) string {
+	if p.SHA256 != "" && !strings.EqualFold(p.SHA256, sums.SHA256) {
+		return fmt.Sprintf("SHA256 mismatch: expected %s, got %s", p.SHA256, sums.SHA256)
+	} else if p.SHA1 != "" && !strings.EqualFold(p.SHA1, sums.SHA1) {
+		return fmt.Sprintf("SHA1 mismatch: expected %s, got %s", p.SHA1, sums.SHA1)
+	} else if p.MD5 != "" && !strings.EqualFold(p.MD5, sums.MD5) {
+		return fmt.Sprintf("MD5 mismatch: expected %s, got %s", p.MD5, sums.MD5)
+	}
+	return ""
+}
+
+// saveUploadMeta creates or updates the MetaResource of an uploaded file and moves the verified
+// temp file to path, applying the stream, expiry and tag policy of the upload.
+// The content is staged in the backend before the transaction, inside it the staged file is only
+// renamed into place as the last step. The replaced file is kept until the commit, so if anything fails
+// the previous file and record stay untouched.
+func (h *Handler) saveUploadMeta(path, contentType string, size int64, sums fileSums, policy uploadPolicy, tempPath string) (MetaResource, error) {
+	swap := stagedSwap{h: h}
+	if err := swap.stage(tempPath, path, sums.SHA256); err != nil {
+		return MetaResource{}, err
+	}
+
 	var res MetaResource
-	err = h.DB.Transaction(func(tx *gorm.DB) error {
-		res.Path = finalRelativePath
-		res.Type = ResourceTypeFile
-		res.ModTime = time.Now()
-		res.Size = written
-		if err := tx.Where(MetaResource{Path: finalRelativePath}).FirstOrCreate(&res).Error; err != nil {
+	var previousSHA256 string
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		res, previousSHA256, err = saveUploadMetaTx(tx, path, contentType, size, sums, policy)
+		if err != nil {
 			return err
 		}
+		return swap.swap()
+	})
+	// A failed commit puts the previous file back too
+	swap.done(err == nil)
+	if err != nil {
+		return res, err
+	}
 
-		res.MD5 = sumMD5
-		res.SHA1 = sumSHA1
-		res.SHA256 = sumSHA256
-		res.ContentType = contentType
-		if res.ContentType == "" {
-			res.ContentType = "application/octet-stream"
-		}
+	if previousSHA256 != sums.SHA256 {
+		// overwritten content may have been the last reference to its blob
+		h.releaseBlobs(previousSHA256)
+	}
+	return res, nil
+}
 
-		if expiresHeader != "" {
-			res.ExpiresAt = &expiresAt
-		}
+// saveUploadMetaTx does the database part of saveUploadMeta within tx.
+// Returns the saved record and the SHA256 it had before.
+func saveUploadMetaTx(tx *gorm.DB, path, contentType string, size int64, sums fileSums, policy uploadPolicy) (MetaResource, string, error) {
+	var res MetaResource
+	res.Path = path
+	res.Type = ResourceTypeFile
+	res.ModTime = time.Now()
+	res.Size = size
+	if err := tx.Where(MetaResource{Path: path}).FirstOrCreate(&res).Error; err != nil {
+		return res, "", err
+	}
+	previousSHA256 := res.SHA256
+
+	res.Size = size
+	res.MD5 = sums.MD5
+	res.SHA1 = sums.SHA1
+	res.SHA256 = sums.SHA256
+	res.ContentType = contentType
+	if res.ContentType == "" {
+		res.ContentType = "application/octet-stream"
+	}
 
-		if streamHeader != "" {
-			res.Stream = &stream
-			res.Group = &group
-			res.PolicyKeepLatest = &keepLatest
-			if keepLatest {
-				// Update stale files to expire immediately
-				// Same stream, flagged for KeepLatest, but NOT in the new group.
-				err := tx.Model(&MetaResource{}).
-					Where("stream = ? AND `group` != ? AND policy_keep_latest = ?", *res.Stream, *res.Group, true).
-					Update("expires_at", time.Now()).Error
-				if err != nil {
-					return err
-				}
+	if policy.ExpiresAt != nil {
+		res.ExpiresAt = policy.ExpiresAt
+	}
+
+	if policy.Stream != "" {
+		res.Stream = &policy.Stream
+		res.Group = &policy.Group
+		res.PolicyKeepLatest = &policy.KeepLatest
+		if policy.KeepLatest {
+			// Update stale files to expire immediately
+			// Same stream, flagged for KeepLatest, but NOT in the new group.
+			err := tx.Model(&MetaResource{}).
+				Where("stream = ? AND `group` != ? AND policy_keep_latest = ?", *res.Stream, *res.Group, true).
+				Update("expires_at", time.Now()).Error
+			if err != nil {
+				return res, previousSHA256, err
 			}
 		}
+	}
 
-		if tags != "" {
-			if err := tx.Where("resource_id = ?", res.ID).Delete(&MetaTag{}).Error; err != nil {
-				return err
-			}
+	if policy.Tags != "" {
+		if err := tx.Where("resource_id = ?", res.ID).Delete(&MetaTag{}).Error; err != nil {
+			return res, previousSHA256, err
+		}
 
-			ts := parseTagString(tags)
-			for i := range ts {
-				ts[i].ResourceID = res.ID
-			}
+		ts := parseTagString(policy.Tags)
+		for i := range ts {
+			ts[i].ResourceID = res.ID
+		}
 
-			if len(ts) > 0 {
-				if err := tx.Create(&ts).Error; err != nil {
-					return err
-				}
+		if len(ts) > 0 {
+			if err := tx.Create(&ts).Error; err != nil {
+				return res, previousSHA256, err
 			}
 		}
+	}
 
-		// Save the final state (Updates existing or finishes the Create)
-		return tx.Save(&res).Error
-	})
+	// Save the final state (Updates existing or finishes the Create)
+	if err := tx.Save(&res).Error; err != nil {
+		return res, previousSHA256, err
+	}
+	return res, previousSHA256, nil
+}
+
+// tempDir holds in-flight uploads. It lives inside BaseDir, so with the fs backend
+// moving a finished upload into place is an atomic rename on the same filesystem.
+const tempDir = systemDir + "/tmp"
+
+// tempFileTTL is the age after which the janitor removes leftovers of crashed uploads
+const tempFileTTL = 24 * time.Hour
+
+func (h *Handler) createTempFile() (*os.File, error) {
+	dir := h.localPath(tempDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, "upload-*")
+}
 
+// cleanupTempFiles removes temp files left behind by interrupted uploads
+func (h *Handler) cleanupTempFiles() {
+	entries, err := os.ReadDir(h.localPath(tempDir))
 	if err != nil {
-		h.Audit.WithContext(c).Failure(audit.ActionUpload, urlPath, err)
-		log.WithError(err).Error("db sync failed")
-		c.JSON(500, gin.H{"error": "Database sync failed"})
 		return
 	}
 
-	// 4. Audit Success
-	h.Audit.WithContext(c).Success(audit.ActionUpload, urlPath, "size", written, "sha256", res.SHA256)
-
-	status := http.StatusOK
-	if method == http.MethodPost {
-		status = http.StatusCreated
+	cutoff := time.Now().Add(-tempFileTTL)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(h.localPath(tempDir), e.Name())); err != nil {
+			h.Log.Errorf("Janitor: failed to remove temp file %s: %v", e.Name(), err)
+		}
 	}
-	c.JSON(status, res)
 }
 
 func (h *Handler) DeleteEntry(c *gin.Context) {
+	h.deleteEntry(c, dbPath(c.Request.URL.Path))
+}
+
+// deleteEntry removes the file or directory tree at path
+func (h *Handler) deleteEntry(c *gin.Context, path string) {
 	log := logger(c)
-	path := dbPath(c.Request.URL.Path)
-	fsPath := h.fsPath(path)
-	log.WithField("fspath", fsPath).Infof("about to delete")
-	_, err := os.Stat(fsPath)
+	log.WithField("path", path).Infof("about to delete")
+	_, err := h.Storage.Stat(path)
 	if err != nil {
 		c.Status(http.StatusNotFound)
 		return
 	}
 
-	scopes := c.GetStringSlice("allowed_paths")
+	scopes := c.GetStringSlice("delete_paths")
 	if ok, msg := h.CanModify(path, scopes, ModifyOptions{}); !ok {
 		h.Audit.WithContext(c).Failure(audit.ActionDelete, path, errors.New(msg))
 		c.JSON(403, gin.H{"error": msg})
 		return
 	}
 
-	// 2. COLLECT: Find all metadata paths that will be affected
+	affectedPaths, err := h.removeTree(path)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionDelete, path, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.Audit.WithContext(c).Success(
+		audit.ActionDelete,
+		path,
+		"deleted_count", len(affectedPaths),
+		"affected_paths", affectedPaths, // This will be a JSON array in the log
+	)
+	h.afterChange(path)
+	c.Status(http.StatusNoContent)
+}
+
+// removeTree deletes a file or directory tree from storage together with its metadata.
+// Returns the paths of the removed records.
+func (h *Handler) removeTree(path string) ([]string, error) {
+	// COLLECT: Find all metadata paths that will be affected
 	// We do this before physical deletion so we have a record of what we are losing
 	var affectedPaths []string
+	var affectedSHAs []string
 	childPattern := path
 	if !strings.HasSuffix(childPattern, "/") {
 		childPattern += "/%"
@@ -316,29 +500,25 @@ func (h *Handler) DeleteEntry(c *gin.Context) {
 	h.DB.Model(&MetaResource{}).
 		Where("path = ? OR path LIKE ?", path, childPattern).
 		Pluck("path", &affectedPaths)
+	h.DB.Model(&MetaResource{}).
+		Where("path = ? OR path LIKE ?", path, childPattern).
+		Distinct().
+		Pluck("sha256", &affectedSHAs)
 
-	err = os.RemoveAll(fsPath)
-	if err != nil {
-		h.Audit.WithContext(c).Failure(audit.ActionDelete, path, err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if err := h.Storage.Remove(path); err != nil {
+		return nil, err
 	}
 
-	err = h.DB.Transaction(func(tx *gorm.DB) error {
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
 		return tx.Where("path = ? OR path LIKE ?", path, childPattern).
 			Delete(&MetaResource{}).Error
 	})
 
 	if err != nil {
 		h.Log.WithError(err).Error("failed to clear metadata after physical delete")
-		// We don't return 500 here because the physical files ARE gone.
+		// We don't fail here because the physical files ARE gone.
+	} else {
+		h.releaseBlobs(affectedSHAs...)
 	}
-
-	h.Audit.WithContext(c).Success(
-		audit.ActionDelete,
-		path,
-		"deleted_count", len(affectedPaths),
-		"affected_paths", affectedPaths, // This will be a JSON array in the log
-	)
-	c.Status(http.StatusNoContent)
+	return affectedPaths, nil
 }
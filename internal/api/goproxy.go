@@ -0,0 +1,399 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/audit"
+	"github.com/kovi/yaar/internal/auth"
+)
+
+// Go module proxies serve the GOPROXY protocol below a prefix. A version is published by uploading its module zip
+// to <prefix>/<module>/@v/<version>.zip, the .mod and .info files are stored next to it.
+// Published versions are immutable. list and @latest are answered from the stored .info files.
+
+var goSemverRe = regexp.MustCompile(`^v(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?(\+incompatible)?$`)
+
+// goModuleRequest is a request below a Go module proxy prefix.
+// module and version are stored case-encoded, see goUnescape.
+type goModuleRequest struct {
+	root    string
+	module  string // escaped module path
+	version string // escaped version, "" for list and @latest
+	ext     string // .info, .mod or .zip
+	latest  bool
+}
+
+func (r goModuleRequest) versionDir() string {
+	return path.Join(r.root, r.module, "@v")
+}
+
+// parseGoModuleRequest splits <prefix>/<module>/@v/<file> and <prefix>/<module>/@latest
+func (h *Handler) parseGoModuleRequest(p string) (goModuleRequest, bool) {
+	root, ok := h.Config.GoProxyRepo(p)
+	if !ok {
+		return goModuleRequest{}, false
+	}
+	r := goModuleRequest{root: root}
+	rel := strings.TrimPrefix(p, root+"/")
+
+	if module, ok := strings.CutSuffix(rel, "/@latest"); ok {
+		r.module, r.latest = module, true
+		return r, module != ""
+	}
+	i := strings.LastIndex(rel, "/@v/")
+	if i <= 0 {
+		return goModuleRequest{}, false
+	}
+	r.module = rel[:i]
+	file := rel[i+len("/@v/"):]
+	if file == "list" || strings.Contains(file, "/") {
+		return r, file == "list"
+	}
+	r.ext = path.Ext(file)
+	r.version = strings.TrimSuffix(file, r.ext)
+	return r, r.version != ""
+}
+
+// goUnescape reverses the case encoding of module paths and versions ("!a" for "A")
+func goUnescape(s string) (string, bool) {
+	var b strings.Builder
+	bang := false
+	for _, r := range s {
+		switch {
+		case bang:
+			if r < 'a' || r > 'z' {
+				return "", false
+			}
+			b.WriteRune(r - 'a' + 'A')
+			bang = false
+		case r == '!':
+			bang = true
+		case r >= 'A' && r <= 'Z':
+			return "", false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), !bang
+}
+
+// goValidVersion reports if version is canonical semver that fits the major version suffix of module
+func goValidVersion(module, version string) bool {
+	m := goSemverRe.FindStringSubmatch(version)
+	if m == nil {
+		return false
+	}
+	// numeric pre-release identifiers must not have leading zeros
+	for _, id := range strings.Split(strings.TrimPrefix(m[4], "-"), ".") {
+		if len(id) > 1 && id[0] == '0' && strings.Trim(id, "0123456789") == "" {
+			return false
+		}
+	}
+
+	major := m[1]
+	suffix := path.Base(module)
+	if n, err := strconv.Atoi(strings.TrimPrefix(suffix, "v")); err == nil && suffix[0] == 'v' && n >= 2 && suffix == "v"+strconv.Itoa(n) {
+		return major == strconv.Itoa(n) && m[6] == ""
+	}
+	return major == "0" || major == "1" || m[6] != ""
+}
+
+type goVersionInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// HandleGoProxy serves the dynamic parts of the GOPROXY protocol and publishing.
+// Returns false if the request is not for a Go module proxy; stored files are served as usual.
+func (h *Handler) HandleGoProxy(c *gin.Context) bool {
+	r, ok := h.parseGoModuleRequest(dbPath(c.Request.URL.Path))
+	if !ok {
+		return false
+	}
+	method := c.Request.Method
+	read := method == http.MethodGet || method == http.MethodHead
+
+	switch {
+	case r.latest && read:
+		h.goLatest(c, r)
+	case r.version == "" && read:
+		h.goList(c, r)
+	case r.version != "" && method == http.MethodPut:
+		if r.ext != ".zip" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Publish the module zip, .mod and .info are generated"})
+			return true
+		}
+		if auth.EnsureAuth(c) {
+			h.goPublish(c, r)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// goVersions returns the published versions of a module
+func (h *Handler) goVersions(c *gin.Context, r goModuleRequest) ([]string, error) {
+	dir := r.versionDir() + "/"
+	records, err := h.filesUnder(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, r := range records {
+		name := strings.TrimPrefix(r.Path, dir)
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, ".info") || !h.canRead(c, r.Path) {
+			continue
+		}
+		if v, ok := goUnescape(strings.TrimSuffix(name, ".info")); ok {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareSemver(strings.TrimPrefix(versions[i], "v"), strings.TrimPrefix(versions[j], "v")) < 0
+	})
+	return versions, nil
+}
+
+// goList handles <module>/@v/list
+func (h *Handler) goList(c *gin.Context, r goModuleRequest) {
+	versions, err := h.goVersions(c, r)
+	if err != nil {
+		logger(c).WithError(err).Error("failed to list module versions")
+		c.JSON(500, gin.H{"error": "Database error"})
+		return
+	}
+	if len(versions) == 0 {
+		c.String(http.StatusNotFound, "not found")
+		return
+	}
+	c.String(http.StatusOK, strings.Join(versions, "\n")+"\n")
+}
+
+// goLatest handles <module>/@latest: the highest release, or the highest pre-release if there is none
+func (h *Handler) goLatest(c *gin.Context, r goModuleRequest) {
+	versions, err := h.goVersions(c, r)
+	if err != nil {
+		logger(c).WithError(err).Error("failed to list module versions")
+		c.JSON(500, gin.H{"error": "Database error"})
+		return
+	}
+	if len(versions) == 0 {
+		c.String(http.StatusNotFound, "not found")
+		return
+	}
+
+	latest := versions[len(versions)-1]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !npmIsPrerelease(versions[i]) {
+			latest = versions[i]
+			break
+		}
+	}
+	h.ServeFile(c, path.Join(r.versionDir(), goEscape(latest)+".info"))
+}
+
+// goEscape applies the case encoding of module paths and versions
+func goEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// goModFile returns the go.mod of a module zip, or a minimal one if the module has none
+func goModFile(zr *zip.Reader, module, version string) ([]byte, error) {
+	prefix := module + "@" + version + "/"
+	var gomod *zip.File
+	for _, f := range zr.File {
+		name, ok := strings.CutPrefix(f.Name, prefix)
+		if !ok || name == "" || path.Clean(name) != name || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("%s is not below %s", f.Name, prefix)
+		}
+		if name == "go.mod" {
+			gomod = f
+		}
+	}
+	if gomod == nil {
+		return []byte(fmt.Sprintf("module %s\n", module)), nil
+	}
+
+	rc, err := gomod.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	if declared := goModulePath(data); declared != module {
+		return nil, fmt.Errorf("go.mod declares module %q", declared)
+	}
+	return data, nil
+}
+
+// goModulePath returns the path of the module directive of a go.mod
+func goModulePath(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "//")
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "module" {
+			if unquoted, err := strconv.Unquote(fields[1]); err == nil {
+				return unquoted
+			}
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// claimGoVersion makes sure only one request at a time publishes the version with the given .info file
+func (h *Handler) claimGoVersion(info string) bool {
+	h.goPublishMu.Lock()
+	defer h.goPublishMu.Unlock()
+	if h.goPublishing[info] {
+		return false
+	}
+	if h.goPublishing == nil {
+		h.goPublishing = make(map[string]bool)
+	}
+	h.goPublishing[info] = true
+	return true
+}
+
+func (h *Handler) releaseGoVersion(info string) {
+	h.goPublishMu.Lock()
+	delete(h.goPublishing, info)
+	h.goPublishMu.Unlock()
+}
+
+// goPublish stores an uploaded module zip with its .mod and .info, all immutable
+func (h *Handler) goPublish(c *gin.Context, r goModuleRequest) {
+	scopes := c.GetStringSlice("allowed_paths")
+	target := path.Join(r.versionDir(), r.version+".zip")
+
+	module, okModule := goUnescape(r.module)
+	version, okVersion := goUnescape(r.version)
+	if !okModule || !okVersion || module == "" || path.Clean(module) != module {
+		c.JSON(400, gin.H{"error": "Invalid module path or version"})
+		return
+	}
+	if !goValidVersion(module, version) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid version %s: must be canonical semver matching the module's major version", version)})
+		return
+	}
+
+	info := path.Join(r.versionDir(), r.version+".info")
+	if !h.claimGoVersion(info) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Version " + version + " is being published"})
+		return
+	}
+	defer h.releaseGoVersion(info)
+	if _, err := h.Storage.Stat(info); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Version " + version + " is already published"})
+		return
+	}
+	for _, p := range []string{target, info} {
+		if ok, msg := h.CanModify(p, scopes, ModifyOptions{IgnoreProtected: true, IsUpload: true}); !ok {
+			h.Audit.WithContext(c).Failure(audit.ActionUpload, p, errors.New(msg))
+			c.JSON(403, gin.H{"error": msg})
+			return
+		}
+	}
+
+	policy, err := parseUploadPolicy(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	policy.Stream, policy.Group = module, version
+
+	out, err := h.createTempFile()
+	if err != nil {
+		logger(c).WithError(err).Error("failed to create temp file")
+		c.JSON(500, gin.H{"error": "Failed to store file"})
+		return
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hashes := newHashSet()
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, h.Config.Storage.MaxUploadSizeBytes)
+	written, err := io.Copy(io.MultiWriter(out, hashes), body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File content exceeded limit"})
+			return
+		}
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload interrupted"})
+		return
+	}
+	sums := hashes.Sums()
+	if mismatchErr := policy.verify(sums); mismatchErr != "" {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, errors.New(mismatchErr), "status", "corrupted")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Integrity check failed", "details": mismatchErr})
+		return
+	}
+
+	zr, err := zip.NewReader(out, written)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid module zip"})
+		return
+	}
+	gomod, err := goModFile(zr, module, version)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, err)
+		c.JSON(400, gin.H{"error": "Invalid module zip", "details": err.Error()})
+		return
+	}
+	if err := out.Close(); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to store file"})
+		return
+	}
+
+	infoData, _ := json.Marshal(goVersionInfo{Version: version, Time: time.Now().UTC().Truncate(time.Second)})
+	mod := path.Join(r.versionDir(), r.version+".mod")
+	res, err := h.saveUploadMeta(target, "application/zip", written, sums, policy, out.Name())
+	if err == nil {
+		_, err = h.storeBytes(mod, "text/plain; charset=utf-8", gomod, policy)
+	}
+	// .info goes last, the version is listed once it exists
+	if err == nil {
+		_, err = h.storeBytes(info, "application/json", infoData, policy)
+	}
+	if err == nil {
+		err = h.DB.Model(&MetaResource{}).Where("path IN ?", []string{target, mod, info}).Update("immutable", true).Error
+	}
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, err)
+		logger(c).WithError(err).Error("db sync failed")
+		c.JSON(500, gin.H{"error": "Database sync failed"})
+		return
+	}
+
+	h.Audit.WithContext(c).Success(audit.ActionUpload, target, "size", written, "sha256", res.SHA256, "version", version)
+	h.afterChange(target, mod, info)
+	c.JSON(http.StatusOK, res)
+}
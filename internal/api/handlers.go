@@ -3,8 +3,8 @@ package api
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
-	"os"
 	"path/filepath"
 	"time"
 
@@ -16,7 +16,7 @@ import (
 	"gorm.io/gorm"
 )
 
-func (f *FileResponse) updateWithFileInfo(i os.FileInfo) {
+func (f *FileResponse) updateWithFileInfo(i fs.FileInfo) {
 	f.IsDir = i.IsDir()
 	f.Size = i.Size()
 	f.ModTime = i.ModTime()
@@ -53,7 +53,7 @@ func (h *Handler) toResponseFromMeta(c *gin.Context, meta MetaResource) FileResp
 	return o
 }
 
-func (h *Handler) toResponse(c *gin.Context, urlPath string, i os.FileInfo) FileResponse {
+func (h *Handler) toResponse(c *gin.Context, urlPath string, i fs.FileInfo) FileResponse {
 	allowedPaths := c.GetStringSlice("allowed_paths")
 
 	o := FileResponse{}
@@ -95,17 +95,19 @@ func (h *Handler) toResponse(c *gin.Context, urlPath string, i os.FileInfo) File
 
 func (h *Handler) GetMeta(c *gin.Context) {
 	path := dbPath(c.Param("path"))
-	fsPath := h.fsPath(path)
+	if v, ok := h.Config.Virtual(path); ok {
+		h.getVirtualMeta(c, v, path)
+		return
+	}
 
-	stat, err := os.Stat(fsPath)
-	if err != nil {
-		c.Status(http.StatusNotFound)
+	stat, ok := h.statReadable(c, path)
+	if !ok {
 		return
 	}
 
 	// --- Directory listing ---
 	if stat.IsDir() {
-		entries, err := os.ReadDir(fsPath)
+		entries, err := h.Storage.List(path)
 		if err != nil {
 			c.Status(http.StatusInternalServerError)
 			return
@@ -113,13 +115,12 @@ func (h *Handler) GetMeta(c *gin.Context) {
 
 		result := make([]FileResponse, 0, len(entries))
 
-		for _, e := range entries {
-			info, err := e.Info()
-			if err != nil {
+		for _, info := range entries {
+			if !h.canSee(c, filepath.Join(path, info.Name()), info.IsDir()) {
 				continue
 			}
 
-			f := h.toResponse(c, filepath.Join(path, e.Name()), info)
+			f := h.toResponse(c, filepath.Join(path, info.Name()), info)
 			result = append(result, f)
 		}
 
@@ -131,7 +132,7 @@ func (h *Handler) GetMeta(c *gin.Context) {
 	c.JSON(http.StatusOK, f)
 }
 
-func toResourceType(s os.FileInfo) ResourceType {
+func toResourceType(s fs.FileInfo) ResourceType {
 	if s.IsDir() {
 		return ResourceTypeDir
 	}
@@ -156,11 +157,16 @@ func (h *Handler) PatchMeta(c *gin.Context) {
 		}
 	}
 
-	// File must exist on filesystem
-	fullPath := filepath.Join(h.BaseDir, filepath.Clean(path))
-	stat, err := os.Stat(fullPath)
-	if os.IsNotExist(err) {
-		h.Log.WithField("path", fullPath).Warn("Patch attempted on non-existent file")
+	if isSystemPath(path) || !auth.IsInScopes(path, c.GetStringSlice("meta_paths")) {
+		h.Audit.WithContext(c).Failure(audit.ActionPatchMeta, path, errors.New("out of scope"))
+		c.JSON(http.StatusForbidden, gin.H{"error": "Path is outside of your authorized scope."})
+		return
+	}
+
+	// File must exist in storage
+	stat, err := h.Storage.Stat(path)
+	if err != nil {
+		h.Log.WithField("path", path).Warn("Patch attempted on non-existent file")
 		c.JSON(http.StatusNotFound, gin.H{"error": "Physical path not found on disk"})
 		return
 	}
@@ -247,6 +253,10 @@ func (h *Handler) PatchMeta(c *gin.Context) {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Stream != nil || req.Tags != nil {
+		// npm packuments are built from streams and tags
+		h.afterChange(resource.Path)
+	}
 
 	c.JSON(http.StatusOK, resource)
 }
@@ -272,9 +282,8 @@ func (h *Handler) PostMeta(c *gin.Context) {
 		c.JSON(403, gin.H{"error": msg})
 		return
 	}
-	fsPath := h.fsPath(dbPath)
 	if req.CreateDir {
-		if err := os.MkdirAll(fsPath, 0755); err != nil {
+		if err := h.Storage.Mkdir(dbPath); err != nil {
 			c.JSON(500, gin.H{"error": "Failed to create directory"})
 			return
 		}
@@ -286,9 +295,7 @@ func (h *Handler) PostMeta(c *gin.Context) {
 
 	if req.RenameTo != "" {
 		oldURLPath := dbPath
-		fullOldPath := h.fsPath(dbPath)
 		newURLPath := filepath.Join(filepath.Dir(oldURLPath), filepath.Clean(req.RenameTo))
-		fullNewPath := h.fsPath(newURLPath)
 
 		if h.Config.IsProtected(oldURLPath) {
 			h.Audit.WithContext(c).Failure(audit.ActionRename, oldURLPath, fmt.Errorf("protected path"))
@@ -298,6 +305,13 @@ func (h *Handler) PostMeta(c *gin.Context) {
 			return
 		}
 
+		// Moving removes the old path
+		if ok, msg := h.CanModify(oldURLPath, c.GetStringSlice("delete_paths"), ModifyOptions{}); !ok {
+			h.Audit.WithContext(c).Failure(audit.ActionRename, oldURLPath, errors.New(msg))
+			c.JSON(403, gin.H{"error": msg})
+			return
+		}
+
 		// We already checked oldPath .
 		// Now we must check if the NEW path is also in scope.
 		if ok, msg := h.CanModify(newURLPath, scopes, ModifyOptions{}); !ok {
@@ -306,47 +320,54 @@ func (h *Handler) PostMeta(c *gin.Context) {
 			return
 		}
 
-		// 1. Filesystem Rename
-		if err := os.Rename(fullOldPath, fullNewPath); err != nil {
-			log.WithError(err).Infof("Rename failed: req:%v p:%v -> %v, dbPath:%v", req.RenameTo, fullOldPath, fullNewPath, dbPath)
-			c.JSON(500, gin.H{"error": "Filesystem rename failed: " + err.Error()})
+		if err := h.moveTree(oldURLPath, newURLPath); err != nil {
+			log.WithError(err).Infof("Rename failed: req:%v p:%v -> %v", req.RenameTo, oldURLPath, newURLPath)
+			c.JSON(500, gin.H{"error": "Rename failed: " + err.Error()})
 			return
 		}
 
-		// 2. Database Update (Recursive)
-		err := h.DB.Transaction(func(tx *gorm.DB) error {
-			// We use a raw SQL REPLACE to update the prefix for the folder and all nested children
-			// SQL: UPDATE meta_resources SET path = REPLACE(path, '/old', '/new')
-			//      WHERE path = '/old' OR path LIKE '/old/%'
+		h.Audit.WithContext(c).Success(audit.ActionRename, newURLPath)
+		h.afterChange(oldURLPath, newURLPath)
+		c.JSON(200, gin.H{"status": "renamed", "new_path": newURLPath})
+		return
+	}
 
-			oldPrefix := oldURLPath
-			newPrefix := newURLPath
+	c.JSON(400, gin.H{"error": "invalid action"})
+}
 
-			// Important: append trailing slash for the LIKE match to avoid partial name matches
-			// e.g., don't rename "/images-backup" when renaming "/images"
-			childMatch := oldPrefix + "/%"
+// moveTree renames a file or directory tree in storage and moves its metadata along
+func (h *Handler) moveTree(oldURLPath, newURLPath string) error {
+	// 1. Storage Rename
+	if err := h.Storage.Rename(oldURLPath, newURLPath); err != nil {
+		return err
+	}
 
-			result := tx.Model(&MetaResource{}).
-				Where("path = ? OR path LIKE ?", oldPrefix, childMatch).
-				Update("path", gorm.Expr("REPLACE(path, ?, ?)", oldPrefix, newPrefix))
+	// 2. Database Update (Recursive)
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		// We use a raw SQL REPLACE to update the prefix for the folder and all nested children
+		// SQL: UPDATE meta_resources SET path = REPLACE(path, '/old', '/new')
+		//      WHERE path = '/old' OR path LIKE '/old/%'
 
-			if result.Error != nil {
-				return result.Error
-			}
+		oldPrefix := oldURLPath
+		newPrefix := newURLPath
 
-			h.Log.Infof("Renamed %d metadata records from %s to %s", result.RowsAffected, oldPrefix, newPrefix)
-			return nil
-		})
+		// Important: append trailing slash for the LIKE match to avoid partial name matches
+		// e.g., don't rename "/images-backup" when renaming "/images"
+		childMatch := oldPrefix + "/%"
 
-		if err != nil {
-			c.JSON(500, gin.H{"error": "Database path update failed"})
-			return
+		result := tx.Model(&MetaResource{}).
+			Where("path = ? OR path LIKE ?", oldPrefix, childMatch).
+			Update("path", gorm.Expr("REPLACE(path, ?, ?)", oldPrefix, newPrefix))
+
+		if result.Error != nil {
+			return result.Error
 		}
 
-		h.Audit.WithContext(c).Success(audit.ActionRename, newURLPath)
-		c.JSON(200, gin.H{"status": "renamed", "new_path": newURLPath})
-		return
+		h.Log.Infof("Renamed %d metadata records from %s to %s", result.RowsAffected, oldPrefix, newPrefix)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("database path update failed: %w", err)
 	}
-
-	c.JSON(400, gin.H{"error": "invalid action"})
+	return nil
 }
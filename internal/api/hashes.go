@@ -0,0 +1,83 @@
+package api
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"hash"
+)
+
+// fileSums holds the hex encoded checksums stored on MetaResource
+type fileSums struct {
+	MD5    string
+	SHA1   string
+	SHA256 string
+}
+
+// hashSet calculates all supported checksums in one pass.
+// It is an io.Writer so it can be combined with io.MultiWriter.
+type hashSet struct {
+	md5    hash.Hash
+	sha1   hash.Hash
+	sha256 hash.Hash
+}
+
+func newHashSet() *hashSet {
+	return &hashSet{
+		md5:    md5.New(),
+		sha1:   sha1.New(),
+		sha256: sha256.New(),
+	}
+}
+
+func (hs *hashSet) Write(p []byte) (int, error) {
+	// hash.Hash.Write never returns an error
+	hs.md5.Write(p)
+	hs.sha1.Write(p)
+	hs.sha256.Write(p)
+	return len(p), nil
+}
+
+func (hs *hashSet) Sums() fileSums {
+	return fileSums{
+		MD5:    hex.EncodeToString(hs.md5.Sum(nil)),
+		SHA1:   hex.EncodeToString(hs.sha1.Sum(nil)),
+		SHA256: hex.EncodeToString(hs.sha256.Sum(nil)),
+	}
+}
+
+// MarshalState serializes the intermediate state of all hashers,
+// so a hashing run can be continued later (e.g. resumable uploads).
+func (hs *hashSet) MarshalState() (md5State, sha1State, sha256State []byte, err error) {
+	if md5State, err = hs.md5.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return
+	}
+	if sha1State, err = hs.sha1.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return
+	}
+	sha256State, err = hs.sha256.(encoding.BinaryMarshaler).MarshalBinary()
+	return
+}
+
+// restoreHashSet recreates a hashSet from the output of MarshalState
+func restoreHashSet(md5State, sha1State, sha256State []byte) (*hashSet, error) {
+	hs := newHashSet()
+	if len(md5State) == 0 {
+		// nothing hashed yet
+		return hs, nil
+	}
+
+	if err := hs.md5.(encoding.BinaryUnmarshaler).UnmarshalBinary(md5State); err != nil {
+		return nil, fmt.Errorf("md5 state: %w", err)
+	}
+	if err := hs.sha1.(encoding.BinaryUnmarshaler).UnmarshalBinary(sha1State); err != nil {
+		return nil, fmt.Errorf("sha1 state: %w", err)
+	}
+	if err := hs.sha256.(encoding.BinaryUnmarshaler).UnmarshalBinary(sha256State); err != nil {
+		return nil, fmt.Errorf("sha256 state: %w", err)
+	}
+	return hs, nil
+}
@@ -0,0 +1,387 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/audit"
+	"github.com/kovi/yaar/internal/auth"
+	"gopkg.in/yaml.v3"
+)
+
+// Helm repositories are chart directories with an index.yaml listing every chart .tgz stored below them,
+// built from the Chart.yaml of each chart. <dir>/api/charts is the ChartMuseum API used by helm cm-push.
+
+const (
+	helmIndexFile = "index.yaml"
+
+	// helmMaxChartYAMLSize limits the Chart.yaml read from a chart
+	helmMaxChartYAMLSize = 1 << 20
+)
+
+type helmIndex struct {
+	APIVersion string                      `yaml:"apiVersion"`
+	Entries    map[string][]helmChartEntry `yaml:"entries"`
+	Generated  string                      `yaml:"generated"`
+}
+
+// helmChartEntry is the Chart.yaml of a chart version plus urls, digest and created
+type helmChartEntry map[string]any
+
+func (e helmChartEntry) field(name string) string {
+	s, _ := e[name].(string)
+	return s
+}
+
+// readChartYAML returns the Chart.yaml of a packaged chart
+func readChartYAML(r io.Reader) (helmChartEntry, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.New("chart is not a gzipped tar")
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return nil, errors.New("Chart.yaml not found")
+		}
+		// <chart>/Chart.yaml, not the ones of bundled dependencies in <chart>/charts/
+		dir, name, ok := strings.Cut(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if !ok || dir == "" || name != "Chart.yaml" {
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(tr, helmMaxChartYAMLSize))
+		if err != nil {
+			return nil, err
+		}
+		var chart helmChartEntry
+		if err := yaml.Unmarshal(data, &chart); err != nil {
+			return nil, fmt.Errorf("invalid Chart.yaml: %w", err)
+		}
+		if chart.field("name") == "" || chart.field("version") == "" {
+			return nil, errors.New("Chart.yaml has no name or version")
+		}
+		if strings.ContainsAny(chart.field("name"), `/\`) {
+			return nil, errors.New("invalid chart name")
+		}
+		return chart, nil
+	}
+}
+
+// helmCharts returns the records of the charts of a repository
+func (h *Handler) helmCharts(root string) ([]MetaResource, error) {
+	candidates, err := h.filesUnder(root + "/")
+	if err != nil {
+		return nil, err
+	}
+	var charts []MetaResource
+	for _, r := range candidates {
+		if strings.HasSuffix(r.Path, ".tgz") {
+			charts = append(charts, r)
+		}
+	}
+	return charts, nil
+}
+
+// updateHelmIndexes regenerates the index.yaml of the chart directories the changed paths belong to
+func (h *Handler) updateHelmIndexes(paths ...string) {
+	roots := make(map[string]bool)
+	for _, p := range paths {
+		root, ok := h.Config.HelmRepo(p)
+		if !ok || p == path.Join(root, helmIndexFile) {
+			continue
+		}
+		roots[root] = true
+	}
+
+	for root := range roots {
+		if err := h.writeHelmIndex(root); err != nil {
+			h.Log.WithError(err).Errorf("helm: failed to update the index of %s", root)
+		}
+	}
+}
+
+func (h *Handler) writeHelmIndex(root string) error {
+	indexPath := path.Join(root, helmIndexFile)
+	records, err := h.helmCharts(root)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return h.removeFile(indexPath)
+	}
+
+	// Reading a chart is expensive, reuse the entries of unchanged ones
+	old, _ := h.readHelmIndex(root)
+	cached := make(map[string]helmChartEntry)
+	if old != nil {
+		for _, versions := range old.Entries {
+			for _, e := range versions {
+				if urls, ok := e["urls"].([]any); ok && len(urls) > 0 {
+					if url, ok := urls[0].(string); ok {
+						cached[url] = e
+					}
+				}
+			}
+		}
+	}
+
+	entries := make(map[string][]helmChartEntry)
+	for _, res := range records {
+		url := strings.TrimPrefix(res.Path, root+"/")
+		entry, ok := cached[url]
+		if !ok || entry.field("digest") != res.SHA256 {
+			entry, err = h.readHelmChart(res.Path)
+			if err != nil {
+				h.Log.WithError(err).Warnf("helm: skipping %s", res.Path)
+				continue
+			}
+			entry["urls"] = []any{url}
+			entry["digest"] = res.SHA256
+			entry["created"] = res.ModTime.UTC().Format(time.RFC3339Nano)
+		}
+		name := entry.field("name")
+		entries[name] = append(entries[name], entry)
+	}
+	for _, versions := range entries {
+		sort.SliceStable(versions, func(i, j int) bool {
+			return compareSemver(strings.TrimPrefix(versions[i].field("version"), "v"), strings.TrimPrefix(versions[j].field("version"), "v")) > 0
+		})
+	}
+
+	// Nothing to do if the entries didn't change
+	if old != nil {
+		before, errBefore := yaml.Marshal(old.Entries)
+		after, errAfter := yaml.Marshal(entries)
+		if errBefore == nil && errAfter == nil && bytes.Equal(before, after) {
+			return nil
+		}
+	}
+
+	data, err := yaml.Marshal(helmIndex{APIVersion: "v1", Entries: entries, Generated: time.Now().UTC().Format(time.RFC3339Nano)})
+	if err != nil {
+		return err
+	}
+	return h.writeGeneratedFile(indexPath, "application/x-yaml", data)
+}
+
+func (h *Handler) readHelmIndex(root string) (*helmIndex, error) {
+	data, err := h.readStoredFile(path.Join(root, helmIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index helmIndex
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+func (h *Handler) readHelmChart(p string) (helmChartEntry, error) {
+	f, err := h.Storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readChartYAML(f)
+}
+
+/* ===================== CHARTMUSEUM API ===================== */
+
+// HandleHelm serves the ChartMuseum API below <dir>/api/charts.
+// Returns false if the request is not for it; index.yaml and the charts are served as files.
+func (h *Handler) HandleHelm(c *gin.Context) bool {
+	p := dbPath(c.Request.URL.Path)
+	root, ok := h.Config.HelmRepo(p)
+	if !ok {
+		return false
+	}
+	rest, ok := strings.CutPrefix(p, path.Join(root, "api", "charts"))
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return false
+	}
+	args := strings.Split(strings.Trim(rest, "/"), "/")
+	if args[0] == "" {
+		args = nil
+	}
+	method := c.Request.Method
+
+	switch {
+	case len(args) == 0 && method == http.MethodPost:
+		if auth.EnsureAuth(c) {
+			h.helmUpload(c, root)
+		}
+	case len(args) <= 2 && (method == http.MethodGet || method == http.MethodHead):
+		h.helmGetCharts(c, root, args)
+	case len(args) == 2 && method == http.MethodDelete:
+		if auth.EnsureAuth(c) {
+			h.helmDelete(c, root, args[0], args[1])
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// helmGetCharts handles GET api/charts, api/charts/<name> and api/charts/<name>/<version>
+func (h *Handler) helmGetCharts(c *gin.Context, root string, args []string) {
+	index, err := h.readHelmIndex(root)
+	if err != nil || !h.canRead(c, path.Join(root, helmIndexFile)) {
+		index = &helmIndex{}
+	}
+	if len(args) == 0 {
+		entries := index.Entries
+		if entries == nil {
+			entries = map[string][]helmChartEntry{}
+		}
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+
+	versions := index.Entries[args[0]]
+	if len(versions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "chart not found"})
+		return
+	}
+	if len(args) == 1 {
+		c.JSON(http.StatusOK, versions)
+		return
+	}
+	for _, e := range versions {
+		// entries are sorted, the first one is the latest
+		if args[1] == "latest" || e.field("version") == args[1] {
+			c.JSON(http.StatusOK, e)
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "improper constraint: " + args[1]})
+}
+
+// helmChartPath returns where a chart version is stored
+func helmChartPath(root, name, version string) string {
+	return path.Join(root, name+"-"+version+".tgz")
+}
+
+// helmUpload handles POST api/charts with the chart as body or as "chart" (and "prov") form file.
+// Existing versions are only replaced with ?force.
+func (h *Handler) helmUpload(c *gin.Context, root string) {
+	scopes := c.GetStringSlice("allowed_paths")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.Config.Storage.MaxUploadSizeBytes)
+
+	var chart, prov []byte
+	var err error
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		chart, err = readFormFile(c, "chart")
+		if err == nil {
+			prov, err = readFormFile(c, "prov")
+		}
+	} else {
+		chart, err = io.ReadAll(c.Request.Body)
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File content exceeded limit"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload interrupted"})
+		return
+	}
+	if len(chart) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no chart uploaded"})
+		return
+	}
+
+	meta, err := readChartYAML(bytes.NewReader(chart))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name, version := meta.field("name"), meta.field("version")
+	target := helmChartPath(root, name, version)
+
+	if _, err := h.Storage.Stat(target); err == nil && c.Query("force") == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "file already exists"})
+		return
+	}
+	if ok, msg := h.CanModify(target, scopes, ModifyOptions{IgnoreProtected: true, IsUpload: true}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, errors.New(msg))
+		c.JSON(403, gin.H{"error": msg})
+		return
+	}
+
+	policy, err := parseUploadPolicy(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	policy.Stream, policy.Group = name, version
+
+	res, err := h.storeBytes(target, "application/gzip", chart, policy)
+	if err == nil && prov != nil {
+		_, err = h.storeBytes(target+".prov", "application/pgp-signature", prov, uploadPolicy{Stream: name, Group: version})
+	}
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, err)
+		logger(c).WithError(err).Error("db sync failed")
+		c.JSON(500, gin.H{"error": "Database sync failed"})
+		return
+	}
+
+	h.Audit.WithContext(c).Success(audit.ActionUpload, target, "size", len(chart), "sha256", res.SHA256, "version", version)
+	h.afterChange(target)
+	c.JSON(http.StatusCreated, gin.H{"saved": true})
+}
+
+// readFormFile returns the content of a multipart file field, nil if it is missing
+func readFormFile(c *gin.Context, field string) ([]byte, error) {
+	fileHeader, err := c.FormFile(field)
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// helmDelete handles DELETE api/charts/<name>/<version>
+func (h *Handler) helmDelete(c *gin.Context, root, name, version string) {
+	target := helmChartPath(root, name, version)
+	if _, err := h.Storage.Stat(target); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "chart not found"})
+		return
+	}
+	if ok, msg := h.CanModify(target, c.GetStringSlice("delete_paths"), ModifyOptions{}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionDelete, target, errors.New(msg))
+		c.JSON(403, gin.H{"error": msg})
+		return
+	}
+
+	for _, p := range []string{target, target + ".prov"} {
+		if err := h.removeFile(p); err != nil {
+			h.Audit.WithContext(c).Failure(audit.ActionDelete, p, err)
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	h.Audit.WithContext(c).Success(audit.ActionDelete, target)
+	h.afterChange(target)
+	c.JSON(http.StatusOK, gin.H{"deleted": true})
+}
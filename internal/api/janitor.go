@@ -2,9 +2,8 @@ package api
 
 import (
 	"context"
-	"io"
-	"os"
-	"path/filepath"
+	"errors"
+	"io/fs"
 	"time"
 )
 
@@ -26,6 +25,10 @@ func (h *Handler) StartJanitor(ctx context.Context, period time.Duration) {
 }
 
 func (h *Handler) RunCleanup() {
+	h.cleanupUploadSessions()
+	h.cleanupTempFiles()
+	h.cleanupStaging()
+
 	var expired []MetaResource
 	now := time.Now().UTC()
 
@@ -47,11 +50,9 @@ func (h *Handler) RunCleanup() {
 			continue
 		}
 
-		fullPath := filepath.Join(h.BaseDir, filepath.Clean(res.Path))
-
-		info, err := os.Stat(fullPath)
+		info, err := h.Storage.Stat(res.Path)
 		if err != nil {
-			if os.IsNotExist(err) {
+			if errors.Is(err, fs.ErrNotExist) {
 				// File already gone? Just clean the DB
 				h.DB.Delete(&res)
 			}
@@ -60,7 +61,7 @@ func (h *Handler) RunCleanup() {
 
 		if info.IsDir() {
 			// 2. Only delete directories if they are empty
-			isEmpty, err := isDirEmpty(fullPath)
+			isEmpty, err := h.isDirEmpty(res.Path)
 			if err != nil {
 				h.Log.Errorf("Janitor: error checking dir %s: %v", res.Path, err)
 				continue
@@ -73,29 +74,24 @@ func (h *Handler) RunCleanup() {
 		}
 
 		// Safe to remove (File or Empty Dir)
-		if err := os.Remove(fullPath); err != nil {
+		if err := h.Storage.Remove(res.Path); err != nil {
 			h.Log.Errorf("Janitor: failed to remove %s: %v", res.Path, err)
 			continue
 		}
 
 		// 4. Cleanup DB
 		h.DB.Delete(&res)
+		h.releaseBlobs(res.SHA256)
 		h.Audit.Success("SYSTEM_CLEANUP", res.Path, "reason", "expired")
+		h.afterChange(res.Path)
 	}
 }
 
 // isDirEmpty returns true if the directory contains no files/folders
-func isDirEmpty(name string) (bool, error) {
-	f, err := os.Open(name)
+func (h *Handler) isDirEmpty(name string) (bool, error) {
+	entries, err := h.Storage.List(name)
 	if err != nil {
 		return false, err
 	}
-	defer f.Close()
-
-	// Read only one entry
-	_, err = f.Readdirnames(1)
-	if err == io.EOF {
-		return true, nil
-	}
-	return false, err
+	return len(entries) == 0, nil
 }
@@ -0,0 +1,483 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/audit"
+)
+
+// Git LFS repositories are directories below an lfs.paths prefix, the LFS URL of a repository is
+// http://host/<prefix>/<repo>. Each one keeps
+//
+//	objects/<oid[0:2]>/<oid[2:4]>/<oid>  the objects, named by their SHA256
+//	locks/<id>                           one immutable JSON record per lock, id is the SHA256 of the locked path
+//
+// Objects are downloaded like any other file; the batch API hands out the plain file URLs.
+const (
+	lfsObjectsDir  = "objects"
+	lfsLocksDir    = "locks"
+	lfsContentType = "application/vnd.git-lfs+json"
+
+	lfsMaxRequestSize = 10 << 20
+	lfsMaxLocks       = 100 // default and upper limit of locks per listing
+)
+
+var (
+	lfsOidRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+	// lfsRoutes are tried in order, the repository may contain slashes
+	lfsRoutes = []struct {
+		kind string
+		re   *regexp.Regexp
+	}{
+		{"batch", regexp.MustCompile(`^(.*)/objects/batch$`)},
+		{"verify", regexp.MustCompile(`^(.*)/objects/verify$`)},
+		{"object", regexp.MustCompile(`^(.*)/objects/[0-9a-f]{2}/[0-9a-f]{2}/([0-9a-f]{64})$`)},
+		{"locks", regexp.MustCompile(`^(.*)/locks$`)},
+		{"locks-verify", regexp.MustCompile(`^(.*)/locks/verify$`)},
+		{"unlock", regexp.MustCompile(`^(.*)/locks/([0-9a-f]{64})/unlock$`)},
+	}
+)
+
+func lfsObjectPath(repo, oid string) string {
+	return path.Join(repo, lfsObjectsDir, oid[0:2], oid[2:4], oid)
+}
+
+func lfsLockPath(repo, id string) string {
+	return path.Join(repo, lfsLocksDir, id)
+}
+
+func lfsJSON(c *gin.Context, status int, v any) {
+	c.Header("Content-Type", lfsContentType)
+	c.JSON(status, v)
+}
+
+func lfsError(c *gin.Context, status int, message string) {
+	lfsJSON(c, status, gin.H{"message": message})
+}
+
+// lfsAuth answers with the challenge git-lfs needs to ask for credentials
+func lfsAuth(c *gin.Context) bool {
+	if _, ok := c.Get("username"); ok {
+		return true
+	}
+	c.Header("LFS-Authenticate", `Basic realm="yaar"`)
+	lfsError(c, http.StatusUnauthorized, "Authentication required")
+	return false
+}
+
+// HandleLFS serves the Git LFS batch and locking APIs below the lfs.paths prefixes.
+// Returns false for other requests, e.g. object downloads.
+func (h *Handler) HandleLFS(c *gin.Context) bool {
+	p := dbPath(c.Request.URL.Path)
+	root, ok := h.Config.LFSRepo(p)
+	if !ok {
+		return false
+	}
+	rel := strings.TrimPrefix(p, root)
+	method := c.Request.Method
+
+	for _, route := range lfsRoutes {
+		m := route.re.FindStringSubmatch(rel)
+		if m == nil {
+			continue
+		}
+		repo := root + m[1]
+		switch {
+		case route.kind == "batch" && method == http.MethodPost:
+			h.lfsBatch(c, repo)
+		case route.kind == "verify" && method == http.MethodPost:
+			if lfsAuth(c) {
+				h.lfsVerify(c, repo)
+			}
+		case route.kind == "object" && method == http.MethodPut:
+			if lfsAuth(c) {
+				// the object name is its checksum, the upload pipeline rejects anything else
+				c.Request.Header.Set("X-Checksum-Sha256", m[2])
+				h.uploadFile(c, p)
+			}
+		case route.kind == "locks" && method == http.MethodGet:
+			if lfsAuth(c) {
+				h.lfsListLocks(c, repo)
+			}
+		case route.kind == "locks" && method == http.MethodPost:
+			if lfsAuth(c) {
+				h.lfsCreateLock(c, repo)
+			}
+		case route.kind == "locks-verify" && method == http.MethodPost:
+			if lfsAuth(c) {
+				h.lfsVerifyLocks(c, repo)
+			}
+		case route.kind == "unlock" && method == http.MethodPost:
+			if lfsAuth(c) {
+				h.lfsUnlock(c, repo, m[2])
+			}
+		default:
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+/* ===================== BATCH API ===================== */
+
+type lfsPointer struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsObject struct {
+	lfsPointer
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError      `json:"error,omitempty"`
+}
+
+// lfsStored returns the size of the object if it is stored, -1 otherwise
+func (h *Handler) lfsStored(repo, oid string) int64 {
+	var res MetaResource
+	r := h.DB.Select("size").Where("path = ? AND sha256 = ?", lfsObjectPath(repo, oid), oid).Limit(1).Find(&res)
+	if r.Error != nil || r.RowsAffected == 0 {
+		return -1
+	}
+	return res.Size
+}
+
+func (h *Handler) lfsBatch(c *gin.Context, repo string) {
+	var req struct {
+		Operation string       `json:"operation"`
+		Transfers []string     `json:"transfers"`
+		Objects   []lfsPointer `json:"objects"`
+		HashAlgo  string       `json:"hash_algo"`
+	}
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, lfsMaxRequestSize)).Decode(&req); err != nil {
+		lfsError(c, http.StatusUnprocessableEntity, "Invalid batch request")
+		return
+	}
+	if req.Operation != "download" && req.Operation != "upload" {
+		lfsError(c, http.StatusUnprocessableEntity, "Operation must be download or upload")
+		return
+	}
+	if len(req.Transfers) > 0 && !slices.Contains(req.Transfers, "basic") {
+		lfsError(c, http.StatusUnprocessableEntity, "Only the basic transfer adapter is supported")
+		return
+	}
+	if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+		lfsError(c, http.StatusConflict, "Only sha256 is supported")
+		return
+	}
+	if req.Operation == "upload" && !lfsAuth(c) {
+		return
+	}
+
+	// Uploads and verification need the same credentials as the batch request
+	header := map[string]string{}
+	if a := c.GetHeader("Authorization"); a != "" {
+		header["Authorization"] = a
+	}
+	if t := c.GetHeader("X-API-Token"); t != "" {
+		header["X-API-Token"] = t
+	}
+	base := requestBaseURL(c)
+	href := func(p string) string {
+		return base + (&url.URL{Path: p}).EscapedPath()
+	}
+
+	scopes := c.GetStringSlice("allowed_paths")
+	objects := make([]lfsObject, 0, len(req.Objects))
+	for _, o := range req.Objects {
+		obj := lfsObject{lfsPointer: o}
+		objects = append(objects, obj)
+		res := &objects[len(objects)-1]
+		if !lfsOidRe.MatchString(o.Oid) || o.Size < 0 {
+			res.Error = &lfsObjectError{Code: http.StatusUnprocessableEntity, Message: "Invalid object"}
+			continue
+		}
+		p := lfsObjectPath(repo, o.Oid)
+		size := h.lfsStored(repo, o.Oid)
+
+		if req.Operation == "download" {
+			if size < 0 || !h.canRead(c, p) {
+				res.Error = &lfsObjectError{Code: http.StatusNotFound, Message: "Object does not exist"}
+				continue
+			}
+			res.Size = size
+			res.Authenticated = true
+			res.Actions = map[string]lfsAction{"download": {Href: href(p)}}
+			continue
+		}
+
+		if size == o.Size {
+			continue // already stored, nothing to do for the client
+		}
+		if ok, msg := h.CanModify(p, scopes, ModifyOptions{IgnoreProtected: size < 0, IsUpload: true}); !ok {
+			res.Error = &lfsObjectError{Code: http.StatusForbidden, Message: msg}
+			continue
+		}
+		if o.Size > h.Config.Storage.MaxUploadSizeBytes {
+			res.Error = &lfsObjectError{Code: http.StatusUnprocessableEntity, Message: "Object exceeds the maximum upload size"}
+			continue
+		}
+		res.Authenticated = true
+		res.Actions = map[string]lfsAction{
+			"upload": {Href: href(p), Header: header},
+			"verify": {Href: href(path.Join(repo, lfsObjectsDir, "verify")), Header: header},
+		}
+	}
+
+	lfsJSON(c, http.StatusOK, gin.H{"transfer": "basic", "objects": objects, "hash_algo": "sha256"})
+}
+
+// lfsVerify confirms an upload, git-lfs calls it after the PUT
+func (h *Handler) lfsVerify(c *gin.Context, repo string) {
+	var o lfsPointer
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, lfsMaxRequestSize)).Decode(&o); err != nil || !lfsOidRe.MatchString(o.Oid) {
+		lfsError(c, http.StatusUnprocessableEntity, "Invalid object")
+		return
+	}
+	size := h.lfsStored(repo, o.Oid)
+	if size < 0 {
+		lfsError(c, http.StatusNotFound, "Object does not exist")
+		return
+	}
+	if size != o.Size {
+		lfsError(c, http.StatusUnprocessableEntity, fmt.Sprintf("Object size is %d, not %d", size, o.Size))
+		return
+	}
+	lfsJSON(c, http.StatusOK, gin.H{})
+}
+
+/* ===================== LOCKING API ===================== */
+
+type lfsLock struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	LockedAt time.Time `json:"locked_at"`
+	Owner    struct {
+		Name string `json:"name"`
+	} `json:"owner"`
+}
+
+// lfsLocks reads all lock records of repo, sorted by id
+func (h *Handler) lfsLocks(repo string) ([]lfsLock, error) {
+	entries, err := h.Storage.List(path.Join(repo, lfsLocksDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var locks []lfsLock
+	for _, e := range entries {
+		if e.IsDir() || !lfsOidRe.MatchString(e.Name()) {
+			continue
+		}
+		lock, err := h.lfsReadLock(repo, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		if lock != nil {
+			locks = append(locks, *lock)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].ID < locks[j].ID })
+	return locks, nil
+}
+
+// lfsReadLock returns the lock with id, nil if there is none
+func (h *Handler) lfsReadLock(repo, id string) (*lfsLock, error) {
+	f, err := h.Storage.Open(lfsLockPath(repo, id))
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+	var lock lfsLock
+	if err := json.NewDecoder(f).Decode(&lock); err != nil {
+		return nil, fmt.Errorf("invalid lock record %s: %w", id, err)
+	}
+	return &lock, nil
+}
+
+// lfsPage applies the cursor (the id to start at) and limit of a listing.
+// Returns the page and the cursor of the next one.
+func lfsPage(locks []lfsLock, cursor string, limit int) ([]lfsLock, string) {
+	if limit <= 0 || limit > lfsMaxLocks {
+		limit = lfsMaxLocks
+	}
+	start := sort.Search(len(locks), func(i int) bool { return locks[i].ID >= cursor })
+	locks = locks[start:]
+	if len(locks) > limit {
+		return locks[:limit], locks[limit].ID
+	}
+	return locks, ""
+}
+
+func (h *Handler) lfsListLocks(c *gin.Context, repo string) {
+	if !h.canRead(c, repo) {
+		lfsError(c, http.StatusNotFound, "Repository not found")
+		return
+	}
+	locks, err := h.lfsLocks(repo)
+	if err != nil {
+		logger(c).WithError(err).Error("lfs: failed to read locks")
+		lfsError(c, http.StatusInternalServerError, "Failed to read locks")
+		return
+	}
+
+	filtered := make([]lfsLock, 0, len(locks))
+	for _, l := range locks {
+		if (c.Query("path") == "" || l.Path == c.Query("path")) && (c.Query("id") == "" || l.ID == c.Query("id")) {
+			filtered = append(filtered, l)
+		}
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	page, next := lfsPage(filtered, c.Query("cursor"), limit)
+	resp := gin.H{"locks": page}
+	if next != "" {
+		resp["next_cursor"] = next
+	}
+	lfsJSON(c, http.StatusOK, resp)
+}
+
+func (h *Handler) lfsVerifyLocks(c *gin.Context, repo string) {
+	var req struct {
+		Cursor string `json:"cursor"`
+		Limit  int    `json:"limit"`
+	}
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, lfsMaxRequestSize)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		lfsError(c, http.StatusUnprocessableEntity, "Invalid request")
+		return
+	}
+	locks, err := h.lfsLocks(repo)
+	if err != nil {
+		logger(c).WithError(err).Error("lfs: failed to read locks")
+		lfsError(c, http.StatusInternalServerError, "Failed to read locks")
+		return
+	}
+
+	page, next := lfsPage(locks, req.Cursor, req.Limit)
+	ours, theirs := []lfsLock{}, []lfsLock{}
+	for _, l := range page {
+		if l.Owner.Name == c.GetString("username") {
+			ours = append(ours, l)
+		} else {
+			theirs = append(theirs, l)
+		}
+	}
+	resp := gin.H{"ours": ours, "theirs": theirs}
+	if next != "" {
+		resp["next_cursor"] = next
+	}
+	lfsJSON(c, http.StatusOK, resp)
+}
+
+// lfsCreateLock stores the lock record as an immutable file, which keeps everyone else from replacing it
+func (h *Handler) lfsCreateLock(c *gin.Context, repo string) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, lfsMaxRequestSize)).Decode(&req); err != nil || req.Path == "" {
+		lfsError(c, http.StatusUnprocessableEntity, "Missing path")
+		return
+	}
+	sum := sha256.Sum256([]byte(req.Path))
+	id := hex.EncodeToString(sum[:])
+	p := lfsLockPath(repo, id)
+
+	h.lfsLockMu.Lock()
+	defer h.lfsLockMu.Unlock()
+
+	existing, err := h.lfsReadLock(repo, id)
+	if err != nil {
+		lfsError(c, http.StatusInternalServerError, "Failed to read locks")
+		return
+	}
+	if existing != nil {
+		lfsJSON(c, http.StatusConflict, gin.H{"lock": existing, "message": "Already locked"})
+		return
+	}
+	if ok, msg := h.CanModify(p, c.GetStringSlice("allowed_paths"), ModifyOptions{IgnoreProtected: true, IsUpload: true}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionLock, p, errors.New(msg), "lfs_path", req.Path)
+		lfsError(c, http.StatusForbidden, msg)
+		return
+	}
+
+	lock := lfsLock{ID: id, Path: req.Path, LockedAt: time.Now().UTC().Truncate(time.Second)}
+	lock.Owner.Name = c.GetString("username")
+	data, _ := json.Marshal(lock)
+	res, err := h.storeBytes(p, "application/json", data, uploadPolicy{})
+	if err == nil {
+		err = h.DB.Model(&res).Update("immutable", true).Error
+	}
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionLock, p, err, "lfs_path", req.Path)
+		lfsError(c, http.StatusInternalServerError, "Failed to create lock")
+		return
+	}
+	h.Audit.WithContext(c).Success(audit.ActionLock, p, "lfs_path", req.Path)
+	lfsJSON(c, http.StatusCreated, gin.H{"lock": lock})
+}
+
+// lfsUnlock releases a lock. Admins may force the release of other users' locks.
+func (h *Handler) lfsUnlock(c *gin.Context, repo, id string) {
+	var req struct {
+		Force bool `json:"force"`
+	}
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, lfsMaxRequestSize)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		lfsError(c, http.StatusUnprocessableEntity, "Invalid request")
+		return
+	}
+	p := lfsLockPath(repo, id)
+
+	h.lfsLockMu.Lock()
+	defer h.lfsLockMu.Unlock()
+
+	lock, err := h.lfsReadLock(repo, id)
+	if err != nil {
+		lfsError(c, http.StatusInternalServerError, "Failed to read locks")
+		return
+	}
+	if lock == nil {
+		lfsError(c, http.StatusNotFound, "Lock not found")
+		return
+	}
+	if lock.Owner.Name != c.GetString("username") && !(req.Force && c.GetBool("is_admin")) {
+		h.Audit.WithContext(c).Failure(audit.ActionUnlock, p, errors.New("lock owned by "+lock.Owner.Name), "lfs_path", lock.Path)
+		lfsError(c, http.StatusForbidden, "The lock belongs to "+lock.Owner.Name)
+		return
+	}
+
+	if err := h.removeFile(p); err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUnlock, p, err, "lfs_path", lock.Path)
+		lfsError(c, http.StatusInternalServerError, "Failed to release lock")
+		return
+	}
+	h.Audit.WithContext(c).Success(audit.ActionUnlock, p, "lfs_path", lock.Path, "force", req.Force)
+	lfsJSON(c, http.StatusOK, gin.H{"lock": lock})
+}
@@ -0,0 +1,485 @@
+package api
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/audit"
+)
+
+const mavenMetadataFile = "maven-metadata.xml"
+
+// mavenChecksum returns the stored hash a Maven checksum sidecar (.sha1, .md5, .sha256) refers to
+func mavenChecksum(meta *MetaResource, ext string) string {
+	switch ext {
+	case ".sha1":
+		return meta.SHA1
+	case ".md5":
+		return meta.MD5
+	case ".sha256":
+		return meta.SHA256
+	}
+	return ""
+}
+
+func isMavenChecksum(name string) bool {
+	switch path.Ext(name) {
+	case ".sha1", ".md5", ".sha256", ".sha512":
+		return true
+	}
+	return false
+}
+
+// serveMavenChecksum answers GET/HEAD of a missing checksum sidecar in a Maven repository
+// from the hashes stored with the file. Returns false if the request is not such a sidecar.
+func (h *Handler) serveMavenChecksum(c *gin.Context, p string) bool {
+	if _, ok := h.Config.MavenRepo(p); !ok {
+		return false
+	}
+
+	ext := path.Ext(p)
+	meta, err := h.GetFileMeta(strings.TrimSuffix(p, ext))
+	if err != nil || meta == nil {
+		return false
+	}
+	sum := mavenChecksum(meta, ext)
+	if sum == "" {
+		return false
+	}
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("Content-Length", strconv.Itoa(len(sum)))
+	c.Status(http.StatusOK)
+	if c.Request.Method != http.MethodHead {
+		io.WriteString(c.Writer, sum)
+	}
+	return true
+}
+
+// acceptMavenChecksum handles the upload of a checksum sidecar in a Maven repository.
+// Sidecars we can serve from the stored hashes are verified against them instead of being stored.
+// Returns false if the upload should be stored as a regular file.
+func (h *Handler) acceptMavenChecksum(c *gin.Context, p string) bool {
+	if _, ok := h.Config.MavenRepo(p); !ok {
+		return false
+	}
+
+	ext := path.Ext(p)
+	target := strings.TrimSuffix(p, ext)
+	meta, err := h.GetFileMeta(target)
+	if err != nil || meta == nil || mavenChecksum(meta, ext) == "" {
+		return false
+	}
+
+	// A sidecar is a hex digest, optionally followed by the file name
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1024))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload interrupted"})
+		return true
+	}
+	fields := strings.Fields(string(body))
+
+	// maven-metadata.xml is regenerated by the server, the client's checksum of its own copy doesn't apply
+	if path.Base(target) != mavenMetadataFile {
+		if len(fields) == 0 || !strings.EqualFold(fields[0], mavenChecksum(meta, ext)) {
+			err := fmt.Errorf("%s mismatch for %s", strings.TrimPrefix(ext, "."), target)
+			h.Audit.WithContext(c).Failure(audit.ActionUpload, p, err, "status", "corrupted")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Integrity check failed", "details": err.Error()})
+			return true
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"path": p, "checksum": "verified"})
+	return true
+}
+
+type mavenMetadata struct {
+	XMLName    xml.Name        `xml:"metadata"`
+	GroupID    string          `xml:"groupId"`
+	ArtifactID string          `xml:"artifactId"`
+	Version    string          `xml:"version,omitempty"`
+	Versioning mavenVersioning `xml:"versioning"`
+}
+
+type mavenVersioning struct {
+	Latest           string                 `xml:"latest,omitempty"`
+	Release          string                 `xml:"release,omitempty"`
+	Versions         []string               `xml:"versions>version,omitempty"`
+	Snapshot         *mavenSnapshot         `xml:"snapshot,omitempty"`
+	LastUpdated      string                 `xml:"lastUpdated"`
+	SnapshotVersions []mavenSnapshotVersion `xml:"snapshotVersions>snapshotVersion,omitempty"`
+}
+
+type mavenSnapshot struct {
+	Timestamp   string `xml:"timestamp"`
+	BuildNumber int    `xml:"buildNumber"`
+}
+
+type mavenSnapshotVersion struct {
+	Classifier string `xml:"classifier,omitempty"`
+	Extension  string `xml:"extension"`
+	Value      string `xml:"value"`
+	Updated    string `xml:"updated"`
+}
+
+const mavenTimeFormat = "20060102150405"
+
+// mavenCoordinates splits a path in a Maven repository into its artifact and version directory,
+// e.g. /m2/org/acme/app/1.0/app-1.0.jar -> /m2/org/acme/app, /m2/org/acme/app/1.0
+func mavenCoordinates(root, p string) (artifactDir, versionDir string, ok bool) {
+	rel := strings.Trim(strings.TrimPrefix(p, root), "/")
+	segments := strings.Split(rel, "/")
+	// at least one group segment, artifact, version and file
+	if len(segments) < 4 {
+		return "", "", false
+	}
+
+	versionDir = path.Dir(p)
+	artifactDir = path.Dir(versionDir)
+	if !isMavenArtifactFile(path.Base(artifactDir), path.Base(versionDir), path.Base(p)) {
+		return "", "", false
+	}
+	return artifactDir, versionDir, true
+}
+
+// isMavenArtifactFile reports if name is a file of the given artifact version (pom, jar, sources, ...)
+func isMavenArtifactFile(artifactID, version, name string) bool {
+	if isMavenChecksum(name) || strings.HasPrefix(name, mavenMetadataFile) {
+		return false
+	}
+	return strings.HasPrefix(name, artifactID+"-"+strings.TrimSuffix(version, "-SNAPSHOT"))
+}
+
+// hasGroup reports if dir lies deep enough below root to be an artifact directory (group + artifact)
+func hasGroup(root, dir string) bool {
+	rel := strings.Trim(strings.TrimPrefix(dir, root), "/")
+	return strings.Count(rel, "/") >= 1
+}
+
+// updateMavenMetadata regenerates maven-metadata.xml of the artifacts and snapshot versions touched by paths
+func (h *Handler) updateMavenMetadata(paths ...string) {
+	artifactDirs := make(map[string]string) // dir -> repository root
+	snapshotDirs := make(map[string]string)
+
+	for _, p := range paths {
+		root, ok := h.Config.MavenRepo(p)
+		if !ok {
+			continue
+		}
+
+		name := path.Base(p)
+		switch {
+		case name == mavenMetadataFile:
+			// uploaded by the client, replace it with ours
+			dir := path.Dir(p)
+			if strings.HasSuffix(dir, "-SNAPSHOT") && hasGroup(root, path.Dir(dir)) {
+				snapshotDirs[dir] = root
+				artifactDirs[path.Dir(dir)] = root
+			} else if hasGroup(root, dir) {
+				artifactDirs[dir] = root
+			}
+		case isMavenChecksum(name):
+		default:
+			if artifactDir, versionDir, ok := mavenCoordinates(root, p); ok {
+				artifactDirs[artifactDir] = root
+				if strings.HasSuffix(versionDir, "-SNAPSHOT") {
+					snapshotDirs[versionDir] = root
+				}
+				continue
+			}
+			// a removed version directory
+			parent := path.Dir(p)
+			if _, err := h.Storage.Stat(path.Join(parent, mavenMetadataFile)); err == nil && hasGroup(root, parent) {
+				artifactDirs[parent] = root
+			}
+		}
+	}
+
+	for dir, root := range snapshotDirs {
+		if err := h.writeSnapshotMetadata(root, dir); err != nil {
+			h.Log.WithError(err).Errorf("Maven: failed to update metadata of %s", dir)
+		}
+	}
+	for dir, root := range artifactDirs {
+		if err := h.writeArtifactMetadata(root, dir); err != nil {
+			h.Log.WithError(err).Errorf("Maven: failed to update metadata of %s", dir)
+		}
+	}
+}
+
+func mavenGroupID(root, artifactDir string) string {
+	rel := strings.Trim(strings.TrimPrefix(path.Dir(artifactDir), root), "/")
+	return strings.ReplaceAll(rel, "/", ".")
+}
+
+// writeArtifactMetadata writes <artifact>/maven-metadata.xml listing all versions
+func (h *Handler) writeArtifactMetadata(root, dir string) error {
+	metadataPath := path.Join(dir, mavenMetadataFile)
+	artifactID := path.Base(dir)
+
+	children, err := h.Storage.List(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var versions []string
+	for _, child := range children {
+		if !child.IsDir() {
+			continue
+		}
+		files, err := h.Storage.List(path.Join(dir, child.Name()))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if !f.IsDir() && isMavenArtifactFile(artifactID, child.Name(), f.Name()) {
+				versions = append(versions, child.Name())
+				break
+			}
+		}
+	}
+
+	if len(versions) == 0 {
+		return h.removeFile(metadataPath)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return compareMavenVersions(versions[i], versions[j]) < 0 })
+	md := mavenMetadata{
+		GroupID:    mavenGroupID(root, dir),
+		ArtifactID: artifactID,
+		Versioning: mavenVersioning{
+			Latest:      versions[len(versions)-1],
+			Versions:    versions,
+			LastUpdated: time.Now().UTC().Format(mavenTimeFormat),
+		},
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !strings.HasSuffix(versions[i], "-SNAPSHOT") {
+			md.Versioning.Release = versions[i]
+			break
+		}
+	}
+	return h.writeMavenMetadata(metadataPath, md)
+}
+
+// writeSnapshotMetadata writes <artifact>/<version>-SNAPSHOT/maven-metadata.xml
+// with the latest timestamped build of every classifier and extension.
+func (h *Handler) writeSnapshotMetadata(root, dir string) error {
+	metadataPath := path.Join(dir, mavenMetadataFile)
+	version := path.Base(dir)
+	artifactDir := path.Dir(dir)
+	artifactID := path.Base(artifactDir)
+	base := strings.TrimSuffix(version, "-SNAPSHOT")
+
+	files, err := h.Storage.List(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// artifactId-1.0-20240101.120000-3[-classifier].ext
+	re := regexp.MustCompile(`^` + regexp.QuoteMeta(artifactID+"-"+base) + `-(\d{8}\.\d{6})-(\d+)(.*)$`)
+
+	latest := make(map[string]mavenSnapshotVersion) // classifier:extension -> newest build
+	builds := make(map[string]int)
+	var snapshot *mavenSnapshot
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !isMavenArtifactFile(artifactID, version, name) {
+			continue
+		}
+
+		var sv mavenSnapshotVersion
+		var build int
+		if m := re.FindStringSubmatch(name); m != nil {
+			build, _ = strconv.Atoi(m[2])
+			sv.Value = base + "-" + m[1] + "-" + m[2]
+			sv.Updated = strings.Replace(m[1], ".", "", 1)
+			sv.Classifier, sv.Extension = splitClassifier(m[3])
+			if snapshot == nil || build > snapshot.BuildNumber {
+				snapshot = &mavenSnapshot{Timestamp: m[1], BuildNumber: build}
+			}
+		} else {
+			// non-unique snapshot, e.g. app-1.0-SNAPSHOT.jar
+			sv.Value = version
+			sv.Updated = f.ModTime().UTC().Format(mavenTimeFormat)
+			sv.Classifier, sv.Extension = splitClassifier(strings.TrimPrefix(name, artifactID+"-"+version))
+		}
+		if sv.Extension == "" {
+			continue
+		}
+
+		key := sv.Classifier + ":" + sv.Extension
+		if prev, ok := builds[key]; !ok || build >= prev {
+			builds[key] = build
+			latest[key] = sv
+		}
+	}
+
+	if len(latest) == 0 {
+		return h.removeFile(metadataPath)
+	}
+
+	md := mavenMetadata{
+		GroupID:    mavenGroupID(root, artifactDir),
+		ArtifactID: artifactID,
+		Version:    version,
+		Versioning: mavenVersioning{
+			Snapshot:    snapshot,
+			LastUpdated: time.Now().UTC().Format(mavenTimeFormat),
+		},
+	}
+	keys := make([]string, 0, len(latest))
+	for k := range latest {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		md.Versioning.SnapshotVersions = append(md.Versioning.SnapshotVersions, latest[k])
+	}
+	return h.writeMavenMetadata(metadataPath, md)
+}
+
+// splitClassifier splits the rest of a file name after the version, e.g. "-sources.jar" -> sources, jar
+func splitClassifier(rest string) (classifier, extension string) {
+	if strings.HasPrefix(rest, "-") {
+		classifier, rest, _ = strings.Cut(rest[1:], ".")
+		return classifier, rest
+	}
+	return "", strings.TrimPrefix(rest, ".")
+}
+
+func (h *Handler) writeMavenMetadata(p string, md mavenMetadata) error {
+	data, err := xml.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), append(data, '\n')...)
+	return h.writeGeneratedFile(p, "text/xml", data)
+}
+
+// compareMavenVersions orders versions like Maven's ComparableVersion (simplified):
+// numbers numerically, and qualifiers alpha < beta < milestone < rc < snapshot < release < sp.
+func compareMavenVersions(a, b string) int {
+	ta, tb := tokenizeMavenVersion(a), tokenizeMavenVersion(b)
+	for i := 0; i < len(ta) || i < len(tb); i++ {
+		x, y := mavenPadding(tb, i), mavenPadding(ta, i)
+		if i < len(ta) {
+			x = ta[i]
+		}
+		if i < len(tb) {
+			y = tb[i]
+		}
+		if c := x.compare(y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+type mavenToken struct {
+	isNum bool
+	num   int64
+	str   string
+}
+
+// mavenPadding is the neutral token compared against a missing one: 0 for numbers, release for qualifiers
+func mavenPadding(other []mavenToken, i int) mavenToken {
+	if i < len(other) && other[i].isNum {
+		return mavenToken{isNum: true}
+	}
+	return mavenToken{}
+}
+
+var mavenQualifiers = map[string]int{
+	"alpha":     0,
+	"a":         0,
+	"beta":      1,
+	"b":         1,
+	"milestone": 2,
+	"m":         2,
+	"rc":        3,
+	"cr":        3,
+	"snapshot":  4,
+	"":          5,
+	"ga":        5,
+	"final":     5,
+	"release":   5,
+	"sp":        6,
+}
+
+func (t mavenToken) rank() int {
+	if r, ok := mavenQualifiers[t.str]; ok {
+		return r
+	}
+	return 7 // unknown qualifiers sort after the known ones
+}
+
+func (t mavenToken) compare(o mavenToken) int {
+	switch {
+	case t.isNum && o.isNum:
+		if t.num < o.num {
+			return -1
+		} else if t.num > o.num {
+			return 1
+		}
+		return 0
+	case t.isNum:
+		return 1
+	case o.isNum:
+		return -1
+	}
+	if r1, r2 := t.rank(), o.rank(); r1 != r2 {
+		if r1 < r2 {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(t.str, o.str)
+}
+
+func tokenizeMavenVersion(v string) []mavenToken {
+	var tokens []mavenToken
+	var cur []rune
+	flush := func() {
+		if len(cur) == 0 {
+			return
+		}
+		s := string(cur)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			tokens = append(tokens, mavenToken{isNum: true, num: n})
+		} else {
+			tokens = append(tokens, mavenToken{str: s})
+		}
+		cur = cur[:0]
+	}
+
+	for _, r := range strings.ToLower(v) {
+		if r == '.' || r == '-' || r == '_' {
+			flush()
+			continue
+		}
+		if len(cur) > 0 && unicode.IsDigit(cur[len(cur)-1]) != unicode.IsDigit(r) {
+			flush()
+		}
+		cur = append(cur, r)
+	}
+	flush()
+	return tokens
+}
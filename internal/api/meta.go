@@ -1,18 +1,44 @@
 package api
 
 import (
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/kovi/yaar/internal/audit"
 	"github.com/kovi/yaar/internal/config"
+	"github.com/kovi/yaar/internal/storage"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
 type Handler struct {
-	BaseDir string
+	BaseDir string          // Local directory for internal state (see systemDir), and the tree itself with the fs backend
+	Storage storage.Backend // Holds the artifact tree
 	DB      *gorm.DB
 	Config  *config.Config
 	Log     *logrus.Entry
 	Audit   *audit.Auditor
+
+	uploadLocksMu sync.Mutex
+	uploadLocks   map[string]*uploadLock // upload session id -> lock, while requests use it
+	indexMu       sync.Mutex             // serializes the regeneration of index files
+
+	changesMu      sync.Mutex
+	pendingChanges []string    // changed paths waiting for their index files to be regenerated
+	regenerating   []string    // changed paths whose index files are being regenerated
+	indexTimer     *time.Timer // runs regenerateIndexes once indexDelay is over
+
+	remoteMu      sync.Mutex
+	remoteFetches map[string]*remoteFetch // path -> fetch from a remote in progress
+
+	goPublishMu  sync.Mutex
+	goPublishing map[string]bool // .info path -> Go module version being published
+
+	virtualMu   sync.Mutex
+	virtualHits map[string]string // path below a virtual repository -> path it was found at
+
+	lfsLockMu sync.Mutex // serializes creating and releasing Git LFS locks
 }
 
 func (h *Handler) GetFileMeta(path string) (*MetaResource, error) {
@@ -31,3 +57,25 @@ func (h *Handler) GetFileMeta(path string) (*MetaResource, error) {
 
 	return &res, nil
 }
+
+// likeEscaper escapes the wildcards of LIKE, for patterns with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// filesUnder returns the file records below dir, which ends with a slash, ordered by path
+func (h *Handler) filesUnder(dir string) ([]MetaResource, error) {
+	var candidates []MetaResource
+	err := h.DB.Preload("Tags").
+		Where(`path LIKE ? ESCAPE '\' AND type = ?`, likeEscaper.Replace(dir)+"%", ResourceTypeFile).
+		Order("path").Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+	// LIKE ignores the case of ASCII letters
+	files := candidates[:0]
+	for _, r := range candidates {
+		if strings.HasPrefix(r.Path, dir) {
+			files = append(files, r)
+		}
+	}
+	return files, nil
+}
@@ -11,8 +11,12 @@ func AutoMigrate(db *gorm.DB) error {
 	return db.AutoMigrate(
 		&MetaResource{},
 		&MetaTag{},
+		&UploadSession{},
 		&models.User{},
 		&models.Token{},
+		&models.TokenPermission{},
+		&models.Group{},
+		&models.RoleBinding{},
 	)
 }
 
@@ -78,6 +82,26 @@ type MetaTag struct {
 	Value      string `gorm:"size:255" json:"value"`
 }
 
+// UploadSession tracks the state of a resumable upload.
+// The received bytes are kept in the system directory until the session is finalized.
+type UploadSession struct {
+	ID          string `gorm:"primaryKey" json:"id"`
+	Kind        string `gorm:"type:text;index" json:"-"` // "" for /_/api/v1/uploads, "oci" for registry blob uploads
+	Path        string `gorm:"type:text;not null" json:"path"`
+	UserID      uint   `gorm:"index" json:"-"`
+	ContentType string `gorm:"type:text" json:"contenttype,omitempty"`
+	Size        int64  `json:"size,omitempty"` // Declared total size, 0 if unknown
+	Offset      int64  `json:"offset"`         // Bytes received so far
+
+	// Serialized hasher state, so checksums don't need a re-read on finalize
+	MD5State    []byte `json:"-"`
+	SHA1State   []byte `json:"-"`
+	SHA256State []byte `json:"-"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `gorm:"index" json:"updated_at"`
+}
+
 type MetaPatchRequest struct {
 	ExpiresAt   *string `json:"expires_at"`
 	Tags        *string `json:"tags"`
@@ -0,0 +1,757 @@
+package api
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/audit"
+	"github.com/kovi/yaar/internal/auth"
+	"gorm.io/gorm"
+)
+
+// npm registries keep every package (<name> may be @scope/pkg) below <prefix>/<name>/-/:
+//
+//	<pkg>-<version>.tgz  tarballs, in stream <name> group <version>
+//	packument.json       the package document, generated from the tarballs
+//
+// A version is a group of stream <name>, so the versions of a package are the groups of its stream.
+// The stream model has no named pointers to a group, so a dist-tag is recorded as npm-dist-tag tag on
+// the files of the group it points to. latest defaults to the newest group, like KeepLatest sees it.
+const (
+	npmPackumentFile = "packument.json"
+	npmDistTagKey    = "npm-dist-tag"
+)
+
+var npmNameRe = regexp.MustCompile(`^(@[a-z0-9-~][a-z0-9-._~]*/)?[a-z0-9-~][a-z0-9-._~]*$`)
+
+type npmRequest struct {
+	root string
+	name string   // package name, "" for registry level endpoints (/-/...)
+	rest []string // path segments after the name
+}
+
+func (r npmRequest) packageDir() string {
+	return path.Join(r.root, r.name)
+}
+
+func (r npmRequest) packumentPath() string {
+	return path.Join(r.root, r.name, "-", npmPackumentFile)
+}
+
+// splitNPMName takes the package name from the start of segs, scoped names span two segments
+func splitNPMName(segs []string) (string, []string, bool) {
+	n := 1
+	if strings.HasPrefix(segs[0], "@") {
+		n = 2
+	}
+	if len(segs) < n {
+		return "", nil, false
+	}
+	name := strings.Join(segs[:n], "/")
+	return name, segs[n:], npmNameRe.MatchString(name)
+}
+
+// parseNPMRequest splits a path below an npm registry into package name and the rest
+func (h *Handler) parseNPMRequest(p string) (npmRequest, bool) {
+	root, ok := h.Config.NPMRepo(p)
+	if !ok {
+		return npmRequest{}, false
+	}
+	r := npmRequest{root: root}
+	rel := strings.Trim(strings.TrimPrefix(p, root), "/")
+	if rel == "" {
+		return r, false
+	}
+
+	segs := strings.Split(rel, "/")
+	if segs[0] == "-" {
+		r.rest = segs
+		return r, true
+	}
+	r.name, r.rest, ok = splitNPMName(segs)
+	return r, ok
+}
+
+// requestBaseURL is the scheme and host the client used to reach us
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// HandleNPM serves the npm registry API below the npm.paths prefixes.
+// Returns false if the request is not an npm endpoint, e.g. a tarball download.
+func (h *Handler) HandleNPM(c *gin.Context) bool {
+	r, ok := h.parseNPMRequest(dbPath(c.Request.URL.Path))
+	if !ok {
+		return false
+	}
+	method := c.Request.Method
+
+	if r.name == "" {
+		switch {
+		case len(r.rest) == 2 && r.rest[1] == "ping" && method == http.MethodGet:
+			c.JSON(http.StatusOK, gin.H{})
+		case len(r.rest) == 2 && r.rest[1] == "whoami" && method == http.MethodGet:
+			if auth.EnsureAuth(c) {
+				c.JSON(http.StatusOK, gin.H{"username": c.GetString("username")})
+			}
+		case len(r.rest) > 3 && r.rest[1] == "package":
+			// /-/package/<name>/dist-tags[/<tag>]
+			name, rest, ok := splitNPMName(r.rest[2:])
+			if !ok || len(rest) == 0 || len(rest) > 2 || rest[0] != "dist-tags" {
+				return false
+			}
+			r.name = name
+			tag := ""
+			if len(rest) == 2 {
+				tag = rest[1]
+			}
+			h.npmDistTags(c, r, tag)
+		default:
+			return false
+		}
+		return true
+	}
+
+	switch {
+	case len(r.rest) == 0 && (method == http.MethodGet || method == http.MethodHead):
+		h.npmGetPackument(c, r)
+	case len(r.rest) == 0 && method == http.MethodPut:
+		if auth.EnsureAuth(c) {
+			h.npmPublish(c, r)
+		}
+	case len(r.rest) == 2 && r.rest[0] == "-rev" && method == http.MethodPut:
+		if auth.EnsureAuth(c) {
+			h.npmUpdatePackument(c, r)
+		}
+	case len(r.rest) == 2 && r.rest[0] == "-rev" && method == http.MethodDelete:
+		if auth.EnsureAuth(c) {
+			h.npmUnpublishPackage(c, r)
+		}
+	case len(r.rest) == 4 && r.rest[0] == "-" && r.rest[2] == "-rev" && method == http.MethodDelete:
+		if auth.EnsureAuth(c) {
+			h.npmUnpublishTarball(c, r, path.Join(r.packageDir(), "-", r.rest[1]))
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+/* ===================== PACKUMENT ===================== */
+
+// npmPackument is the package document. Versions hold the package.json of each tarball plus dist.
+type npmPackument struct {
+	ID          string                    `json:"_id"`
+	Rev         string                    `json:"_rev"`
+	Name        string                    `json:"name"`
+	Description string                    `json:"description,omitempty"`
+	DistTags    map[string]string         `json:"dist-tags"`
+	Versions    map[string]map[string]any `json:"versions"`
+	Time        map[string]string         `json:"time"`
+}
+
+// npmDist returns the dist field of a version
+func npmDist(version map[string]any) map[string]any {
+	dist, _ := version["dist"].(map[string]any)
+	return dist
+}
+
+func (h *Handler) readNPMPackument(p string) (*npmPackument, error) {
+	f, err := h.Storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var doc npmPackument
+	if err := json.NewDecoder(f).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// npmGetPackument handles GET /<name>, with absolute tarball URLs for this host
+func (h *Handler) npmGetPackument(c *gin.Context, r npmRequest) {
+	p := r.packumentPath()
+	if !h.canRead(c, p) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	doc, err := h.readNPMPackument(p)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	base := requestBaseURL(c)
+	for _, v := range doc.Versions {
+		if dist := npmDist(v); dist != nil {
+			if tarball, ok := dist["tarball"].(string); ok {
+				dist["tarball"] = base + (&url.URL{Path: tarball}).EscapedPath()
+			}
+		}
+	}
+	c.JSON(http.StatusOK, doc)
+}
+
+// npmTarballs returns the records of the published versions of a package: the tarballs in its stream
+func (h *Handler) npmTarballs(r npmRequest) ([]MetaResource, error) {
+	dir := path.Join(r.packageDir(), "-") + "/"
+	candidates, err := h.filesUnder(dir)
+	if err != nil {
+		return nil, err
+	}
+	var tarballs []MetaResource
+	for _, t := range candidates {
+		if t.Stream == nil || *t.Stream != r.name || t.Group == nil || *t.Group == "" {
+			continue
+		}
+		if name := strings.TrimPrefix(t.Path, dir); !strings.Contains(name, "/") && strings.HasSuffix(name, ".tgz") {
+			tarballs = append(tarballs, t)
+		}
+	}
+	return tarballs, nil
+}
+
+// updateNPMPackuments regenerates the packuments of the packages the changed paths belong to
+func (h *Handler) updateNPMPackuments(paths ...string) {
+	packages := make(map[string]npmRequest)
+	for _, p := range paths {
+		r, ok := h.parseNPMRequest(p)
+		if !ok || r.name == "" || path.Base(p) == npmPackumentFile {
+			continue
+		}
+		packages[r.packageDir()] = r
+	}
+
+	for dir, r := range packages {
+		if err := h.writeNPMPackument(r); err != nil {
+			h.Log.WithError(err).Errorf("npm: failed to update packument of %s", dir)
+		}
+	}
+}
+
+func (h *Handler) writeNPMPackument(r npmRequest) error {
+	tarballs, err := h.npmTarballs(r)
+	if err != nil {
+		return err
+	}
+	p := r.packumentPath()
+	if len(tarballs) == 0 {
+		return h.removeFile(p)
+	}
+
+	// Reading a tarball is expensive, reuse the versions of unchanged ones
+	cached := make(map[string]map[string]any)
+	if old, err := h.readNPMPackument(p); err == nil {
+		for _, v := range old.Versions {
+			if dist := npmDist(v); dist != nil {
+				if tarball, ok := dist["tarball"].(string); ok {
+					cached[tarball] = v
+				}
+			}
+		}
+	}
+
+	doc := npmPackument{
+		ID:       r.name,
+		Name:     r.name,
+		DistTags: make(map[string]string),
+		Versions: make(map[string]map[string]any),
+		Time:     make(map[string]string),
+	}
+	var created, modified time.Time
+	var newest MetaResource
+	for _, t := range tarballs {
+		v, ok := cached[t.Path]
+		if dist := npmDist(v); !ok || dist == nil || dist["shasum"] != t.SHA1 {
+			if v, err = h.readNPMVersion(r.name, t); err != nil {
+				h.Log.WithError(err).Warnf("npm: skipping %s", t.Path)
+				continue
+			}
+		}
+		version := *t.Group
+		if v["version"] != version {
+			h.Log.Warnf("npm: skipping %s, it is version %v but in group %s", t.Path, v["version"], version)
+			continue
+		}
+		doc.Versions[version] = v
+		doc.Time[version] = t.ModTime.UTC().Format(time.RFC3339)
+		if created.IsZero() || t.ModTime.Before(created) {
+			created = t.ModTime
+		}
+		if t.ModTime.After(modified) {
+			modified = t.ModTime
+		}
+		if newest.ID == 0 || t.CreatedAt.After(newest.CreatedAt) {
+			newest = t
+		}
+		for _, tag := range t.Tags {
+			if tag.Key == npmDistTagKey {
+				doc.DistTags[tag.Value] = version
+			}
+		}
+	}
+	if len(doc.Versions) == 0 {
+		return h.removeFile(p)
+	}
+	doc.Time["created"] = created.UTC().Format(time.RFC3339)
+	doc.Time["modified"] = modified.UTC().Format(time.RFC3339)
+
+	if _, ok := doc.DistTags["latest"]; !ok {
+		doc.DistTags["latest"] = *newest.Group
+	}
+	if description, ok := doc.Versions[doc.DistTags["latest"]]["description"].(string); ok {
+		doc.Description = description
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(data)
+	doc.Rev = fmt.Sprintf("%d-%s", len(doc.Versions), hex.EncodeToString(sum[:8]))
+	if data, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	return h.writeGeneratedFile(p, "application/json", data)
+}
+
+// readNPMVersion builds the version entry of a tarball from its package.json and checksums
+func (h *Handler) readNPMVersion(name string, t MetaResource) (map[string]any, error) {
+	f, err := h.Storage.Open(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sha := sha512.New()
+	in := io.TeeReader(f, sha)
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	var pkg map[string]any
+	for pkg == nil {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("package.json not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the package usually sits in package/, but any top level directory is fine
+		dir, file := path.Split(strings.TrimPrefix(hdr.Name, "./"))
+		if file == "package.json" && strings.Count(dir, "/") == 1 {
+			if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(&pkg); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, err := io.Copy(io.Discard, in); err != nil {
+		return nil, err
+	}
+
+	version, _ := pkg["version"].(string)
+	if version == "" {
+		return nil, errors.New("package.json has no version")
+	}
+	if pkg["name"] != name {
+		return nil, fmt.Errorf("package.json is for %v", pkg["name"])
+	}
+	pkg["_id"] = name + "@" + version
+	pkg["dist"] = map[string]any{
+		"shasum":    t.SHA1,
+		"integrity": "sha512-" + base64.StdEncoding.EncodeToString(sha.Sum(nil)),
+		"tarball":   t.Path,
+	}
+	return pkg, nil
+}
+
+func npmIsPrerelease(v string) bool {
+	v, _, _ = strings.Cut(v, "+")
+	return strings.Contains(v, "-")
+}
+
+// compareSemver orders versions by semver precedence
+func compareSemver(a, b string) int {
+	a, _, _ = strings.Cut(a, "+")
+	b, _, _ = strings.Cut(b, "+")
+	aCore, aPre, aHasPre := strings.Cut(a, "-")
+	bCore, bPre, bHasPre := strings.Cut(b, "-")
+
+	if c := compareDotted(aCore, bCore, true); c != 0 {
+		return c
+	}
+	switch {
+	case aHasPre && !bHasPre:
+		return -1
+	case !aHasPre && bHasPre:
+		return 1
+	}
+	return compareDotted(aPre, bPre, false)
+}
+
+// compareDotted compares dot separated identifiers, numeric ones by value.
+// With numericOnly, non numeric identifiers count as 0.
+func compareDotted(a, b string, numericOnly bool) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		if i >= len(as) {
+			return -1
+		}
+		if i >= len(bs) {
+			return 1
+		}
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case numericOnly || aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			return -1 // numeric identifiers have lower precedence
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+/* ===================== PUBLISH ===================== */
+
+type npmPublishDoc struct {
+	Name     string            `json:"name"`
+	DistTags map[string]string `json:"dist-tags"`
+	Versions map[string]struct {
+		Dist struct {
+			Shasum    string `json:"shasum"`
+			Integrity string `json:"integrity"`
+		} `json:"dist"`
+	} `json:"versions"`
+	Attachments map[string]struct {
+		Data   string `json:"data"`
+		Length int64  `json:"length"`
+	} `json:"_attachments"`
+}
+
+// npmPublish handles PUT /<name> sent by npm publish: one version with its tarball attached.
+// Published versions can't be overwritten.
+func (h *Handler) npmPublish(c *gin.Context, r npmRequest) {
+	scopes := c.GetStringSlice("allowed_paths")
+	// base64 makes the attachment a third larger
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.Config.Storage.MaxUploadSizeBytes/3*4+1<<20)
+
+	var doc npmPublishDoc
+	if err := json.NewDecoder(c.Request.Body).Decode(&doc); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File content exceeded limit"})
+			return
+		}
+		c.JSON(400, gin.H{"error": "Invalid package document"})
+		return
+	}
+	if doc.Name != r.name {
+		c.JSON(400, gin.H{"error": "Package name does not match the URL"})
+		return
+	}
+	if len(doc.Versions) != 1 || len(doc.Attachments) != 1 {
+		c.JSON(400, gin.H{"error": "Exactly one version with its tarball must be published"})
+		return
+	}
+
+	var version string
+	for v := range doc.Versions {
+		version = v
+	}
+	dist := doc.Versions[version].Dist
+	filename := path.Base(r.name) + "-" + version + ".tgz"
+	var data []byte
+	for key, att := range doc.Attachments {
+		if path.Base(key) != filename {
+			c.JSON(400, gin.H{"error": "Attachment does not match the version"})
+			return
+		}
+		var err error
+		data, err = base64.StdEncoding.DecodeString(att.Data)
+		if err != nil || att.Length > 0 && int64(len(data)) != att.Length {
+			c.JSON(400, gin.H{"error": "Invalid attachment"})
+			return
+		}
+	}
+	target := path.Join(r.packageDir(), "-", filename)
+
+	if sum := sha1.Sum(data); dist.Shasum != "" && !strings.EqualFold(dist.Shasum, hex.EncodeToString(sum[:])) {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, errors.New("shasum mismatch"), "status", "corrupted")
+		c.JSON(400, gin.H{"error": "Integrity check failed", "details": "shasum mismatch"})
+		return
+	}
+	if expected, ok := strings.CutPrefix(dist.Integrity, "sha512-"); ok {
+		if sum := sha512.Sum512(data); expected != base64.StdEncoding.EncodeToString(sum[:]) {
+			h.Audit.WithContext(c).Failure(audit.ActionUpload, target, errors.New("integrity mismatch"), "status", "corrupted")
+			c.JSON(400, gin.H{"error": "Integrity check failed", "details": "integrity mismatch"})
+			return
+		}
+	}
+
+	if _, err := h.Storage.Stat(target); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot publish over the previously published version " + version})
+		return
+	}
+	if ok, msg := h.CanModify(target, scopes, ModifyOptions{IgnoreProtected: true, IsUpload: true}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, errors.New(msg))
+		c.JSON(403, gin.H{"error": msg})
+		return
+	}
+
+	res, err := h.storeBytes(target, "application/gzip", data, uploadPolicy{Stream: r.name, Group: version})
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, err)
+		logger(c).WithError(err).Error("db sync failed")
+		c.JSON(500, gin.H{"error": "Database sync failed"})
+		return
+	}
+	for tag, v := range doc.DistTags {
+		if v == version {
+			if err := h.setNPMDistTag(r, tag, version); err != nil {
+				logger(c).WithError(err).Errorf("failed to set dist-tag %s", tag)
+			}
+		}
+	}
+
+	h.Audit.WithContext(c).Success(audit.ActionUpload, target, "size", len(data), "sha256", res.SHA256)
+	h.afterChange(target)
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+/* ===================== DIST-TAGS ===================== */
+
+// setNPMDistTag points tag to the group of version, or removes it if version is empty
+func (h *Handler) setNPMDistTag(r npmRequest, tag, version string) error {
+	tarballs, err := h.npmTarballs(r)
+	if err != nil {
+		return err
+	}
+	ids := make([]uint, 0, len(tarballs))
+	var targetIDs []uint
+	for _, t := range tarballs {
+		ids = append(ids, t.ID)
+		if *t.Group == version {
+			targetIDs = append(targetIDs, t.ID)
+		}
+	}
+	if version != "" && len(targetIDs) == 0 {
+		return fmt.Errorf("%s is not a version of %s", version, r.name)
+	}
+
+	return h.DB.Transaction(func(tx *gorm.DB) error {
+		if len(ids) > 0 {
+			err := tx.Where("`key` = ? AND value = ? AND resource_id IN ?", npmDistTagKey, tag, ids).Delete(&MetaTag{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		for _, id := range targetIDs {
+			if err := tx.Create(&MetaTag{ResourceID: id, Key: npmDistTagKey, Value: tag}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// npmDistTags handles GET /-/package/<name>/dist-tags and PUT/DELETE /-/package/<name>/dist-tags/<tag>
+func (h *Handler) npmDistTags(c *gin.Context, r npmRequest, tag string) {
+	method := c.Request.Method
+	// versions are looked up in the packument, a publish just before must be in it
+	h.awaitIndexes(r.packumentPath())
+	doc, err := h.readNPMPackument(r.packumentPath())
+	if err != nil || !h.canRead(c, r.packumentPath()) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	if method == http.MethodGet && tag == "" {
+		c.JSON(http.StatusOK, doc.DistTags)
+		return
+	}
+	if tag == "" || (method != http.MethodPut && method != http.MethodDelete) {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
+		return
+	}
+	if !auth.EnsureAuth(c) {
+		return
+	}
+
+	version := ""
+	if method == http.MethodPut {
+		if err := c.ShouldBindJSON(&version); err != nil {
+			c.JSON(400, gin.H{"error": "Body must be a version string"})
+			return
+		}
+		if _, ok := doc.Versions[version]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+			return
+		}
+	}
+
+	if ok, msg := h.CanModify(r.packageDir(), c.GetStringSlice("allowed_paths"), ModifyOptions{}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionPatchMeta, r.packageDir(), errors.New(msg))
+		c.JSON(403, gin.H{"error": msg})
+		return
+	}
+	if err := h.setNPMDistTag(r, tag, version); err != nil {
+		logger(c).WithError(err).Error("failed to update dist-tag")
+		c.JSON(500, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.Audit.WithContext(c).Success(audit.ActionPatchMeta, r.packageDir(), "dist_tag", tag, "version", version)
+	h.afterChange(r.packageDir())
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// npmUpdatePackument handles PUT /<name>/-rev/<rev>, which npm unpublish uses to update the dist-tags
+// before it deletes the tarball. Only the dist-tags of the document are applied.
+func (h *Handler) npmUpdatePackument(c *gin.Context, r npmRequest) {
+	var update struct {
+		DistTags map[string]string `json:"dist-tags"`
+	}
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid package document"})
+		return
+	}
+	h.awaitIndexes(r.packumentPath())
+	doc, err := h.readNPMPackument(r.packumentPath())
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	if ok, msg := h.CanModify(r.packageDir(), c.GetStringSlice("allowed_paths"), ModifyOptions{}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionPatchMeta, r.packageDir(), errors.New(msg))
+		c.JSON(403, gin.H{"error": msg})
+		return
+	}
+
+	tags := make([]string, 0, len(doc.DistTags)+len(update.DistTags))
+	for tag := range doc.DistTags {
+		tags = append(tags, tag)
+	}
+	for tag := range update.DistTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		version := update.DistTags[tag]
+		if _, ok := doc.Versions[version]; !ok {
+			version = ""
+		}
+		if err := h.setNPMDistTag(r, tag, version); err != nil {
+			logger(c).WithError(err).Error("failed to update dist-tag")
+			c.JSON(500, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	h.Audit.WithContext(c).Success(audit.ActionPatchMeta, r.packageDir(), "dist_tags", update.DistTags)
+	h.afterChange(r.packageDir())
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+/* ===================== UNPUBLISH ===================== */
+
+// npmUnpublishTarball handles DELETE /<name>/-/<tarball>/-rev/<rev>
+func (h *Handler) npmUnpublishTarball(c *gin.Context, r npmRequest, target string) {
+	if _, err := h.Storage.Stat(target); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	if ok, msg := h.CanModify(target, c.GetStringSlice("delete_paths"), ModifyOptions{}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionDelete, target, errors.New(msg))
+		c.JSON(403, gin.H{"error": msg})
+		return
+	}
+
+	if _, err := h.removeTree(target); err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionDelete, target, err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	h.Audit.WithContext(c).Success(audit.ActionDelete, target)
+	h.afterChange(target)
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// npmUnpublishPackage handles DELETE /<name>/-rev/<rev>, removing the package with all versions
+func (h *Handler) npmUnpublishPackage(c *gin.Context, r npmRequest) {
+	dir := r.packageDir()
+	if _, err := h.Storage.Stat(dir); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	tarballs, err := h.npmTarballs(r)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error"})
+		return
+	}
+
+	// every version must be deletable, e.g. none may be immutable
+	scopes := c.GetStringSlice("delete_paths")
+	for _, p := range append([]string{dir}, pluckPaths(tarballs)...) {
+		if ok, msg := h.CanModify(p, scopes, ModifyOptions{}); !ok {
+			h.Audit.WithContext(c).Failure(audit.ActionDelete, p, errors.New(msg))
+			c.JSON(403, gin.H{"error": msg})
+			return
+		}
+	}
+
+	affectedPaths, err := h.removeTree(dir)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionDelete, dir, err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	h.Audit.WithContext(c).Success(audit.ActionDelete, dir, "deleted_count", len(affectedPaths), "affected_paths", affectedPaths)
+	h.afterChange(dir)
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func pluckPaths(records []MetaResource) []string {
+	paths := make([]string, 0, len(records))
+	for _, r := range records {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
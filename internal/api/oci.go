@@ -0,0 +1,1015 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kovi/yaar/internal/audit"
+	"github.com/kovi/yaar/internal/utils"
+)
+
+// The OCI Distribution API (/v2/) keeps every image repository as a directory below oci.path:
+//
+//	<repo>/_blobs/sha256/<hex>      layers and image configs
+//	<repo>/_manifests/sha256/<hex>  manifests by digest
+//	<repo>/_tags/<tag>              copy of the tagged manifest, in stream <repo>, group <tag>
+//
+// Repository name components can't start with "_", so these never clash with nested repositories.
+const (
+	ociBlobsDir     = "_blobs"
+	ociManifestsDir = "_manifests"
+	ociTagsDir      = "_tags"
+
+	ociMaxManifestSize = 4 << 20
+
+	// ociGCGrace protects blobs and manifests of a push that is still in progress from the garbage collection
+	ociGCGrace = time.Hour
+)
+
+var (
+	ociNameRe   = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	ociTagRe    = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	ociDigestRe = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+	// ociRoutes are tried in order, the repository name may contain slashes
+	ociRoutes = []struct {
+		kind string
+		re   *regexp.Regexp
+	}{
+		{"uploads", regexp.MustCompile(`^/(.+)/blobs/uploads/?$`)},
+		{"upload", regexp.MustCompile(`^/(.+)/blobs/uploads/([^/]+)$`)},
+		{"blob", regexp.MustCompile(`^/(.+)/blobs/([^/]+)$`)},
+		{"manifest", regexp.MustCompile(`^/(.+)/manifests/([^/]+)$`)},
+		{"tags", regexp.MustCompile(`^/(.+)/tags/list$`)},
+	}
+)
+
+// ociDescriptor references a blob or manifest from a manifest
+type ociDescriptor struct {
+	MediaType string   `json:"mediaType"`
+	Digest    string   `json:"digest"`
+	Size      int64    `json:"size"`
+	URLs      []string `json:"urls,omitempty"`
+}
+
+// ociManifest holds the fields of image manifests and image indexes (both OCI and Docker) we care about
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    *ociDescriptor  `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+	Subject   *ociDescriptor  `json:"subject"`
+}
+
+// blobs returns the digests of the blobs the manifest needs. Foreign layers (with urls) are not stored here.
+func (m *ociManifest) blobs() []string {
+	var digests []string
+	if m.Config != nil {
+		digests = append(digests, m.Config.Digest)
+	}
+	for _, l := range m.Layers {
+		if len(l.URLs) == 0 {
+			digests = append(digests, l.Digest)
+		}
+	}
+	return digests
+}
+
+func ociError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"errors": []gin.H{{"code": code, "message": message}}})
+}
+
+func (h *Handler) ociRepoPath(name string) string {
+	return path.Join(h.Config.OCI.Path, name)
+}
+
+func (h *Handler) ociBlobPath(name, digest string) string {
+	return path.Join(h.ociRepoPath(name), ociBlobsDir, "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (h *Handler) ociManifestPath(name, digest string) string {
+	return path.Join(h.ociRepoPath(name), ociManifestsDir, "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (h *Handler) ociTagPath(name, tag string) string {
+	return path.Join(h.ociRepoPath(name), ociTagsDir, tag)
+}
+
+// ociRepoOf returns the repository a path below oci.path belongs to
+func (h *Handler) ociRepoOf(p string) (string, bool) {
+	rel, ok := strings.CutPrefix(p, h.Config.OCI.Path+"/")
+	if !ok {
+		return "", false
+	}
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		switch part {
+		case ociBlobsDir, ociManifestsDir, ociTagsDir:
+			return strings.Join(parts[:i], "/"), i > 0
+		}
+	}
+	return "", false
+}
+
+// ociRange is the Range header of an upload session holding size bytes
+func ociRange(size int64) string {
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+	return fmt.Sprintf("0-%d", end)
+}
+
+// ociAuthorize checks that the caller may upload or delete (action) p. On failure the response is already written.
+func (h *Handler) ociAuthorize(c *gin.Context, p, action string, opts ModifyOptions) bool {
+	if _, ok := c.Get("username"); !ok {
+		c.Header("WWW-Authenticate", `Basic realm="yaar"`)
+		ociError(c, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return false
+	}
+	scopes := c.GetStringSlice("allowed_paths")
+	if action == audit.ActionDelete {
+		scopes = c.GetStringSlice("delete_paths")
+	}
+	if ok, msg := h.CanModify(p, scopes, opts); !ok {
+		h.Audit.WithContext(c).Failure(action, p, errors.New(msg))
+		ociError(c, http.StatusForbidden, "DENIED", msg)
+		return false
+	}
+	return true
+}
+
+// HandleOCI serves the OCI Distribution API under /v2/ when oci.enabled is set
+func (h *Handler) HandleOCI(c *gin.Context) {
+	if !h.Config.OCI.Enabled {
+		h.defaultHandler(c)
+		return
+	}
+	c.Header("Docker-Distribution-API-Version", "registry/2.0")
+
+	p := c.Param("path")
+	method := c.Request.Method
+	switch {
+	case p == "/" && (method == http.MethodGet || method == http.MethodHead):
+		h.ociPing(c)
+		return
+	case p == "/_catalog" && method == http.MethodGet:
+		h.ociCatalog(c)
+		return
+	}
+
+	for _, route := range ociRoutes {
+		m := route.re.FindStringSubmatch(p)
+		if m == nil {
+			continue
+		}
+		name, ref := m[1], ""
+		if len(m) > 2 {
+			ref = m[2]
+		}
+		if !ociNameRe.MatchString(name) {
+			ociError(c, http.StatusBadRequest, "NAME_INVALID", "invalid repository name")
+			return
+		}
+		if !h.canRead(c, h.ociRepoPath(name)) {
+			if _, ok := c.Get("username"); !ok {
+				c.Header("WWW-Authenticate", `Basic realm="yaar"`)
+				ociError(c, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+				return
+			}
+			ociError(c, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+			return
+		}
+
+		switch route.kind + " " + method {
+		case "uploads POST":
+			h.ociStartUpload(c, name)
+		case "upload GET":
+			h.ociUploadStatus(c, name, ref)
+		case "upload PATCH":
+			h.ociPatchUpload(c, name, ref)
+		case "upload PUT":
+			h.ociFinishUpload(c, name, ref)
+		case "upload DELETE":
+			h.ociCancelUpload(c, name, ref)
+		case "blob GET", "blob HEAD":
+			h.ociGetBlob(c, name, ref)
+		case "blob DELETE":
+			h.ociDeleteBlob(c, name, ref)
+		case "manifest GET", "manifest HEAD":
+			h.ociGetManifest(c, name, ref)
+		case "manifest PUT":
+			h.ociPutManifest(c, name, ref)
+		case "manifest DELETE":
+			h.ociDeleteManifest(c, name, ref)
+		case "tags GET":
+			h.ociListTags(c, name)
+		default:
+			ociError(c, http.StatusMethodNotAllowed, "UNSUPPORTED", "the operation is unsupported")
+		}
+		return
+	}
+
+	ociError(c, http.StatusNotFound, "NOT_FOUND", "unknown registry endpoint")
+}
+
+// ociPing answers GET /v2/. Clients like docker log in only if they are challenged here.
+func (h *Handler) ociPing(c *gin.Context) {
+	if _, ok := c.Get("username"); !ok {
+		c.Header("WWW-Authenticate", `Basic realm="yaar"`)
+		ociError(c, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// ociPaginate applies the n and last query parameters of list endpoints to the sorted list
+// and responds with the body built from the remaining page
+func ociPaginate(c *gin.Context, list []string, body func([]string) any) {
+	if last := c.Query("last"); last != "" {
+		i := sort.SearchStrings(list, last)
+		if i < len(list) && list[i] == last {
+			i++
+		}
+		list = list[i:]
+	}
+	if n, err := strconv.Atoi(c.Query("n")); err == nil && n > 0 && n < len(list) {
+		list = list[:n]
+		next := *c.Request.URL
+		q := next.Query()
+		q.Set("last", list[len(list)-1])
+		next.RawQuery = q.Encode()
+		c.Header("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+	}
+	if list == nil {
+		list = []string{}
+	}
+	c.JSON(http.StatusOK, body(list))
+}
+
+// ociCatalog handles GET /v2/_catalog, listing every repository with at least one tag
+func (h *Handler) ociCatalog(c *gin.Context) {
+	var paths []string
+	if err := h.DB.Model(&MetaResource{}).Where("path LIKE ?", h.Config.OCI.Path+"/%/"+ociTagsDir+"/%").Pluck("path", &paths).Error; err != nil {
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "database error")
+		return
+	}
+
+	seen := map[string]bool{}
+	var repos []string
+	for _, p := range paths {
+		name, ok := h.ociRepoOf(p)
+		if !ok || seen[name] || h.ociTagPath(name, path.Base(p)) != p || !h.canRead(c, h.ociRepoPath(name)) {
+			continue
+		}
+		seen[name] = true
+		repos = append(repos, name)
+	}
+	sort.Strings(repos)
+	ociPaginate(c, repos, func(list []string) any { return gin.H{"repositories": list} })
+}
+
+// ociTags returns the tag records of a repository
+func (h *Handler) ociTags(name string) ([]MetaResource, error) {
+	dir := path.Join(h.ociRepoPath(name), ociTagsDir) + "/"
+	candidates, err := h.filesUnder(dir)
+	if err != nil {
+		return nil, err
+	}
+	var tags []MetaResource
+	for _, t := range candidates {
+		// Nested repositories share the prefix
+		if !strings.Contains(strings.TrimPrefix(t.Path, dir), "/") {
+			tags = append(tags, t)
+		}
+	}
+	return tags, nil
+}
+
+// ociListTags handles GET /v2/<name>/tags/list
+func (h *Handler) ociListTags(c *gin.Context, name string) {
+	records, err := h.ociTags(name)
+	if err != nil {
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "database error")
+		return
+	}
+	if len(records) == 0 {
+		ociError(c, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+
+	tags := make([]string, 0, len(records))
+	for _, t := range records {
+		tags = append(tags, path.Base(t.Path))
+	}
+	sort.Strings(tags)
+	ociPaginate(c, tags, func(list []string) any { return gin.H{"name": name, "tags": list} })
+}
+
+/* ===================== BLOBS ===================== */
+
+// storeOCIBlob moves a received local file into the repository as blob, unless it is there already
+func (h *Handler) storeOCIBlob(name, localPath string, size int64, sums fileSums) (string, error) {
+	p := h.ociBlobPath(name, "sha256:"+sums.SHA256)
+	if meta, err := h.GetFileMeta(p); err == nil && meta != nil && meta.SHA256 == sums.SHA256 {
+		os.Remove(localPath)
+		// Pushed again, a manifest referring to it follows
+		return p, h.ociTouch(p)
+	}
+
+	_, err := h.saveUploadMeta(p, "application/octet-stream", size, sums, uploadPolicy{}, localPath)
+	return p, err
+}
+
+// ociReceiveBlob stores a request body as blob and checks it against the expected digest
+func (h *Handler) ociReceiveBlob(c *gin.Context, name, digest string) {
+	out, err := h.createTempFile()
+	if err != nil {
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "failed to store blob")
+		return
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hashes := newHashSet()
+	limit := h.Config.Storage.MaxUploadSizeBytes
+	written, err := io.Copy(io.MultiWriter(out, hashes), io.LimitReader(c.Request.Body, limit+1))
+	if err != nil {
+		ociError(c, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", "failed to read the blob")
+		return
+	}
+	if written > limit {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, h.ociRepoPath(name), errors.New("file content exceeded limit"))
+		ociError(c, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "blob exceeds the upload size limit")
+		return
+	}
+	out.Close()
+
+	h.ociCommitBlob(c, name, digest, out.Name(), written, hashes.Sums())
+}
+
+// ociCommitBlob verifies and stores a completely received blob and writes the response
+func (h *Handler) ociCommitBlob(c *gin.Context, name, digest, localPath string, size int64, sums fileSums) {
+	if digest != "sha256:"+sums.SHA256 {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, h.ociRepoPath(name), errors.New("digest mismatch"), "digest", digest, "actual", "sha256:"+sums.SHA256)
+		ociError(c, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+		return
+	}
+
+	p, err := h.storeOCIBlob(name, localPath, size, sums)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, p, err)
+		logger(c).WithError(err).Error("failed to store blob")
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "failed to store blob")
+		return
+	}
+
+	h.Audit.WithContext(c).Success(audit.ActionUpload, p, "size", size, "digest", digest)
+	c.Header("Location", "/v2/"+name+"/blobs/"+digest)
+	c.Header("Docker-Content-Digest", digest)
+	c.Status(http.StatusCreated)
+}
+
+// ociMountBlob copies a blob from another repository. Returns false if the source blob doesn't exist.
+func (h *Handler) ociMountBlob(c *gin.Context, name, from, digest string) bool {
+	if !ociNameRe.MatchString(from) || !ociDigestRe.MatchString(digest) || !h.canRead(c, h.ociRepoPath(from)) {
+		return false
+	}
+	src := h.ociBlobPath(from, digest)
+	meta, err := h.GetFileMeta(src)
+	if err != nil || meta == nil {
+		return false
+	}
+	in, err := h.Storage.Open(src)
+	if err != nil {
+		return false
+	}
+	defer in.Close()
+
+	out, err := h.createTempFile()
+	if err != nil {
+		return false
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hashes := newHashSet()
+	written, err := io.Copy(io.MultiWriter(out, hashes), in)
+	if err != nil || out.Close() != nil {
+		return false
+	}
+
+	h.ociCommitBlob(c, name, digest, out.Name(), written, hashes.Sums())
+	return true
+}
+
+// ociStartUpload handles POST /v2/<name>/blobs/uploads/
+// Supports monolithic uploads (?digest=), cross repository mounts (?mount=&from=) and starts chunked uploads otherwise.
+func (h *Handler) ociStartUpload(c *gin.Context, name string) {
+	repoPath := h.ociRepoPath(name)
+	if !h.ociAuthorize(c, repoPath, audit.ActionUpload, ModifyOptions{IgnoreProtected: true, IsUpload: true}) {
+		return
+	}
+
+	if mount := c.Query("mount"); mount != "" && h.ociMountBlob(c, name, c.Query("from"), mount) {
+		return
+	}
+
+	if digest := c.Query("digest"); digest != "" {
+		if !ociDigestRe.MatchString(digest) {
+			ociError(c, http.StatusBadRequest, "DIGEST_INVALID", "unsupported digest")
+			return
+		}
+		h.ociReceiveBlob(c, name, digest)
+		return
+	}
+
+	s := UploadSession{
+		ID:     uuid.New().String(),
+		Kind:   "oci",
+		Path:   repoPath,
+		UserID: c.GetUint("user_id"),
+	}
+	dataPath := h.uploadDataPath(s.ID)
+	os.MkdirAll(filepath.Dir(dataPath), 0755)
+	f, err := os.Create(dataPath)
+	if err != nil {
+		logger(c).WithError(err).Error("failed to create upload session file")
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "failed to create upload session")
+		return
+	}
+	f.Close()
+	if err := h.DB.Create(&s).Error; err != nil {
+		os.Remove(dataPath)
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "failed to create upload session")
+		return
+	}
+
+	h.ociUploadHeaders(c, name, &s)
+	c.Status(http.StatusAccepted)
+}
+
+func (h *Handler) ociUploadHeaders(c *gin.Context, name string, s *UploadSession) {
+	c.Header("Location", "/v2/"+name+"/blobs/uploads/"+s.ID)
+	c.Header("Docker-Upload-UUID", s.ID)
+	c.Header("Range", ociRange(s.Offset))
+}
+
+// ociLoadUpload fetches a blob upload session of the caller. On failure the response is already written.
+func (h *Handler) ociLoadUpload(c *gin.Context, name, id string) (*UploadSession, bool) {
+	var s UploadSession
+	r := h.DB.Where("id = ? AND kind = ? AND path = ?", id, "oci", h.ociRepoPath(name)).Limit(1).Find(&s)
+	if r.Error != nil {
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "database error")
+		return nil, false
+	}
+	if r.RowsAffected == 0 || s.UserID != c.GetUint("user_id") {
+		ociError(c, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+		return nil, false
+	}
+	return &s, true
+}
+
+// ociAppend adds the request body to the session. On failure the response is already written.
+func (h *Handler) ociAppend(c *gin.Context, name string, s *UploadSession) bool {
+	log := logger(c).WithField("session", s.ID)
+
+	if cr := strings.TrimPrefix(c.GetHeader("Content-Range"), "bytes "); cr != "" {
+		start, _, _ := strings.Cut(cr, "-")
+		if offset, err := strconv.ParseInt(start, 10, 64); err != nil || offset != s.Offset {
+			h.ociUploadHeaders(c, name, s)
+			ociError(c, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "content range does not match the upload offset")
+			return false
+		}
+	}
+
+	hashes, err := restoreHashSet(s.MD5State, s.SHA1State, s.SHA256State)
+	if err != nil {
+		log.WithError(err).Error("failed to restore hash state")
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "corrupted upload session")
+		return false
+	}
+
+	f, err := h.openUploadData(s)
+	if err != nil {
+		log.WithError(err).Error("failed to open upload session file")
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "corrupted upload session")
+		return false
+	}
+	defer f.Close()
+
+	limit := h.Config.Storage.MaxUploadSizeBytes - s.Offset
+	written, copyErr := io.Copy(io.MultiWriter(f, hashes), io.LimitReader(c.Request.Body, limit+1))
+	if written > limit {
+		if err := f.Truncate(s.Offset); err != nil {
+			log.WithError(err).Warn("failed to truncate upload session file")
+		}
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, s.Path, errors.New("file content exceeded limit"), "session", s.ID)
+		ociError(c, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "blob exceeds the upload size limit")
+		return false
+	}
+
+	s.Offset += written
+	s.MD5State, s.SHA1State, s.SHA256State, err = hashes.MarshalState()
+	if err == nil {
+		err = h.DB.Save(s).Error
+	}
+	if err != nil {
+		log.WithError(err).Error("failed to save upload session")
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "failed to save upload progress")
+		return false
+	}
+
+	if copyErr != nil {
+		log.WithError(copyErr).Warnf("chunk interrupted at offset %d", s.Offset)
+		h.ociUploadHeaders(c, name, s)
+		ociError(c, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", "chunk interrupted")
+		return false
+	}
+	return true
+}
+
+// ociUploadStatus handles GET /v2/<name>/blobs/uploads/<id>
+func (h *Handler) ociUploadStatus(c *gin.Context, name, id string) {
+	s, ok := h.ociLoadUpload(c, name, id)
+	if !ok {
+		return
+	}
+	h.ociUploadHeaders(c, name, s)
+	c.Status(http.StatusNoContent)
+}
+
+// ociPatchUpload handles PATCH /v2/<name>/blobs/uploads/<id>
+func (h *Handler) ociPatchUpload(c *gin.Context, name, id string) {
+	if !h.ociAuthorize(c, h.ociRepoPath(name), audit.ActionUpload, ModifyOptions{IgnoreProtected: true, IsUpload: true}) {
+		return
+	}
+	unlock, ok := h.lockUpload(id, false)
+	if !ok {
+		ociError(c, http.StatusConflict, "BLOB_UPLOAD_INVALID", "another chunk is being written to this session")
+		return
+	}
+	defer unlock()
+
+	s, ok := h.ociLoadUpload(c, name, id)
+	if !ok || !h.ociAppend(c, name, s) {
+		return
+	}
+	h.ociUploadHeaders(c, name, s)
+	c.Status(http.StatusAccepted)
+}
+
+// ociFinishUpload handles PUT /v2/<name>/blobs/uploads/<id>?digest=, the body may hold the last chunk
+func (h *Handler) ociFinishUpload(c *gin.Context, name, id string) {
+	if !h.ociAuthorize(c, h.ociRepoPath(name), audit.ActionUpload, ModifyOptions{IgnoreProtected: true, IsUpload: true}) {
+		return
+	}
+	unlock, ok := h.lockUpload(id, false)
+	if !ok {
+		ociError(c, http.StatusConflict, "BLOB_UPLOAD_INVALID", "another chunk is being written to this session")
+		return
+	}
+	defer unlock()
+
+	s, ok := h.ociLoadUpload(c, name, id)
+	if !ok {
+		return
+	}
+	digest := c.Query("digest")
+	if !ociDigestRe.MatchString(digest) {
+		ociError(c, http.StatusBadRequest, "DIGEST_INVALID", "unsupported digest")
+		return
+	}
+	if c.Request.ContentLength != 0 && !h.ociAppend(c, name, s) {
+		return
+	}
+
+	hashes, err := restoreHashSet(s.MD5State, s.SHA1State, s.SHA256State)
+	if err != nil {
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "corrupted upload session")
+		return
+	}
+	// A digest mismatch discards the upload as well
+	h.ociCommitBlob(c, name, digest, h.uploadDataPath(s.ID), s.Offset, hashes.Sums())
+	h.removeUploadSession(s)
+}
+
+// ociCancelUpload handles DELETE /v2/<name>/blobs/uploads/<id>
+func (h *Handler) ociCancelUpload(c *gin.Context, name, id string) {
+	unlock, ok := h.lockUpload(id, false)
+	if !ok {
+		ociError(c, http.StatusConflict, "BLOB_UPLOAD_INVALID", "another chunk is being written to this session")
+		return
+	}
+	defer unlock()
+
+	s, ok := h.ociLoadUpload(c, name, id)
+	if !ok {
+		return
+	}
+	h.removeUploadSession(s)
+	c.Status(http.StatusNoContent)
+}
+
+// ociServe streams a stored blob or manifest with its digest
+func (h *Handler) ociServe(c *gin.Context, p string, meta *MetaResource) {
+	f, err := h.Storage.Open(p)
+	if err != nil {
+		ociError(c, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "failed to read blob")
+		return
+	}
+
+	digest := "sha256:" + meta.SHA256
+	c.Header("Docker-Content-Digest", digest)
+	c.Header("ETag", `"`+digest+`"`)
+	c.Header("Content-Type", meta.ContentType)
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime(), f)
+}
+
+// ociGetBlob handles GET/HEAD /v2/<name>/blobs/<digest>
+func (h *Handler) ociGetBlob(c *gin.Context, name, digest string) {
+	if !ociDigestRe.MatchString(digest) {
+		ociError(c, http.StatusBadRequest, "DIGEST_INVALID", "unsupported digest")
+		return
+	}
+	p := h.ociBlobPath(name, digest)
+	meta, err := h.GetFileMeta(p)
+	if err != nil || meta == nil {
+		ociError(c, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	if c.Request.Method == http.MethodHead {
+		// Clients skip uploading blobs that exist, keep it until their manifest arrives
+		if err := h.ociTouch(p); err != nil {
+			logger(c).WithError(err).Warn("failed to touch blob")
+		}
+	}
+	h.ociServe(c, p, meta)
+}
+
+// ociTouch marks records as used, so the garbage collection spares them for ociGCGrace. It goes by UpdatedAt,
+// ModTime mirrors the file for the sync.
+func (h *Handler) ociTouch(paths ...string) error {
+	return h.DB.Model(&MetaResource{}).Where("path IN ?", paths).UpdateColumn("updated_at", time.Now()).Error
+}
+
+// ociTouchReferences touches the blobs and manifests m refers to. Returns the first digest that is unknown.
+// The garbage collection runs under indexMu too, so the references can't vanish between check and touch.
+func (h *Handler) ociTouchReferences(name string, m *ociManifest) (string, bool) {
+	refs := map[string]string{} // path -> digest
+	for _, d := range m.blobs() {
+		refs[h.ociBlobPath(name, d)] = d
+	}
+	for _, d := range m.Manifests {
+		refs[h.ociManifestPath(name, d.Digest)] = d.Digest
+	}
+
+	h.indexMu.Lock()
+	defer h.indexMu.Unlock()
+	for p, d := range refs {
+		if !ociDigestRe.MatchString(d) {
+			return d, false
+		}
+		res := h.DB.Model(&MetaResource{}).Where("path = ?", p).UpdateColumn("updated_at", time.Now())
+		if res.Error != nil || res.RowsAffected == 0 {
+			return d, false
+		}
+	}
+	return "", true
+}
+
+// ociDeleteBlob handles DELETE /v2/<name>/blobs/<digest>
+func (h *Handler) ociDeleteBlob(c *gin.Context, name, digest string) {
+	if !ociDigestRe.MatchString(digest) {
+		ociError(c, http.StatusBadRequest, "DIGEST_INVALID", "unsupported digest")
+		return
+	}
+	p := h.ociBlobPath(name, digest)
+	if !h.ociAuthorize(c, p, audit.ActionDelete, ModifyOptions{}) {
+		return
+	}
+	if meta, err := h.GetFileMeta(p); err != nil || meta == nil {
+		ociError(c, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	if err := h.removeFile(p); err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionDelete, p, err)
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "failed to delete blob")
+		return
+	}
+	h.Audit.WithContext(c).Success(audit.ActionDelete, p, "digest", digest)
+	c.Status(http.StatusAccepted)
+}
+
+/* ===================== MANIFESTS ===================== */
+
+// ociManifestRef resolves a tag or digest reference to the stored path
+func (h *Handler) ociManifestRef(name, ref string) (string, bool) {
+	if ociDigestRe.MatchString(ref) {
+		return h.ociManifestPath(name, ref), true
+	}
+	if ociTagRe.MatchString(ref) {
+		return h.ociTagPath(name, ref), true
+	}
+	return "", false
+}
+
+// ociGetManifest handles GET/HEAD /v2/<name>/manifests/<reference>
+func (h *Handler) ociGetManifest(c *gin.Context, name, ref string) {
+	p, ok := h.ociManifestRef(name, ref)
+	if !ok {
+		ociError(c, http.StatusBadRequest, "MANIFEST_INVALID", "invalid reference")
+		return
+	}
+	meta, err := h.GetFileMeta(p)
+	if err != nil || meta == nil {
+		ociError(c, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+		return
+	}
+	h.ociServe(c, p, meta)
+}
+
+// ociPutManifest handles PUT /v2/<name>/manifests/<reference>
+// Pushing by tag stores the manifest by digest and a copy as tag, in stream <name> group <tag>.
+// The X-KeepLatest, X-Expires and X-Tags headers apply to the tag like to regular uploads.
+func (h *Handler) ociPutManifest(c *gin.Context, name, ref string) {
+	target, ok := h.ociManifestRef(name, ref)
+	if !ok {
+		ociError(c, http.StatusBadRequest, "MANIFEST_INVALID", "invalid reference")
+		return
+	}
+	existing, _ := h.GetFileMeta(target)
+	if !h.ociAuthorize(c, target, audit.ActionUpload, ModifyOptions{IgnoreProtected: existing == nil, IsUpload: true}) {
+		return
+	}
+
+	policy := uploadPolicy{
+		KeepLatest: c.GetHeader("X-KeepLatest") == "true",
+		Tags:       c.GetHeader("X-Tags"),
+	}
+	if expires := c.GetHeader("X-Expires"); expires != "" {
+		expiresAt, err := utils.ParseExpiry(expires)
+		if err != nil {
+			ociError(c, http.StatusBadRequest, "MANIFEST_INVALID", "X-Expires: "+err.Error())
+			return
+		}
+		policy.ExpiresAt = &expiresAt
+	}
+
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, ociMaxManifestSize+1))
+	if err != nil {
+		ociError(c, http.StatusBadRequest, "MANIFEST_INVALID", "failed to read the manifest")
+		return
+	}
+	if len(data) > ociMaxManifestSize {
+		ociError(c, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "manifest too large")
+		return
+	}
+
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		ociError(c, http.StatusBadRequest, "MANIFEST_INVALID", "manifest is not valid JSON")
+		return
+	}
+	contentType := m.MediaType
+	if contentType == "" {
+		contentType = c.ContentType()
+	}
+	if contentType == "" {
+		ociError(c, http.StatusBadRequest, "MANIFEST_INVALID", "manifest media type unknown")
+		return
+	}
+
+	hashes := newHashSet()
+	hashes.Write(data)
+	digest := "sha256:" + hashes.Sums().SHA256
+	if ociDigestRe.MatchString(ref) && ref != digest {
+		ociError(c, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+		return
+	}
+
+	if m.Config == nil && m.Manifests == nil {
+		ociError(c, http.StatusBadRequest, "MANIFEST_INVALID", "manifest has neither config nor manifests")
+		return
+	}
+	if unknown, ok := h.ociTouchReferences(name, &m); !ok {
+		ociError(c, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown to registry: "+unknown)
+		return
+	}
+
+	paths := []string{h.ociManifestPath(name, digest)}
+	if target != paths[0] {
+		paths = append(paths, target)
+	}
+	for _, p := range paths {
+		pol := uploadPolicy{}
+		if p == target && !ociDigestRe.MatchString(ref) {
+			pol = policy
+			pol.Stream, pol.Group = name, ref
+		}
+		if _, err := h.storeBytes(p, contentType, data, pol); err != nil {
+			h.Audit.WithContext(c).Failure(audit.ActionUpload, p, err, "digest", digest)
+			logger(c).WithError(err).Error("failed to store manifest")
+			ociError(c, http.StatusInternalServerError, "UNKNOWN", "failed to store manifest")
+			return
+		}
+	}
+
+	h.Audit.WithContext(c).Success(audit.ActionUpload, target, "digest", digest, "size", len(data))
+	h.afterChange(paths...)
+	c.Header("Location", "/v2/"+name+"/manifests/"+digest)
+	c.Header("Docker-Content-Digest", digest)
+	if m.Subject != nil {
+		c.Header("OCI-Subject", m.Subject.Digest)
+	}
+	c.Status(http.StatusCreated)
+}
+
+// ociDeleteManifest handles DELETE /v2/<name>/manifests/<reference>
+// Deleting a digest removes the tags pointing to it too, deleting a tag only untags the manifest.
+func (h *Handler) ociDeleteManifest(c *gin.Context, name, ref string) {
+	target, ok := h.ociManifestRef(name, ref)
+	if !ok {
+		ociError(c, http.StatusBadRequest, "MANIFEST_INVALID", "invalid reference")
+		return
+	}
+	meta, err := h.GetFileMeta(target)
+	if err != nil || meta == nil {
+		ociError(c, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+		return
+	}
+
+	paths := []string{target}
+	if ociDigestRe.MatchString(ref) {
+		tags, err := h.ociTags(name)
+		if err != nil {
+			ociError(c, http.StatusInternalServerError, "UNKNOWN", "database error")
+			return
+		}
+		for _, t := range tags {
+			if t.SHA256 == meta.SHA256 {
+				paths = append(paths, t.Path)
+			}
+		}
+	}
+
+	for _, p := range paths {
+		if !h.ociAuthorize(c, p, audit.ActionDelete, ModifyOptions{}) {
+			return
+		}
+	}
+	for _, p := range paths {
+		if err := h.removeFile(p); err != nil {
+			h.Audit.WithContext(c).Failure(audit.ActionDelete, p, err)
+			ociError(c, http.StatusInternalServerError, "UNKNOWN", "failed to delete manifest")
+			return
+		}
+	}
+
+	h.Audit.WithContext(c).Success(audit.ActionDelete, target, "digest", "sha256:"+meta.SHA256, "affected_paths", paths)
+	h.afterChange(paths...)
+	c.Status(http.StatusAccepted)
+}
+
+/* ===================== GARBAGE COLLECTION ===================== */
+
+// collectOCIGarbage removes the manifests and blobs of the changed repositories that are no longer
+// reachable from a tag. Manifests referring to a reachable manifest as subject (signatures, SBOMs) are kept.
+func (h *Handler) collectOCIGarbage(paths ...string) {
+	if !h.Config.OCI.Enabled {
+		return
+	}
+	repos := map[string]bool{}
+	for _, p := range paths {
+		if name, ok := h.ociRepoOf(p); ok {
+			repos[name] = true
+		}
+	}
+	for name := range repos {
+		if err := h.collectOCIRepoGarbage(name); err != nil {
+			h.Log.WithError(err).Errorf("OCI: garbage collection of %s failed", name)
+		}
+	}
+}
+
+func (h *Handler) collectOCIRepoGarbage(name string) error {
+	repoPath := h.ociRepoPath(name)
+	var records []MetaResource
+	if err := h.DB.Where("path LIKE ?", repoPath+"/%").Find(&records).Error; err != nil {
+		return err
+	}
+
+	manifestDir := path.Join(repoPath, ociManifestsDir, "sha256") + "/"
+	blobDir := path.Join(repoPath, ociBlobsDir, "sha256") + "/"
+	tagDir := path.Join(repoPath, ociTagsDir) + "/"
+
+	var tags []MetaResource
+	manifests := map[string]MetaResource{}
+	blobs := map[string]MetaResource{}
+	for _, r := range records {
+		if hex, ok := strings.CutPrefix(r.Path, manifestDir); ok && !strings.Contains(hex, "/") {
+			manifests[hex] = r
+		} else if hex, ok := strings.CutPrefix(r.Path, blobDir); ok && !strings.Contains(hex, "/") {
+			blobs[hex] = r
+		} else if tag, ok := strings.CutPrefix(r.Path, tagDir); ok && !strings.Contains(tag, "/") {
+			tags = append(tags, r)
+		}
+	}
+
+	// Without all manifests the live blobs are unknown, nothing is swept then
+	parsed := map[string]*ociManifest{}
+	for hex, r := range manifests {
+		m, err := h.readOCIManifest(r.Path)
+		if err != nil {
+			return fmt.Errorf("reading manifest %s: %w", r.Path, err)
+		}
+		parsed[hex] = m
+	}
+
+	liveManifests := map[string]bool{}
+	liveBlobs := map[string]bool{}
+	var mark func(hex string)
+	mark = func(hex string) {
+		if liveManifests[hex] {
+			return
+		}
+		liveManifests[hex] = true
+		m, ok := parsed[hex]
+		if !ok {
+			return
+		}
+		for _, d := range m.blobs() {
+			liveBlobs[strings.TrimPrefix(d, "sha256:")] = true
+		}
+		for _, d := range m.Manifests {
+			mark(strings.TrimPrefix(d.Digest, "sha256:"))
+		}
+	}
+	for _, t := range tags {
+		mark(t.SHA256)
+	}
+	for changed := true; changed; {
+		changed = false
+		for hex, m := range parsed {
+			if !liveManifests[hex] && m.Subject != nil && liveManifests[strings.TrimPrefix(m.Subject.Digest, "sha256:")] {
+				mark(hex)
+				changed = true
+			}
+		}
+	}
+
+	cutoff := time.Now().Add(-ociGCGrace)
+	var garbage []MetaResource
+	for hex, r := range manifests {
+		if !liveManifests[hex] && r.UpdatedAt.Before(cutoff) {
+			garbage = append(garbage, r)
+		}
+	}
+	for hex, r := range blobs {
+		if !liveBlobs[hex] && r.UpdatedAt.Before(cutoff) {
+			garbage = append(garbage, r)
+		}
+	}
+
+	for _, r := range garbage {
+		if err := h.removeFile(r.Path); err != nil {
+			h.Log.WithError(err).Errorf("OCI: failed to remove %s", r.Path)
+			continue
+		}
+		h.Audit.Success("SYSTEM_CLEANUP", r.Path, "reason", "unreferenced")
+	}
+	return nil
+}
+
+func (h *Handler) readOCIManifest(p string) (*ociManifest, error) {
+	f, err := h.Storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var m ociManifest
+	if err := json.NewDecoder(io.LimitReader(f, ociMaxManifestSize)).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
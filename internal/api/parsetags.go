@@ -29,3 +29,16 @@ func parseTagString(input string) []MetaTag {
 	}
 	return tags
 }
+
+// formatTags is the inverse of parseTagString
+func formatTags(tags []MetaTag) string {
+	parts := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t.Value == "" {
+			parts = append(parts, t.Key)
+		} else {
+			parts = append(parts, t.Key+"="+t.Value)
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -1,8 +1,11 @@
 package api
 
 import (
+	"io/fs"
+	"net/http"
 	"path/filepath"
 
+	"github.com/gin-gonic/gin"
 	"github.com/kovi/yaar/internal/auth"
 	"github.com/sirupsen/logrus"
 )
@@ -16,19 +19,12 @@ type ModifyOptions struct {
 func (h *Handler) CanModify(urlPath string, allowedScopes []string, opts ModifyOptions) (bool, string) {
 	urlPath = filepath.Clean("/" + urlPath)
 
-	// 1. SCOPE CHECK: Is the path within one of the allowed scopes?
-	inScope := false
-	if len(allowedScopes) == 0 || (len(allowedScopes) == 1 && allowedScopes[0] == "/") {
-		inScope = true
-	} else {
-		for _, scope := range allowedScopes {
-			if auth.IsInScope(urlPath, scope) {
-				inScope = true
-				break
-			}
-		}
+	if isSystemPath(urlPath) {
+		return false, "Action prohibited: " + systemDir + " is reserved for internal use."
 	}
-	if !inScope {
+
+	// 1. SCOPE CHECK: Is the path within one of the allowed scopes (prefixes or globs)?
+	if !auth.IsInScopes(urlPath, allowedScopes) {
 		return false, "Path is outside of your authorized scope."
 	}
 
@@ -72,3 +68,71 @@ func (h *Handler) CanModify(urlPath string, allowedScopes []string, opts ModifyO
 
 	return true, ""
 }
+
+// canRead reports if the caller may download path: it is below an anonymous-read prefix
+// or in the read scope of the user (narrowed by the token, if any). The internal state is always hidden.
+func (h *Handler) canRead(c *gin.Context, path string) bool {
+	if isSystemPath(path) {
+		return false
+	}
+	if h.Config.IsAnonymousReadable(path) {
+		return true
+	}
+	return auth.IsInScopes(path, c.GetStringSlice("read_paths"))
+}
+
+// canList reports if the caller may see the directory dir: it is readable itself
+// or leads to something readable. Listings then only show the readable part.
+func (h *Handler) canList(c *gin.Context, dir string) bool {
+	if h.canRead(c, dir) {
+		return true
+	}
+	if isSystemPath(dir) {
+		return false
+	}
+	for _, scopes := range [][]string{c.GetStringSlice("read_paths"), h.Config.Storage.AnonymousRead} {
+		for _, scope := range scopes {
+			if auth.LeadsToScope(dir, scope) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canSee is canList for directories and canRead for files
+func (h *Handler) canSee(c *gin.Context, path string, isDir bool) bool {
+	if isDir {
+		return h.canList(c, path)
+	}
+	return h.canRead(c, path)
+}
+
+// denyRead answers a request for something the caller may not read. Anonymous callers are asked to
+// log in, everyone else gets the same 404 as for a missing path.
+func denyRead(c *gin.Context, path string) {
+	if _, ok := c.Get("username"); !ok && !isSystemPath(path) {
+		auth.EnsureAuth(c)
+		return
+	}
+	c.AbortWithStatus(http.StatusNotFound)
+}
+
+// statReadable returns the file info of path if the caller may see it, otherwise the response is written.
+// Readability is checked first, so the answer doesn't tell if an unreadable path exists.
+func (h *Handler) statReadable(c *gin.Context, path string) (fs.FileInfo, bool) {
+	if !h.canList(c, path) {
+		denyRead(c, path)
+		return nil, false
+	}
+	stat, err := h.Storage.Stat(path)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+	if !h.canSee(c, path, stat.IsDir()) {
+		denyRead(c, path)
+		return nil, false
+	}
+	return stat, true
+}
@@ -0,0 +1,362 @@
+package api
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/audit"
+)
+
+// Python package indexes serve the simple repository API (PEP 503 HTML, PEP 691 JSON)
+// under <prefix>/simple/, built from the wheels and sdists stored anywhere below the prefix.
+// twine uploads (legacy upload API) go to <prefix>/<project>/<filename>.
+
+const (
+	pypiJSONType = "application/vnd.pypi.simple.v1+json"
+	pypiHTMLType = "application/vnd.pypi.simple.v1+html"
+
+	// pypiRequiresPythonTag holds the Requires-Python metadata sent by twine
+	pypiRequiresPythonTag = "requires_python"
+)
+
+var pypiNormalizeRe = regexp.MustCompile(`[-_.]+`)
+
+// pypiNormalize returns the PEP 503 normalized form of a project name
+func pypiNormalize(name string) string {
+	return strings.ToLower(pypiNormalizeRe.ReplaceAllString(name, "-"))
+}
+
+// pypiProjectOf returns the normalized project name of a distribution file name, or "" if it isn't one
+func pypiProjectOf(filename string) string {
+	var base string
+	switch {
+	case strings.HasSuffix(filename, ".whl"), strings.HasSuffix(filename, ".egg"):
+		// {name}-{version}(-{build})?-{python}-{abi}-{platform}.whl, the name has no dashes
+		name, _, ok := strings.Cut(filename, "-")
+		if !ok {
+			return ""
+		}
+		return pypiNormalize(name)
+	case strings.HasSuffix(filename, ".tar.gz"):
+		base = strings.TrimSuffix(filename, ".tar.gz")
+	case strings.HasSuffix(filename, ".zip"):
+		base = strings.TrimSuffix(filename, ".zip")
+	case strings.HasSuffix(filename, ".tar.bz2"):
+		base = strings.TrimSuffix(filename, ".tar.bz2")
+	default:
+		return ""
+	}
+
+	// {name}-{version}, older sdists may have dashes in the name: the version starts with a digit
+	parts := strings.Split(base, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" && parts[i][0] >= '0' && parts[i][0] <= '9' {
+			return pypiNormalize(strings.Join(parts[:i], "-"))
+		}
+	}
+	return ""
+}
+
+type pypiFile struct {
+	Project        string
+	Filename       string
+	URL            string
+	SHA256         string
+	RequiresPython string
+}
+
+// pypiFiles lists the distribution files of the index at root
+func (h *Handler) pypiFiles(c *gin.Context, root string) ([]pypiFile, error) {
+	records, err := h.filesUnder(root + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []pypiFile
+	for _, r := range records {
+		filename := path.Base(r.Path)
+		project := pypiProjectOf(filename)
+		if project == "" || !h.canRead(c, r.Path) {
+			continue
+		}
+		f := pypiFile{
+			Project:  project,
+			Filename: filename,
+			URL:      (&url.URL{Path: r.Path}).EscapedPath(),
+			SHA256:   r.SHA256,
+		}
+		for _, t := range r.Tags {
+			if t.Key == pypiRequiresPythonTag {
+				f.RequiresPython = t.Value
+			}
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+var pypiIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta name="pypi:repository-version" content="1.0">
+    <title>Simple index</title>
+  </head>
+  <body>
+{{- range .}}
+    <a href="{{.}}/">{{.}}</a><br/>
+{{- end}}
+  </body>
+</html>
+`))
+
+var pypiProjectTemplate = template.Must(template.New("project").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta name="pypi:repository-version" content="1.0">
+    <title>Links for {{.Name}}</title>
+  </head>
+  <body>
+    <h1>Links for {{.Name}}</h1>
+{{- range .Files}}
+    <a href="{{.URL}}#sha256={{.SHA256}}"{{if .RequiresPython}} data-requires-python="{{.RequiresPython}}"{{end}}>{{.Filename}}</a><br/>
+{{- end}}
+  </body>
+</html>
+`))
+
+// pypiWantsJSON negotiates between the PEP 691 JSON and the HTML flavour of the simple API
+func pypiWantsJSON(c *gin.Context) bool {
+	if format := c.Query("format"); format != "" {
+		return format == pypiJSONType
+	}
+	accept := c.GetHeader("Accept")
+	jsonScore := getScore(accept, pypiJSONType)
+	htmlScore := max(getScore(accept, pypiHTMLType), getScore(accept, "text/html"))
+	return jsonScore > 0 && jsonScore >= htmlScore
+}
+
+// servePyPIIndex answers GET/HEAD of <prefix>/simple/ and <prefix>/simple/<project>/.
+// Returns false if p is not such a page.
+func (h *Handler) servePyPIIndex(c *gin.Context, p string) bool {
+	root, ok := h.Config.PyPIRepo(p)
+	if !ok {
+		return false
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(p, root), "/"), "/")
+	if parts[0] != "simple" || len(parts) > 2 {
+		return false
+	}
+
+	files, err := h.pypiFiles(c, root)
+	if err != nil {
+		logger(c).WithError(err).Error("failed to list python packages")
+		c.JSON(500, gin.H{"error": "Database error"})
+		return true
+	}
+	asJSON := pypiWantsJSON(c)
+	c.Header("Vary", "Accept")
+	meta := gin.H{"api-version": "1.0"}
+
+	if len(parts) == 1 {
+		seen := map[string]bool{}
+		var projects []string
+		for _, f := range files {
+			if !seen[f.Project] {
+				seen[f.Project] = true
+				projects = append(projects, f.Project)
+			}
+		}
+		sort.Strings(projects)
+
+		if asJSON {
+			list := make([]gin.H, 0, len(projects))
+			for _, name := range projects {
+				list = append(list, gin.H{"name": name})
+			}
+			c.Header("Content-Type", pypiJSONType)
+			c.JSON(http.StatusOK, gin.H{"meta": meta, "projects": list})
+			return true
+		}
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		pypiIndexTemplate.Execute(c.Writer, projects)
+		return true
+	}
+
+	project := pypiNormalize(parts[1])
+	if project != parts[1] {
+		// PEP 503: redirect to the normalized name
+		c.Redirect(http.StatusMovedPermanently, path.Join(root, "simple", project)+"/")
+		return true
+	}
+
+	var matching []pypiFile
+	for _, f := range files {
+		if f.Project == project {
+			matching = append(matching, f)
+		}
+	}
+	if len(matching) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return true
+	}
+
+	if asJSON {
+		list := make([]gin.H, 0, len(matching))
+		for _, f := range matching {
+			entry := gin.H{"filename": f.Filename, "url": f.URL, "hashes": gin.H{"sha256": f.SHA256}}
+			if f.RequiresPython != "" {
+				entry["requires-python"] = f.RequiresPython
+			}
+			list = append(list, entry)
+		}
+		c.Header("Content-Type", pypiJSONType)
+		c.JSON(http.StatusOK, gin.H{"meta": meta, "name": project, "files": list})
+		return true
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	pypiProjectTemplate.Execute(c.Writer, gin.H{"Name": project, "Files": matching})
+	return true
+}
+
+// pypiMaxFormFields is what the metadata fields of a twine upload may add to the size of the file
+const pypiMaxFormFields = 1 << 20
+
+// isPyPIUpload reports if the request may be a twine upload (legacy upload API) to a Python package index.
+// The form is only read once the user is authenticated.
+func (h *Handler) isPyPIUpload(c *gin.Context) bool {
+	if _, ok := h.Config.PyPIRepo(dbPath(c.Request.URL.Path)); !ok {
+		return false
+	}
+	return strings.HasPrefix(c.ContentType(), "multipart/form-data")
+}
+
+// HandlePyPIUpload stores a distribution uploaded with twine at <prefix>/<project>/<filename>.
+// The sha256_digest and md5_digest fields are verified like X-Checksum-* headers.
+// Other forms are regular uploads.
+func (h *Handler) HandlePyPIUpload(c *gin.Context) {
+	root, _ := h.Config.PyPIRepo(dbPath(c.Request.URL.Path))
+	scopes := c.GetStringSlice("allowed_paths")
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.Config.Storage.MaxUploadSizeBytes+pypiMaxFormFields)
+	if _, err := c.MultipartForm(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File content exceeded limit"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form"})
+		return
+	}
+	if c.PostForm(":action") != "file_upload" {
+		h.HandleUpload(c)
+		return
+	}
+
+	fileHeader, err := c.FormFile("content")
+	if err != nil {
+		c.JSON(400, gin.H{"error": "missing content in form"})
+		return
+	}
+	filename := fileHeader.Filename
+	project := pypiProjectOf(filename)
+	if project == "" || strings.ContainsAny(filename, `/\`) {
+		c.JSON(400, gin.H{"error": "Invalid distribution file name"})
+		return
+	}
+	if name := c.PostForm("name"); name != "" && pypiNormalize(name) != project {
+		c.JSON(400, gin.H{"error": "File name does not match the project name"})
+		return
+	}
+	target := path.Join(root, project, filename)
+
+	if fileHeader.Size > h.Config.Storage.MaxUploadSizeBytes {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, errors.New("file too large"), "MaxUploadSizeBytes", h.Config.Storage.MaxUploadSizeBytes)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File too large"})
+		return
+	}
+
+	// Released files are never replaced, like on pypi.org
+	if _, err := h.Storage.Stat(target); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "File already exists"})
+		return
+	}
+	if ok, msg := h.CanModify(target, scopes, ModifyOptions{IgnoreProtected: true, IsUpload: true}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, errors.New(msg))
+		c.JSON(403, gin.H{"error": msg})
+		return
+	}
+
+	policy, err := parseUploadPolicy(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	policy.SHA256 = c.PostForm("sha256_digest")
+	policy.MD5 = c.PostForm("md5_digest")
+
+	in, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Upload interrupted"})
+		return
+	}
+	defer in.Close()
+
+	out, err := h.createTempFile()
+	if err != nil {
+		logger(c).WithError(err).Error("failed to create temp file")
+		c.JSON(500, gin.H{"error": "Failed to store file"})
+		return
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hashes := newHashSet()
+	written, err := io.Copy(io.MultiWriter(out, hashes), in)
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload interrupted"})
+		return
+	}
+
+	sums := hashes.Sums()
+	if mismatchErr := policy.verify(sums); mismatchErr != "" {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, errors.New(mismatchErr), "status", "corrupted")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Integrity check failed", "details": mismatchErr})
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(filename))
+	res, err := h.saveUploadMeta(target, contentType, written, sums, policy, out.Name())
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, target, err)
+		logger(c).WithError(err).Error("db sync failed")
+		c.JSON(500, gin.H{"error": "Database sync failed"})
+		return
+	}
+
+	if requires := c.PostForm("requires_python"); requires != "" {
+		tag := MetaTag{ResourceID: res.ID, Key: pypiRequiresPythonTag, Value: requires}
+		if err := h.DB.Create(&tag).Error; err != nil {
+			logger(c).WithError(err).Warn("failed to record requires_python")
+		}
+	}
+
+	h.Audit.WithContext(c).Success(audit.ActionUpload, target, "size", written, "sha256", res.SHA256, "version", c.PostForm("version"))
+	h.afterChange(target)
+	c.JSON(http.StatusOK, res)
+}
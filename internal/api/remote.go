@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/audit"
+	"github.com/kovi/yaar/internal/config"
+)
+
+// Remotes are pull-through caches: a GET of a missing or stale file below a remote's path fetches it from the
+// upstream, stores it like an upload tagged origin=remote and serves it. When the upstream can't be reached
+// the cached copy is served; offline remotes never contact the upstream.
+
+const remoteOriginTag = "origin=remote"
+
+var remoteClient = &http.Client{}
+
+// remoteFetchTimeout bounds a download, which goes on when the requests waiting for it are gone
+const remoteFetchTimeout = 10 * time.Minute
+
+var errRemoteNotFound = errors.New("not found upstream")
+
+type remoteFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// serveRemote answers GET/HEAD of a file below a remote mount.
+// Returns false if p is not below one, or is a directory.
+func (h *Handler) serveRemote(c *gin.Context, p string) bool {
+	remote, ok := h.Config.Remote(p)
+	if !ok || p == remote.Path {
+		return false
+	}
+	if stat, err := h.Storage.Stat(p); err == nil && stat.IsDir() {
+		return false
+	}
+
+	if err := h.syncRemote(c, remote, p); err != nil {
+		if errors.Is(err, errRemoteNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		} else {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Upstream unavailable"})
+		}
+		return true
+	}
+	h.ServeFile(c, p)
+	return true
+}
+
+// syncRemote makes sure the cache holds a copy of p that can be served, fetching it if missing or stale.
+// Fails only if there is no cached copy.
+func (h *Handler) syncRemote(c *gin.Context, remote *config.RemoteConfig, p string) error {
+	_, err := h.Storage.Stat(p)
+	cached := err == nil
+	if remote.Offline || h.isRemoteFresh(remote, p, cached) {
+		if !cached {
+			return errRemoteNotFound
+		}
+		return nil
+	}
+
+	if err := h.fetchRemote(c, remote, p); err != nil {
+		if !cached {
+			return err
+		}
+		// keep serving the cached copy while the upstream is down
+		logger(c).WithError(err).Warnf("remote: serving stale %s", p)
+	}
+	return nil
+}
+
+// isRemoteFresh reports if the cached copy of p can be served without asking the upstream.
+// Immutable files are never refreshed.
+func (h *Handler) isRemoteFresh(remote *config.RemoteConfig, p string, cached bool) bool {
+	if !cached {
+		return false
+	}
+	meta, err := h.GetFileMeta(p)
+	if err != nil || meta == nil {
+		return true
+	}
+	if meta.Immutable != nil && *meta.Immutable {
+		return true
+	}
+	return remote.TTL == 0 || time.Since(meta.UpdatedAt) < remote.TTL
+}
+
+// fetchRemote downloads p from the upstream into the cache.
+// Concurrent requests for the same path share one download, which runs in the background so that it isn't
+// cut off by the request that started it going away. Each request only waits as long as it is there.
+func (h *Handler) fetchRemote(c *gin.Context, remote *config.RemoteConfig, p string) error {
+	h.remoteMu.Lock()
+	f, ok := h.remoteFetches[p]
+	if !ok {
+		if h.remoteFetches == nil {
+			h.remoteFetches = make(map[string]*remoteFetch)
+		}
+		f = &remoteFetch{done: make(chan struct{})}
+		h.remoteFetches[p] = f
+
+		// The gin context is reused once the request is over
+		cc := c.Copy()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(cc.Request.Context()), remoteFetchTimeout)
+			defer cancel()
+			f.err = h.downloadRemote(ctx, cc, remote, p)
+
+			h.remoteMu.Lock()
+			delete(h.remoteFetches, p)
+			h.remoteMu.Unlock()
+			close(f.done)
+		}()
+	}
+	h.remoteMu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-c.Request.Context().Done():
+		return c.Request.Context().Err()
+	}
+}
+
+// downloadRemote fetches p and stores it, nothing is left in the cache if that fails
+func (h *Handler) downloadRemote(ctx context.Context, c *gin.Context, remote *config.RemoteConfig, p string) error {
+	upstream := remote.URL + (&url.URL{Path: strings.TrimPrefix(p, remote.Path)}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream, nil)
+	if err != nil {
+		return err
+	}
+	meta, err := h.GetFileMeta(p)
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		req.Header.Set("If-Modified-Since", meta.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if meta == nil {
+			return fmt.Errorf("%s: unexpected %s", upstream, resp.Status)
+		}
+		return h.DB.Model(meta).UpdateColumn("updated_at", time.Now()).Error
+	case http.StatusNotFound, http.StatusGone:
+		return errRemoteNotFound
+	default:
+		return fmt.Errorf("%s: %s", upstream, resp.Status)
+	}
+
+	out, err := h.createTempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hashes := newHashSet()
+	limit := h.Config.Storage.MaxUploadSizeBytes
+	written, err := io.Copy(io.MultiWriter(out, hashes), io.LimitReader(resp.Body, limit+1))
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if written > limit {
+		return fmt.Errorf("%s: larger than %d bytes", upstream, limit)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return fmt.Errorf("%s: truncated download", upstream)
+	}
+
+	// Upstreams like Artifactory or yaar itself announce the checksums
+	policy := uploadPolicy{
+		Tags:   remoteOriginTag,
+		SHA256: resp.Header.Get("X-Checksum-Sha256"),
+		SHA1:   resp.Header.Get("X-Checksum-Sha1"),
+		MD5:    resp.Header.Get("X-Checksum-Md5"),
+	}
+	sums := hashes.Sums()
+	if mismatchErr := policy.verify(sums); mismatchErr != "" {
+		h.Audit.WithContext(c).Failure(audit.ActionFetch, p, errors.New(mismatchErr), "url", upstream, "status", "corrupted")
+		return fmt.Errorf("%s: %s", upstream, mismatchErr)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(p))
+	}
+	res, err := h.saveUploadMeta(p, contentType, written, sums, policy, out.Name())
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionFetch, p, err, "url", upstream)
+		return err
+	}
+
+	h.Audit.WithContext(c).Success(audit.ActionFetch, p, "url", upstream, "size", written, "sha256", res.SHA256)
+	h.afterChange(p)
+	return nil
+}
@@ -2,7 +2,6 @@ package api
 
 import (
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 
@@ -19,16 +18,35 @@ func (h *Handler) RegisterRoutes(r *gin.Engine) {
 		files.PATCH("/*path", auth.Protect(), h.PatchMeta)
 		files.POST("/*path", auth.Protect(), h.PostMeta)
 	}
+	uploads := api.Group("/uploads", auth.Protect())
+	{
+		uploads.POST("", h.CreateUploadSession)
+		uploads.GET("/:id", h.GetUploadSession)
+		uploads.HEAD("/:id", h.GetUploadSession)
+		uploads.PATCH("/:id", h.AppendUploadChunk)
+		uploads.PUT("/:id", h.FinalizeUploadSession)
+		uploads.DELETE("/:id", h.AbortUploadSession)
+	}
 	api.GET("/search", h.Search)
 	api.GET("/settings", h.GetSettings)
 
+	admin := r.Group("/_/api/admin", auth.AdminRequired())
+	{
+		admin.GET("/dedup", h.GetDedupStats)
+	}
+
 	// --- stream routes ---
 	stream := api.Group("/streams")
 	{
 		stream.GET("", h.ListStreams)
 		stream.GET("/:name", h.GetStreamDetails)
+		stream.GET("/:name/:group/archive", h.GetStreamGroupArchive)
+		stream.HEAD("/:name/:group/archive", h.GetStreamGroupArchive)
 	}
 
+	// OCI Distribution API, falls back to the file tree when disabled
+	r.Any("/v2/*path", h.HandleOCI)
+
 	r.NoRoute(h.defaultHandler)
 }
 
@@ -39,12 +57,32 @@ Concept:
 - The API URL (/_/api/fs/*path): Serves Metadata. Works for both files and directories.
 */
 func (h *Handler) defaultHandler(c *gin.Context) {
+	if h.HandleWebDAV(c) || h.HandleS3(c) {
+		return
+	}
+
 	// not handled api paths are 404
 	if strings.HasPrefix(c.Request.URL.Path, "/_/api") {
 		c.Status(http.StatusNotFound)
 		return
 	}
 
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		if !h.readAllowed(c) {
+			return
+		}
+		h.awaitIndexes(dbPath(c.Request.URL.Path))
+	}
+
+	if h.HandleNPM(c) || h.HandleGoProxy(c) || h.HandleHelm(c) || h.HandleLFS(c) {
+		return
+	}
+
+	if _, ok := h.Config.Virtual(dbPath(c.Request.URL.Path)); ok && c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Virtual repositories are read-only"})
+		return
+	}
+
 	switch c.Request.Method {
 	case http.MethodDelete:
 		if auth.EnsureAuth(c) {
@@ -52,6 +90,12 @@ func (h *Handler) defaultHandler(c *gin.Context) {
 		}
 		return
 	case http.MethodPost:
+		if h.isPyPIUpload(c) {
+			if auth.EnsureAuth(c) {
+				h.HandlePyPIUpload(c)
+			}
+			return
+		}
 		fallthrough
 	case http.MethodPut:
 		if auth.EnsureAuth(c) {
@@ -62,10 +106,22 @@ func (h *Handler) defaultHandler(c *gin.Context) {
 		fallthrough
 	case http.MethodHead:
 		dbPath := dbPath(c.Request.URL.Path)
-		path := h.fsPath(dbPath)
 		isHtmlRequested := getScore(c.GetHeader("Accept"), "text/html") > 0
-		stat, err := os.Stat(path)
-		if err != nil || (stat.IsDir() && isHtmlRequested) {
+		stat, err := h.Storage.Stat(dbPath)
+		if err == nil && stat.IsDir() && c.Query("archive") != "" && !isSystemPath(dbPath) {
+			h.ServeArchive(c, dbPath)
+			return
+		}
+		if !isSystemPath(dbPath) && (h.serveVirtual(c, dbPath) || h.serveRemote(c, dbPath)) {
+			return
+		}
+		if err != nil && isMavenChecksum(dbPath) && h.serveMavenChecksum(c, dbPath) {
+			return
+		}
+		if (err != nil || stat.IsDir()) && h.servePyPIIndex(c, dbPath) {
+			return
+		}
+		if err != nil || isSystemPath(dbPath) || (stat.IsDir() && isHtmlRequested) {
 			// Path doesn't exist?
 			// Serve UI so the SPA can show a 404 or the directory listing
 			c.File("./web/index.html")
@@ -79,6 +135,21 @@ func (h *Handler) defaultHandler(c *gin.Context) {
 	c.Status(http.StatusNotFound)
 }
 
+// readAllowed answers unreadable GET/HEAD requests, package endpoints included
+func (h *Handler) readAllowed(c *gin.Context) bool {
+	p := dbPath(c.Request.URL.Path)
+	if isSystemPath(p) || h.canRead(c, p) {
+		return true
+	}
+	if getScore(c.GetHeader("Accept"), "text/html") > 0 {
+		// The UI asks for a login or shows the readable part of the tree
+		c.File("./web/index.html")
+		return false
+	}
+	denyRead(c, p)
+	return false
+}
+
 func getScore(header, target string) float64 {
 	for _, part := range strings.Split(header, ",") {
 		pair := strings.Split(strings.TrimSpace(part), ";")
@@ -0,0 +1,806 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// YUM repositories keep their metadata in <prefix>/repodata/: repomd.xml pointing to primary, filelists and other,
+// built from the headers of every .rpm stored below the prefix. The parsed headers are cached in
+// repodata/packages.json.gz, so only new or replaced packages are read when the metadata is rebuilt.
+
+const (
+	rpmRepodataDir = "repodata"
+	rpmCacheFile   = "packages.json.gz"
+
+	// rpmMaxHeaderSize limits the header read from a package
+	rpmMaxHeaderSize = 64 << 20
+)
+
+// Header tags, see rpmtag.h
+const (
+	rpmTagName            = 1000
+	rpmTagVersion         = 1001
+	rpmTagRelease         = 1002
+	rpmTagEpoch           = 1003
+	rpmTagSummary         = 1004
+	rpmTagDescription     = 1005
+	rpmTagBuildTime       = 1006
+	rpmTagBuildHost       = 1007
+	rpmTagSize            = 1009
+	rpmTagVendor          = 1011
+	rpmTagLicense         = 1014
+	rpmTagPackager        = 1015
+	rpmTagGroup           = 1016
+	rpmTagURL             = 1020
+	rpmTagArch            = 1022
+	rpmTagOldFilenames    = 1027
+	rpmTagFileModes       = 1030
+	rpmTagFileFlags       = 1037
+	rpmTagSourceRPM       = 1044
+	rpmTagArchiveSize     = 1046
+	rpmTagProvideName     = 1047
+	rpmTagRequireFlags    = 1048
+	rpmTagRequireName     = 1049
+	rpmTagRequireVersion  = 1050
+	rpmTagConflictFlags   = 1053
+	rpmTagConflictName    = 1054
+	rpmTagConflictVersion = 1055
+	rpmTagChangelogTime   = 1080
+	rpmTagChangelogName   = 1081
+	rpmTagChangelogText   = 1082
+	rpmTagObsoleteName    = 1090
+	rpmTagProvideFlags    = 1112
+	rpmTagProvideVersion  = 1113
+	rpmTagObsoleteFlags   = 1114
+	rpmTagObsoleteVersion = 1115
+	rpmTagDirIndexes      = 1116
+	rpmTagBaseNames       = 1117
+	rpmTagDirNames        = 1118
+)
+
+const (
+	rpmTypeChar        = 1
+	rpmTypeInt8        = 2
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeInt64       = 5
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+
+	rpmSenseLess    = 1 << 1
+	rpmSenseGreater = 1 << 2
+	rpmSenseEqual   = 1 << 3
+	rpmSensePrereq  = 1 << 6
+	rpmSenseScripts = 1<<9 | 1<<10 // %pre and %post
+	rpmSenseRPMLib  = 1 << 24
+
+	rpmFileGhost = 1 << 6
+)
+
+type rpmIndexEntry struct {
+	Type   uint32
+	Offset uint32
+	Count  uint32
+}
+
+type rpmHeader struct {
+	entries map[uint32]rpmIndexEntry
+	store   []byte
+}
+
+// readRPMHeader reads a header structure: magic, index entries and their data store
+func readRPMHeader(r io.Reader) (*rpmHeader, int64, error) {
+	intro := make([]byte, 16)
+	if _, err := io.ReadFull(r, intro); err != nil {
+		return nil, 0, errors.New("truncated rpm header")
+	}
+	if !bytes.Equal(intro[:3], []byte{0x8e, 0xad, 0xe8}) {
+		return nil, 0, errors.New("invalid rpm header magic")
+	}
+	count := int64(binary.BigEndian.Uint32(intro[8:12]))
+	storeSize := int64(binary.BigEndian.Uint32(intro[12:16]))
+	size := 16 + count*16 + storeSize
+	if size > rpmMaxHeaderSize {
+		return nil, 0, errors.New("rpm header too large")
+	}
+
+	index := make([]byte, count*16)
+	h := &rpmHeader{entries: make(map[uint32]rpmIndexEntry, count), store: make([]byte, storeSize)}
+	if _, err := io.ReadFull(r, index); err != nil {
+		return nil, 0, errors.New("truncated rpm header")
+	}
+	if _, err := io.ReadFull(r, h.store); err != nil {
+		return nil, 0, errors.New("truncated rpm header")
+	}
+	for i := int64(0); i < count; i++ {
+		e := index[i*16:]
+		h.entries[binary.BigEndian.Uint32(e)] = rpmIndexEntry{
+			Type:   binary.BigEndian.Uint32(e[4:]),
+			Offset: binary.BigEndian.Uint32(e[8:]),
+			Count:  binary.BigEndian.Uint32(e[12:]),
+		}
+	}
+	return h, size, nil
+}
+
+// readRPM reads the main header of a package and returns its byte range in the file
+func readRPM(r io.Reader) (h *rpmHeader, start, end int64, err error) {
+	br := bufio.NewReader(r)
+	lead := make([]byte, 96)
+	if _, err := io.ReadFull(br, lead); err != nil || !bytes.Equal(lead[:4], []byte{0xed, 0xab, 0xee, 0xdb}) {
+		return nil, 0, 0, errors.New("not an rpm package")
+	}
+
+	// The signature header is padded to 8 bytes
+	_, sigSize, err := readRPMHeader(br)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	padding := (8 - sigSize%8) % 8
+	if _, err := io.CopyN(io.Discard, br, padding); err != nil {
+		return nil, 0, 0, errors.New("truncated rpm package")
+	}
+
+	start = int64(len(lead)) + sigSize + padding
+	h, size, err := readRPMHeader(br)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return h, start, start + size, nil
+}
+
+// strings returns the values of a string, string array or i18n string tag (the default locale only)
+func (h *rpmHeader) strings(tag uint32) []string {
+	e, ok := h.entries[tag]
+	if !ok || int(e.Offset) > len(h.store) {
+		return nil
+	}
+	n := int(e.Count)
+	switch e.Type {
+	case rpmTypeString:
+		n = 1
+	case rpmTypeI18NString:
+		n = min(n, 1)
+	case rpmTypeStringArray:
+	default:
+		return nil
+	}
+
+	data := h.store[e.Offset:]
+	values := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return nil
+		}
+		values = append(values, string(data[:end]))
+		data = data[end+1:]
+	}
+	return values
+}
+
+func (h *rpmHeader) string(tag uint32) string {
+	if values := h.strings(tag); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// ints returns the values of an integer tag as unsigned numbers
+func (h *rpmHeader) ints(tag uint32) []int64 {
+	e, ok := h.entries[tag]
+	if !ok {
+		return nil
+	}
+	var width int
+	switch e.Type {
+	case rpmTypeChar, rpmTypeInt8:
+		width = 1
+	case rpmTypeInt16:
+		width = 2
+	case rpmTypeInt32:
+		width = 4
+	case rpmTypeInt64:
+		width = 8
+	default:
+		return nil
+	}
+	if int64(e.Offset)+int64(e.Count)*int64(width) > int64(len(h.store)) {
+		return nil
+	}
+
+	values := make([]int64, e.Count)
+	for i := range values {
+		b := h.store[int(e.Offset)+i*width:]
+		switch width {
+		case 1:
+			values[i] = int64(b[0])
+		case 2:
+			values[i] = int64(binary.BigEndian.Uint16(b))
+		case 4:
+			values[i] = int64(binary.BigEndian.Uint32(b))
+		case 8:
+			values[i] = int64(binary.BigEndian.Uint64(b))
+		}
+	}
+	return values
+}
+
+func (h *rpmHeader) int(tag uint32) int64 {
+	if values := h.ints(tag); len(values) > 0 {
+		return values[0]
+	}
+	return 0
+}
+
+type rpmVersion struct {
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+}
+
+type rpmEntry struct {
+	Name  string `xml:"name,attr"`
+	Flags string `xml:"flags,attr,omitempty"`
+	Epoch string `xml:"epoch,attr,omitempty"`
+	Ver   string `xml:"ver,attr,omitempty"`
+	Rel   string `xml:"rel,attr,omitempty"`
+	Pre   string `xml:"pre,attr,omitempty"`
+}
+
+type rpmFile struct {
+	Type string `xml:"type,attr,omitempty"`
+	Path string `xml:",chardata"`
+}
+
+type rpmChangelog struct {
+	Author string `xml:"author,attr"`
+	Date   int64  `xml:"date,attr"`
+	Text   string `xml:",chardata"`
+}
+
+// rpmPackage is what the metadata needs to know about a package, as cached in repodata/packages.json.gz
+type rpmPackage struct {
+	Path   string
+	SHA256 string
+
+	Name        string
+	Arch        string
+	Version     rpmVersion
+	Summary     string
+	Description string
+	Packager    string
+	URL         string
+	License     string
+	Vendor      string
+	Group       string
+	BuildHost   string
+	SourceRPM   string
+
+	FileTime      int64
+	BuildTime     int64
+	PackageSize   int64
+	InstalledSize int64
+	ArchiveSize   int64
+	HeaderStart   int64
+	HeaderEnd     int64
+
+	Provides   []rpmEntry
+	Requires   []rpmEntry
+	Conflicts  []rpmEntry
+	Obsoletes  []rpmEntry
+	Files      []rpmFile
+	Changelogs []rpmChangelog
+}
+
+// parseRPMEVR splits [epoch:]version[-release]
+func parseRPMEVR(evr string) rpmVersion {
+	v := rpmVersion{Epoch: "0"}
+	if epoch, rest, ok := strings.Cut(evr, ":"); ok {
+		v.Epoch, evr = epoch, rest
+	}
+	if i := strings.LastIndex(evr, "-"); i >= 0 {
+		v.Ver, v.Rel = evr[:i], evr[i+1:]
+	} else {
+		v.Ver = evr
+	}
+	return v
+}
+
+// rpmDependencies combines the name, flags and version tags of a dependency kind
+func (h *rpmHeader) rpmDependencies(nameTag, flagsTag, versionTag uint32) []rpmEntry {
+	names := h.strings(nameTag)
+	flags := h.ints(flagsTag)
+	versions := h.strings(versionTag)
+
+	var entries []rpmEntry
+	seen := make(map[rpmEntry]bool)
+	for i, name := range names {
+		var f int64
+		if i < len(flags) {
+			f = flags[i]
+		}
+		// rpmlib() requirements are satisfied by rpm itself, createrepo leaves them out as well
+		if f&rpmSenseRPMLib != 0 || strings.HasPrefix(name, "rpmlib(") {
+			continue
+		}
+
+		e := rpmEntry{Name: name}
+		switch f & (rpmSenseLess | rpmSenseGreater | rpmSenseEqual) {
+		case rpmSenseLess:
+			e.Flags = "LT"
+		case rpmSenseGreater:
+			e.Flags = "GT"
+		case rpmSenseEqual:
+			e.Flags = "EQ"
+		case rpmSenseLess | rpmSenseEqual:
+			e.Flags = "LE"
+		case rpmSenseGreater | rpmSenseEqual:
+			e.Flags = "GE"
+		}
+		if i < len(versions) && versions[i] != "" {
+			v := parseRPMEVR(versions[i])
+			e.Epoch, e.Ver, e.Rel = v.Epoch, v.Ver, v.Rel
+		}
+		if f&(rpmSensePrereq|rpmSenseScripts) != 0 {
+			e.Pre = "1"
+		}
+		if !seen[e] {
+			seen[e] = true
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// rpmFiles lists the files of a package, from the compressed file list or the old flat one
+func (h *rpmHeader) rpmFiles() []rpmFile {
+	names := h.strings(rpmTagOldFilenames)
+	if names == nil {
+		dirs := h.strings(rpmTagDirNames)
+		dirIndexes := h.ints(rpmTagDirIndexes)
+		for i, base := range h.strings(rpmTagBaseNames) {
+			if i >= len(dirIndexes) || int(dirIndexes[i]) >= len(dirs) {
+				return nil
+			}
+			names = append(names, dirs[dirIndexes[i]]+base)
+		}
+	}
+
+	modes := h.ints(rpmTagFileModes)
+	flags := h.ints(rpmTagFileFlags)
+	files := make([]rpmFile, 0, len(names))
+	for i, name := range names {
+		f := rpmFile{Path: name}
+		if i < len(flags) && flags[i]&rpmFileGhost != 0 {
+			f.Type = "ghost"
+		} else if i < len(modes) && modes[i]&0xf000 == 0x4000 {
+			f.Type = "dir"
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// newRPMPackage collects the metadata of a stored package from its header
+func newRPMPackage(h *rpmHeader, start, end int64, res MetaResource) rpmPackage {
+	pkg := rpmPackage{
+		Path:          res.Path,
+		SHA256:        res.SHA256,
+		Name:          h.string(rpmTagName),
+		Arch:          h.string(rpmTagArch),
+		Version:       rpmVersion{Epoch: "0", Ver: h.string(rpmTagVersion), Rel: h.string(rpmTagRelease)},
+		Summary:       h.string(rpmTagSummary),
+		Description:   h.string(rpmTagDescription),
+		Packager:      h.string(rpmTagPackager),
+		URL:           h.string(rpmTagURL),
+		License:       h.string(rpmTagLicense),
+		Vendor:        h.string(rpmTagVendor),
+		Group:         h.string(rpmTagGroup),
+		BuildHost:     h.string(rpmTagBuildHost),
+		SourceRPM:     h.string(rpmTagSourceRPM),
+		FileTime:      res.ModTime.Unix(),
+		BuildTime:     h.int(rpmTagBuildTime),
+		PackageSize:   res.Size,
+		InstalledSize: h.int(rpmTagSize),
+		ArchiveSize:   h.int(rpmTagArchiveSize),
+		HeaderStart:   start,
+		HeaderEnd:     end,
+		Provides:      h.rpmDependencies(rpmTagProvideName, rpmTagProvideFlags, rpmTagProvideVersion),
+		Requires:      h.rpmDependencies(rpmTagRequireName, rpmTagRequireFlags, rpmTagRequireVersion),
+		Conflicts:     h.rpmDependencies(rpmTagConflictName, rpmTagConflictFlags, rpmTagConflictVersion),
+		Obsoletes:     h.rpmDependencies(rpmTagObsoleteName, rpmTagObsoleteFlags, rpmTagObsoleteVersion),
+		Files:         h.rpmFiles(),
+	}
+	if _, ok := h.entries[rpmTagEpoch]; ok {
+		pkg.Version.Epoch = strconv.FormatInt(h.int(rpmTagEpoch), 10)
+	}
+	// Source packages have no source rpm
+	if pkg.SourceRPM == "" {
+		pkg.Arch = "src"
+	}
+
+	times := h.ints(rpmTagChangelogTime)
+	authors := h.strings(rpmTagChangelogName)
+	texts := h.strings(rpmTagChangelogText)
+	for i := range times {
+		if i < len(authors) && i < len(texts) {
+			pkg.Changelogs = append(pkg.Changelogs, rpmChangelog{Author: authors[i], Date: times[i], Text: texts[i]})
+		}
+	}
+	return pkg
+}
+
+// primary.xml, filelists.xml and other.xml, rpm: elements are written with a literal prefix like createrepo does
+
+type rpmPrimaryXML struct {
+	XMLName  xml.Name            `xml:"metadata"`
+	Xmlns    string              `xml:"xmlns,attr"`
+	XmlnsRPM string              `xml:"xmlns:rpm,attr"`
+	Count    int                 `xml:"packages,attr"`
+	Packages []rpmPrimaryPackage `xml:"package"`
+}
+
+type rpmPrimaryPackage struct {
+	Type     string     `xml:"type,attr"`
+	Name     string     `xml:"name"`
+	Arch     string     `xml:"arch"`
+	Version  rpmVersion `xml:"version"`
+	Checksum struct {
+		Type  string `xml:"type,attr"`
+		PkgID string `xml:"pkgid,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"checksum"`
+	Summary     string `xml:"summary"`
+	Description string `xml:"description"`
+	Packager    string `xml:"packager"`
+	URL         string `xml:"url"`
+	Time        struct {
+		File  int64 `xml:"file,attr"`
+		Build int64 `xml:"build,attr"`
+	} `xml:"time"`
+	Size struct {
+		Package   int64 `xml:"package,attr"`
+		Installed int64 `xml:"installed,attr"`
+		Archive   int64 `xml:"archive,attr"`
+	} `xml:"size"`
+	Location struct {
+		Href string `xml:"href,attr"`
+	} `xml:"location"`
+	Format rpmFormat `xml:"format"`
+}
+
+type rpmFormat struct {
+	License     string `xml:"rpm:license"`
+	Vendor      string `xml:"rpm:vendor"`
+	Group       string `xml:"rpm:group"`
+	BuildHost   string `xml:"rpm:buildhost"`
+	SourceRPM   string `xml:"rpm:sourcerpm"`
+	HeaderRange struct {
+		Start int64 `xml:"start,attr"`
+		End   int64 `xml:"end,attr"`
+	} `xml:"rpm:header-range"`
+	Provides  *rpmEntries `xml:"rpm:provides,omitempty"`
+	Requires  *rpmEntries `xml:"rpm:requires,omitempty"`
+	Conflicts *rpmEntries `xml:"rpm:conflicts,omitempty"`
+	Obsoletes *rpmEntries `xml:"rpm:obsoletes,omitempty"`
+	Files     []rpmFile   `xml:"file"`
+}
+
+type rpmEntries struct {
+	Entries []rpmEntry `xml:"rpm:entry"`
+}
+
+func newRPMEntries(entries []rpmEntry) *rpmEntries {
+	if len(entries) == 0 {
+		return nil
+	}
+	return &rpmEntries{Entries: entries}
+}
+
+type rpmFilelistsXML struct {
+	XMLName  xml.Name         `xml:"filelists"`
+	Xmlns    string           `xml:"xmlns,attr"`
+	Count    int              `xml:"packages,attr"`
+	Packages []rpmFilePackage `xml:"package"`
+}
+
+type rpmFilePackage struct {
+	PkgID      string         `xml:"pkgid,attr"`
+	Name       string         `xml:"name,attr"`
+	Arch       string         `xml:"arch,attr"`
+	Version    rpmVersion     `xml:"version"`
+	Files      []rpmFile      `xml:"file,omitempty"`
+	Changelogs []rpmChangelog `xml:"changelog,omitempty"`
+}
+
+type rpmOtherXML struct {
+	XMLName  xml.Name         `xml:"otherdata"`
+	Xmlns    string           `xml:"xmlns,attr"`
+	Count    int              `xml:"packages,attr"`
+	Packages []rpmFilePackage `xml:"package"`
+}
+
+type rpmRepomdXML struct {
+	XMLName  xml.Name        `xml:"repomd"`
+	Xmlns    string          `xml:"xmlns,attr"`
+	XmlnsRPM string          `xml:"xmlns:rpm,attr"`
+	Revision int64           `xml:"revision"`
+	Data     []rpmRepomdData `xml:"data"`
+}
+
+type rpmRepomdData struct {
+	Type     string `xml:"type,attr"`
+	Checksum struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"checksum"`
+	OpenChecksum struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"open-checksum"`
+	Location struct {
+		Href string `xml:"href,attr"`
+	} `xml:"location"`
+	Timestamp int64 `xml:"timestamp"`
+	Size      int64 `xml:"size"`
+	OpenSize  int64 `xml:"open-size"`
+}
+
+// isPrimaryRPMFile reports if a file belongs in primary.xml, which only lists the paths packages commonly depend on
+func isPrimaryRPMFile(name string) bool {
+	return strings.HasPrefix(name, "/etc/") || strings.Contains(name, "bin/") || name == "/usr/lib/sendmail"
+}
+
+// rpmMetadata renders primary, filelists and other of the given packages
+func rpmMetadata(root string, packages []rpmPackage) (primary, filelists, other []byte, err error) {
+	primaryDoc := rpmPrimaryXML{Xmlns: "http://linux.duke.edu/metadata/common", XmlnsRPM: "http://linux.duke.edu/metadata/rpm", Count: len(packages)}
+	filelistsDoc := rpmFilelistsXML{Xmlns: "http://linux.duke.edu/metadata/filelists", Count: len(packages)}
+	otherDoc := rpmOtherXML{Xmlns: "http://linux.duke.edu/metadata/other", Count: len(packages)}
+
+	for _, pkg := range packages {
+		p := rpmPrimaryPackage{Type: "rpm", Name: pkg.Name, Arch: pkg.Arch, Version: pkg.Version,
+			Summary: pkg.Summary, Description: pkg.Description, Packager: pkg.Packager, URL: pkg.URL}
+		p.Checksum.Type, p.Checksum.PkgID, p.Checksum.Value = "sha256", "YES", pkg.SHA256
+		p.Time.File, p.Time.Build = pkg.FileTime, pkg.BuildTime
+		p.Size.Package, p.Size.Installed, p.Size.Archive = pkg.PackageSize, pkg.InstalledSize, pkg.ArchiveSize
+		p.Location.Href = strings.TrimPrefix(pkg.Path, root+"/")
+		p.Format = rpmFormat{
+			License: pkg.License, Vendor: pkg.Vendor, Group: pkg.Group, BuildHost: pkg.BuildHost, SourceRPM: pkg.SourceRPM,
+			Provides:  newRPMEntries(pkg.Provides),
+			Requires:  newRPMEntries(pkg.Requires),
+			Conflicts: newRPMEntries(pkg.Conflicts),
+			Obsoletes: newRPMEntries(pkg.Obsoletes),
+		}
+		p.Format.HeaderRange.Start, p.Format.HeaderRange.End = pkg.HeaderStart, pkg.HeaderEnd
+		for _, f := range pkg.Files {
+			if isPrimaryRPMFile(f.Path) {
+				p.Format.Files = append(p.Format.Files, f)
+			}
+		}
+		primaryDoc.Packages = append(primaryDoc.Packages, p)
+
+		ref := rpmFilePackage{PkgID: pkg.SHA256, Name: pkg.Name, Arch: pkg.Arch, Version: pkg.Version}
+		ref.Files = pkg.Files
+		filelistsDoc.Packages = append(filelistsDoc.Packages, ref)
+		ref.Files, ref.Changelogs = nil, pkg.Changelogs
+		otherDoc.Packages = append(otherDoc.Packages, ref)
+	}
+
+	if primary, err = marshalXMLDocument(primaryDoc); err != nil {
+		return
+	}
+	if filelists, err = marshalXMLDocument(filelistsDoc); err != nil {
+		return
+	}
+	other, err = marshalXMLDocument(otherDoc)
+	return
+}
+
+func marshalXMLDocument(doc any) ([]byte, error) {
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(gz)
+}
+
+// rpmPackages returns the records of the .rpm files of a repository
+func (h *Handler) rpmPackages(root string) ([]MetaResource, error) {
+	candidates, err := h.filesUnder(root + "/")
+	if err != nil {
+		return nil, err
+	}
+	var rpms []MetaResource
+	for _, r := range candidates {
+		if strings.HasSuffix(r.Path, ".rpm") {
+			rpms = append(rpms, r)
+		}
+	}
+	return rpms, nil
+}
+
+// updateRPMRepodata rebuilds the metadata of the YUM repositories the changed paths belong to
+func (h *Handler) updateRPMRepodata(paths ...string) {
+	roots := make(map[string]bool)
+	for _, p := range paths {
+		root, ok := h.Config.RPMRepo(p)
+		if !ok || strings.HasPrefix(p, path.Join(root, rpmRepodataDir)+"/") {
+			continue
+		}
+		roots[root] = true
+	}
+
+	for root := range roots {
+		if err := h.writeRPMRepodata(root); err != nil {
+			h.Log.WithError(err).Errorf("rpm: failed to update the repodata of %s", root)
+		}
+	}
+}
+
+func (h *Handler) writeRPMRepodata(root string) error {
+	repodata := path.Join(root, rpmRepodataDir)
+	records, err := h.rpmPackages(root)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		for _, f := range []string{"repomd.xml", "primary.xml.gz", "filelists.xml.gz", "other.xml.gz", rpmCacheFile} {
+			if err := h.removeFile(path.Join(repodata, f)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	cached := make(map[string]rpmPackage)
+	if old, err := h.readRPMCache(path.Join(repodata, rpmCacheFile)); err == nil {
+		for _, pkg := range old {
+			cached[pkg.Path] = pkg
+		}
+	}
+
+	packages := make([]rpmPackage, 0, len(records))
+	for _, res := range records {
+		pkg, ok := cached[res.Path]
+		if !ok || pkg.SHA256 != res.SHA256 {
+			pkg, err = h.readRPMPackage(res)
+			if err != nil {
+				h.Log.WithError(err).Warnf("rpm: skipping %s", res.Path)
+				continue
+			}
+		}
+		packages = append(packages, pkg)
+	}
+
+	primary, filelists, other, err := rpmMetadata(root, packages)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to do if the package list didn't change
+	primarySum := sha256.Sum256(primary)
+	var repomd rpmRepomdXML
+	if old, err := h.readStoredFile(path.Join(repodata, "repomd.xml")); err == nil && xml.Unmarshal(old, &repomd) == nil {
+		for _, d := range repomd.Data {
+			if d.Type == "primary" && d.OpenChecksum.Value == hex.EncodeToString(primarySum[:]) {
+				return nil
+			}
+		}
+	}
+
+	cache, err := json.Marshal(packages)
+	if err != nil {
+		return err
+	}
+	if cache, err = gzipBytes(cache); err != nil {
+		return err
+	}
+	if err := h.writeGeneratedFile(path.Join(repodata, rpmCacheFile), "application/gzip", cache); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	repomd = rpmRepomdXML{Xmlns: "http://linux.duke.edu/metadata/repo", XmlnsRPM: "http://linux.duke.edu/metadata/rpm", Revision: now}
+	for _, f := range []struct {
+		kind string
+		data []byte
+	}{{"primary", primary}, {"filelists", filelists}, {"other", other}} {
+		compressed, err := gzipBytes(f.data)
+		if err != nil {
+			return err
+		}
+		name := f.kind + ".xml.gz"
+		if err := h.writeGeneratedFile(path.Join(repodata, name), "application/gzip", compressed); err != nil {
+			return err
+		}
+
+		openSum := sha256.Sum256(f.data)
+		sum := sha256.Sum256(compressed)
+		d := rpmRepomdData{Type: f.kind, Timestamp: now, Size: int64(len(compressed)), OpenSize: int64(len(f.data))}
+		d.Checksum.Type, d.Checksum.Value = "sha256", hex.EncodeToString(sum[:])
+		d.OpenChecksum.Type, d.OpenChecksum.Value = "sha256", hex.EncodeToString(openSum[:])
+		d.Location.Href = path.Join(rpmRepodataDir, name)
+		repomd.Data = append(repomd.Data, d)
+	}
+
+	// repomd.xml goes last, clients only see the new files once it points to them
+	data, err := marshalXMLDocument(repomd)
+	if err != nil {
+		return err
+	}
+	return h.writeGeneratedFile(path.Join(repodata, "repomd.xml"), "application/xml", data)
+}
+
+func (h *Handler) readRPMPackage(res MetaResource) (rpmPackage, error) {
+	f, err := h.Storage.Open(res.Path)
+	if err != nil {
+		return rpmPackage{}, err
+	}
+	defer f.Close()
+
+	header, start, end, err := readRPM(f)
+	if err != nil {
+		return rpmPackage{}, err
+	}
+	pkg := newRPMPackage(header, start, end, res)
+	if pkg.Name == "" || pkg.Version.Ver == "" {
+		return rpmPackage{}, fmt.Errorf("rpm header has no name or version")
+	}
+	return pkg, nil
+}
+
+func (h *Handler) readRPMCache(p string) ([]rpmPackage, error) {
+	data, err := h.readStoredFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = gunzipBytes(data); err != nil {
+		return nil, err
+	}
+	var packages []rpmPackage
+	err = json.Unmarshal(data, &packages)
+	return packages, err
+}
+
+func (h *Handler) readStoredFile(p string) ([]byte, error) {
+	f, err := h.Storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
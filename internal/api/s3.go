@@ -0,0 +1,885 @@
+package api
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kovi/yaar/internal/audit"
+	"github.com/kovi/yaar/internal/auth"
+)
+
+// S3 API subset for tools that already speak S3. Buckets are the top-level directories and keys the paths
+// below them. Only path-style requests signed with SigV4 (header or presigned URL) are answered here,
+// anonymous requests are plain file downloads.
+
+const s3NS = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// s3MaxKeys is the default and upper limit of keys per listing
+const s3MaxKeys = 1000
+
+var s3HashRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+func s3Error(c *gin.Context, status int, code, message string) {
+	if c.Request.Method == http.MethodHead {
+		c.Status(status)
+		return
+	}
+	s3XML(c, status, s3ErrorResponse{Code: code, Message: message, Resource: c.Request.URL.Path})
+}
+
+func s3XML(c *gin.Context, status int, v any) {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Data(status, "application/xml", append([]byte(xml.Header), out...))
+}
+
+func s3ETag(md5 string) string {
+	return `"` + md5 + `"`
+}
+
+// HandleS3 answers SigV4 signed requests. Returns false for all other requests.
+func (h *Handler) HandleS3(c *gin.Context) bool {
+	if !auth.IsS3Request(c.Request) {
+		return false
+	}
+	if err := auth.IdentifyS3(c, h.DB, h.Config); err != nil {
+		logger(c).WithError(err).Info("s3: authentication failed")
+		code := "AccessDenied"
+		for _, known := range []error{auth.ErrS3InvalidAccessKey, auth.ErrS3Malformed, auth.ErrS3Signature, auth.ErrS3ClockSkew} {
+			if errors.Is(err, known) {
+				code = known.Error()
+			}
+		}
+		s3Error(c, http.StatusForbidden, code, "Request could not be authenticated")
+		return true
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(c.Request.URL.Path, "/"), "/")
+	q := c.Request.URL.Query()
+	method := c.Request.Method
+	if bucket != "" && (bucket == "_" || strings.Contains(bucket, "..") || isSystemPath("/"+bucket)) {
+		s3Error(c, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return true
+	}
+
+	switch {
+	case bucket == "" && method == http.MethodGet:
+		h.s3ListBuckets(c)
+	case key == "" && method == http.MethodGet && q.Has("location"):
+		s3XML(c, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: s3NS})
+	case key == "" && method == http.MethodGet:
+		h.s3ListObjects(c, bucket)
+	case key == "" && method == http.MethodHead:
+		if stat, err := h.Storage.Stat("/" + bucket); err != nil || !stat.IsDir() {
+			c.Status(http.StatusNotFound)
+			return true
+		}
+		c.Status(http.StatusOK)
+	case key == "" && method == http.MethodPut:
+		h.s3CreateBucket(c, bucket)
+	case key == "" && method == http.MethodPost && q.Has("delete"):
+		h.s3DeleteObjects(c, bucket)
+	case key == "":
+		s3Error(c, http.StatusNotImplemented, "NotImplemented", "Not supported on buckets")
+
+	case method == http.MethodPost && q.Has("uploads"):
+		h.s3CreateMultipartUpload(c, bucket, key)
+	case method == http.MethodPut && q.Has("uploadId"):
+		h.s3UploadPart(c, bucket, key)
+	case method == http.MethodPost && q.Has("uploadId"):
+		h.s3CompleteMultipartUpload(c, bucket, key)
+	case method == http.MethodDelete && q.Has("uploadId"):
+		h.s3AbortMultipartUpload(c, bucket, key)
+	case method == http.MethodPut && c.GetHeader("X-Amz-Copy-Source") == "":
+		h.s3PutObject(c, bucket, key)
+	case method == http.MethodGet || method == http.MethodHead:
+		h.s3GetObject(c, bucket, key)
+	case method == http.MethodDelete:
+		h.s3DeleteObject(c, bucket, key)
+	default:
+		s3Error(c, http.StatusNotImplemented, "NotImplemented", "Not supported")
+	}
+	return true
+}
+
+// s3Path is the tree path of a key, trailing slashes are dropped
+func s3Path(bucket, key string) string {
+	return dbPath("/" + bucket + "/" + key)
+}
+
+/* ===================== BUCKETS & LISTINGS ===================== */
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+func (h *Handler) s3ListBuckets(c *gin.Context) {
+	entries, err := h.Storage.List("/")
+	if err != nil {
+		s3Error(c, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	result := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct{ ID, DisplayName string }
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3NS}
+	result.Owner.ID = c.GetString("username")
+	result.Owner.DisplayName = c.GetString("username")
+	for _, e := range entries {
+		if !e.IsDir() || !h.canList(c, "/"+e.Name()) {
+			continue
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{Name: e.Name(), CreationDate: e.ModTime().UTC().Format(s3TimeFormat)})
+	}
+	s3XML(c, http.StatusOK, result)
+}
+
+func (h *Handler) s3CreateBucket(c *gin.Context, bucket string) {
+	p := "/" + bucket
+	if stat, err := h.Storage.Stat(p); err == nil && stat.IsDir() {
+		c.Status(http.StatusOK)
+		return
+	}
+	if ok, msg := h.CanModify(p, c.GetStringSlice("allowed_paths"), ModifyOptions{}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionMkdir, p, errors.New(msg))
+		s3Error(c, http.StatusForbidden, "AccessDenied", msg)
+		return
+	}
+	if err := h.Storage.Mkdir(p); err != nil {
+		s3Error(c, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	h.Audit.WithContext(c).Success(audit.ActionMkdir, p)
+	c.Header("Location", p)
+	c.Status(http.StatusOK)
+}
+
+type s3Entry struct {
+	key  string // directories end with a slash
+	info fs.FileInfo
+}
+
+// s3Keys returns the keys of bucket starting with prefix, sorted.
+// Unless recursive only the directory holding prefix is read, its subdirectories are "<dir>/" keys.
+func (h *Handler) s3Keys(c *gin.Context, bucket, prefix string, recursive bool) ([]s3Entry, error) {
+	var result []s3Entry
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := h.Storage.List(path.Join("/", bucket, dir))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		for _, e := range entries {
+			key := dir + e.Name()
+			if !h.canSee(c, path.Join("/", bucket, key), e.IsDir()) {
+				continue
+			}
+			if !e.IsDir() {
+				if strings.HasPrefix(key, prefix) {
+					result = append(result, s3Entry{key: key, info: e})
+				}
+				continue
+			}
+			key += "/"
+			if !recursive {
+				if strings.HasPrefix(key, prefix) {
+					result = append(result, s3Entry{key: key, info: e})
+				}
+			} else if strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key) {
+				if err := walk(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(prefix[:strings.LastIndex(prefix, "/")+1]); err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].key < result[j].key })
+	return result, nil
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	MaxKeys               int
+	Delimiter             string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+// s3ListObjects handles ListObjectsV2 and the older ListObjects
+func (h *Handler) s3ListObjects(c *gin.Context, bucket string) {
+	if stat, err := h.Storage.Stat("/" + bucket); err != nil || !stat.IsDir() {
+		s3Error(c, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	q := c.Request.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3Error(c, http.StatusBadRequest, "InvalidArgument", "Invalid max-keys")
+			return
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+
+	result := s3ListBucketResult{Xmlns: s3NS, Name: bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys}
+	encode := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		result.EncodingType = "url"
+		encode = url.QueryEscape
+	}
+
+	marker := q.Get("marker")
+	if v2 {
+		marker = q.Get("start-after")
+		result.StartAfter = encode(marker)
+		if token := q.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				s3Error(c, http.StatusBadRequest, "InvalidArgument", "Invalid continuation token")
+				return
+			}
+			marker = string(decoded)
+			result.ContinuationToken = token
+		}
+	} else {
+		result.Marker = &marker
+	}
+
+	entries, err := h.s3Keys(c, bucket, prefix, delimiter != "/")
+	if err != nil {
+		s3Error(c, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	var last string
+	var files []s3Entry
+	count := 0
+	for _, e := range entries {
+		if e.key <= marker {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(e.key[len(prefix):], delimiter); i >= 0 {
+				cp := e.key[:len(prefix)+i+len(delimiter)]
+				if cp <= marker || cp == last {
+					continue
+				}
+				if count == maxKeys {
+					result.IsTruncated = true
+					break
+				}
+				result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(cp)})
+				last = cp
+				count++
+				continue
+			}
+		}
+		if e.info.IsDir() {
+			continue
+		}
+		if count == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		files = append(files, e)
+		last = e.key
+		count++
+	}
+
+	paths := make([]string, len(files))
+	for i, e := range files {
+		paths[i] = s3Path(bucket, e.key)
+	}
+	var metas []MetaResource
+	h.DB.Select("path", "md5").Where("path IN ?", paths).Find(&metas)
+	md5s := make(map[string]string, len(metas))
+	for _, m := range metas {
+		md5s[m.Path] = m.MD5
+	}
+	for i, e := range files {
+		result.Contents = append(result.Contents, s3Object{
+			Key:          encode(e.key),
+			LastModified: e.info.ModTime().UTC().Format(s3TimeFormat),
+			ETag:         s3ETag(md5s[paths[i]]),
+			Size:         e.info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	if v2 {
+		result.KeyCount = &count
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else if result.IsTruncated && delimiter != "" {
+		result.NextMarker = encode(last)
+	}
+	s3XML(c, http.StatusOK, result)
+}
+
+/* ===================== OBJECTS ===================== */
+
+func (h *Handler) s3GetObject(c *gin.Context, bucket, key string) {
+	p := s3Path(bucket, key)
+	f, err := h.Storage.Open(p)
+	if err != nil || !h.canRead(c, p) {
+		s3Error(c, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		s3Error(c, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	if meta, _ := h.GetFileMeta(p); meta != nil {
+		if meta.MD5 != "" {
+			c.Header("ETag", s3ETag(meta.MD5))
+		}
+		if meta.ContentType != "" {
+			c.Header("Content-Type", meta.ContentType)
+		}
+		if meta.SHA256 != "" {
+			c.Header("X-Checksum-Sha256", meta.SHA256)
+		}
+	}
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), f)
+}
+
+// s3Body returns the request body, decoding the aws-chunked encoding of streaming uploads
+func s3Body(c *gin.Context) io.Reader {
+	if strings.HasPrefix(c.GetHeader("X-Amz-Content-Sha256"), "STREAMING-") || strings.Contains(c.GetHeader("Content-Encoding"), "aws-chunked") {
+		return &awsChunkedReader{r: bufio.NewReader(c.Request.Body)}
+	}
+	return c.Request.Body
+}
+
+// s3Policy holds the checksums the client sent along with a body and the tags of x-amz-tagging
+func s3Policy(c *gin.Context) (uploadPolicy, error) {
+	var policy uploadPolicy
+	if hash := c.GetHeader("X-Amz-Content-Sha256"); s3HashRe.MatchString(hash) {
+		policy.SHA256 = hash
+	}
+	if sum := c.GetHeader("Content-Md5"); sum != "" {
+		raw, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil {
+			return policy, errors.New("invalid Content-MD5")
+		}
+		policy.MD5 = hex.EncodeToString(raw)
+	}
+	if tagging := c.GetHeader("X-Amz-Tagging"); tagging != "" {
+		values, err := url.ParseQuery(tagging)
+		if err != nil {
+			return policy, errors.New("invalid x-amz-tagging")
+		}
+		var tags []string
+		for k, vs := range values {
+			for _, v := range vs {
+				tags = append(tags, k+"="+v)
+			}
+		}
+		sort.Strings(tags)
+		policy.Tags = strings.Join(tags, ",")
+	}
+	return policy, nil
+}
+
+// s3Receive writes r to a temp file, calculating its checksums.
+// The caller removes the file, which is already closed.
+func (h *Handler) s3Receive(r io.Reader) (string, int64, fileSums, error) {
+	out, err := h.createTempFile()
+	if err != nil {
+		return "", 0, fileSums{}, err
+	}
+	defer out.Close()
+
+	hashes := newHashSet()
+	limit := h.Config.Storage.MaxUploadSizeBytes
+	written, err := io.Copy(io.MultiWriter(out, hashes), io.LimitReader(r, limit+1))
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil && written > limit {
+		err = errS3TooLarge
+	}
+	return out.Name(), written, hashes.Sums(), err
+}
+
+var errS3TooLarge = errors.New("upload exceeds the maximum size")
+
+// s3WriteError answers a failed receive or verification
+func s3WriteError(c *gin.Context, err error) {
+	if errors.Is(err, errS3TooLarge) {
+		s3Error(c, http.StatusBadRequest, "EntityTooLarge", err.Error())
+		return
+	}
+	s3Error(c, http.StatusBadRequest, "IncompleteBody", err.Error())
+}
+
+// s3Authorize checks that the caller may write p. On failure the response is already written.
+func (h *Handler) s3Authorize(c *gin.Context, p string) bool {
+	_, err := h.Storage.Stat(p)
+	opts := ModifyOptions{IgnoreProtected: err != nil, IsUpload: true}
+	if ok, msg := h.CanModify(p, c.GetStringSlice("allowed_paths"), opts); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, p, errors.New(msg))
+		s3Error(c, http.StatusForbidden, "AccessDenied", msg)
+		return false
+	}
+	return true
+}
+
+func (h *Handler) s3PutObject(c *gin.Context, bucket, key string) {
+	p := s3Path(bucket, key)
+	stat, err := h.Storage.Stat(p)
+	if err == nil && stat.IsDir() {
+		if strings.HasSuffix(key, "/") {
+			// Directory markers of existing directories
+			c.Header("ETag", s3ETag(hex.EncodeToString(md5.New().Sum(nil))))
+			c.Status(http.StatusOK)
+			return
+		}
+		s3Error(c, http.StatusConflict, "InvalidRequest", "A directory with that name exists")
+		return
+	}
+	if err == nil && c.GetHeader("If-None-Match") == "*" {
+		s3Error(c, http.StatusPreconditionFailed, "PreconditionFailed", "The key already exists")
+		return
+	}
+	if !h.s3Authorize(c, p) {
+		return
+	}
+
+	if strings.HasSuffix(key, "/") {
+		// Empty objects ending with a slash are how S3 tools create directories
+		if err := h.Storage.Mkdir(p); err != nil {
+			s3Error(c, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		h.Audit.WithContext(c).Success(audit.ActionMkdir, p)
+		c.Header("ETag", s3ETag(hex.EncodeToString(md5.New().Sum(nil))))
+		c.Status(http.StatusOK)
+		return
+	}
+
+	policy, err := s3Policy(c)
+	if err != nil {
+		s3Error(c, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	tempPath, size, sums, err := h.s3Receive(s3Body(c))
+	defer os.Remove(tempPath)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, p, err)
+		s3WriteError(c, err)
+		return
+	}
+	if mismatch := policy.verify(sums); mismatch != "" {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, p, errors.New(mismatch), "status", "corrupted")
+		code := "XAmzContentSHA256Mismatch"
+		if policy.MD5 != "" && policy.MD5 != sums.MD5 {
+			code = "BadDigest"
+		}
+		s3Error(c, http.StatusBadRequest, code, mismatch)
+		return
+	}
+
+	res, err := h.saveUploadMeta(p, c.GetHeader("Content-Type"), size, sums, policy, tempPath)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, p, err)
+		s3Error(c, http.StatusInternalServerError, "InternalError", "Failed to store object")
+		return
+	}
+	h.Audit.WithContext(c).Success(audit.ActionUpload, p, "size", size, "sha256", res.SHA256)
+	h.afterChange(p)
+	c.Header("ETag", s3ETag(sums.MD5))
+	c.Status(http.StatusOK)
+}
+
+// s3Delete removes the file at p. Deleting a missing key is no error in S3.
+func (h *Handler) s3Delete(c *gin.Context, p string) (code, message string) {
+	stat, err := h.Storage.Stat(p)
+	if err != nil {
+		return "", ""
+	}
+	if stat.IsDir() {
+		// Directory markers: only empty directories go away
+		if empty, err := h.isDirEmpty(p); err != nil || !empty {
+			return "", ""
+		}
+	}
+	if ok, msg := h.CanModify(p, c.GetStringSlice("delete_paths"), ModifyOptions{}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionDelete, p, errors.New(msg))
+		return "AccessDenied", msg
+	}
+	if _, err := h.removeTree(p); err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionDelete, p, err)
+		return "InternalError", err.Error()
+	}
+	h.Audit.WithContext(c).Success(audit.ActionDelete, p)
+	h.afterChange(p)
+	return "", ""
+}
+
+func (h *Handler) s3DeleteObject(c *gin.Context, bucket, key string) {
+	if code, msg := h.s3Delete(c, s3Path(bucket, key)); code != "" {
+		status := http.StatusForbidden
+		if code == "InternalError" {
+			status = http.StatusInternalServerError
+		}
+		s3Error(c, status, code, msg)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// s3DeleteObjects handles the batch delete (POST /<bucket>?delete)
+func (h *Handler) s3DeleteObjects(c *gin.Context, bucket string) {
+	var req struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(c.Request.Body, 2<<20)).Decode(&req); err != nil {
+		s3Error(c, http.StatusBadRequest, "MalformedXML", "Invalid delete request")
+		return
+	}
+	type deleted struct {
+		Key string
+	}
+	type failed struct {
+		Key, Code, Message string
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Xmlns   string    `xml:"xmlns,attr"`
+		Deleted []deleted `xml:"Deleted"`
+		Errors  []failed  `xml:"Error"`
+	}{Xmlns: s3NS}
+	for _, o := range req.Objects {
+		if code, msg := h.s3Delete(c, s3Path(bucket, o.Key)); code != "" {
+			result.Errors = append(result.Errors, failed{Key: o.Key, Code: code, Message: msg})
+		} else if !req.Quiet {
+			result.Deleted = append(result.Deleted, deleted{Key: o.Key})
+		}
+	}
+	s3XML(c, http.StatusOK, result)
+}
+
+/* ===================== MULTIPART UPLOADS ===================== */
+
+// Multipart uploads are upload sessions of kind "s3", the parts are files in the session's data directory
+
+func (h *Handler) s3PartPath(uploadID string, part int) string {
+	return filepath.Join(h.uploadDataPath(uploadID), fmt.Sprintf("%05d", part))
+}
+
+func (h *Handler) s3TaggingPath(uploadID string) string {
+	return filepath.Join(h.uploadDataPath(uploadID), "tagging")
+}
+
+// loadS3Upload fetches the multipart upload of the request. On failure the response is already written.
+func (h *Handler) loadS3Upload(c *gin.Context, p string) (*UploadSession, bool) {
+	var s UploadSession
+	r := h.DB.Where("id = ? AND kind = ?", c.Query("uploadId"), "s3").Limit(1).Find(&s)
+	if r.Error != nil {
+		s3Error(c, http.StatusInternalServerError, "InternalError", "Database error")
+		return nil, false
+	}
+	if r.RowsAffected == 0 || s.UserID != c.GetUint("user_id") || s.Path != p {
+		s3Error(c, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+		return nil, false
+	}
+	return &s, true
+}
+
+func (h *Handler) s3CreateMultipartUpload(c *gin.Context, bucket, key string) {
+	p := s3Path(bucket, key)
+	if !h.s3Authorize(c, p) {
+		return
+	}
+	policy, err := s3Policy(c)
+	if err != nil {
+		s3Error(c, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	s := UploadSession{
+		ID:          uuid.New().String(),
+		Kind:        "s3",
+		Path:        p,
+		UserID:      c.GetUint("user_id"),
+		ContentType: c.GetHeader("Content-Type"),
+	}
+	// the tags are applied on completion
+	err = os.MkdirAll(h.uploadDataPath(s.ID), 0755)
+	if err == nil {
+		err = os.WriteFile(h.s3TaggingPath(s.ID), []byte(policy.Tags), 0644)
+	}
+	if err != nil {
+		os.RemoveAll(h.uploadDataPath(s.ID))
+		s3Error(c, http.StatusInternalServerError, "InternalError", "Failed to create upload")
+		return
+	}
+	if err := h.DB.Create(&s).Error; err != nil {
+		os.RemoveAll(h.uploadDataPath(s.ID))
+		s3Error(c, http.StatusInternalServerError, "InternalError", "Failed to create upload")
+		return
+	}
+	s3XML(c, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3NS, Bucket: bucket, Key: key, UploadId: s.ID})
+}
+
+func (h *Handler) s3UploadPart(c *gin.Context, bucket, key string) {
+	s, ok := h.loadS3Upload(c, s3Path(bucket, key))
+	if !ok {
+		return
+	}
+	part, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || part < 1 || part > 10000 {
+		s3Error(c, http.StatusBadRequest, "InvalidArgument", "Part number must be between 1 and 10000")
+		return
+	}
+	policy, err := s3Policy(c)
+	if err != nil {
+		s3Error(c, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+
+	tempPath, _, sums, err := h.s3Receive(s3Body(c))
+	defer os.Remove(tempPath)
+	if err != nil {
+		s3WriteError(c, err)
+		return
+	}
+	if mismatch := policy.verify(sums); mismatch != "" {
+		s3Error(c, http.StatusBadRequest, "BadDigest", mismatch)
+		return
+	}
+	if err := os.Rename(tempPath, h.s3PartPath(s.ID, part)); err != nil {
+		s3Error(c, http.StatusInternalServerError, "InternalError", "Failed to store part")
+		return
+	}
+	h.DB.Model(s).UpdateColumn("updated_at", time.Now())
+	c.Header("ETag", s3ETag(sums.MD5))
+	c.Status(http.StatusOK)
+}
+
+func (h *Handler) s3CompleteMultipartUpload(c *gin.Context, bucket, key string) {
+	p := s3Path(bucket, key)
+	s, ok := h.loadS3Upload(c, p)
+	if !ok {
+		return
+	}
+	unlock, _ := h.lockUpload(s.ID, true)
+	defer unlock()
+
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(c.Request.Body, 2<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		s3Error(c, http.StatusBadRequest, "MalformedXML", "Invalid part list")
+		return
+	}
+	if !h.s3Authorize(c, p) {
+		return
+	}
+
+	// Concatenate the parts, checking each against the ETag the client got for it
+	readers := make([]io.Reader, 0, len(req.Parts))
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			s3Error(c, http.StatusBadRequest, "InvalidPartOrder", "Parts must be listed in ascending order")
+			return
+		}
+		f, err := os.Open(h.s3PartPath(s.ID, part.PartNumber))
+		if err != nil {
+			s3Error(c, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d was not uploaded", part.PartNumber))
+			return
+		}
+		defer f.Close()
+		readers = append(readers, &s3PartReader{r: f, hash: md5.New(), etag: strings.Trim(part.ETag, `"`), number: part.PartNumber})
+	}
+
+	tempPath, size, sums, err := h.s3Receive(io.MultiReader(readers...))
+	defer os.Remove(tempPath)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, p, err)
+		if errors.Is(err, errS3TooLarge) {
+			s3WriteError(c, err)
+		} else {
+			s3Error(c, http.StatusBadRequest, "InvalidPart", err.Error())
+		}
+		return
+	}
+
+	tags, _ := os.ReadFile(h.s3TaggingPath(s.ID))
+	policy := uploadPolicy{Tags: string(tags)}
+	res, err := h.saveUploadMeta(p, s.ContentType, size, sums, policy, tempPath)
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, p, err)
+		s3Error(c, http.StatusInternalServerError, "InternalError", "Failed to store object")
+		return
+	}
+	h.removeUploadSession(s)
+	h.Audit.WithContext(c).Success(audit.ActionUpload, p, "size", size, "sha256", res.SHA256, "parts", len(req.Parts))
+	h.afterChange(p)
+
+	s3XML(c, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Xmlns: s3NS, Location: "/" + bucket + "/" + key, Bucket: bucket, Key: key, ETag: s3ETag(sums.MD5)})
+}
+
+func (h *Handler) s3AbortMultipartUpload(c *gin.Context, bucket, key string) {
+	s, ok := h.loadS3Upload(c, s3Path(bucket, key))
+	if !ok {
+		return
+	}
+	h.removeUploadSession(s)
+	c.Status(http.StatusNoContent)
+}
+
+// s3PartReader reads one stored part and fails at its end if the part doesn't match the ETag
+type s3PartReader struct {
+	r      io.Reader
+	hash   hash.Hash
+	etag   string
+	number int
+}
+
+func (p *s3PartReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.hash.Write(b[:n])
+	if err == io.EOF && p.etag != hex.EncodeToString(p.hash.Sum(nil)) {
+		return n, fmt.Errorf("part %d does not match its ETag", p.number)
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes the aws-chunked content encoding of streaming uploads:
+// "<hex size>[;chunk-signature=...]\r\n<data>\r\n" chunks up to one of size 0, followed by optional trailers.
+// Chunk signatures and trailing checksums are not verified, the stored checksums are calculated anyway.
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (a *awsChunkedReader) Read(p []byte) (int, error) {
+	if a.done {
+		return 0, io.EOF
+	}
+	if a.left == 0 {
+		line, err := a.r.ReadString('\n')
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid aws-chunked chunk size %q", size)
+		}
+		if n == 0 {
+			a.done = true
+			return 0, io.EOF
+		}
+		a.left = n
+	}
+
+	if int64(len(p)) > a.left {
+		p = p[:a.left]
+	}
+	n, err := a.r.Read(p)
+	a.left -= int64(n)
+	if a.left == 0 && err == nil {
+		// every chunk ends with CRLF
+		_, err = a.r.Discard(2)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -43,7 +43,7 @@ func (h *Handler) Search(c *gin.Context) {
 	seenPaths := make(map[string]bool)
 
 	addResult := func(r MetaResource) {
-		if seenPaths[r.Path] {
+		if seenPaths[r.Path] || !h.canSee(c, r.Path, r.Type == ResourceTypeDir) {
 			return
 		}
 		seenPaths[r.Path] = true
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// stagingDir holds content in the storage backend that is not in the tree yet: new files waiting for
+// their database records and replaced files kept until a transaction is over.
+// Slow transfers to remote backends happen before the transaction, inside it files are only renamed.
+const stagingDir = systemDir + "/staging"
+
+// stageFile moves a verified temp file into stagingDir and returns its name there
+func (h *Handler) stageFile(tempPath, sha256 string) (string, error) {
+	name := stagingDir + "/" + uuid.NewString()
+	if err := h.placeFile(tempPath, name, sha256); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// moveStaged renames a staged file to urlPath, replacing what is there
+func (h *Handler) moveStaged(name, urlPath string) error {
+	err := h.Storage.Rename(name, urlPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Only the fs backend needs the parent directory
+		if err := h.Storage.Mkdir(path.Dir(urlPath)); err != nil {
+			return err
+		}
+		err = h.Storage.Rename(name, urlPath)
+	}
+	return err
+}
+
+// stagedSwap replaces several files as a whole. The files are staged up front, swap moves them into place
+// within a transaction and done drops the replaced ones or, if the transaction failed, puts them back.
+type stagedSwap struct {
+	h     *Handler
+	files []*swapFile
+}
+
+type swapFile struct {
+	path    string
+	staged  string
+	backup  string // Staged name of the replaced file, if there was one
+	swapped bool
+}
+
+// stage moves the temp file of urlPath into stagingDir
+func (s *stagedSwap) stage(tempPath, urlPath, sha256 string) error {
+	name, err := s.h.stageFile(tempPath, sha256)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, &swapFile{path: urlPath, staged: name})
+	return nil
+}
+
+// swap moves all staged files into place, keeping the files they replace
+func (s *stagedSwap) swap() error {
+	for _, f := range s.files {
+		backup := stagingDir + "/" + uuid.NewString()
+		err := s.h.Storage.Rename(f.path, backup)
+		if err == nil {
+			f.backup = backup
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		f.swapped = true
+		if err := s.h.moveStaged(f.staged, f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// done cleans up after the transaction. Unless it was committed, the previous files are restored.
+func (s *stagedSwap) done(committed bool) {
+	for i := len(s.files) - 1; i >= 0; i-- {
+		f := s.files[i]
+		if !committed && f.swapped {
+			if f.backup != "" {
+				if err := s.h.Storage.Rename(f.backup, f.path); err != nil {
+					s.h.Log.WithError(err).Errorf("Failed to restore %s from %s", f.path, f.backup)
+					continue
+				}
+			} else if err := s.h.Storage.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				s.h.Log.WithError(err).Errorf("Failed to remove %s", f.path)
+			}
+		}
+		for _, name := range []string{f.staged, f.backup} {
+			if name == "" {
+				continue
+			}
+			if err := s.h.Storage.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				s.h.Log.WithError(err).Errorf("Failed to remove staged file %s", name)
+			}
+		}
+	}
+}
+
+// cleanupStaging removes staged files left behind by a crash
+func (h *Handler) cleanupStaging() {
+	entries, err := h.Storage.List(stagingDir)
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-tempFileTTL)
+	for _, e := range entries {
+		if e.ModTime().After(cutoff) {
+			continue
+		}
+		if err := h.Storage.Remove(stagingDir + "/" + e.Name()); err != nil {
+			h.Log.Errorf("Janitor: failed to remove staged file %s: %v", e.Name(), err)
+		}
+	}
+}
@@ -1,24 +1,43 @@
 package api
 
 import (
-	"os"
-
 	"github.com/gin-gonic/gin"
 )
 
-// ListStreams returns a unique list of all stream names currently in the DB
+// ListStreams returns a unique list of all stream names currently in the DB.
+// Streams without a readable file are left out.
 func (h *Handler) ListStreams(c *gin.Context) {
 	var streams []string
-	// Query unique non-null stream names from meta_resources
-	err := h.DB.Model(&MetaResource{}).
-		Where("stream IS NOT NULL AND stream != ''").
-		Distinct().
-		Pluck("stream", &streams).Error
+	if h.canRead(c, "/") {
+		// Query unique non-null stream names from meta_resources
+		err := h.DB.Model(&MetaResource{}).
+			Where("stream IS NOT NULL AND stream != ''").
+			Distinct().
+			Pluck("stream", &streams).Error
+
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Database error"})
+			return
+		}
+		c.JSON(200, streams)
+		return
+	}
 
+	var rows []MetaResource
+	err := h.DB.Select("stream", "path").
+		Where("stream IS NOT NULL AND stream != ''").
+		Order("stream").
+		Find(&rows).Error
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Database error"})
 		return
 	}
+	streams = []string{}
+	for _, r := range rows {
+		if (len(streams) == 0 || streams[len(streams)-1] != *r.Stream) && h.canRead(c, r.Path) {
+			streams = append(streams, *r.Stream)
+		}
+	}
 	c.JSON(200, streams)
 }
 
@@ -48,6 +67,9 @@ func (h *Handler) GetStreamDetails(c *gin.Context) {
 	var groupOrder []string
 
 	for _, res := range resources {
+		if !h.canRead(c, res.Path) {
+			continue
+		}
 		groupName := ""
 		if res.Group != nil {
 			groupName = *res.Group
@@ -57,7 +79,7 @@ func (h *Handler) GetStreamDetails(c *gin.Context) {
 		}
 
 		r := h.toResponseFromMeta(c, res)
-		i, err := os.Stat(h.fsPath(res.Path))
+		i, err := h.Storage.Stat(res.Path)
 		if err == nil {
 			r.updateWithFileInfo(i)
 		}
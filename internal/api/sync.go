@@ -7,11 +7,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"io/fs"
 	"net/http"
-	"os"
-	"path/filepath"
 	"sync/atomic"
 	"time"
+
+	"github.com/kovi/yaar/internal/storage"
 )
 
 type SyncController struct {
@@ -92,28 +93,23 @@ func (h *Handler) SyncFilesystem(ctx context.Context) {
 
 	foundOnDisk := make(map[string]bool)
 
-	// 2. Walk the filesystem
-	err := filepath.WalkDir(h.BaseDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Calculate virtual URL path
-		rel, _ := filepath.Rel(h.BaseDir, path)
-		urlPath := "/" + filepath.ToSlash(rel)
-		if urlPath == "/." {
-			urlPath = "/"
+	// 2. Walk the storage
+	err := storage.Walk(h.Storage, "/", func(urlPath string, info fs.FileInfo) error {
+		if isSystemPath(urlPath) {
+			if info.IsDir() {
+				return storage.SkipDir
+			}
+			return nil
 		}
 
 		foundOnDisk[urlPath] = true
 
 		// SKIP: We don't need to add directories to the DB during sync.
 		// If they exist in DB (e.g. they have tags), cleanup will handle them if they vanish.
-		if d.IsDir() {
+		if info.IsDir() {
 			return nil
 		}
 
-		info, _ := d.Info()
 		meta, exists := dbFiles[urlPath]
 
 		// CHANGE DETECTION LOGIC:
@@ -123,7 +119,7 @@ func (h *Handler) SyncFilesystem(ctx context.Context) {
 		// - Physical ModTime is different (we use Unix timestamps for reliable comparison)
 		if !exists || meta.Size != info.Size() || meta.ModTime.Unix() != info.ModTime().Unix() {
 			h.Log.Infof("Sync: Processing %s (Size/Time mismatch) m.size:%v, f.size:%v, m.modtime:%v, f.modtime:%v", urlPath, meta.Size, info.Size(), meta.ModTime.Unix(), info.ModTime().Unix())
-			h.processIncomingFile(ctx, path, urlPath, info)
+			h.processIncomingFile(ctx, urlPath, info)
 		}
 
 		return nil
@@ -143,10 +139,13 @@ func (h *Handler) SyncFilesystem(ctx context.Context) {
 			h.Audit.Success("SYSTEM_SYNC_CLEANUP", path, "reason", "missing_on_disk")
 		}
 	}
+
+	// 4. Drop blobs whose paths were changed or removed outside of the API
+	h.collectOrphanBlobs()
 }
 
-func (h *Handler) processIncomingFile(ctx context.Context, fullDiskPath, urlPath string, info os.FileInfo) {
-	f, err := os.Open(fullDiskPath)
+func (h *Handler) processIncomingFile(ctx context.Context, urlPath string, info fs.FileInfo) {
+	f, err := h.Storage.Open(urlPath)
 	if err != nil {
 		return
 	}
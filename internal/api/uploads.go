@@ -0,0 +1,403 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kovi/yaar/internal/audit"
+)
+
+// uploadSessionTTL is the time after which an untouched upload session is discarded by the janitor
+const uploadSessionTTL = 24 * time.Hour
+
+// uploadSessionDir holds the partial data of all upload sessions
+const uploadSessionDir = systemDir + "/uploads"
+
+func (h *Handler) uploadDataPath(id string) string {
+	return h.localPath(uploadSessionDir + "/" + id)
+}
+
+// uploadLock serializes all writes to one session
+type uploadLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockUpload locks the session, or returns false if it is locked and wait isn't set.
+// The lock is dropped from uploadLocks once the last request using it unlocks it.
+func (h *Handler) lockUpload(id string, wait bool) (unlock func(), ok bool) {
+	h.uploadLocksMu.Lock()
+	l := h.uploadLocks[id]
+	if l == nil {
+		if h.uploadLocks == nil {
+			h.uploadLocks = make(map[string]*uploadLock)
+		}
+		l = &uploadLock{}
+		h.uploadLocks[id] = l
+	}
+	l.users++
+	h.uploadLocksMu.Unlock()
+
+	release := func() {
+		h.uploadLocksMu.Lock()
+		if l.users--; l.users == 0 {
+			delete(h.uploadLocks, id)
+		}
+		h.uploadLocksMu.Unlock()
+	}
+	if wait {
+		l.Lock()
+	} else if !l.TryLock() {
+		release()
+		return nil, false
+	}
+	return func() {
+		l.Unlock()
+		release()
+	}, true
+}
+
+// openUploadData opens the data of a session for writing at its offset.
+// Anything beyond the acknowledged offset (e.g. left over by a crash) is dropped.
+func (h *Handler) openUploadData(s *UploadSession) (*os.File, error) {
+	f, err := os.OpenFile(h.uploadDataPath(s.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(s.Offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(s.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// loadUploadSession fetches the session from the URL and checks that it belongs to the caller.
+// On failure the response is already written.
+func (h *Handler) loadUploadSession(c *gin.Context) (*UploadSession, bool) {
+	var s UploadSession
+	r := h.DB.Where("id = ? AND kind = ?", c.Param("id"), "").Limit(1).Find(&s)
+	if r.Error != nil {
+		c.JSON(500, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	if r.RowsAffected == 0 || s.UserID != c.GetUint("user_id") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+		return nil, false
+	}
+	return &s, true
+}
+
+// CreateUploadSession handles POST /_/api/v1/uploads
+func (h *Handler) CreateUploadSession(c *gin.Context) {
+	var req struct {
+		Path        string `json:"path" binding:"required"`
+		Size        int64  `json:"size"`
+		ContentType string `json:"contenttype"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	urlPath := dbPath("/" + req.Path)
+	scopes := c.GetStringSlice("allowed_paths")
+
+	if req.Size > h.Config.Storage.MaxUploadSizeBytes {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, urlPath, errors.New("file too large"), "MaxUploadSizeBytes", h.Config.Storage.MaxUploadSizeBytes)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("File too large. Maximum allowed: %s", h.Config.Storage.MaxUploadSize),
+		})
+		return
+	}
+
+	stat, err := h.Storage.Stat(urlPath)
+	if err == nil && stat.IsDir() {
+		c.JSON(http.StatusConflict, gin.H{"error": "directory with same name already exists"})
+		return
+	}
+
+	opts := ModifyOptions{
+		IgnoreProtected: err != nil, // Allow if new file, block if overwrite
+		IsUpload:        true,
+	}
+	if ok, msg := h.CanModify(urlPath, scopes, opts); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, urlPath, errors.New(msg))
+		c.JSON(403, gin.H{"error": msg})
+		return
+	}
+
+	s := UploadSession{
+		ID:          uuid.New().String(),
+		Path:        urlPath,
+		UserID:      c.GetUint("user_id"),
+		ContentType: req.ContentType,
+		Size:        req.Size,
+	}
+
+	dataPath := h.uploadDataPath(s.ID)
+	os.MkdirAll(filepath.Dir(dataPath), 0755)
+	f, err := os.Create(dataPath)
+	if err != nil {
+		logger(c).WithError(err).Error("failed to create upload session file")
+		c.JSON(500, gin.H{"error": "Failed to create upload session"})
+		return
+	}
+	f.Close()
+
+	if err := h.DB.Create(&s).Error; err != nil {
+		os.Remove(dataPath)
+		c.JSON(500, gin.H{"error": "Failed to create upload session"})
+		return
+	}
+
+	c.Header("Location", "/_/api/v1/uploads/"+s.ID)
+	c.Header("Upload-Offset", "0")
+	c.JSON(http.StatusCreated, s)
+}
+
+// GetUploadSession handles GET/HEAD /_/api/v1/uploads/:id and reports the current offset
+func (h *Handler) GetUploadSession(c *gin.Context) {
+	s, ok := h.loadUploadSession(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	c.JSON(http.StatusOK, s)
+}
+
+// AppendUploadChunk handles PATCH /_/api/v1/uploads/:id
+// The Upload-Offset header must match the number of bytes already received.
+// Whatever was received before a connection drop is kept, so the client can resume from there.
+func (h *Handler) AppendUploadChunk(c *gin.Context) {
+	unlock, ok := h.lockUpload(c.Param("id"), false)
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Another chunk is being written to this session"})
+		return
+	}
+	defer unlock()
+
+	s, ok := h.loadUploadSession(c)
+	if !ok {
+		return
+	}
+	log := logger(c).WithField("session", s.ID)
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Upload-Offset header is required"})
+		return
+	}
+	if offset != s.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"error": "Offset mismatch", "offset": s.Offset})
+		return
+	}
+
+	limit := h.Config.Storage.MaxUploadSizeBytes - s.Offset
+	if s.Size > 0 && s.Size-s.Offset < limit {
+		limit = s.Size - s.Offset
+	}
+
+	hashes, err := restoreHashSet(s.MD5State, s.SHA1State, s.SHA256State)
+	if err != nil {
+		log.WithError(err).Error("failed to restore hash state")
+		c.JSON(500, gin.H{"error": "Corrupted upload session"})
+		return
+	}
+
+	f, err := h.openUploadData(s)
+	if err != nil {
+		log.WithError(err).Error("failed to open upload session file")
+		c.JSON(500, gin.H{"error": "Corrupted upload session"})
+		return
+	}
+	defer f.Close()
+
+	written, copyErr := io.Copy(io.MultiWriter(f, hashes), io.LimitReader(c.Request.Body, limit))
+
+	if written >= limit {
+		// If the next read returns data, they exceeded the limit
+		buf := make([]byte, 1)
+		if n, _ := c.Request.Body.Read(buf); n > 0 {
+			// Dropped by the next chunk anyway
+			if err := f.Truncate(s.Offset); err != nil {
+				log.WithError(err).Warn("failed to truncate upload session file")
+			}
+			h.Audit.WithContext(c).Failure(audit.ActionUpload, s.Path, errors.New("file content exceeded limit"), "session", s.ID)
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File content exceeded limit"})
+			return
+		}
+	}
+
+	s.Offset += written
+	s.MD5State, s.SHA1State, s.SHA256State, err = hashes.MarshalState()
+	if err != nil {
+		log.WithError(err).Error("failed to save hash state")
+		c.JSON(500, gin.H{"error": "Failed to save upload progress"})
+		return
+	}
+	if err := h.DB.Save(s).Error; err != nil {
+		log.WithError(err).Error("failed to save upload session")
+		c.JSON(500, gin.H{"error": "Failed to save upload progress"})
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	if copyErr != nil {
+		log.WithError(copyErr).Warnf("chunk interrupted at offset %d", s.Offset)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chunk interrupted", "offset": s.Offset})
+		return
+	}
+
+	c.JSON(http.StatusOK, s)
+}
+
+// FinalizeUploadSession handles PUT /_/api/v1/uploads/:id
+// It moves the received data into place and applies the X-Stream, X-Tags, X-Expires
+// and X-Checksum-* headers of this request, just like a regular upload.
+func (h *Handler) FinalizeUploadSession(c *gin.Context) {
+	unlock, ok := h.lockUpload(c.Param("id"), false)
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Another chunk is being written to this session"})
+		return
+	}
+	defer unlock()
+
+	s, ok := h.loadUploadSession(c)
+	if !ok {
+		return
+	}
+	log := logger(c).WithField("session", s.ID).WithField("path", s.Path)
+	scopes := c.GetStringSlice("allowed_paths")
+
+	if s.Size > 0 && s.Offset != s.Size {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload incomplete", "offset": s.Offset, "size": s.Size})
+		return
+	}
+
+	policy, err := parseUploadPolicy(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Policies may have changed since the session was created, check again
+	stat, err := h.Storage.Stat(s.Path)
+	if err == nil && stat.IsDir() {
+		c.JSON(http.StatusConflict, gin.H{"error": "directory with same name already exists"})
+		return
+	}
+	opts := ModifyOptions{
+		IgnoreProtected: err != nil,
+		IsUpload:        true,
+	}
+	if ok, msg := h.CanModify(s.Path, scopes, opts); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, s.Path, errors.New(msg), "session", s.ID)
+		c.JSON(403, gin.H{"error": msg})
+		return
+	}
+
+	hashes, err := restoreHashSet(s.MD5State, s.SHA1State, s.SHA256State)
+	if err != nil {
+		log.WithError(err).Error("failed to restore hash state")
+		c.JSON(500, gin.H{"error": "Corrupted upload session"})
+		return
+	}
+
+	sums := hashes.Sums()
+	if mismatchErr := policy.verify(sums); mismatchErr != "" {
+		// The session stays, the client may retry with other checksums or abort it
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, s.Path, errors.New(mismatchErr), "status", "corrupted", "session", s.ID)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Integrity check failed",
+			"details": mismatchErr,
+		})
+		return
+	}
+
+	res, err := h.saveUploadMeta(s.Path, s.ContentType, s.Offset, sums, policy, h.uploadDataPath(s.ID))
+	if err != nil {
+		h.Audit.WithContext(c).Failure(audit.ActionUpload, s.Path, err, "session", s.ID)
+		log.WithError(err).Error("db sync failed")
+		c.JSON(500, gin.H{"error": "Database sync failed"})
+		return
+	}
+	h.removeUploadSession(s)
+
+	h.Audit.WithContext(c).Success(audit.ActionUpload, s.Path, "size", s.Offset, "sha256", res.SHA256, "session", s.ID)
+	h.afterChange(s.Path)
+	c.JSON(http.StatusOK, res)
+}
+
+// AbortUploadSession handles DELETE /_/api/v1/uploads/:id
+func (h *Handler) AbortUploadSession(c *gin.Context) {
+	unlock, ok := h.lockUpload(c.Param("id"), false)
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Another chunk is being written to this session"})
+		return
+	}
+	defer unlock()
+
+	s, ok := h.loadUploadSession(c)
+	if !ok {
+		return
+	}
+
+	h.removeUploadSession(s)
+	c.Status(http.StatusNoContent)
+}
+
+// removeUploadSession drops the partial data and the DB record of a session
+func (h *Handler) removeUploadSession(s *UploadSession) {
+	os.RemoveAll(h.uploadDataPath(s.ID))
+	if err := h.DB.Delete(s).Error; err != nil {
+		h.Log.WithError(err).Errorf("failed to delete upload session %s", s.ID)
+	}
+}
+
+// cleanupUploadSessions discards sessions that were not touched for uploadSessionTTL
+func (h *Handler) cleanupUploadSessions() {
+	var stale []UploadSession
+	err := h.DB.Where("updated_at <= ?", time.Now().UTC().Add(-uploadSessionTTL)).Find(&stale).Error
+	if err != nil {
+		h.Log.WithError(err).Error("Janitor: failed to query stale upload sessions")
+		return
+	}
+
+	for i := range stale {
+		if h.removeStaleUploadSession(stale[i].ID) {
+			h.Audit.Success("SYSTEM_CLEANUP", stale[i].Path, "reason", "stale_upload_session", "session", stale[i].ID)
+		}
+	}
+}
+
+// removeStaleUploadSession removes the session unless a request is using it or touched it meanwhile
+func (h *Handler) removeStaleUploadSession(id string) bool {
+	unlock, ok := h.lockUpload(id, false)
+	if !ok {
+		return false
+	}
+	defer unlock()
+
+	var s UploadSession
+	r := h.DB.Where("id = ? AND updated_at <= ?", id, time.Now().UTC().Add(-uploadSessionTTL)).Limit(1).Find(&s)
+	if r.Error != nil || r.RowsAffected == 0 {
+		return false
+	}
+	h.removeUploadSession(&s)
+	return true
+}
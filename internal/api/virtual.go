@@ -0,0 +1,142 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/config"
+)
+
+// A virtual repository is a read-only view of several directories, local ones or remotes.
+// Files are looked up in the configured order and the first hit wins; hits are remembered until the next change.
+
+// virtualCacheSize bounds the remembered lookups, the cache starts over once it is full
+const virtualCacheSize = 10000
+
+// serveVirtual answers GET/HEAD of a file below a virtual repository.
+// Returns false if p is not below one, or no backing directory holds it.
+func (h *Handler) serveVirtual(c *gin.Context, p string) bool {
+	v, ok := h.Config.Virtual(p)
+	if !ok {
+		return false
+	}
+	if target, ok := h.resolveVirtual(c, v, p); ok {
+		h.ServeFile(c, target)
+		return true
+	}
+	// Maven checksum sidecars are served from the hashes stored with the file
+	if ext := path.Ext(p); isMavenChecksum(p) {
+		if target, ok := h.resolveVirtual(c, v, strings.TrimSuffix(p, ext)); ok && h.serveMavenChecksum(c, target+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveVirtual returns the path of the file served at p below v
+func (h *Handler) resolveVirtual(c *gin.Context, v *config.VirtualConfig, p string) (string, bool) {
+	h.virtualMu.Lock()
+	target, ok := h.virtualHits[p]
+	h.virtualMu.Unlock()
+	if ok && h.isVirtualCandidate(c, target) {
+		return target, true
+	}
+
+	rel := strings.TrimPrefix(p, v.Path)
+	for _, root := range v.Paths {
+		target := root + rel
+		if !h.isVirtualCandidate(c, target) {
+			continue
+		}
+		h.virtualMu.Lock()
+		if h.virtualHits == nil || len(h.virtualHits) >= virtualCacheSize {
+			h.virtualHits = make(map[string]string)
+		}
+		h.virtualHits[p] = target
+		h.virtualMu.Unlock()
+		return target, true
+	}
+	return "", false
+}
+
+// isVirtualCandidate reports if p is a file that can be served, fetching it if p is below a remote
+func (h *Handler) isVirtualCandidate(c *gin.Context, p string) bool {
+	if isSystemPath(p) {
+		return false
+	}
+	stat, err := h.Storage.Stat(p)
+	if err == nil && stat.IsDir() {
+		return false
+	}
+	if remote, ok := h.Config.Remote(p); ok && p != remote.Path {
+		return h.syncRemote(c, remote, p) == nil
+	}
+	return err == nil
+}
+
+// resetVirtualCache forgets the remembered lookups, a change may have added a file to a preferred directory
+func (h *Handler) resetVirtualCache() {
+	h.virtualMu.Lock()
+	h.virtualHits = nil
+	h.virtualMu.Unlock()
+}
+
+// getVirtualMeta is GetMeta for paths below a virtual repository.
+// Directories list the merged content of all backing directories, earlier ones win on name clashes.
+// Read access is checked on the virtual paths, not on the backing ones.
+func (h *Handler) getVirtualMeta(c *gin.Context, v *config.VirtualConfig, p string) {
+	if !h.canList(c, p) {
+		denyRead(c, p)
+		return
+	}
+	if target, ok := h.resolveVirtual(c, v, p); ok {
+		if !h.canRead(c, p) {
+			denyRead(c, p)
+			return
+		}
+		stat, err := h.Storage.Stat(target)
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		f := h.toResponse(c, target, stat)
+		f.Policy.IsAllowed = false
+		c.JSON(http.StatusOK, f)
+		return
+	}
+
+	rel := strings.TrimPrefix(p, v.Path)
+	found := p == v.Path
+	seen := make(map[string]bool)
+	result := make([]FileResponse, 0)
+	for _, root := range v.Paths {
+		dir := root + rel
+		if stat, err := h.Storage.Stat(dir); err != nil || !stat.IsDir() {
+			continue
+		}
+		entries, err := h.Storage.List(dir)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		found = true
+		for _, info := range entries {
+			entryPath := filepath.Join(dir, info.Name())
+			if seen[info.Name()] || isSystemPath(entryPath) || !h.canSee(c, path.Join(p, info.Name()), info.IsDir()) {
+				continue
+			}
+			seen[info.Name()] = true
+			f := h.toResponse(c, entryPath, info)
+			f.Policy.IsAllowed = false
+			result = append(result, f)
+		}
+	}
+	if !found {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,673 @@
+package api
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kovi/yaar/internal/audit"
+	"github.com/kovi/yaar/internal/auth"
+)
+
+// WebDAV (RFC 4918) view of the storage tree below davPrefix, for clients that can only mount WebDAV.
+// Writes go through the same handlers as the plain HTTP API. yaar metadata is exposed as read-only
+// properties in the davNS namespace. Locks are granted for client compatibility but not enforced.
+
+const davPrefix = "/_/dav"
+
+// davNS is the XML namespace of the yaar properties
+const davNS = "https://github.com/kovi/yaar"
+
+// davLockTimeout is announced for every granted lock
+const davLockTimeout = time.Hour
+
+// HandleWebDAV answers requests below davPrefix. Returns false for other paths.
+func (h *Handler) HandleWebDAV(c *gin.Context) bool {
+	rest, ok := strings.CutPrefix(c.Request.URL.Path, davPrefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return false
+	}
+	p := dbPath("/" + rest)
+	if isSystemPath(p) {
+		c.Status(http.StatusNotFound)
+		return true
+	}
+
+	switch c.Request.Method {
+	case http.MethodOptions:
+		c.Header("DAV", "1, 2")
+		c.Header("MS-Author-Via", "DAV")
+		c.Header("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK, UNLOCK")
+		c.Status(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		h.davGet(c, p)
+	case "PROPFIND":
+		h.davPropfind(c, p)
+	case "PROPPATCH":
+		h.davProppatch(c, p)
+	case http.MethodPut:
+		if h.davWritable(c, p) {
+			if stat, err := h.Storage.Stat(p); err == nil && stat.IsDir() {
+				c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Is a collection"})
+				return true
+			}
+			h.uploadFile(c, p)
+		}
+	case http.MethodDelete:
+		if h.davWritable(c, p) {
+			h.deleteEntry(c, p)
+		}
+	case "MKCOL":
+		if h.davWritable(c, p) {
+			h.davMkcol(c, p)
+		}
+	case "COPY", "MOVE":
+		if h.davWritable(c, p) {
+			h.davCopyMove(c, p)
+		}
+	case "LOCK":
+		if h.davWritable(c, p) {
+			h.davLock(c, p)
+		}
+	case "UNLOCK":
+		c.Status(http.StatusNoContent)
+	default:
+		c.Status(http.StatusMethodNotAllowed)
+	}
+	return true
+}
+
+// davWritable checks that the caller is logged in and p is not part of a read-only view.
+// DAV clients only send credentials when challenged. On failure the response is already written.
+func (h *Handler) davWritable(c *gin.Context, p string) bool {
+	if !auth.EnsureAuth(c) {
+		return false
+	}
+	if _, ok := h.Config.Virtual(p); ok {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Virtual repositories are read-only"})
+		return false
+	}
+	return true
+}
+
+// davHref is the URL of p in the WebDAV view, collections end with a slash
+func davHref(p string, isDir bool) string {
+	href := davPrefix + (&url.URL{Path: p}).EscapedPath()
+	if isDir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
+
+func (h *Handler) davGet(c *gin.Context, p string) {
+	stat, ok := h.statReadable(c, p)
+	if !ok {
+		return
+	}
+	if !stat.IsDir() {
+		h.ServeFile(c, p)
+		return
+	}
+
+	// Browsers get a plain listing
+	entries, err := h.Storage.List(p)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<html><head><title>%s</title></head><body><h1>%s</h1><ul>\n", html.EscapeString(p), html.EscapeString(p))
+	for _, e := range entries {
+		child := path.Join(p, e.Name())
+		if !h.canSee(c, child, e.IsDir()) {
+			continue
+		}
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(davHref(child, e.IsDir())), html.EscapeString(name))
+	}
+	b.WriteString("</ul></body></html>\n")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(b.String()))
+}
+
+/* ===================== PROPERTIES ===================== */
+
+type davPropfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XmlnsD    string        `xml:"xmlns:D,attr"`
+	XmlnsY    string        `xml:"xmlns:Y,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"D:href"`
+	Propstats []davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Props  []davProperty `xml:"D:prop>x"`
+	Status string        `xml:"D:status"`
+}
+
+// davProperty is a property with its name as written on the wire (e.g. D:getetag).
+// Properties of foreign namespaces carry their own xmlns.
+type davProperty struct {
+	XMLName xml.Name
+	Xmlns   string `xml:"xmlns,attr,omitempty"`
+	Inner   string `xml:",innerxml"`
+}
+
+func davText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// davProperties returns the live properties of a resource and the yaar properties of its metadata,
+// keyed by namespace and local name
+func davProperties(info fs.FileInfo, meta *MetaResource) map[xml.Name]string {
+	props := map[xml.Name]string{
+		{Space: "DAV:", Local: "displayname"}:     davText(info.Name()),
+		{Space: "DAV:", Local: "getlastmodified"}: info.ModTime().UTC().Format(http.TimeFormat),
+		{Space: "DAV:", Local: "resourcetype"}:    "",
+		{Space: "DAV:", Local: "supportedlock"}:   "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>",
+	}
+	if info.IsDir() {
+		props[xml.Name{Space: "DAV:", Local: "resourcetype"}] = "<D:collection/>"
+	} else {
+		props[xml.Name{Space: "DAV:", Local: "getcontentlength"}] = strconv.FormatInt(info.Size(), 10)
+		props[xml.Name{Space: "DAV:", Local: "getetag"}] = davText(fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	}
+	if meta == nil {
+		return props
+	}
+
+	yaar := func(name, value string) {
+		if value != "" {
+			props[xml.Name{Space: davNS, Local: name}] = davText(value)
+		}
+	}
+	if !info.IsDir() {
+		if meta.ContentType != "" {
+			props[xml.Name{Space: "DAV:", Local: "getcontenttype"}] = davText(meta.ContentType)
+		}
+		if meta.SHA256 != "" {
+			props[xml.Name{Space: "DAV:", Local: "getetag"}] = davText(`"` + meta.SHA256 + `"`)
+		}
+	}
+	yaar("tags", formatTags(meta.Tags))
+	if meta.Stream != nil && *meta.Stream != "" {
+		yaar("stream", *meta.Stream+"/"+*meta.Group)
+	}
+	if meta.PolicyKeepLatest != nil && *meta.PolicyKeepLatest {
+		yaar("keep-latest", "true")
+	}
+	if meta.ExpiresAt != nil {
+		yaar("expires", meta.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	if meta.Immutable != nil && *meta.Immutable {
+		yaar("immutable", "true")
+	}
+	yaar("sha256", meta.SHA256)
+	yaar("sha1", meta.SHA1)
+	yaar("md5", meta.MD5)
+	return props
+}
+
+// davWireName is the element name of a property in our responses
+func davWireName(name xml.Name) (xml.Name, string) {
+	switch name.Space {
+	case "DAV:":
+		return xml.Name{Local: "D:" + name.Local}, ""
+	case davNS:
+		return xml.Name{Local: "Y:" + name.Local}, ""
+	}
+	return xml.Name{Local: name.Local}, name.Space
+}
+
+func (h *Handler) davPropfind(c *gin.Context, p string) {
+	stat, ok := h.statReadable(c, p)
+	if !ok {
+		return
+	}
+
+	depth := c.GetHeader("Depth")
+	if depth != "0" && depth != "1" {
+		// An infinite walk of the whole tree is too expensive
+		c.JSON(http.StatusForbidden, gin.H{"error": "Depth must be 0 or 1"})
+		return
+	}
+
+	var req davPropfindRequest
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := xml.Unmarshal(body, &req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid PROPFIND body"})
+			return
+		}
+	}
+
+	paths := []string{p}
+	infos := map[string]fs.FileInfo{p: stat}
+	if stat.IsDir() && depth == "1" {
+		entries, err := h.Storage.List(p)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		for _, e := range entries {
+			child := path.Join(p, e.Name())
+			if !h.canSee(c, child, e.IsDir()) {
+				continue
+			}
+			paths = append(paths, child)
+			infos[child] = e
+		}
+	}
+
+	var metas []MetaResource
+	if err := h.DB.Preload("Tags").Where("path IN ?", paths).Find(&metas).Error; err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	metaByPath := make(map[string]*MetaResource, len(metas))
+	for i := range metas {
+		metaByPath[metas[i].Path] = &metas[i]
+	}
+
+	ms := davMultistatus{XmlnsD: "DAV:", XmlnsY: davNS}
+	for _, rp := range paths {
+		props := davProperties(infos[rp], metaByPath[rp])
+		ms.Responses = append(ms.Responses, davResponse{
+			Href:      davHref(rp, infos[rp].IsDir()),
+			Propstats: davPropstats(req, props),
+		})
+	}
+	davWriteXML(c, http.StatusMultiStatus, ms)
+}
+
+// davPropstats answers a PROPFIND for one resource: all properties, their names, or the requested ones
+func davPropstats(req davPropfindRequest, props map[xml.Name]string) []davPropstat {
+	found := davPropstat{Status: "HTTP/1.1 200 OK"}
+	missing := davPropstat{Status: "HTTP/1.1 404 Not Found"}
+
+	if req.Prop != nil && req.AllProp == nil {
+		for _, n := range req.Prop.Names {
+			wire, xmlns := davWireName(n.XMLName)
+			if value, ok := props[n.XMLName]; ok {
+				found.Props = append(found.Props, davProperty{XMLName: wire, Xmlns: xmlns, Inner: value})
+			} else {
+				missing.Props = append(missing.Props, davProperty{XMLName: wire, Xmlns: xmlns})
+			}
+		}
+	} else {
+		names := make([]xml.Name, 0, len(props))
+		for n := range props {
+			names = append(names, n)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if names[i].Space != names[j].Space {
+				return names[i].Space < names[j].Space
+			}
+			return names[i].Local < names[j].Local
+		})
+		for _, n := range names {
+			wire, _ := davWireName(n)
+			prop := davProperty{XMLName: wire}
+			if req.PropName == nil {
+				prop.Inner = props[n]
+			}
+			found.Props = append(found.Props, prop)
+		}
+	}
+
+	var result []davPropstat
+	if len(found.Props) > 0 {
+		result = append(result, found)
+	}
+	if len(missing.Props) > 0 {
+		result = append(result, missing)
+	}
+	return result
+}
+
+// davProppatch refuses all changes, the metadata is managed with the X-* upload headers and the metadata API
+func (h *Handler) davProppatch(c *gin.Context, p string) {
+	if !h.davWritable(c, p) {
+		return
+	}
+	if _, err := h.Storage.Stat(p); err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	// The body is a propertyupdate with set and remove instructions
+	type propList struct {
+		Prop *struct {
+			Names []struct {
+				XMLName xml.Name
+			} `xml:",any"`
+		} `xml:"DAV: prop"`
+	}
+	var update struct {
+		XMLName xml.Name   `xml:"DAV: propertyupdate"`
+		Set     []propList `xml:"DAV: set"`
+		Remove  []propList `xml:"DAV: remove"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(c.Request.Body, 1<<20)).Decode(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid PROPPATCH body"})
+		return
+	}
+
+	forbidden := davPropstat{Status: "HTTP/1.1 403 Forbidden"}
+	for _, l := range append(update.Set, update.Remove...) {
+		if l.Prop == nil {
+			continue
+		}
+		for _, n := range l.Prop.Names {
+			wire, xmlns := davWireName(n.XMLName)
+			forbidden.Props = append(forbidden.Props, davProperty{XMLName: wire, Xmlns: xmlns})
+		}
+	}
+	ms := davMultistatus{XmlnsD: "DAV:", XmlnsY: davNS}
+	ms.Responses = []davResponse{{Href: davHref(p, false), Propstats: []davPropstat{forbidden}}}
+	davWriteXML(c, http.StatusMultiStatus, ms)
+}
+
+func davWriteXML(c *gin.Context, status int, v any) {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Data(status, "application/xml; charset=utf-8", append([]byte(xml.Header), out...))
+}
+
+/* ===================== COLLECTIONS, COPY & MOVE ===================== */
+
+func (h *Handler) davMkcol(c *gin.Context, p string) {
+	if c.Request.ContentLength > 0 {
+		c.Status(http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, err := h.Storage.Stat(p); err == nil {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Already exists"})
+		return
+	}
+	if parent, err := h.Storage.Stat(path.Dir(p)); err != nil || !parent.IsDir() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Parent collection does not exist"})
+		return
+	}
+	if ok, msg := h.CanModify(p, c.GetStringSlice("allowed_paths"), ModifyOptions{}); !ok {
+		h.Audit.WithContext(c).Failure(audit.ActionMkdir, p, errors.New(msg))
+		c.JSON(http.StatusForbidden, gin.H{"error": msg})
+		return
+	}
+	if err := h.Storage.Mkdir(p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create directory"})
+		return
+	}
+	h.Audit.WithContext(c).Success(audit.ActionMkdir, p)
+	c.Status(http.StatusCreated)
+}
+
+// davDestination returns the tree path of the Destination header of COPY and MOVE
+func davDestination(c *gin.Context) (string, bool) {
+	u, err := url.Parse(c.GetHeader("Destination"))
+	if err != nil {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(u.Path, davPrefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+	return dbPath("/" + rest), true
+}
+
+func (h *Handler) davCopyMove(c *gin.Context, src string) {
+	isMove := c.Request.Method == "MOVE"
+	action := audit.ActionCopy
+	if isMove {
+		action = audit.ActionRename
+	}
+	scopes := c.GetStringSlice("allowed_paths")
+
+	srcStat, ok := h.statReadable(c, src)
+	if !ok {
+		return
+	}
+	dst, ok := davDestination(c)
+	if !ok || isSystemPath(dst) || dst == "/" {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Destination must be below " + davPrefix})
+		return
+	}
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Destination is inside the source"})
+		return
+	}
+	if _, ok := h.Config.Virtual(dst); ok {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Virtual repositories are read-only"})
+		return
+	}
+	if parent, err := h.Storage.Stat(path.Dir(dst)); err != nil || !parent.IsDir() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Parent collection does not exist"})
+		return
+	}
+
+	if isMove {
+		if ok, msg := h.CanModify(src, c.GetStringSlice("delete_paths"), ModifyOptions{}); !ok {
+			h.Audit.WithContext(c).Failure(action, src, errors.New(msg))
+			c.JSON(http.StatusForbidden, gin.H{"error": msg})
+			return
+		}
+	}
+
+	_, err := h.Storage.Stat(dst)
+	exists := err == nil
+	if exists && c.GetHeader("Overwrite") == "F" {
+		c.Status(http.StatusPreconditionFailed)
+		return
+	}
+	if ok, msg := h.CanModify(dst, scopes, ModifyOptions{IgnoreProtected: !exists, IsUpload: true}); !ok {
+		h.Audit.WithContext(c).Failure(action, dst, errors.New(msg))
+		c.JSON(http.StatusForbidden, gin.H{"error": msg})
+		return
+	}
+	if exists {
+		if _, err := h.removeTree(dst); err != nil {
+			h.Audit.WithContext(c).Failure(action, dst, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if isMove {
+		err = h.moveTree(src, dst)
+	} else {
+		err = h.copyTree(src, dst, srcStat, c.GetHeader("Depth") != "0")
+	}
+	if err != nil {
+		h.Audit.WithContext(c).Failure(action, dst, err, "from", src)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.Audit.WithContext(c).Success(action, dst, "from", src)
+	if isMove {
+		h.afterChange(src, dst)
+	} else {
+		h.afterChange(dst)
+	}
+	if exists {
+		c.Status(http.StatusNoContent)
+	} else {
+		c.Status(http.StatusCreated)
+	}
+}
+
+// copyTree copies a file, or a directory with (if recursive) everything below it, to dst.
+// Copied files keep their metadata except immutability.
+func (h *Handler) copyTree(src, dst string, info fs.FileInfo, recursive bool) error {
+	if !info.IsDir() {
+		return h.copyFile(src, dst)
+	}
+	if err := h.Storage.Mkdir(dst); err != nil {
+		return err
+	}
+	if !recursive {
+		return nil
+	}
+	entries, err := h.Storage.List(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := h.copyTree(path.Join(src, e.Name()), path.Join(dst, e.Name()), e, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) copyFile(src, dst string) error {
+	in, err := h.Storage.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := h.createTempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hashes := newHashSet()
+	written, err := io.Copy(io.MultiWriter(out, hashes), in)
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	var policy uploadPolicy
+	contentType := ""
+	meta, err := h.GetFileMeta(src)
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		contentType = meta.ContentType
+		if meta.Stream != nil {
+			policy.Stream, policy.Group = *meta.Stream, *meta.Group
+		}
+		// keep-latest would expire the source group
+		policy.ExpiresAt = meta.ExpiresAt
+		policy.Tags = formatTags(meta.Tags)
+	}
+
+	sums := hashes.Sums()
+	_, err = h.saveUploadMeta(dst, contentType, written, sums, policy, out.Name())
+	return err
+}
+
+/* ===================== LOCKS ===================== */
+
+// davLock grants every lock request. Tokens are not tracked, so locks don't keep other clients out;
+// macOS and Windows only mount shares writable if locking works.
+func (h *Handler) davLock(c *gin.Context, p string) {
+	var req struct {
+		Owner *struct {
+			Inner string `xml:",innerxml"`
+		} `xml:"DAV: owner"`
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	token := "opaquelocktoken:" + uuid.NewString()
+	status := http.StatusOK
+	if len(bytes.TrimSpace(body)) == 0 {
+		// A refresh names the lock in the If header: (<token>)
+		ifHeader := c.GetHeader("If")
+		start, end := strings.Index(ifHeader, "<"), strings.Index(ifHeader, ">")
+		if start < 0 || end < start {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Lock refresh without If header"})
+			return
+		}
+		token = ifHeader[start+1 : end]
+	} else {
+		if err := xml.Unmarshal(body, &req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid LOCK body"})
+			return
+		}
+		if _, err := h.Storage.Stat(p); err != nil {
+			// Locking an unmapped URL creates an empty file
+			if ok, msg := h.CanModify(p, c.GetStringSlice("allowed_paths"), ModifyOptions{IgnoreProtected: true, IsUpload: true}); !ok {
+				c.JSON(http.StatusForbidden, gin.H{"error": msg})
+				return
+			}
+			if _, err := h.storeBytes(p, "", nil, uploadPolicy{}); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			h.Audit.WithContext(c).Success(audit.ActionUpload, p, "size", 0)
+			h.afterChange(p)
+			status = http.StatusCreated
+		}
+	}
+
+	depth := "infinity"
+	if c.GetHeader("Depth") == "0" {
+		depth = "0"
+	}
+	owner := ""
+	if req.Owner != nil {
+		owner = "<D:owner>" + req.Owner.Inner + "</D:owner>"
+	}
+
+	c.Header("Lock-Token", "<"+token+">")
+	c.Data(status, "application/xml; charset=utf-8", []byte(xml.Header+
+		`<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>`+
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>`+
+		`<D:depth>`+depth+`</D:depth>`+owner+
+		`<D:timeout>Second-`+strconv.Itoa(int(davLockTimeout.Seconds()))+`</D:timeout>`+
+		`<D:locktoken><D:href>`+davText(token)+`</D:href></D:locktoken>`+
+		`<D:lockroot><D:href>`+davText(davHref(p, false))+`</D:href></D:lockroot>`+
+		`</D:activelock></D:lockdiscovery></D:prop>`))
+}
@@ -15,6 +15,11 @@ const (
 	ActionRename    = "FILE_RENAME"
 	ActionMkdir     = "DIR_CREATE"
 	ActionPatchMeta = "META_PATCH"
+	ActionExtract   = "ARCHIVE_EXTRACT"
+	ActionFetch     = "REMOTE_FETCH"
+	ActionCopy      = "FILE_COPY"
+	ActionLock      = "LFS_LOCK"
+	ActionUnlock    = "LFS_UNLOCK"
 )
 
 type Auditor struct {
@@ -1,6 +1,9 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"sync"
 	"time"
 
@@ -10,6 +13,7 @@ import (
 type cachedUser struct {
 	exists    bool
 	isAdmin   bool
+	scopes    map[string][]string
 	expiresAt time.Time
 }
 
@@ -35,13 +39,21 @@ func (c *UserCache) Get(userID uint) (exists bool, isAdmin bool, found bool) {
 	return item.exists, item.isAdmin, true
 }
 
-func (c *UserCache) Set(userID uint, exists bool, isAdmin bool, ttl time.Duration) {
+// Scopes returns the cached scopes of the user per permission, nil if they are not cached
+func (c *UserCache) Scopes(userID uint) map[string][]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.store[userID].scopes
+}
+
+func (c *UserCache) Set(userID uint, exists bool, isAdmin bool, scopes map[string][]string, ttl time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	c.store[userID] = cachedUser{
 		exists:    exists,
 		isAdmin:   isAdmin,
+		scopes:    scopes,
 		expiresAt: time.Now().Add(ttl),
 	}
 }
@@ -53,3 +65,55 @@ func (c *UserCache) Invalidate(userID uint) {
 	defer c.mu.Unlock()
 	delete(c.store, userID)
 }
+
+type cachedLogin struct {
+	mac       []byte
+	identity  Identity
+	expiresAt time.Time
+}
+
+// LoginCache remembers successful logins at external providers so that repeated logins don't hit them.
+// Passwords are only kept as HMAC with a key of this process.
+type LoginCache struct {
+	mu    sync.Mutex
+	key   []byte
+	store map[string]cachedLogin
+}
+
+func NewLoginCache() *LoginCache {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &LoginCache{key: key, store: make(map[string]cachedLogin)}
+}
+
+// Get returns the identity of an earlier login with the same username and password
+func (c *LoginCache) Get(username, password string) (Identity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.store[username]
+	if !ok || time.Now().After(item.expiresAt) || !hmac.Equal(item.mac, c.mac(username, password)) {
+		return Identity{}, false
+	}
+	return item.identity, true
+}
+
+func (c *LoginCache) Set(username, password string, identity Identity, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, v := range c.store {
+		if time.Now().After(v.expiresAt) {
+			delete(c.store, k)
+		}
+	}
+	c.store[username] = cachedLogin{mac: c.mac(username, password), identity: identity, expiresAt: time.Now().Add(ttl)}
+}
+
+func (c *LoginCache) mac(username, password string) []byte {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(username + "\x00" + password))
+	return m.Sum(nil)
+}
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/models"
+	"gorm.io/gorm"
+)
+
+// ListGroups handles GET /_/api/admin/groups
+func (h *AuthHandler) ListGroups(c *gin.Context) {
+	var groups []models.Group
+	h.DB.Preload("Members", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "username", "is_admin")
+	}).Preload("Bindings").Order("name").Find(&groups)
+	c.JSON(200, groups)
+}
+
+// CreateGroup handles POST /_/api/admin/groups
+func (h *AuthHandler) CreateGroup(c *gin.Context) {
+	var req struct {
+		Name     string               `json:"name" binding:"required"`
+		Provider string               `json:"provider"`
+		Bindings []models.RoleBinding `json:"bindings"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !validBindings(c, req.Bindings) || !validGroupProvider(c, req.Provider) {
+		return
+	}
+
+	group := models.Group{Name: req.Name, Provider: req.Provider, Bindings: req.Bindings}
+	if err := h.DB.Create(&group).Error; err != nil {
+		h.Audit.WithContext(c).Failure("GROUP_CREATE", req.Name, err, "changed_by", c.GetString("username"))
+		c.JSON(500, gin.H{"error": "Could not create group"})
+		return
+	}
+
+	h.Audit.WithContext(c).Success("GROUP_CREATE", group.Name, "changed_by", c.GetString("username"), "bindings", group.Bindings)
+	c.JSON(201, group)
+}
+
+// UpdateGroup handles PATCH /_/api/admin/groups/:id, bindings are replaced as a whole
+func (h *AuthHandler) UpdateGroup(c *gin.Context) {
+	var req struct {
+		Name     *string               `json:"name"`
+		Provider *string               `json:"provider"`
+		Bindings *[]models.RoleBinding `json:"bindings"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Bindings != nil && !validBindings(c, *req.Bindings) {
+		return
+	}
+	if req.Provider != nil && !validGroupProvider(c, *req.Provider) {
+		return
+	}
+
+	var group models.Group
+	if err := h.DB.Preload("Members").First(&group, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Group not found"})
+		return
+	}
+
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if req.Name != nil {
+			if err := tx.Model(&group).Update("name", *req.Name).Error; err != nil {
+				return err
+			}
+		}
+		if req.Provider != nil {
+			if err := tx.Model(&group).Update("provider", *req.Provider).Error; err != nil {
+				return err
+			}
+		}
+		if req.Bindings != nil {
+			if err := tx.Where("group_id = ?", group.ID).Delete(&models.RoleBinding{}).Error; err != nil {
+				return err
+			}
+			for _, b := range *req.Bindings {
+				b.GroupID = group.ID
+				if err := tx.Create(&b).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		h.Audit.WithContext(c).Failure("GROUP_UPDATE", group.Name, err, "changed_by", c.GetString("username"))
+		c.JSON(500, gin.H{"error": "Update failed"})
+		return
+	}
+
+	h.invalidateMembers(group)
+	h.Audit.WithContext(c).Success(
+		"GROUP_UPDATE",
+		group.Name,
+		"changed_by", c.GetString("username"),
+		"name_set", req.Name != nil,
+		"provider", req.Provider,
+		"bindings", req.Bindings,
+	)
+	c.JSON(200, gin.H{"status": "updated", "name": group.Name})
+}
+
+// DeleteGroup handles DELETE /_/api/admin/groups/:id
+func (h *AuthHandler) DeleteGroup(c *gin.Context) {
+	var group models.Group
+	if err := h.DB.Preload("Members").First(&group, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Group not found"})
+		return
+	}
+
+	if err := h.DB.Select("Members", "Bindings").Delete(&group).Error; err != nil {
+		h.Audit.WithContext(c).Failure("GROUP_DELETE", group.Name, err, "deleted_by", c.GetString("username"))
+		c.JSON(500, gin.H{"error": "Failed to delete group"})
+		return
+	}
+
+	h.invalidateMembers(group)
+	h.Audit.WithContext(c).Success("GROUP_DELETE", group.Name, "deleted_by", c.GetString("username"))
+	c.Status(http.StatusNoContent)
+}
+
+// AddGroupMember handles PUT /_/api/admin/groups/:id/members/:user_id
+func (h *AuthHandler) AddGroupMember(c *gin.Context) {
+	group, user, ok := h.groupAndUser(c)
+	if !ok {
+		return
+	}
+
+	if err := h.DB.Model(&group).Association("Members").Append(&user); err != nil {
+		h.Audit.WithContext(c).Failure("GROUP_MEMBER_ADD", group.Name, err, "user", user.Username, "changed_by", c.GetString("username"))
+		c.JSON(500, gin.H{"error": "Failed to add member"})
+		return
+	}
+
+	h.UserCache.Invalidate(user.ID)
+	h.Audit.WithContext(c).Success("GROUP_MEMBER_ADD", group.Name, "user", user.Username, "changed_by", c.GetString("username"))
+	c.Status(http.StatusNoContent)
+}
+
+// RemoveGroupMember handles DELETE /_/api/admin/groups/:id/members/:user_id
+func (h *AuthHandler) RemoveGroupMember(c *gin.Context) {
+	group, user, ok := h.groupAndUser(c)
+	if !ok {
+		return
+	}
+
+	if err := h.DB.Model(&group).Association("Members").Delete(&user); err != nil {
+		h.Audit.WithContext(c).Failure("GROUP_MEMBER_REMOVE", group.Name, err, "user", user.Username, "changed_by", c.GetString("username"))
+		c.JSON(500, gin.H{"error": "Failed to remove member"})
+		return
+	}
+
+	h.UserCache.Invalidate(user.ID)
+	h.Audit.WithContext(c).Success("GROUP_MEMBER_REMOVE", group.Name, "user", user.Username, "changed_by", c.GetString("username"))
+	c.Status(http.StatusNoContent)
+}
+
+// groupAndUser loads the group and user of a membership route, or writes a 404
+func (h *AuthHandler) groupAndUser(c *gin.Context) (models.Group, models.User, bool) {
+	var group models.Group
+	if err := h.DB.First(&group, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Group not found"})
+		return group, models.User{}, false
+	}
+	var user models.User
+	if err := h.DB.First(&user, c.Param("user_id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return group, user, false
+	}
+	return group, user, true
+}
+
+// invalidateMembers drops the cached scopes of everyone in group
+func (h *AuthHandler) invalidateMembers(group models.Group) {
+	for _, m := range group.Members {
+		h.UserCache.Invalidate(m.ID)
+	}
+}
+
+func validBindings(c *gin.Context, bindings []models.RoleBinding) bool {
+	for _, b := range bindings {
+		if !IsRole(b.Role) {
+			c.JSON(400, gin.H{"error": "Unknown role: " + b.Role})
+			return false
+		}
+	}
+	return true
+}
+
+// validGroupProvider checks the provider syncing the members of a group, empty for none
+func validGroupProvider(c *gin.Context, provider string) bool {
+	switch provider {
+	case "", models.ProviderLDAP, models.ProviderOIDC:
+		return true
+	}
+	c.JSON(400, gin.H{"error": "Unknown provider: " + provider})
+	return false
+}
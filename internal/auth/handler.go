@@ -1,14 +1,19 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/kovi/yaar/internal/audit"
 	"github.com/kovi/yaar/internal/config"
 	"github.com/kovi/yaar/internal/models"
+	"github.com/kovi/yaar/internal/oidc"
 	"github.com/kovi/yaar/internal/utils"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
@@ -20,6 +25,12 @@ type AuthHandler struct {
 	Audit     *audit.Auditor
 	UserCache UserCache
 	Log       *logrus.Entry
+
+	oidcMu sync.Mutex
+	oidc   *oidc.Provider // Discovered on the first SSO login
+
+	ldapMu     sync.Mutex
+	ldapLogins *LoginCache
 }
 
 // Login handles POST /_/api/login
@@ -34,16 +45,22 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	var user models.User
-	if err := h.DB.Where("username = ?", req.Username).Limit(1).Find(&user).Error; err != nil {
+	user, provider, err := h.authenticate(c.Request.Context(), req.Username, req.Password)
+	switch {
+	case errors.Is(err, ErrInvalidCredentials):
 		c.JSON(401, gin.H{"error": "Invalid credentials"})
 		return
-	}
-
-	if !user.CheckPassword(req.Password) {
-		c.JSON(401, gin.H{"error": "Invalid credentials"})
+	case errors.Is(err, errAccountTaken):
+		h.Audit.WithContext(c).Failure("LOGIN", req.Username, err)
+		c.JSON(409, gin.H{"error": "Could not log in: " + err.Error()})
+		return
+	case err != nil:
+		c.JSON(503, gin.H{"error": "Login provider unavailable"})
 		return
 	}
+	if provider != models.ProviderLocal {
+		h.Audit.WithContext(c).Success("LOGIN_"+strings.ToUpper(provider), user.Username, "is_admin", user.IsAdmin)
+	}
 
 	// 1. Generate the token using the secret from your config
 	token, err := GenerateToken(user, h.Config.Server.JwtSecret)
@@ -63,23 +80,24 @@ func (h *AuthHandler) Login(c *gin.Context) {
 // ListUsers handles GET /_/api/admin/users
 func (h *AuthHandler) ListUsers(c *gin.Context) {
 	var users []models.User
-	h.DB.Select("id", "username", "is_admin", "created_at").Find(&users)
+	h.DB.Select("id", "username", "is_admin", "read_scope", "provider", "created_at").Find(&users)
 	c.JSON(200, users)
 }
 
 // CreateUser handles POST /_/api/admin/users
 func (h *AuthHandler) CreateUser(c *gin.Context) {
 	var req struct {
-		Username string `json:"username" binding:"required"`
-		Password string `json:"password" binding:"required"`
-		IsAdmin  bool   `json:"is_admin"`
+		Username  string `json:"username" binding:"required"`
+		Password  string `json:"password" binding:"required"`
+		IsAdmin   bool   `json:"is_admin"`
+		ReadScope string `json:"read_scope"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 
-	user := models.User{Username: req.Username, IsAdmin: req.IsAdmin}
+	user := models.User{Username: req.Username, IsAdmin: req.IsAdmin, ReadScope: req.ReadScope}
 	user.SetPassword(req.Password)
 
 	if err := h.DB.Create(&user).Error; err != nil {
@@ -95,9 +113,10 @@ func (h *AuthHandler) GetMe(c *gin.Context) {
 	userId, _ := c.Get("user_id")
 
 	c.JSON(200, gin.H{
-		"id":       userId,
-		"username": username,
-		"is_admin": isAdmin,
+		"id":         userId,
+		"username":   username,
+		"is_admin":   isAdmin,
+		"read_paths": c.GetStringSlice("read_paths"),
 	})
 }
 
@@ -107,8 +126,9 @@ func (h *AuthHandler) UpdateUser(c *gin.Context) {
 	currentUserID := c.MustGet("user_id").(uint)
 
 	var req struct {
-		Password *string `json:"password"`
-		IsAdmin  *bool   `json:"is_admin"`
+		Password  *string `json:"password"`
+		IsAdmin   *bool   `json:"is_admin"`
+		ReadScope *string `json:"read_scope"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -140,6 +160,9 @@ func (h *AuthHandler) UpdateUser(c *gin.Context) {
 		if req.IsAdmin != nil {
 			updates["is_admin"] = *req.IsAdmin
 		}
+		if req.ReadScope != nil {
+			updates["read_scope"] = *req.ReadScope
+		}
 		if req.Password != nil {
 			updates["password_hash"] = user.PasswordHash
 		}
@@ -154,6 +177,7 @@ func (h *AuthHandler) UpdateUser(c *gin.Context) {
 			err,
 			"changed_by", c.GetString("username"),
 			"is_admin_set", req.IsAdmin != nil,
+			"read_scope_set", req.ReadScope != nil,
 		)
 
 		c.JSON(500, gin.H{"error": "Update failed"})
@@ -167,6 +191,7 @@ func (h *AuthHandler) UpdateUser(c *gin.Context) {
 		user.Username,
 		"changed_by", c.GetString("username"),
 		"is_admin_set", req.IsAdmin != nil,
+		"read_scope_set", req.ReadScope != nil,
 	)
 
 	c.JSON(200, gin.H{"status": "updated", "username": user.Username})
@@ -190,7 +215,13 @@ func (h *AuthHandler) DeleteUser(c *gin.Context) {
 		return
 	}
 
-	if err := h.DB.Delete(&user).Error; err != nil {
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM group_members WHERE user_id = ?", user.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
 		h.Audit.WithContext(c).Failure(
 			"USER_DELETE",
 			user.Username,
@@ -215,15 +246,24 @@ func (h *AuthHandler) DeleteUser(c *gin.Context) {
 // CreateToken handles POST /_/api/admin/tokens
 func (h *AuthHandler) CreateToken(c *gin.Context) {
 	var req struct {
-		UserID    uint   `json:"user_id" binding:"required"`
-		Name      string `json:"name" binding:"required"`
-		PathScope string `json:"path_scope"`
-		Expires   string `json:"expires"` // NEW
+		UserID      uint                     `json:"user_id" binding:"required"`
+		Name        string                   `json:"name" binding:"required"`
+		PathScope   string                   `json:"path_scope"`
+		ReadScope   string                   `json:"read_scope"`
+		Permissions []models.TokenPermission `json:"permissions"`
+		Expires     string                   `json:"expires"` // NEW
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil { /* ... */
 	}
 
+	for _, p := range req.Permissions {
+		if !slices.Contains(Permissions, p.Action) {
+			c.JSON(400, gin.H{"error": "Unknown permission: " + p.Action})
+			return
+		}
+	}
+
 	var expiresAt *time.Time
 	if req.Expires != "" {
 		t, err := utils.ParseExpiry(req.Expires) // Reusing our smart parser
@@ -236,11 +276,13 @@ func (h *AuthHandler) CreateToken(c *gin.Context) {
 
 	plainToken, _ := GenerateRandomToken()
 	token := models.Token{
-		UserID:     req.UserID,
-		Name:       req.Name,
-		PathScope:  req.PathScope,
-		ExpiresAt:  expiresAt,
-		SecretHash: HashToken(plainToken),
+		UserID:      req.UserID,
+		Name:        req.Name,
+		PathScope:   req.PathScope,
+		ReadScope:   req.ReadScope,
+		Permissions: req.Permissions,
+		ExpiresAt:   expiresAt,
+		SecretHash:  HashToken(plainToken),
 	}
 
 	if err := h.DB.Create(&token).Error; err != nil {
@@ -254,21 +296,28 @@ func (h *AuthHandler) CreateToken(c *gin.Context) {
 		token.Name,
 		"owner", token.User.Username,
 		"scope", token.PathScope,
+		"read_scope", token.ReadScope,
+		"permissions", token.Permissions,
 	)
 
 	// IMPORTANT: We return the plainToken ONLY ONCE here.
+	s3 := S3Credentials(token, h.Config.Server.JwtSecret)
 	c.JSON(201, gin.H{
-		"id":          token.ID,
-		"plain_token": plainToken,
-		"name":        token.Name,
-		"path_scope":  token.PathScope,
+		"id":            token.ID,
+		"plain_token":   plainToken,
+		"name":          token.Name,
+		"path_scope":    token.PathScope,
+		"read_scope":    token.ReadScope,
+		"permissions":   token.Permissions,
+		"s3_access_key": s3.AccessKey,
+		"s3_secret_key": s3.SecretKey,
 	})
 }
 
 // ListTokens handles GET /_/api/admin/tokens
 func (h *AuthHandler) ListTokens(c *gin.Context) {
 	var tokens []models.Token
-	h.DB.Preload("User").Find(&tokens)
+	h.DB.Preload("User").Preload("Permissions").Find(&tokens)
 	c.JSON(200, tokens)
 }
 
@@ -284,7 +333,7 @@ func (h *AuthHandler) DeleteToken(c *gin.Context) {
 	}
 
 	// 2. Physical Deletion
-	if err := h.DB.Delete(&token).Error; err != nil {
+	if err := h.DB.Select("Permissions").Delete(&token).Error; err != nil {
 		h.Log.WithError(err).Error("Failed to delete API token")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
 		return
@@ -296,6 +345,7 @@ func (h *AuthHandler) DeleteToken(c *gin.Context) {
 		token.Name,
 		"owner", token.User.Username,
 		"scope", token.PathScope,
+		"read_scope", token.ReadScope,
 	)
 
 	// 4. Return 204 No Content
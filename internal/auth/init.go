@@ -26,6 +26,9 @@ func (h *AuthHandler) RegisterRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Con
 
 	r.POST("/_/api/login", h.Login)
 	r.GET("/_/api/auth/me", Protect(), h.GetMe)
+	r.GET("/_/api/auth/s3-credentials", Protect(), h.GetS3Credentials)
+	r.GET("/_/api/auth/oidc/login", h.OIDCLogin)
+	r.GET(oidcCallback, h.OIDCCallback)
 	admin := r.Group("/_/api/admin", AdminRequired())
 	{
 		admin.GET("/users", h.ListUsers)
@@ -36,6 +39,13 @@ func (h *AuthHandler) RegisterRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Con
 		admin.GET("/tokens", h.ListTokens)
 		admin.POST("/tokens", h.CreateToken)
 		admin.DELETE("/tokens/:name", h.DeleteToken)
+
+		admin.GET("/groups", h.ListGroups)
+		admin.POST("/groups", h.CreateGroup)
+		admin.PATCH("/groups/:id", h.UpdateGroup)
+		admin.DELETE("/groups/:id", h.DeleteGroup)
+		admin.PUT("/groups/:id/members/:user_id", h.AddGroupMember)
+		admin.DELETE("/groups/:id/members/:user_id", h.RemoveGroupMember)
 	}
 
 }
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/kovi/yaar/internal/models"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// ldapProvider checks passwords with a bind against a directory
+type ldapProvider struct {
+	cfg    config.LDAPConfig
+	logins *LoginCache
+}
+
+func (h *AuthHandler) ldapProvider() ldapProvider {
+	h.ldapMu.Lock()
+	defer h.ldapMu.Unlock()
+	if h.ldapLogins == nil {
+		h.ldapLogins = NewLoginCache()
+	}
+	return ldapProvider{cfg: h.Config.LDAP, logins: h.ldapLogins}
+}
+
+func (p ldapProvider) Name() string { return models.ProviderLDAP }
+
+func (p ldapProvider) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	if username == "" || password == "" {
+		return Identity{}, ErrInvalidCredentials
+	}
+	if id, ok := p.logins.Get(username, password); ok {
+		return id, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ldapTimeout)
+	defer cancel()
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+
+	attrs := []string{"cn"}
+	if p.cfg.GroupBaseDN == "" && p.cfg.GroupAttribute != "" {
+		attrs = append(attrs, p.cfg.GroupAttribute)
+	}
+	filter := strings.ReplaceAll(p.cfg.UserFilter, "%s", ldap.EscapeFilter(username))
+	res, err := conn.Search(ldap.NewSearchRequest(p.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 0, false, filter, attrs, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return Identity{}, fmt.Errorf("user search: %w", err)
+	}
+	if res == nil || len(res.Entries) != 1 {
+		// Unknown or ambiguous
+		return Identity{}, ErrInvalidCredentials
+	}
+	user := res.Entries[0]
+
+	if err := conn.Bind(user.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Identity{}, ErrInvalidCredentials
+		}
+		return Identity{}, err
+	}
+
+	var groups []string // Unknown unless the directory is asked for them
+	if p.cfg.GroupBaseDN != "" {
+		groups = []string{}
+		// Search groups with the service account again, users may not be allowed to
+		if err := conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+			return Identity{}, fmt.Errorf("service bind: %w", err)
+		}
+		filter := strings.NewReplacer("%s", ldap.EscapeFilter(user.DN), "%u", ldap.EscapeFilter(username)).Replace(p.cfg.GroupFilter)
+		found, err := conn.Search(ldap.NewSearchRequest(p.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+			0, 0, false, filter, []string{"cn"}, nil))
+		if err != nil {
+			return Identity{}, fmt.Errorf("group search: %w", err)
+		}
+		for _, g := range found.Entries {
+			groups = append(groups, g.GetEqualFoldAttributeValues("cn")...)
+		}
+	} else if p.cfg.GroupAttribute != "" {
+		groups = []string{}
+		for _, dn := range user.GetEqualFoldAttributeValues(p.cfg.GroupAttribute) {
+			groups = append(groups, rdnValue(dn))
+		}
+	}
+
+	id := Identity{Username: username, Groups: groups, IsAdmin: adminFromGroups(groups, p.cfg.AdminGroups)}
+	if p.cfg.CacheTTL > 0 {
+		p.logins.Set(username, password, id, p.cfg.CacheTTL)
+	}
+	return id, nil
+}
+
+// connect dials the directory and binds with the service account, if there is one.
+// The context deadline applies to the dial and to every later operation.
+func (p ldapProvider) connect(ctx context.Context) (*ldap.Conn, error) {
+	u, err := url.Parse(p.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.cfg.InsecureSkipVerify, ServerName: u.Hostname()}
+	conn, err := ldap.DialURL(p.cfg.URL, ldap.DialWithDialer(&net.Dialer{Deadline: deadline}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(time.Until(deadline))
+	if p.cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if p.cfg.BindDN != "" {
+		if err := conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// rdnValue is the value of the first RDN of dn, e.g. the group name of cn=devs,ou=groups,dc=example,dc=org
+func rdnValue(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
@@ -6,50 +6,20 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/config"
 	"github.com/kovi/yaar/internal/models"
+	"github.com/kovi/yaar/internal/sigv4"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
 // Identify simply populates the context with user info if a valid token is found.
 // It allows anonymous requests. It only fails if a token is present but invalid.
-func Identify(secret string, db *gorm.DB, cache *UserCache) gin.HandlerFunc {
+func Identify(cfg *config.Config, db *gorm.DB, cache *UserCache) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// 1. Check for API Token
 		if apiToken := c.GetHeader("X-API-Token"); apiToken != "" {
-			hash := HashToken(apiToken)
-			var t models.Token
-
-			result := db.Preload("User").Where("secret_hash = ?", hash).Limit(1).Find(&t)
-
-			if result.Error != nil {
-				c.AbortWithStatusJSON(500, gin.H{"error": "Database error during authentication"})
-				return
-			}
-
-			if t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt) {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API Token has expired"})
-				return
-			}
-
-			if result.RowsAffected > 0 {
-				// Success: Set context
-				c.Set("user_id", t.UserID)
-				c.Set("username", t.User.Username)
-				c.Set("is_admin", t.User.IsAdmin)
-				c.Set("allowed_paths", strings.Split(t.PathScope, ","))
-
-				// UPDATE LAST USED:
-				// We use a separate Update call to keep it efficient.
-				// This won't trigger hooks or update 'updated_at' if you use .UpdateColumn
-				db.Model(&t).UpdateColumn("last_used_at", time.Now())
-
-				c.Next()
-				return
-			}
-
-			// If token was provided but not found, reject the request
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API Token"})
+			identifyAPIToken(c, db, cfg, apiToken, false)
 			return
 		}
 
@@ -59,13 +29,32 @@ func Identify(secret string, db *gorm.DB, cache *UserCache) gin.HandlerFunc {
 			return
 		}
 
+		// SigV4 signed requests are verified by the S3 API, so failures are answered with S3 errors
+		if strings.HasPrefix(authHeader, sigv4.Algorithm+" ") {
+			c.Next()
+			return
+		}
+
+		// Clients that only speak Basic auth (docker login, Maven, pip, wget, ...) send the API token as password.
+		// The username is not checked, the token identifies its owner.
+		if _, password, ok := c.Request.BasicAuth(); ok {
+			identifyAPIToken(c, db, cfg, password, true)
+			return
+		}
+
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || parts[0] != "Bearer" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid format"})
 			return
 		}
 
-		claims, err := ValidateToken(parts[1], secret)
+		// Package managers (e.g. npm with _authToken) send API tokens as bearer token
+		if strings.HasPrefix(parts[1], apiTokenPrefix) {
+			identifyAPIToken(c, db, cfg, parts[1], false)
+			return
+		}
+
+		claims, err := ValidateToken(parts[1], cfg.Server.JwtSecret)
 		if err != nil {
 			logrus.Infof("validatetoken error: %v", err)
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Expired or invalid session"})
@@ -73,25 +62,32 @@ func Identify(secret string, db *gorm.DB, cache *UserCache) gin.HandlerFunc {
 		}
 
 		exists, _, found := cache.Get(claims.UserID)
+		scopes := cache.Scopes(claims.UserID)
 		if !found {
 			// Cache miss: Check the real database
 			var user models.User
-			res := db.Select("id", "is_admin").Limit(1).Find(&user, claims.UserID)
+			res := db.Select("id", "is_admin", "read_scope").Limit(1).Find(&user, claims.UserID)
 			if res.Error != nil {
 				logrus.Infof("DB query error: %v", res.Error)
 				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Invalid auth"})
 			}
 			if res.RowsAffected == 0 {
 				// User was likely deleted from DB
-				cache.Set(claims.UserID, false, false, 5*time.Minute)
+				cache.Set(claims.UserID, false, false, nil, 5*time.Minute)
 				c.AbortWithStatusJSON(401, gin.H{"error": "User no longer exists"})
 				return
 			}
 
+			var err error
+			if scopes, err = UserScopes(db, user, cfg.Auth.DefaultRole); err != nil {
+				logrus.Infof("DB query error: %v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Invalid auth"})
+				return
+			}
+
 			// Update local info
 			exists = true
-			claims.IsAdmin = user.IsAdmin
-			cache.Set(claims.UserID, true, claims.IsAdmin, 2*time.Minute)
+			cache.Set(claims.UserID, true, IsAdminScope(scopes), scopes, 2*time.Minute)
 		}
 
 		if !exists {
@@ -101,23 +97,121 @@ func Identify(secret string, db *gorm.DB, cache *UserCache) gin.HandlerFunc {
 
 		c.Set("user_id", claims.UserID)
 		c.Set("username", claims.Username)
-		c.Set("is_admin", claims.IsAdmin)
-		c.Set("allowed_paths", strings.Split("/", "")) // Humans have full access by default in this design
+		setScopes(c, scopes)
+		c.Next()
+	}
+}
+
+// identifyAPIToken sets the identity of the token owner, or aborts if the token is unknown or expired.
+// Basic auth clients are challenged again, so they can ask for other credentials.
+func identifyAPIToken(c *gin.Context, db *gorm.DB, cfg *config.Config, apiToken string, basic bool) {
+	reject := func(msg string) {
+		if basic {
+			Challenge(c)
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": msg})
+	}
+	hash := HashToken(apiToken)
+	var t models.Token
+
+	result := db.Preload("User").Preload("Permissions").Where("secret_hash = ?", hash).Limit(1).Find(&t)
+
+	if result.Error != nil {
+		c.AbortWithStatusJSON(500, gin.H{"error": "Database error during authentication"})
+		return
+	}
+
+	if t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt) {
+		reject("API Token has expired")
+		return
+	}
+
+	if result.RowsAffected > 0 {
+		if err := setTokenIdentity(c, db, &t, cfg.Auth.DefaultRole); err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": "Database error during authentication"})
+			return
+		}
 		c.Next()
+		return
 	}
+
+	// If token was provided but not found, reject the request
+	reject("Invalid API Token")
+}
+
+// setTokenIdentity sets the context of a request authenticated with token t.
+// Each permission of the token is limited to the scopes of its user.
+func setTokenIdentity(c *gin.Context, db *gorm.DB, t *models.Token, defaultRole string) error {
+	userScopes, err := UserScopes(db, t.User, defaultRole)
+	if err != nil {
+		return err
+	}
+	scopes := TokenScopes(t)
+	for _, perm := range Permissions {
+		scopes[perm] = IntersectScopes(userScopes[perm], scopes[perm])
+	}
+
+	c.Set("user_id", t.UserID)
+	c.Set("username", t.User.Username)
+	c.Set("token_id", t.ID)
+	setScopes(c, scopes)
+
+	// UPDATE LAST USED:
+	// We use a separate Update call to keep it efficient.
+	// This won't trigger hooks or update 'updated_at' if you use .UpdateColumn
+	db.Model(t).UpdateColumn("last_used_at", time.Now())
+	return nil
+}
+
+// setScopes sets the scopes of the caller per permission in the request context
+func setScopes(c *gin.Context, scopes map[string][]string) {
+	c.Set("is_admin", IsAdminScope(scopes))
+	c.Set("allowed_paths", scopes[PermWrite])
+	c.Set("delete_paths", scopes[PermDelete])
+	c.Set("meta_paths", scopes[PermPatchMeta])
+	c.Set("read_paths", scopes[PermRead])
+}
+
+// TokenScopes returns the scopes of t per permission, a missing permission has none.
+// Tokens without structured permissions write, delete and patch below PathScope and are admin for admins.
+func TokenScopes(t *models.Token) map[string][]string {
+	if len(t.Permissions) == 0 {
+		write := strings.Split(t.PathScope, ",")
+		return map[string][]string{
+			PermRead:      ParseScopes(t.ReadScope),
+			PermWrite:     write,
+			PermDelete:    write,
+			PermPatchMeta: write,
+			PermAdmin:     {"/"},
+		}
+	}
+	scopes := map[string][]string{}
+	for _, p := range t.Permissions {
+		scopes[p.Action] = append(scopes[p.Action], ParseScopes(p.Scope)...)
+	}
+	return scopes
 }
 
 // --- Logic Helpers (Directly usable in SmartRouter) ---
 
-// EnsureAuth returns true if the user is identified, otherwise aborts with 401.
+// EnsureAuth returns true if the user is identified, otherwise aborts with 401 and a Basic challenge.
 func EnsureAuth(c *gin.Context) bool {
 	if _, exists := c.Get("username"); !exists {
+		Challenge(c)
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
 		return false
 	}
 	return true
 }
 
+// Challenge asks the client for Basic credentials, i.e. an API token as password. Tools like Maven or pip only
+// send credentials when challenged. The UI handles the 401 of API calls itself, a challenge would make the browser prompt.
+func Challenge(c *gin.Context) {
+	if !strings.HasPrefix(c.Request.URL.Path, "/_/api/") {
+		c.Header("WWW-Authenticate", `Basic realm="yaar"`)
+	}
+}
+
 // EnsureAdmin returns true if the user is an admin, otherwise aborts with 403.
 // It automatically calls EnsureAuth first.
 func EnsureAdmin(c *gin.Context) bool {
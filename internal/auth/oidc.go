@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/kovi/yaar/internal/models"
+	"github.com/kovi/yaar/internal/oidc"
+)
+
+const (
+	oidcCookie      = "yaar_oidc"
+	oidcCookiePath  = "/_/api/auth/oidc"
+	oidcCallback    = "/_/api/auth/oidc/callback"
+	oidcLoginExpiry = 10 * time.Minute
+	oidcStateAud    = "yaar-oidc-state" // Keeps the cookie from passing as any other token signed with the secret
+)
+
+// oidcLogin is the state of a pending login, kept in a signed cookie until the callback
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+	jwt.RegisteredClaims
+}
+
+// OIDCLogin handles GET /_/api/auth/oidc/login and sends the browser to the identity provider
+func (h *AuthHandler) OIDCLogin(c *gin.Context) {
+	provider, ok := h.oidcProvider(c)
+	if !ok {
+		return
+	}
+
+	login := oidcLogin{
+		State:    oidc.RandomString(),
+		Nonce:    oidc.RandomString(),
+		Verifier: oidc.RandomString(),
+		Redirect: localRedirect(c.Query("redirect")),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(oidcLoginExpiry)),
+			Audience:  jwt.ClaimStrings{oidcStateAud},
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, login).SignedString([]byte(h.Config.Server.JwtSecret))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not start login"})
+		return
+	}
+	h.setOIDCCookie(c, signed, int(oidcLoginExpiry.Seconds()))
+
+	cfg := h.Config.OIDC
+	c.Redirect(http.StatusFound, provider.AuthCodeURL(cfg.ClientID, h.oidcRedirectURL(c), cfg.Scopes, login.State, login.Nonce, login.Verifier))
+}
+
+// OIDCCallback handles GET /_/api/auth/oidc/callback. It provisions the user and hands a regular session to the UI.
+func (h *AuthHandler) OIDCCallback(c *gin.Context) {
+	provider, ok := h.oidcProvider(c)
+	if !ok {
+		return
+	}
+
+	cookie, _ := c.Cookie(oidcCookie)
+	h.setOIDCCookie(c, "", -1)
+	var login oidcLogin
+	_, err := jwt.ParseWithClaims(cookie, &login, func(t *jwt.Token) (any, error) {
+		return []byte(h.Config.Server.JwtSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(oidcStateAud))
+	if err != nil || login.State == "" || c.Query("state") != login.State {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Login expired or invalid state, please try again"})
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		h.Audit.WithContext(c).Failure("LOGIN_OIDC", "", fmt.Errorf("%s: %s", e, c.Query("error_description")))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login was denied by the identity provider"})
+		return
+	}
+
+	cfg := h.Config.OIDC
+	rawIDToken, err := provider.Exchange(c.Request.Context(), cfg.ClientID, cfg.ClientSecret, h.oidcRedirectURL(c), c.Query("code"), login.Verifier)
+	if err != nil {
+		h.Log.WithError(err).Warn("OIDC code exchange failed")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not redeem the authorization code"})
+		return
+	}
+	claims, err := provider.Verify(c.Request.Context(), rawIDToken, cfg.ClientID, login.Nonce)
+	if err != nil {
+		h.Log.WithError(err).Warn("OIDC id token rejected")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+		return
+	}
+
+	username, _ := claims[cfg.UsernameClaim].(string)
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "ID token has no " + cfg.UsernameClaim + " claim"})
+		return
+	}
+	groups := claimStrings(claims[cfg.GroupsClaim])
+	user, err := h.provisionUser(models.ProviderOIDC, Identity{Username: username, Groups: groups, IsAdmin: adminFromGroups(groups, cfg.AdminGroups)})
+	if err != nil {
+		h.Audit.WithContext(c).Failure("LOGIN_OIDC", username, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, errAccountTaken) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": "Could not log in: " + err.Error()})
+		return
+	}
+
+	token, err := GenerateToken(user, h.Config.Server.JwtSecret)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not generate token"})
+		return
+	}
+	h.Audit.WithContext(c).Success("LOGIN_OIDC", user.Username, "is_admin", user.IsAdmin)
+
+	// The UI keeps the session in local storage, like after a password login
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	oidcCompleteTmpl.Execute(c.Writer, gin.H{"Token": token, "Username": user.Username, "IsAdmin": user.IsAdmin, "Redirect": login.Redirect})
+}
+
+// oidcProvider returns the discovered identity provider, or writes an error if SSO is off or unreachable
+func (h *AuthHandler) oidcProvider(c *gin.Context) (*oidc.Provider, bool) {
+	if h.Config.OIDC.Issuer == "" || !h.Config.AuthProvider(models.ProviderOIDC) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return nil, false
+	}
+	h.oidcMu.Lock()
+	defer h.oidcMu.Unlock()
+	if h.oidc == nil || strings.TrimSuffix(h.oidc.Issuer, "/") != h.Config.OIDC.Issuer {
+		p, err := oidc.Discover(c.Request.Context(), &http.Client{Timeout: 10 * time.Second}, h.Config.OIDC.Issuer)
+		if err != nil {
+			h.Log.WithError(err).Warn("OIDC discovery failed")
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider is not reachable"})
+			return nil, false
+		}
+		h.oidc = p
+	}
+	return h.oidc, true
+}
+
+// oidcRedirectURL is the callback URL, the configured one or the one of this server as seen by the browser
+func (h *AuthHandler) oidcRedirectURL(c *gin.Context) string {
+	if h.Config.OIDC.RedirectURL != "" {
+		return h.Config.OIDC.RedirectURL
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + oidcCallback
+}
+
+func (h *AuthHandler) setOIDCCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetCookie(oidcCookie, value, maxAge, oidcCookiePath, "", secure, true)
+}
+
+// localRedirect only allows paths of this server as target after the login
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+// claimStrings reads a claim holding one or more strings, e.g. groups. Nil if the claim is missing.
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := []string{}
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+var oidcCompleteTmpl = template.Must(template.New("oidc").Parse(`<!DOCTYPE html>
+<html><head><title>Signing in...</title></head><body><script>
+localStorage.setItem('af_token', {{.Token}});
+localStorage.setItem('af_user', JSON.stringify({username: {{.Username}}, isAdmin: {{.IsAdmin}}}));
+location.replace({{.Redirect}});
+</script></body></html>
+`))
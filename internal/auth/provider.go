@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/kovi/yaar/internal/models"
+	"github.com/kovi/yaar/internal/oidc"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidCredentials means a provider doesn't know the user or the password is wrong, the next provider is tried
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+var errAccountTaken = errors.New("the username belongs to an account of another provider")
+
+// Identity is a user as confirmed by a login provider
+type Identity struct {
+	Username string
+	Groups   []string // Groups at the provider, mapped to the local groups of the same name. Nil if unknown.
+	IsAdmin  *bool    // Set if the provider decides the admin status
+}
+
+// PasswordProvider checks a username and password, e.g. against the local database or a directory
+type PasswordProvider interface {
+	// Name is the models.Provider* of the users it confirms
+	Name() string
+	Authenticate(ctx context.Context, username, password string) (Identity, error)
+}
+
+// localProvider checks the bcrypt hashes of local users
+type localProvider struct {
+	db *gorm.DB
+}
+
+func (p localProvider) Name() string { return models.ProviderLocal }
+
+func (p localProvider) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	var user models.User
+	if err := p.db.Where("username = ?", username).Limit(1).Find(&user).Error; err != nil {
+		return Identity{}, err
+	}
+	// Users of other providers have no local password
+	if user.ID == 0 || user.Provider != models.ProviderLocal || !user.CheckPassword(password) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{Username: user.Username}, nil
+}
+
+// passwordProviders is the configured login chain, OIDC is not part of it as it has its own login flow
+func (h *AuthHandler) passwordProviders() []PasswordProvider {
+	var chain []PasswordProvider
+	for _, name := range h.Config.Auth.Providers {
+		switch name {
+		case models.ProviderLocal:
+			chain = append(chain, localProvider{db: h.DB})
+		case models.ProviderLDAP:
+			chain = append(chain, h.ldapProvider())
+		}
+	}
+	return chain
+}
+
+// authenticate tries the providers in order and returns the user of the first one accepting the password.
+// Users of external providers are created or updated on the way.
+func (h *AuthHandler) authenticate(ctx context.Context, username, password string) (models.User, string, error) {
+	err := ErrInvalidCredentials
+	for _, p := range h.passwordProviders() {
+		id, perr := p.Authenticate(ctx, username, password)
+		if errors.Is(perr, ErrInvalidCredentials) {
+			continue
+		}
+		if perr != nil {
+			h.Log.WithError(perr).WithField("provider", p.Name()).Warn("Login provider failed")
+			err = perr
+			continue
+		}
+		if p.Name() == models.ProviderLocal {
+			var user models.User
+			return user, p.Name(), h.DB.Where("username = ?", id.Username).First(&user).Error
+		}
+		user, perr := h.provisionUser(p.Name(), id)
+		return user, p.Name(), perr
+	}
+	return models.User{}, "", err
+}
+
+// provisionUser creates the user of an external provider on first login and syncs admin status and the
+// memberships in the groups managed by the provider. Accounts of other providers, local ones included,
+// are never taken over.
+func (h *AuthHandler) provisionUser(provider string, id Identity) (models.User, error) {
+	var user models.User
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("username = ?", id.Username).Limit(1).Find(&user)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			user = models.User{Username: id.Username, Provider: provider}
+			// Never used, password logins only go to the provider
+			if err := user.SetPassword(oidc.RandomString()); err != nil {
+				return err
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		} else if user.Provider != provider {
+			return errAccountTaken
+		}
+
+		if id.IsAdmin != nil {
+			user.IsAdmin = *id.IsAdmin
+			if err := tx.Model(&user).Update("is_admin", user.IsAdmin).Error; err != nil {
+				return err
+			}
+		}
+
+		if id.Groups == nil {
+			// The provider didn't say, memberships stay as they are
+			return nil
+		}
+		var managed []models.Group
+		if err := tx.Where("provider = ?", provider).Find(&managed).Error; err != nil {
+			return err
+		}
+		var join, leave []models.Group
+		for _, g := range managed {
+			if slices.Contains(id.Groups, g.Name) {
+				join = append(join, g)
+			} else {
+				leave = append(leave, g)
+			}
+		}
+		if len(leave) > 0 {
+			if err := tx.Model(&user).Association("Groups").Delete(leave); err != nil {
+				return err
+			}
+		}
+		if len(join) > 0 {
+			return tx.Model(&user).Association("Groups").Append(join)
+		}
+		return nil
+	})
+	if err == nil {
+		h.UserCache.Invalidate(user.ID)
+	}
+	return user, err
+}
+
+// adminFromGroups decides the admin status by group membership, nil if no admin groups are configured
+// or the groups are unknown
+func adminFromGroups(groups, adminGroups []string) *bool {
+	if len(adminGroups) == 0 || groups == nil {
+		return nil
+	}
+	isAdmin := slices.ContainsFunc(groups, func(g string) bool { return slices.Contains(adminGroups, g) })
+	return &isAdmin
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"github.com/kovi/yaar/internal/models"
+	"gorm.io/gorm"
+)
+
+// Roles of group bindings
+const (
+	RoleViewer     = "viewer"
+	RolePublisher  = "publisher"
+	RoleMaintainer = "maintainer"
+	RoleAdmin      = "admin"
+)
+
+// rolePermissions maps a role to the token permissions it grants below its scope
+var rolePermissions = map[string][]string{
+	RoleViewer:     {PermRead},
+	RolePublisher:  {PermRead, PermWrite},
+	RoleMaintainer: {PermRead, PermWrite, PermDelete, PermPatchMeta},
+	RoleAdmin:      Permissions,
+}
+
+// IsRole reports if role is a known role
+func IsRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// UserScopes returns the scopes of user per permission. Admins may do everything, other users get defaultRole
+// on the whole tree and the roles bound to their groups. Reads are still limited by the read scope.
+func UserScopes(db *gorm.DB, user models.User, defaultRole string) (map[string][]string, error) {
+	if user.IsAdmin {
+		scopes := map[string][]string{}
+		for _, perm := range Permissions {
+			scopes[perm] = []string{"/"}
+		}
+		return scopes, nil
+	}
+
+	var bindings []models.RoleBinding
+	err := db.Joins("JOIN group_members ON group_members.group_id = role_bindings.group_id").
+		Where("group_members.user_id = ?", user.ID).
+		Find(&bindings).Error
+	if err != nil {
+		return nil, err
+	}
+	if defaultRole != "" {
+		bindings = append(bindings, models.RoleBinding{Role: defaultRole, Scope: "/"})
+	}
+	scopes := map[string][]string{}
+	for _, b := range bindings {
+		for _, perm := range rolePermissions[b.Role] {
+			scopes[perm] = append(scopes[perm], ParseScopes(b.Scope)...)
+		}
+	}
+	scopes[PermRead] = IntersectScopes(ParseScopes(user.ReadScope), scopes[PermRead])
+	return scopes, nil
+}
+
+// IsAdminScope reports if scopes grant the admin API, that is admin on the whole tree
+func IsAdminScope(scopes map[string][]string) bool {
+	return IsInScopes("/", scopes[PermAdmin])
+}
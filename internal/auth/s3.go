@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kovi/yaar/internal/config"
+	"github.com/kovi/yaar/internal/models"
+	"github.com/kovi/yaar/internal/sigv4"
+	"gorm.io/gorm"
+)
+
+// S3 clients sign requests with SigV4, which needs a shared secret instead of the hashed API token.
+// The access key of a token is derived from its ID and the secret key from its hash and the server secret,
+// so nothing extra is stored and both stop working together with the token.
+
+const s3AccessKeyPrefix = "YAAR"
+
+// s3MaxClockSkew is how far the signing time of a request may be off
+const s3MaxClockSkew = 15 * time.Minute
+
+// Errors of IdentifyS3, named after the S3 error codes
+var (
+	ErrS3AccessDenied     = errors.New("AccessDenied")
+	ErrS3InvalidAccessKey = errors.New("InvalidAccessKeyId")
+	ErrS3Malformed        = errors.New("AuthorizationHeaderMalformed")
+	ErrS3Signature        = errors.New("SignatureDoesNotMatch")
+	ErrS3ClockSkew        = errors.New("RequestTimeTooSkewed")
+)
+
+// S3Credentials returns the SigV4 key pair of a token
+func S3Credentials(t models.Token, serverSecret string) sigv4.Credentials {
+	mac := hmac.New(sha256.New, []byte(serverSecret))
+	mac.Write([]byte("s3:" + t.SecretHash))
+	return sigv4.Credentials{
+		AccessKey: fmt.Sprintf("%s%012d", s3AccessKeyPrefix, t.ID),
+		SecretKey: base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:40],
+	}
+}
+
+// IsS3Request reports if the request is signed with SigV4, in the Authorization header or as presigned URL
+func IsS3Request(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), sigv4.Algorithm+" ") ||
+		r.URL.Query().Get("X-Amz-Algorithm") == sigv4.Algorithm
+}
+
+// s3Signature is the signature of a request and what it covers
+type s3Signature struct {
+	accessKey     string
+	scope         []string // date, region, service, "aws4_request"
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	expires       time.Duration // presigned URLs only
+}
+
+func parseS3Signature(r *http.Request) (*s3Signature, error) {
+	var sig s3Signature
+	var credential string
+	if header := r.Header.Get("Authorization"); header != "" {
+		// AWS4-HMAC-SHA256 Credential=<key>/<scope>, SignedHeaders=<a;b>, Signature=<hex>
+		for _, part := range strings.Split(strings.TrimPrefix(header, sigv4.Algorithm), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch k {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				sig.signedHeaders = strings.Split(v, ";")
+			case "Signature":
+				sig.signature = v
+			}
+		}
+		sig.amzDate = r.Header.Get("X-Amz-Date")
+		sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	} else {
+		q := r.URL.Query()
+		credential = q.Get("X-Amz-Credential")
+		sig.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+		sig.signature = q.Get("X-Amz-Signature")
+		sig.amzDate = q.Get("X-Amz-Date")
+		sig.payloadHash = sigv4.UnsignedPayload
+		seconds, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || seconds <= 0 || seconds > 7*24*3600 {
+			return nil, ErrS3Malformed
+		}
+		sig.expires = time.Duration(seconds) * time.Second
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" ||
+		sig.signature == "" || sig.amzDate == "" || sig.payloadHash == "" || len(sig.signedHeaders) == 0 {
+		return nil, ErrS3Malformed
+	}
+	sig.accessKey = parts[0]
+	sig.scope = parts[1:]
+	return &sig, nil
+}
+
+// IdentifyS3 verifies the SigV4 signature of the request and sets the identity of the token owner like
+// Identify does for API tokens. The body is not covered, the payload hash is for the caller to verify.
+func IdentifyS3(c *gin.Context, db *gorm.DB, cfg *config.Config) error {
+	sig, err := parseS3Signature(c.Request)
+	if err != nil {
+		return err
+	}
+
+	signedAt, err := time.Parse(sigv4.TimeFormat, sig.amzDate)
+	if err != nil || sig.scope[0] != signedAt.Format(sigv4.ShortFormat) {
+		return ErrS3Malformed
+	}
+	now := time.Now()
+	if sig.expires > 0 {
+		if now.After(signedAt.Add(sig.expires)) || signedAt.After(now.Add(s3MaxClockSkew)) {
+			return ErrS3AccessDenied
+		}
+	} else if now.Sub(signedAt) > s3MaxClockSkew || signedAt.Sub(now) > s3MaxClockSkew {
+		return ErrS3ClockSkew
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(sig.accessKey, s3AccessKeyPrefix), 10, 32)
+	if err != nil || !strings.HasPrefix(sig.accessKey, s3AccessKeyPrefix) {
+		return ErrS3InvalidAccessKey
+	}
+	var t models.Token
+	result := db.Preload("User").Preload("Permissions").Where("id = ?", id).Limit(1).Find(&t)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrS3InvalidAccessKey
+	}
+	if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+		return ErrS3AccessDenied
+	}
+	creds := S3Credentials(t, cfg.Server.JwtSecret)
+	if creds.AccessKey != sig.accessKey {
+		return ErrS3InvalidAccessKey
+	}
+
+	// Go moves Content-Length out of the header map
+	req := *c.Request
+	req.Header = c.Request.Header.Clone()
+	for _, name := range sig.signedHeaders {
+		if name == "content-length" {
+			req.Header.Set("Content-Length", strconv.FormatInt(c.Request.ContentLength, 10))
+		}
+	}
+	canonical := sigv4.CanonicalRequest(&req, sig.signedHeaders, sig.payloadHash)
+	stringToSign := sigv4.StringToSign(sig.amzDate, strings.Join(sig.scope, "/"), canonical)
+	expected := sigv4.Signature(creds.SecretKey, signedAt, sig.scope[1], "s3", stringToSign)
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return ErrS3Signature
+	}
+
+	return setTokenIdentity(c, db, &t, cfg.Auth.DefaultRole)
+}
+
+// GetS3Credentials handles GET /_/api/auth/s3-credentials.
+// Only the API token itself can reveal its key pair.
+func (h *AuthHandler) GetS3Credentials(c *gin.Context) {
+	tokenID, ok := c.Get("token_id")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Authenticate with the API token to get its S3 credentials"})
+		return
+	}
+	var t models.Token
+	if err := h.DB.First(&t, tokenID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	creds := S3Credentials(t, h.Config.Server.JwtSecret)
+	c.JSON(http.StatusOK, gin.H{"access_key": creds.AccessKey, "secret_key": creds.SecretKey})
+}
@@ -1,31 +1,105 @@
 package auth
 
 import (
+	"path"
 	"path/filepath"
 	"strings"
 )
 
+// Token permissions
+const (
+	PermRead      = "read"
+	PermWrite     = "write"
+	PermDelete    = "delete"
+	PermPatchMeta = "patch-meta"
+	PermAdmin     = "admin"
+)
+
+// Permissions lists the valid token permission actions
+var Permissions = []string{PermRead, PermWrite, PermDelete, PermPatchMeta, PermAdmin}
+
+// IsInScope reports if path is scope or below it. Segments of scope may be globs, e.g. /builds/*/docs.
 func IsInScope(path, scope string) bool {
 	if scope == "" || scope == "/" {
 		return true
 	}
-	// Simple directory prefix check
-	cleanPath := filepath.Clean("/" + path)
-	cleanScope := filepath.Clean("/" + scope)
-
-	return cleanPath == cleanScope || strings.HasPrefix(cleanPath, cleanScope+"/")
+	pathParts := splitScope(path)
+	scopeParts := splitScope(scope)
+	if len(scopeParts) > len(pathParts) {
+		return false
+	}
+	for i, pattern := range scopeParts {
+		if !matchSegment(pattern, pathParts[i]) {
+			return false
+		}
+	}
+	return true
 }
 
+// IsInScopes reports if path is in one of scopes, no scopes grant nothing
 func IsInScopes(path string, scopes []string) bool {
-	if len(scopes) == 0 || (len(scopes) == 1 && scopes[0] == "/") {
-		return true
-	}
-
 	for _, scope := range scopes {
 		if IsInScope(path, scope) {
 			return true
 		}
 	}
-
 	return false
 }
+
+// LeadsToScope reports if dir is in scope or something below dir may be in it
+func LeadsToScope(dir, scope string) bool {
+	dirParts := splitScope(dir)
+	scopeParts := splitScope(scope)
+	for i := 0; i < len(dirParts) && i < len(scopeParts); i++ {
+		if !matchSegment(scopeParts[i], dirParts[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func splitScope(p string) []string {
+	p = filepath.ToSlash(filepath.Clean("/" + p))
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+func matchSegment(pattern, name string) bool {
+	if pattern == name {
+		return true
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// ParseScopes splits a comma separated scope list, an empty list grants everything
+func ParseScopes(s string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, filepath.Clean("/"+scope))
+		}
+	}
+	if len(scopes) == 0 {
+		return []string{"/"}
+	}
+	return scopes
+}
+
+// IntersectScopes returns the scopes covering the paths that are in both a and b.
+// The result is empty if they have nothing in common.
+func IntersectScopes(a, b []string) []string {
+	result := []string{}
+	for _, x := range a {
+		for _, y := range b {
+			if IsInScope(y, x) {
+				result = append(result, filepath.Clean("/"+y))
+			} else if IsInScope(x, y) {
+				result = append(result, filepath.Clean("/"+x))
+			}
+		}
+	}
+	return result
+}
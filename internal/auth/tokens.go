@@ -7,6 +7,9 @@ import (
 	"fmt"
 )
 
+// apiTokenPrefix starts every API token, JWTs never do
+const apiTokenPrefix = "af_"
+
 // GenerateRandomToken returns a plain-text token with a prefix (e.g., af_...)
 func GenerateRandomToken() (string, error) {
 	b := make([]byte, 24) // 24 bytes of entropy
@@ -14,7 +17,7 @@ func GenerateRandomToken() (string, error) {
 		return "", err
 	}
 	// github style prefix makes it easy to identify
-	return fmt.Sprintf("af_%s", hex.EncodeToString(b)), nil
+	return fmt.Sprintf("%s%s", apiTokenPrefix, hex.EncodeToString(b)), nil
 }
 
 // HashToken converts a plain-text token into a SHA256 hex string
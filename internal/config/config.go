@@ -3,12 +3,15 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -27,12 +30,124 @@ type Config struct {
 		BaseDir            string   `yaml:"base_dir" env:"AF_BASE_DIR"`
 		MaxUploadSize      string   `yaml:"max_upload_size" env:"AF_MAX_SIZE"`
 		MaxUploadSizeBytes int64    `yaml:"-"`
+		MaxExtractEntries  int      `yaml:"max_extract_entries" env:"AF_MAX_EXTRACT_ENTRIES"` // Files and directories an X-Extract archive may have
 		ProtectedPaths     []string `yaml:"protected_paths" env:"AF_PROTECTED_PATHS"`
+		AnonymousRead      []string `yaml:"anonymous_read" env:"AF_ANONYMOUS_READ"` // Prefixes readable without login, [] makes the server private
+		Dedup              bool     `yaml:"dedup" env:"AF_DEDUP"`                   // Store identical content once (hardlinks into a blob store)
+		Backend            string   `yaml:"backend" env:"AF_STORAGE_BACKEND"`       // "fs" (default) or "s3"
+		S3                 S3Config `yaml:"s3"`
 	} `yaml:"storage"`
 
 	Audit struct {
 		File string `yaml:"file" env:"AF_AUDIT_LOG"`
 	} `yaml:"audit"`
+
+	Maven struct {
+		Paths []string `yaml:"paths" env:"AF_MAVEN_PATHS"` // Path prefixes laid out as Maven repositories
+	} `yaml:"maven"`
+
+	PyPI struct {
+		Paths []string `yaml:"paths" env:"AF_PYPI_PATHS"` // Path prefixes served as Python package indexes
+	} `yaml:"pypi"`
+
+	NPM struct {
+		Paths []string `yaml:"paths" env:"AF_NPM_PATHS"` // Path prefixes served as npm registries
+	} `yaml:"npm"`
+
+	APT struct {
+		Paths             []string `yaml:"paths" env:"AF_APT_PATHS"`             // Path prefixes served as flat APT repositories
+		SigningKey        string   `yaml:"signing_key" env:"AF_APT_SIGNING_KEY"` // Armored GPG private key file, signs InRelease
+		SigningPassphrase string   `yaml:"signing_passphrase" env:"AF_APT_SIGNING_PASSPHRASE" json:"-"`
+	} `yaml:"apt"`
+
+	RPM struct {
+		Paths []string `yaml:"paths" env:"AF_RPM_PATHS"` // Path prefixes served as YUM repositories
+	} `yaml:"rpm"`
+
+	GoProxy struct {
+		Paths []string `yaml:"paths" env:"AF_GOPROXY_PATHS"` // Path prefixes served as Go module proxies
+	} `yaml:"goproxy"`
+
+	Helm struct {
+		Paths []string `yaml:"paths" env:"AF_HELM_PATHS"` // Chart directories served as Helm repositories
+	} `yaml:"helm"`
+
+	LFS struct {
+		Paths []string `yaml:"paths" env:"AF_LFS_PATHS"` // Path prefixes serving Git LFS repositories
+	} `yaml:"lfs"`
+
+	// Remotes are pull-through caches of upstream repositories
+	Remotes []RemoteConfig `yaml:"remotes"`
+
+	// Virtuals merge several directories into one read-only view
+	Virtuals []VirtualConfig `yaml:"virtuals"`
+
+	Auth struct {
+		Providers   []string `yaml:"providers" env:"AF_AUTH_PROVIDERS"`       // Login chain of local, ldap and oidc, tried in order. Derived from what is configured if empty.
+		DefaultRole string   `yaml:"default_role" env:"AF_AUTH_DEFAULT_ROLE"` // Role of every user on the whole tree besides their group roles: viewer, publisher, maintainer or none
+	} `yaml:"auth"`
+
+	LDAP LDAPConfig `yaml:"ldap"`
+
+	// OIDC enables single sign-on with an OpenID Connect provider (authorization code flow with PKCE)
+	OIDC struct {
+		Issuer        string   `yaml:"issuer" env:"AF_OIDC_ISSUER"` // e.g. https://sso.example.com/realms/dev, empty disables SSO
+		ClientID      string   `yaml:"client_id" env:"AF_OIDC_CLIENT_ID"`
+		ClientSecret  string   `yaml:"client_secret" env:"AF_OIDC_CLIENT_SECRET" json:"-"` // Empty for public clients
+		RedirectURL   string   `yaml:"redirect_url" env:"AF_OIDC_REDIRECT_URL"`            // Registered callback URL, derived from the request if empty
+		Scopes        []string `yaml:"scopes" env:"AF_OIDC_SCOPES"`
+		UsernameClaim string   `yaml:"username_claim" env:"AF_OIDC_USERNAME_CLAIM"`
+		GroupsClaim   string   `yaml:"groups_claim" env:"AF_OIDC_GROUPS_CLAIM"`
+		AdminGroups   []string `yaml:"admin_groups" env:"AF_OIDC_ADMIN_GROUPS"` // IdP groups whose members are admins
+	} `yaml:"oidc"`
+
+	OCI struct {
+		Enabled bool   `yaml:"enabled" env:"AF_OCI_ENABLED"` // Serve the OCI Distribution API under /v2/
+		Path    string `yaml:"path" env:"AF_OCI_PATH"`       // Directory holding the image repositories
+	} `yaml:"oci"`
+}
+
+// S3Config configures the S3-compatible storage backend.
+// base_dir is still used locally for in-flight uploads.
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint" env:"AF_S3_ENDPOINT"` // e.g. http://localhost:9000
+	Region    string `yaml:"region" env:"AF_S3_REGION"`
+	Bucket    string `yaml:"bucket" env:"AF_S3_BUCKET"`
+	Prefix    string `yaml:"prefix" env:"AF_S3_PREFIX"` // Optional key prefix inside the bucket
+	AccessKey string `yaml:"access_key" env:"AF_S3_ACCESS_KEY"`
+	SecretKey string `yaml:"secret_key" env:"AF_S3_SECRET_KEY" json:"-"`
+}
+
+// LDAPConfig authenticates users with a bind against a directory. Users are looked up with UserFilter below BaseDN,
+// using BindDN for the search (anonymous if empty), then their password is checked with a bind as the found DN.
+type LDAPConfig struct {
+	URL                string        `yaml:"url" env:"AF_LDAP_URL"` // ldap://host:389 or ldaps://host:636
+	StartTLS           bool          `yaml:"start_tls" env:"AF_LDAP_START_TLS"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify" env:"AF_LDAP_INSECURE_SKIP_VERIFY"`
+	BindDN             string        `yaml:"bind_dn" env:"AF_LDAP_BIND_DN"`
+	BindPassword       string        `yaml:"bind_password" env:"AF_LDAP_BIND_PASSWORD" json:"-"`
+	BaseDN             string        `yaml:"base_dn" env:"AF_LDAP_BASE_DN"`
+	UserFilter         string        `yaml:"user_filter" env:"AF_LDAP_USER_FILTER"`         // %s is the username, e.g. (sAMAccountName=%s) for AD
+	GroupAttribute     string        `yaml:"group_attribute" env:"AF_LDAP_GROUP_ATTRIBUTE"` // Group DNs on the user entry, e.g. memberOf
+	GroupBaseDN        string        `yaml:"group_base_dn" env:"AF_LDAP_GROUP_BASE_DN"`     // Search groups here instead of reading GroupAttribute
+	GroupFilter        string        `yaml:"group_filter" env:"AF_LDAP_GROUP_FILTER"`       // %s is the user DN, %u the username
+	AdminGroups        []string      `yaml:"admin_groups" env:"AF_LDAP_ADMIN_GROUPS"`       // Directory groups (cn) whose members are admins
+	CacheTTL           time.Duration `yaml:"cache_ttl"`                                     // Successful logins are answered from memory for this long
+}
+
+// RemoteConfig mounts an upstream repository at Path. Files missing below Path are fetched from URL and cached.
+type RemoteConfig struct {
+	Path    string        `yaml:"path"`
+	URL     string        `yaml:"url"`
+	TTL     time.Duration `yaml:"ttl"`     // Cached files are revalidated with the upstream after TTL, 0 keeps them forever
+	Offline bool          `yaml:"offline"` // Only serve what is cached, never contact the upstream
+}
+
+// VirtualConfig serves a read-only view at Path of the directories in Paths.
+// A file is looked up in Paths in order, the first hit wins.
+type VirtualConfig struct {
+	Path  string   `yaml:"path"`
+	Paths []string `yaml:"paths"` // Local directories or remote paths
 }
 
 // NewConfig sets the hardcoded "Factory Defaults"
@@ -43,7 +158,18 @@ func NewConfig() *Config {
 	cfg.Database.File = "artifactory.db"
 	cfg.Storage.BaseDir = "storage"
 	cfg.Storage.MaxUploadSize = "100MB"
+	cfg.Storage.MaxExtractEntries = 10000
+	cfg.Storage.AnonymousRead = []string{"/"}
+	cfg.Auth.DefaultRole = "maintainer" // Users change everything, as before groups existed
 	cfg.Audit.File = "audit.log"
+	cfg.OCI.Path = "/oci"
+	cfg.LDAP.UserFilter = "(uid=%s)"
+	cfg.LDAP.GroupAttribute = "memberOf"
+	cfg.LDAP.GroupFilter = "(|(member=%s)(uniqueMember=%s)(memberUid=%u))"
+	cfg.LDAP.CacheTTL = 5 * time.Minute
+	cfg.OIDC.Scopes = []string{"openid", "profile", "email"}
+	cfg.OIDC.UsernameClaim = "preferred_username"
+	cfg.OIDC.GroupsClaim = "groups"
 
 	return cfg
 }
@@ -69,24 +195,207 @@ func (c *Config) Finalize() error {
 	}
 	c.Storage.MaxUploadSizeBytes = bytes
 
+	switch c.Storage.Backend {
+	case "", "fs":
+	case "s3":
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			return errors.New("storage.s3.endpoint and storage.s3.bucket are required for the s3 backend")
+		}
+		if c.Storage.Dedup {
+			return errors.New("storage.dedup requires the fs backend")
+		}
+	default:
+		return fmt.Errorf("unknown storage.backend %q", c.Storage.Backend)
+	}
+
 	// Normalize paths to ensure they start with / and don't end with /
-	for i, p := range c.Storage.ProtectedPaths {
-		cleaned := "/" + strings.Trim(filepath.ToSlash(p), "/")
-		c.Storage.ProtectedPaths[i] = cleaned
+	normalizePaths(c.Storage.ProtectedPaths)
+	normalizePaths(c.Storage.AnonymousRead)
+	normalizePaths(c.Maven.Paths)
+	normalizePaths(c.PyPI.Paths)
+	normalizePaths(c.NPM.Paths)
+	normalizePaths(c.APT.Paths)
+	normalizePaths(c.RPM.Paths)
+	normalizePaths(c.GoProxy.Paths)
+	normalizePaths(c.Helm.Paths)
+	normalizePaths(c.LFS.Paths)
+	for i := range c.Remotes {
+		r := &c.Remotes[i]
+		r.Path = "/" + strings.Trim(filepath.ToSlash(r.Path), "/")
+		r.URL = strings.TrimSuffix(r.URL, "/")
+		if r.Path == "/" {
+			return errors.New("remotes: path must not be the root directory")
+		}
+		if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("remotes: invalid url %q for %s", r.URL, r.Path)
+		}
+	}
+	for i := range c.Virtuals {
+		v := &c.Virtuals[i]
+		v.Path = "/" + strings.Trim(filepath.ToSlash(v.Path), "/")
+		normalizePaths(v.Paths)
+		if v.Path == "/" {
+			return errors.New("virtuals: path must not be the root directory")
+		}
+		if len(v.Paths) == 0 {
+			return fmt.Errorf("virtuals: %s has no paths", v.Path)
+		}
+	}
+	for _, v := range c.Virtuals {
+		for _, p := range v.Paths {
+			if _, ok := matchPrefix([]string{v.Path}, p); ok {
+				return fmt.Errorf("virtuals: %s can't include itself (%s)", v.Path, p)
+			}
+			if _, ok := c.Virtual(p); ok {
+				return fmt.Errorf("virtuals: %s can't include the virtual path %s", v.Path, p)
+			}
+		}
+	}
+	c.OCI.Path = "/" + strings.Trim(filepath.ToSlash(c.OCI.Path), "/")
+	if c.OCI.Enabled && c.OCI.Path == "/" {
+		return errors.New("oci.path must not be the root directory")
+	}
+	c.OIDC.Issuer = strings.TrimSuffix(c.OIDC.Issuer, "/")
+	if c.OIDC.Issuer != "" && c.OIDC.ClientID == "" {
+		return errors.New("oidc.client_id is required with oidc.issuer")
+	}
+	if c.LDAP.URL != "" {
+		if u, err := url.Parse(c.LDAP.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			return fmt.Errorf("ldap: invalid url %q", c.LDAP.URL)
+		}
+	}
+	if len(c.Auth.Providers) == 0 {
+		c.Auth.Providers = []string{"local"}
+		if c.LDAP.URL != "" {
+			c.Auth.Providers = append(c.Auth.Providers, "ldap")
+		}
+		if c.OIDC.Issuer != "" {
+			c.Auth.Providers = append(c.Auth.Providers, "oidc")
+		}
+	}
+	switch c.Auth.DefaultRole {
+	case "none":
+		c.Auth.DefaultRole = ""
+	case "", "viewer", "publisher", "maintainer":
+	default:
+		return fmt.Errorf("auth.default_role: unknown role %q", c.Auth.DefaultRole)
+	}
+	for _, p := range c.Auth.Providers {
+		switch p {
+		case "local":
+		case "ldap":
+			if c.LDAP.URL == "" {
+				return errors.New("auth.providers: ldap requires ldap.url")
+			}
+		case "oidc":
+			if c.OIDC.Issuer == "" {
+				return errors.New("auth.providers: oidc requires oidc.issuer")
+			}
+		default:
+			return fmt.Errorf("auth.providers: unknown provider %q", p)
+		}
 	}
 	return nil
 }
 
-// IsProtected checks if the given URL path is within a protected directory
-func (c *Config) IsProtected(urlPath string) bool {
+func normalizePaths(paths []string) {
+	for i, p := range paths {
+		paths[i] = "/" + strings.Trim(filepath.ToSlash(p), "/")
+	}
+}
+
+// matchPrefix returns the first of prefixes that is urlPath itself or one of its parents
+func matchPrefix(prefixes []string, urlPath string) (string, bool) {
 	cleanPath := "/" + strings.Trim(filepath.ToSlash(urlPath), "/")
-	for _, p := range c.Storage.ProtectedPaths {
-		// Check if path is exactly the protected dir or a child of it
+	for _, p := range prefixes {
+		// Check if path is exactly the prefix dir or a child of it
 		if cleanPath == p || strings.HasPrefix(cleanPath, p+"/") {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// IsAnonymousReadable checks if the given URL path may be read without logging in
+func (c *Config) IsAnonymousReadable(urlPath string) bool {
+	for _, p := range c.Storage.AnonymousRead {
+		if p == "/" {
 			return true
 		}
 	}
-	return false
+	_, ok := matchPrefix(c.Storage.AnonymousRead, urlPath)
+	return ok
+}
+
+// IsProtected checks if the given URL path is within a protected directory
+func (c *Config) IsProtected(urlPath string) bool {
+	_, ok := matchPrefix(c.Storage.ProtectedPaths, urlPath)
+	return ok
+}
+
+// AuthProvider reports whether the login provider name (local, ldap or oidc) is enabled
+func (c *Config) AuthProvider(name string) bool {
+	return slices.Contains(c.Auth.Providers, name)
+}
+
+// MavenRepo returns the root of the Maven repository containing urlPath
+func (c *Config) MavenRepo(urlPath string) (string, bool) {
+	return matchPrefix(c.Maven.Paths, urlPath)
+}
+
+// PyPIRepo returns the root of the Python package index containing urlPath
+func (c *Config) PyPIRepo(urlPath string) (string, bool) {
+	return matchPrefix(c.PyPI.Paths, urlPath)
+}
+
+// NPMRepo returns the root of the npm registry containing urlPath
+func (c *Config) NPMRepo(urlPath string) (string, bool) {
+	return matchPrefix(c.NPM.Paths, urlPath)
+}
+
+// APTRepo returns the root of the APT repository containing urlPath
+func (c *Config) APTRepo(urlPath string) (string, bool) {
+	return matchPrefix(c.APT.Paths, urlPath)
+}
+
+// RPMRepo returns the root of the YUM repository containing urlPath
+func (c *Config) RPMRepo(urlPath string) (string, bool) {
+	return matchPrefix(c.RPM.Paths, urlPath)
+}
+
+// GoProxyRepo returns the root of the Go module proxy containing urlPath
+func (c *Config) GoProxyRepo(urlPath string) (string, bool) {
+	return matchPrefix(c.GoProxy.Paths, urlPath)
+}
+
+// HelmRepo returns the chart directory containing urlPath
+func (c *Config) HelmRepo(urlPath string) (string, bool) {
+	return matchPrefix(c.Helm.Paths, urlPath)
+}
+
+// LFSRepo returns the Git LFS prefix containing urlPath
+func (c *Config) LFSRepo(urlPath string) (string, bool) {
+	return matchPrefix(c.LFS.Paths, urlPath)
+}
+
+// Remote returns the remote mounted at urlPath or one of its parents
+func (c *Config) Remote(urlPath string) (*RemoteConfig, bool) {
+	for i := range c.Remotes {
+		if _, ok := matchPrefix([]string{c.Remotes[i].Path}, urlPath); ok {
+			return &c.Remotes[i], true
+		}
+	}
+	return nil, false
+}
+
+// Virtual returns the virtual repository at urlPath or one of its parents
+func (c *Config) Virtual(urlPath string) (*VirtualConfig, bool) {
+	for i := range c.Virtuals {
+		if _, ok := matchPrefix([]string{c.Virtuals[i].Path}, urlPath); ok {
+			return &c.Virtuals[i], true
+		}
+	}
+	return nil, false
 }
 
 // ParseBytes converts strings like "10MB", "1GB" to int64 bytes
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -28,6 +29,19 @@ func TestProtectedPaths(t *testing.T) {
 	}
 }
 
+func TestMavenRepo(t *testing.T) {
+	cfg := &Config{}
+	cfg.Maven.Paths = []string{"maven/releases/"}
+	normalizePaths(cfg.Maven.Paths)
+
+	root, ok := cfg.MavenRepo("/maven/releases/org/acme/app/1.0/app-1.0.jar")
+	assert.True(t, ok)
+	assert.Equal(t, "/maven/releases", root)
+
+	_, ok = cfg.MavenRepo("/maven/releases-old/app.jar")
+	assert.False(t, ok)
+}
+
 func TestConfig_LoadEnv(t *testing.T) {
 	cfg := NewConfig() // default port 8080
 
@@ -74,3 +88,95 @@ func TestConfig_LoadEnvErrors(t *testing.T) {
 		}
 	})
 }
+
+func TestRemotes(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Server.JwtSecret = "01234567890123456789012345678901"
+	yamlPath := t.TempDir() + "/config.yaml"
+	os.WriteFile(yamlPath, []byte("remotes:\n  - path: remote/central/\n    url: https://repo1.maven.org/maven2/\n    ttl: 24h\n"), 0644)
+	assert.NoError(t, cfg.LoadYAML(yamlPath))
+	assert.NoError(t, cfg.Finalize())
+
+	r, ok := cfg.Remote("/remote/central/org/acme/app/1.0/app-1.0.jar")
+	assert.True(t, ok)
+	assert.Equal(t, "/remote/central", r.Path)
+	assert.Equal(t, "https://repo1.maven.org/maven2", r.URL)
+	assert.Equal(t, 24*time.Hour, r.TTL)
+
+	_, ok = cfg.Remote("/remote/centralized/app.jar")
+	assert.False(t, ok)
+
+	cfg.Remotes[0].URL = "ftp://example.com"
+	assert.Error(t, cfg.Finalize())
+}
+
+func TestVirtuals(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Server.JwtSecret = "01234567890123456789012345678901"
+	yamlPath := t.TempDir() + "/config.yaml"
+	os.WriteFile(yamlPath, []byte("virtuals:\n  - path: /virtual/libs/\n    paths: [teams/a, /remote/central/]\n"), 0644)
+	assert.NoError(t, cfg.LoadYAML(yamlPath))
+	assert.NoError(t, cfg.Finalize())
+
+	v, ok := cfg.Virtual("/virtual/libs/org/app.jar")
+	assert.True(t, ok)
+	assert.Equal(t, "/virtual/libs", v.Path)
+	assert.Equal(t, []string{"/teams/a", "/remote/central"}, v.Paths)
+
+	cfg.Virtuals[0].Paths = append(cfg.Virtuals[0].Paths, "/virtual/libs/nested")
+	assert.Error(t, cfg.Finalize())
+	cfg.Virtuals[0].Paths = nil
+	assert.Error(t, cfg.Finalize())
+}
+
+func TestAnonymousRead(t *testing.T) {
+	cfg := NewConfig()
+	assert.True(t, cfg.IsAnonymousReadable("/any/file.txt"), "public by default")
+
+	cfg.Storage.AnonymousRead = []string{"public/", "/docs"}
+	normalizePaths(cfg.Storage.AnonymousRead)
+	assert.True(t, cfg.IsAnonymousReadable("/public/app.zip"))
+	assert.True(t, cfg.IsAnonymousReadable("/docs"))
+	assert.False(t, cfg.IsAnonymousReadable("/docs-internal/a.md"))
+	assert.False(t, cfg.IsAnonymousReadable("/"))
+
+	cfg.Storage.AnonymousRead = nil
+	assert.False(t, cfg.IsAnonymousReadable("/public/app.zip"))
+}
+
+func TestAuthProviders(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Server.JwtSecret = "0123456789abcdef0123456789abcdef"
+	assert.NoError(t, cfg.Finalize())
+	assert.Equal(t, []string{"local"}, cfg.Auth.Providers)
+
+	cfg = NewConfig()
+	cfg.Server.JwtSecret = "0123456789abcdef0123456789abcdef"
+	cfg.LDAP.URL = "ldaps://ldap.example.org"
+	cfg.OIDC.Issuer = "https://sso.example.org/"
+	cfg.OIDC.ClientID = "yaar"
+	assert.NoError(t, cfg.Finalize())
+	assert.Equal(t, []string{"local", "ldap", "oidc"}, cfg.Auth.Providers)
+	assert.True(t, cfg.AuthProvider("ldap"))
+
+	cfg.Auth.Providers = []string{"ldap", "local"}
+	assert.NoError(t, cfg.Finalize())
+	assert.Equal(t, []string{"ldap", "local"}, cfg.Auth.Providers, "explicit order is kept")
+
+	cfg.Auth.Providers = []string{"kerberos"}
+	assert.Error(t, cfg.Finalize())
+	cfg.Auth.Providers = []string{"ldap"}
+	cfg.LDAP.URL = "http://ldap.example.org"
+	assert.Error(t, cfg.Finalize())
+	cfg.LDAP.URL = ""
+	assert.Error(t, cfg.Finalize())
+
+	cfg = NewConfig()
+	cfg.Server.JwtSecret = "0123456789abcdef0123456789abcdef"
+	assert.Equal(t, "maintainer", cfg.Auth.DefaultRole, "users keep their rights when upgrading")
+	cfg.Auth.DefaultRole = "none"
+	assert.NoError(t, cfg.Finalize())
+	assert.Empty(t, cfg.Auth.DefaultRole)
+	cfg.Auth.DefaultRole = "admin"
+	assert.Error(t, cfg.Finalize(), "admin must be granted explicitly")
+}
@@ -9,7 +9,18 @@ type Token struct {
 	Name       string     `gorm:"not null"`    // Name for the CI/CD job (e.g. "Jenkins-App-A")
 	SecretHash string     `gorm:"uniqueIndex"` // The hashed token
 	PathScope  string     `gorm:"default:'/'"` // Restrict to this directory prefix
+	ReadScope  string     `gorm:"default:'/'"` // Readable prefixes, narrows the read scope of the user
 	LastUsedAt *time.Time `json:"last_used_at"`
 	ExpiresAt  *time.Time `json:"expires_at"`
 	CreatedAt  time.Time
+	// Structured permissions, replace PathScope and ReadScope if present
+	Permissions []TokenPermission `json:"permissions"`
+}
+
+// TokenPermission grants one action of a token below its scope
+type TokenPermission struct {
+	ID      uint   `gorm:"primaryKey" json:"-"`
+	TokenID uint   `gorm:"index" json:"-"`
+	Action  string `gorm:"not null" json:"action"`   // read, write, delete, patch-meta or admin
+	Scope   string `gorm:"default:'/'" json:"scope"` // Comma separated prefixes or globs
 }
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+type Group struct {
+	ID        uint          `gorm:"primaryKey" json:"id"`
+	Name      string        `gorm:"uniqueIndex;not null" json:"name"` // e.g. team-frontend
+	Provider  string        `json:"provider"`                         // ldap or oidc if logins sync the members, empty if managed here
+	Members   []User        `gorm:"many2many:group_members" json:"members"`
+	Bindings  []RoleBinding `json:"bindings"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// RoleBinding grants the members of a group a role below a scope
+type RoleBinding struct {
+	ID      uint   `gorm:"primaryKey" json:"-"`
+	GroupID uint   `gorm:"index" json:"-"`
+	Role    string `gorm:"not null" json:"role"`     // viewer, publisher, maintainer or admin
+	Scope   string `gorm:"default:'/'" json:"scope"` // Comma separated prefixes or globs
+}
@@ -6,11 +6,21 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Login providers of users
+const (
+	ProviderLocal = "local"
+	ProviderLDAP  = "ldap"
+	ProviderOIDC  = "oidc"
+)
+
 type User struct {
-	ID           uint   `gorm:"primaryKey" json:"id"`
-	Username     string `gorm:"uniqueIndex;not null" json:"username"`
-	PasswordHash string `gorm:"not null" json:"-"`
-	IsAdmin      bool   `gorm:"default:false" json:"is_admin"`
+	ID           uint    `gorm:"primaryKey" json:"id"`
+	Username     string  `gorm:"uniqueIndex;not null" json:"username"`
+	PasswordHash string  `gorm:"not null" json:"-"`
+	IsAdmin      bool    `gorm:"default:false" json:"is_admin"`
+	ReadScope    string  `gorm:"default:'/'" json:"read_scope"`   // Comma separated prefixes the user may read
+	Provider     string  `gorm:"default:'local'" json:"provider"` // Where the user logs in: local, ldap or oidc
+	Groups       []Group `gorm:"many2many:group_members" json:"groups,omitempty"`
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 }
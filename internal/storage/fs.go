@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FS stores the tree in a local directory
+type FS struct {
+	root string
+}
+
+func NewFS(root string) *FS {
+	return &FS{root: root}
+}
+
+func (f *FS) path(name string) string {
+	return filepath.Join(f.root, filepath.FromSlash(Clean(name)))
+}
+
+func (f *FS) List(name string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(f.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			// removed in the meantime
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(f.path(name))
+}
+
+func (f *FS) Open(name string) (File, error) {
+	return os.Open(f.path(name))
+}
+
+func (f *FS) Create(name string) (io.WriteCloser, error) {
+	p := f.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+func (f *FS) Rename(oldname, newname string) error {
+	return os.Rename(f.path(oldname), f.path(newname))
+}
+
+func (f *FS) Remove(name string) error {
+	p := f.path(name)
+	if _, err := os.Lstat(p); err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (f *FS) Mkdir(name string) error {
+	return os.MkdirAll(f.path(name), 0755)
+}
+
+// Import renames the local file into place, which is atomic when both are on the same filesystem
+func (f *FS) Import(localPath, name string) error {
+	p := f.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.Rename(localPath, p)
+}
@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kovi/yaar/internal/config"
+	"github.com/kovi/yaar/internal/sigv4"
+)
+
+// S3 stores the tree in a bucket of an S3-compatible object store (AWS, MinIO, ...).
+// Directories are key prefixes; empty directories are kept as zero byte "dir/" marker objects.
+type S3 struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+	creds    sigv4.Credentials
+	client   *http.Client
+}
+
+func NewS3(cfg config.S3Config) (*S3, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 bucket is required")
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &S3{
+		endpoint: endpoint,
+		bucket:   cfg.Bucket,
+		prefix:   prefix,
+		region:   region,
+		creds:    sigv4.Credentials{AccessKey: cfg.AccessKey, SecretKey: cfg.SecretKey},
+		client:   &http.Client{},
+	}, nil
+}
+
+// key maps a name to its object key, the root maps to the prefix itself
+func (s *S3) key(name string) string {
+	return s.prefix + strings.TrimPrefix(Clean(name), "/")
+}
+
+// dirKey is the key prefix of all children of a directory
+func (s *S3) dirKey(name string) string {
+	k := s.key(name)
+	if k == "" || strings.HasSuffix(k, "/") {
+		return k
+	}
+	return k + "/"
+}
+
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && (e.Status == http.StatusNotFound || e.Code == "NoSuchKey")
+}
+
+// do sends a signed request for key. The caller closes the body of successful responses.
+func (s *S3) do(method, key string, query url.Values, body io.Reader, size int64, headers http.Header) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = ""
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		req.URL.RawQuery = sigv4.CanonicalQuery(query)
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	payloadHash := sigv4.EmptyPayloadHash
+	if body != nil {
+		payloadHash = sigv4.UnsignedPayload
+	}
+	sigv4.Sign(req, payloadHash, s.creds, s.region, "s3", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &s3Error{Status: resp.StatusCode}
+		xml.NewDecoder(resp.Body).Decode(e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listObjects pages through ListObjectsV2. With a delimiter, fn also receives the common prefixes.
+func (s *S3) listObjects(prefix, delimiter string, maxKeys int, fn func(*listBucketResult) bool) error {
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			q.Set("delimiter", delimiter)
+		}
+		if maxKeys > 0 {
+			q.Set("max-keys", strconv.Itoa(maxKeys))
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", q, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if !fn(&result) || !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) List(name string) ([]fs.FileInfo, error) {
+	prefix := s.dirKey(name)
+	var infos []fs.FileInfo
+	found := false
+
+	err := s.listObjects(prefix, "/", 0, func(r *listBucketResult) bool {
+		for _, o := range r.Contents {
+			found = true
+			if o.Key == prefix {
+				// directory marker
+				continue
+			}
+			infos = append(infos, &fileInfo{name: path.Base(o.Key), size: o.Size, modTime: o.LastModified})
+		}
+		for _, p := range r.CommonPrefixes {
+			found = true
+			infos = append(infos, &fileInfo{name: path.Base(p.Prefix), isDir: true})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !found && Clean(name) != "/" {
+		return nil, &fs.PathError{Op: "list", Path: name, Err: fs.ErrNotExist}
+	}
+	return infos, nil
+}
+
+func (s *S3) Stat(name string) (fs.FileInfo, error) {
+	name = Clean(name)
+	if name == "/" {
+		return &fileInfo{name: "/", isDir: true}, nil
+	}
+
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil, 0, nil)
+	if err == nil {
+		resp.Body.Close()
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &fileInfo{name: path.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// Not an object, maybe a prefix with children
+	isDir := false
+	err = s.listObjects(s.dirKey(name), "/", 1, func(r *listBucketResult) bool {
+		isDir = len(r.Contents) > 0 || len(r.CommonPrefixes) > 0
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !isDir {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return &fileInfo{name: path.Base(name), isDir: true}, nil
+}
+
+func (s *S3) Open(name string) (File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	return &s3Object{s3: s, key: s.key(name), info: info}, nil
+}
+
+// Create buffers the content in a local temp file, S3 needs the size before the upload starts
+func (s *S3) Create(name string) (io.WriteCloser, error) {
+	f, err := os.CreateTemp("", "yaar-s3-*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{File: f, s3: s, name: name}, nil
+}
+
+// Import uploads the local file and removes it
+func (s *S3) Import(localPath, name string) error {
+	if err := s.putFile(localPath, s.key(name)); err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+func (s *S3) putFile(localPath, key string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodPut, key, nil, f, info.Size(), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Rename(oldname, newname string) error {
+	info, err := s.Stat(oldname)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return s.moveObject(s.key(oldname), s.key(newname))
+	}
+
+	oldPrefix, newPrefix := s.dirKey(oldname), s.dirKey(newname)
+	var keys []string
+	err = s.listObjects(oldPrefix, "", 0, func(r *listBucketResult) bool {
+		for _, o := range r.Contents {
+			keys = append(keys, o.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := s.moveObject(k, newPrefix+strings.TrimPrefix(k, oldPrefix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveObject is a server side copy followed by a delete, S3 has no rename
+func (s *S3) moveObject(from, to string) error {
+	headers := http.Header{"X-Amz-Copy-Source": {"/" + s.bucket + "/" + sigv4.EncodePath(from)}}
+	resp, err := s.do(http.MethodPut, to, nil, nil, 0, headers)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.deleteObject(from)
+}
+
+func (s *S3) deleteObject(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Remove(name string) error {
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return s.deleteObject(s.key(name))
+	}
+
+	var keys []string
+	err = s.listObjects(s.dirKey(name), "", 0, func(r *listBucketResult) bool {
+		for _, o := range r.Contents {
+			keys = append(keys, o.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := s.deleteObject(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3) Mkdir(name string) error {
+	if Clean(name) == "/" {
+		return nil
+	}
+	resp, err := s.do(http.MethodPut, s.dirKey(name), nil, strings.NewReader(""), 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Writer buffers to a local temp file and uploads it on Close
+type s3Writer struct {
+	*os.File
+	s3   *S3
+	name string
+}
+
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.File.Name())
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	return w.s3.putFile(w.File.Name(), w.s3.key(w.name))
+}
+
+// s3Object reads an object with ranged GETs, so seeking (e.g. for HTTP Range requests) is cheap
+type s3Object struct {
+	s3     *S3
+	key    string
+	info   fs.FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Stat() (fs.FileInfo, error) {
+	return o.info, nil
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.info.Size() {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		headers := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		resp, err := o.s3.do(http.MethodGet, o.key, nil, nil, 0, headers)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.offset + offset
+	case io.SeekEnd:
+		abs = o.info.Size() + offset
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+
+	if abs != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = abs
+	return abs, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
+
+var _ Importer = (*S3)(nil)
+var _ Importer = (*FS)(nil)
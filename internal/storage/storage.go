@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kovi/yaar/internal/config"
+)
+
+// Backend abstracts where the artifact tree is physically stored.
+// Names are slash separated and relative to the storage root, e.g. "/builds/app.zip".
+// Missing entries are reported with errors matching fs.ErrNotExist.
+type Backend interface {
+	// List returns the direct children of a directory
+	List(name string) ([]fs.FileInfo, error)
+	Stat(name string) (fs.FileInfo, error)
+	Open(name string) (File, error)
+	// Create creates or truncates a file, parent directories are created as needed
+	Create(name string) (io.WriteCloser, error)
+	// Rename moves a file or a whole directory tree
+	Rename(oldname, newname string) error
+	// Remove deletes a file or a whole directory tree
+	Remove(name string) error
+	// Mkdir creates a directory and all its parents
+	Mkdir(name string) error
+}
+
+// File is a readable, seekable stored file
+type File interface {
+	io.ReadSeekCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// Importer is implemented by backends that can take over a finished local file
+// cheaper than copying it through Create (e.g. a rename on the same filesystem).
+type Importer interface {
+	Import(localPath, name string) error
+}
+
+// New creates the backend selected by storage.backend
+func New(cfg *config.Config) (Backend, error) {
+	switch cfg.Storage.Backend {
+	case "", "fs":
+		return NewFS(cfg.Storage.BaseDir), nil
+	case "s3":
+		return NewS3(cfg.Storage.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+}
+
+// Import moves a finished local file into the backend at name.
+// The local file is gone afterwards.
+func Import(b Backend, localPath, name string) error {
+	if i, ok := b.(Importer); ok {
+		return i.Import(localPath, name)
+	}
+
+	in, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := b.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(localPath)
+}
+
+// SkipDir can be returned by a WalkFunc to skip the directory
+var SkipDir = fs.SkipDir
+
+// WalkFunc is called for every entry below the walk root, the root itself included
+type WalkFunc func(name string, info fs.FileInfo) error
+
+// Walk visits the tree below root in lexical order, similar to filepath.Walk
+func Walk(b Backend, root string, fn WalkFunc) error {
+	root = Clean(root)
+	info, err := b.Stat(root)
+	if err != nil {
+		return err
+	}
+	err = walk(b, root, info, fn)
+	if errors.Is(err, SkipDir) {
+		return nil
+	}
+	return err
+}
+
+func walk(b Backend, name string, info fs.FileInfo, fn WalkFunc) error {
+	if err := fn(name, info); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+
+	children, err := b.List(name)
+	if err != nil {
+		return err
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+
+	for _, child := range children {
+		err := walk(b, path.Join(name, child.Name()), child, fn)
+		if err != nil && !(errors.Is(err, SkipDir) && child.IsDir()) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clean normalizes a name to the "/a/b" form used by all backends
+func Clean(name string) string {
+	return path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+}
+
+// fileInfo is a plain fs.FileInfo for backends without native file info
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.isDir }
+func (i *fileInfo) Sys() any           { return nil }
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.isDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kovi/yaar/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a minimal in-memory S3 server covering the calls the S3 backend makes
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte // "bucket/key" -> content
+}
+
+func newFakeS3(t *testing.T) *httptest.Server {
+	f := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	id := bucket + "/" + key
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r, bucket)
+	case r.Method == http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			data, ok := f.objects[strings.TrimPrefix(src, "/")]
+			if !ok {
+				f.notFound(w)
+				return
+			}
+			f.objects[id] = data
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.objects[id] = data
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[id]
+		if !ok {
+			f.notFound(w)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			data = data[start:]
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) notFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>")
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+
+	var keys []string
+	for id := range f.objects {
+		if key, ok := strings.CutPrefix(id, bucket+"/"); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var result listBucketResult
+	seen := map[string]bool{}
+	for _, key := range keys {
+		rest := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+1]
+			if !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, struct {
+					Prefix string `xml:"Prefix"`
+				}{p})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{key, int64(len(f.objects[bucket+"/"+key])), time.Now().UTC()})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func backends(t *testing.T) map[string]Backend {
+	srv := newFakeS3(t)
+	s3, err := NewS3(config.S3Config{Endpoint: srv.URL, Bucket: "artifacts", Prefix: "yaar", AccessKey: "ak", SecretKey: "sk"})
+	require.NoError(t, err)
+
+	all := map[string]Backend{
+		"fs": NewFS(t.TempDir()),
+		"s3": s3,
+	}
+
+	// Optional run against a real S3-compatible server, e.g. MinIO
+	if endpoint := os.Getenv("YAAR_TEST_S3_ENDPOINT"); endpoint != "" {
+		real, err := NewS3(config.S3Config{
+			Endpoint:  endpoint,
+			Bucket:    os.Getenv("YAAR_TEST_S3_BUCKET"),
+			AccessKey: os.Getenv("YAAR_TEST_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("YAAR_TEST_S3_SECRET_KEY"),
+			Prefix:    fmt.Sprintf("yaar-test-%d", time.Now().UnixNano()),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { real.Remove("/") })
+		all["s3-real"] = real
+	}
+	return all
+}
+
+func write(t *testing.T, b Backend, name, content string) {
+	w, err := b.Create(name)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func read(t *testing.T, b Backend, name string) string {
+	f, err := b.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func names(infos []fs.FileInfo) []string {
+	var n []string
+	for _, i := range infos {
+		n = append(n, i.Name())
+	}
+	sort.Strings(n)
+	return n
+}
+
+func TestBackends(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			t.Run("Create, stat and read", func(t *testing.T) {
+				write(t, b, "/a/b/file.txt", "hello world")
+
+				info, err := b.Stat("/a/b/file.txt")
+				require.NoError(t, err)
+				assert.False(t, info.IsDir())
+				assert.Equal(t, int64(11), info.Size())
+				assert.Equal(t, "file.txt", info.Name())
+
+				dir, err := b.Stat("/a/b")
+				require.NoError(t, err)
+				assert.True(t, dir.IsDir())
+
+				assert.Equal(t, "hello world", read(t, b, "/a/b/file.txt"))
+			})
+
+			t.Run("Seek", func(t *testing.T) {
+				f, err := b.Open("/a/b/file.txt")
+				require.NoError(t, err)
+				defer f.Close()
+
+				_, err = f.Seek(6, io.SeekStart)
+				require.NoError(t, err)
+				data, err := io.ReadAll(f)
+				require.NoError(t, err)
+				assert.Equal(t, "world", string(data))
+			})
+
+			t.Run("Missing entries", func(t *testing.T) {
+				_, err := b.Stat("/missing")
+				assert.True(t, errors.Is(err, fs.ErrNotExist))
+				_, err = b.Open("/missing.txt")
+				assert.True(t, errors.Is(err, fs.ErrNotExist))
+				_, err = b.List("/missing")
+				assert.True(t, errors.Is(err, fs.ErrNotExist))
+				assert.True(t, errors.Is(b.Remove("/missing"), fs.ErrNotExist))
+			})
+
+			t.Run("List and empty directories", func(t *testing.T) {
+				require.NoError(t, b.Mkdir("/a/empty"))
+				write(t, b, "/a/top.txt", "x")
+
+				infos, err := b.List("/a")
+				require.NoError(t, err)
+				assert.Equal(t, []string{"b", "empty", "top.txt"}, names(infos))
+
+				infos, err = b.List("/a/empty")
+				require.NoError(t, err)
+				assert.Empty(t, infos)
+
+				info, err := b.Stat("/a/empty")
+				require.NoError(t, err)
+				assert.True(t, info.IsDir())
+			})
+
+			t.Run("Import", func(t *testing.T) {
+				local := filepath.Join(t.TempDir(), "upload")
+				require.NoError(t, os.WriteFile(local, []byte("imported"), 0644))
+
+				require.NoError(t, Import(b, local, "/imp/file.bin"))
+				assert.Equal(t, "imported", read(t, b, "/imp/file.bin"))
+				assert.NoFileExists(t, local)
+			})
+
+			t.Run("Rename file and directory", func(t *testing.T) {
+				require.NoError(t, b.Rename("/imp/file.bin", "/imp/renamed.bin"))
+				assert.Equal(t, "imported", read(t, b, "/imp/renamed.bin"))
+				_, err := b.Stat("/imp/file.bin")
+				assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+				require.NoError(t, b.Rename("/a", "/moved"))
+				assert.Equal(t, "hello world", read(t, b, "/moved/b/file.txt"))
+				_, err = b.Stat("/a")
+				assert.True(t, errors.Is(err, fs.ErrNotExist))
+			})
+
+			t.Run("Walk", func(t *testing.T) {
+				var visited []string
+				err := Walk(b, "/moved", func(name string, info fs.FileInfo) error {
+					if name == "/moved/empty" {
+						return SkipDir
+					}
+					visited = append(visited, name)
+					return nil
+				})
+				require.NoError(t, err)
+				assert.Equal(t, []string{"/moved", "/moved/b", "/moved/b/file.txt", "/moved/top.txt"}, visited)
+			})
+
+			t.Run("Remove recursively", func(t *testing.T) {
+				require.NoError(t, b.Remove("/moved"))
+				_, err := b.Stat("/moved/b/file.txt")
+				assert.True(t, errors.Is(err, fs.ErrNotExist))
+				_, err = b.Stat("/moved")
+				assert.True(t, errors.Is(err, fs.ErrNotExist))
+			})
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Storage.BaseDir = t.TempDir()
+
+	b, err := New(cfg)
+	require.NoError(t, err)
+	assert.IsType(t, &FS{}, b)
+
+	cfg.Storage.Backend = "ftp"
+	_, err = New(cfg)
+	assert.Error(t, err)
+}
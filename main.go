@@ -14,6 +14,7 @@ import (
 	"github.com/kovi/yaar/internal/audit"
 	"github.com/kovi/yaar/internal/auth"
 	"github.com/kovi/yaar/internal/config"
+	"github.com/kovi/yaar/internal/storage"
 	"github.com/kovi/yaar/middleware"
 )
 
@@ -98,6 +99,11 @@ func main() {
 	}
 
 	log.Infof("Data dir: %v", cfg.Storage.BaseDir)
+	store, err := storage.New(cfg)
+	if err != nil {
+		log.Fatalf("Invalid storage: %v", err)
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	r.Use(middleware.LogrusMiddleware(logrus.StandardLogger()))
@@ -105,6 +111,7 @@ func main() {
 
 	m := api.Handler{
 		BaseDir: cfg.Storage.BaseDir,
+		Storage: store,
 		DB:      db,
 		Config:  cfg,
 		Log:     log.WithField("module", "api"),
@@ -119,7 +126,7 @@ func main() {
 		Log:       logrus.WithField("module", "auth")}
 
 	r.Static("/_/static", "./web/static")
-	r.Use(auth.Identify(cfg.Server.JwtSecret, db, &authH.UserCache))
+	r.Use(auth.Identify(&authH.Config, db, &authH.UserCache))
 
 	m.RegisterRoutes(r)
 	authH.RegisterRoutes(r, db, cfg, auditor)
@@ -141,4 +148,5 @@ func main() {
 	r.Run(":" + strconv.Itoa(cfg.Server.Port))
 
 	cancel()
+	m.RegenerateIndexes()
 }
@@ -20,6 +20,7 @@ template.innerHTML = `
                 </label>
             </div>
             <div class="af-modal-footer">
+                <a class="btn btn-ghost hidden" id="login-sso" href="/_/api/auth/oidc/login">Sign in with SSO</a>
                 <button type="button" class="btn btn-ghost modal-close">Cancel</button>
                 <button type="submit" class="btn btn-primary">Login</button>
             </div>
@@ -49,6 +50,14 @@ export function openLogin() {
         };
 
         dialog.querySelector('.modal-close').onclick = () => dialog.close();
+
+        // Offer single sign-on when the server has an identity provider
+        API.getSettings().then(settings => {
+            if (!settings.config?.Auth?.Providers?.includes('oidc')) return;
+            const sso = dialog.querySelector('#login-sso');
+            sso.href += '?redirect=' + encodeURIComponent(window.location.pathname);
+            sso.classList.remove('hidden');
+        }).catch(() => {});
     }
     document.getElementById('login-dialog').showModal();
 }
\ No newline at end of file
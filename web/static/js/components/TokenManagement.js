@@ -16,7 +16,7 @@ export async function TokenManagement() {
                     <tr>
                         <th>Token Name</th>
                         <th>User</th>
-                        <th>Scope</th>
+                        <th>Permissions</th>
                         <th>Expires</th>
                         <th>Last Used</th>
                         <th style="text-align:right">Actions</th>
@@ -27,7 +27,7 @@ export async function TokenManagement() {
                         <tr>
                             <td><strong>${t.Name}</strong></td>
                             <td><span class="badge badge-outline">${t.User?.username || 'System'}</span></td>
-                            <td><code class="af-col-mono" style="font-size: 11px;">${t.PathScope}</code></td>
+                            <td><code class="af-col-mono" style="font-size: 11px;">${formatPermissions(t)}</code></td>
                             <td class="af-col-mono" style="font-size: 11px;">
                                 ${t.expires_at ? `
                                     <span class="${Format.isExpired(t.expires_at) ? 'expiry-critical' : ''}">
@@ -60,6 +60,20 @@ export async function TokenManagement() {
     return container;
 }
 
+const PERMISSIONS = [
+    { action: 'read', label: 'Read', checked: true },
+    { action: 'write', label: 'Write', checked: true },
+    { action: 'delete', label: 'Delete', checked: false },
+    { action: 'patch-meta', label: 'Edit metadata', checked: false },
+    { action: 'admin', label: 'Admin', checked: false },
+];
+
+// Tokens created before structured permissions only have a write scope
+function formatPermissions(t) {
+    if (!t.permissions?.length) return t.PathScope;
+    return t.permissions.map(p => p.action === 'admin' ? p.action : `${p.action}: ${p.scope}`).join('<br>');
+}
+
 function openTokenForm(users) {
     const dialog = document.createElement('dialog');
     dialog.className = 'af-modal';
@@ -79,11 +93,17 @@ function openTokenForm(users) {
                         ${users.map(u => `<option value="${u.id}">${u.username}</option>`).join('')}
                     </select>
                 </label>
-                <label>
-                    <span>Path Scope (Restriction)</span>
-                    <input type="text" name="path_scope" value="/" required>
-                    <small class="af-input-help">The token will only be allowed to write under this path.</small>
-                </label>
+                <div>
+                    <span>Permissions</span>
+                    ${PERMISSIONS.map(p => `
+                        <div class="af-check-group">
+                            <input type="checkbox" name="perm_${p.action}" ${p.checked ? 'checked' : ''}>
+                            <span style="min-width: 90px">${p.label}</span>
+                            ${p.action === 'admin' ? '' : `<input type="text" name="scope_${p.action}" value="/">`}
+                        </div>
+                    `).join('')}
+                    <small class="af-input-help">Comma separated paths or globs (e.g. /releases/*/docs). A download-only token only needs Read.</small>
+                </div>
                 ${ExpirationLabel.LABEL_TEMPLATE}
             </div>
             <div class="af-modal-footer">
@@ -104,18 +124,20 @@ function openTokenForm(users) {
             const result = await API.createToken({
                 name: fd.get('name'),
                 user_id: parseInt(fd.get('user_id')),
-                path_scope: fd.get('path_scope'),
+                permissions: PERMISSIONS
+                    .filter(p => fd.get(`perm_${p.action}`) === 'on')
+                    .map(p => ({ action: p.action, scope: fd.get(`scope_${p.action}`) || '/' })),
                 expires: Format.durationToBackendFormat(fd.get('expires')),
             });
             dialog.close();
             dialog.remove();
-            showSecretToken(result.plain_token); // Show the one-time secret
+            showSecretToken(result.plain_token, result); // Show the one-time secret
             window.dispatchEvent(new CustomEvent('af:settings-refresh'));
         } catch (err) { alert(err.message); }
     };
 }
 
-function showSecretToken(plainToken) {
+function showSecretToken(plainToken, result = {}) {
     const dialog = document.createElement('dialog');
     dialog.className = 'af-modal';
     dialog.style.zIndex = '1200';
@@ -127,6 +149,12 @@ function showSecretToken(plainToken) {
             <div class="af-hash-box" style="padding: 15px; background: #fffbe6; border: 1px solid #ffe58f;">
                 <code class="af-col-mono" id="plain-token-val" style="font-size: 16px; color: #856404;">${plainToken}</code>
             </div>
+            ${result.s3_access_key ? `
+            <p style="font-size: 13px; margin: 15px 0 5px;">S3 credentials of this token:</p>
+            <div class="af-hash-box" style="padding: 10px;">
+                <div class="af-col-mono">Access key: ${result.s3_access_key}</div>
+                <div class="af-col-mono">Secret key: ${result.s3_secret_key}</div>
+            </div>` : ''}
             <div style="margin-top: 20px;">
                 <button class="btn btn-primary" id="copy-token-btn" style="width: 100%">Copy to Clipboard</button>
             </div>
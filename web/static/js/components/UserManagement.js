@@ -81,9 +81,9 @@ function openUserForm(user = null) {
                 
                 <div style="margin-top: 15px; padding-top: 15px; border-top: 1px dashed var(--border)">
                     <label>
-                        <span>Allowed Paths (Experimental)</span>
-                        <input type="text" name="allowed_paths" placeholder="/projects/A, /public" disabled>
-                        <small class="af-input-help">Restrict user to specific directories.</small>
+                        <span>Read Scope</span>
+                        <input type="text" name="read_scope" value="${user?.read_scope || '/'}" placeholder="/projects/A, /public">
+                        <small class="af-input-help">Directories the user may download from, comma separated.</small>
                     </label>
                 </div>
             </div>
@@ -102,7 +102,8 @@ function openUserForm(user = null) {
         const fd = new FormData(e.target);
         const data = {
             password: fd.get('password') || undefined,
-            is_admin: fd.get('is_admin') === 'on'
+            is_admin: fd.get('is_admin') === 'on',
+            read_scope: fd.get('read_scope'),
         };
         if (!isEdit) data.username = fd.get('username');
 